@@ -34,7 +34,7 @@ focus on chains of relationships, rather then individual links.`
             const isExecutable = process.platform === 'win32' || !!(statSync(BINARY_PATH).mode & 0o111);
 
             if (isExecutable) {
-                return ["cld"];
+                return ["cld", "sfd"];
             }
         } catch (err) {
             //logger.log("Error checking supporting modes on causal-chains...");
@@ -91,6 +91,28 @@ focus on chains of relationships, rather then individual links.`
                 label: "LLM Model",
                 description: "The LLM model that you want to use to process your queries.",
             },
+            {
+                name: "fallbackModels",
+                type: "string",
+                required: false,
+                uiElement: "lineedit",
+                saveForUser: "local",
+                label: "Fallback Models",
+                description: "Comma-separated models to use, in order, if the main model's provider is unavailable, e.g. gemini-2.5-flash, gpt-4.1",
+            },
+            {
+                name: "mode",
+                type: "string",
+                required: false,
+                defaultValue: "cld",
+                options: [
+                    {label: "Causal loop diagram", value: "cld"},
+                    {label: "Stock and flow model", value: "sfd"},
+                ],
+                uiElement: "combobox",
+                label: "Mode",
+                description: "Whether to build a causal loop diagram, or a quantitative stock and flow model with equations that is checked by simulating it",
+            },
             {
                 name: "problemStatement",
                 type: "string",
@@ -112,21 +134,96 @@ focus on chains of relationships, rather then individual links.`
                 description: "Background information you want the LLM model to consider when generating a diagram for you",
                 minHeight: 100,
             },
+            {
+                name: "documents",
+                type: "string",
+                required: false,
+                uiElement: "hidden",
+                description: "A JSON array of {\"name\", \"text\"} documents, such as interview transcripts or reports, to search for background knowledge relevant to the prompt",
+            },
+            {
+                name: "contextTokens",
+                type: "number",
+                required: false,
+                uiElement: "lineedit",
+                saveForUser: "local",
+                label: "Background Token Budget",
+                description: "Leave blank for the default (16000), or the most tokens of background knowledge and documents to give the LLM; beyond that only the most relevant parts are used",
+            },
+            {
+                name: "constraints",
+                type: "string",
+                required: false,
+                uiElement: "lineedit",
+                saveForUser: "local",
+                label: "Constraints",
+                description: "Requirements the diagram must meet, in addition to any in your prompt, e.g. at least 3 reinforcing loops; no more than 12 variables; include the variable Tax Burden",
+            },
+            {
+                name: "sectors",
+                type: "boolean",
+                required: false,
+                uiElement: "checkbox",
+                saveForUser: "local",
+                label: "Map by Sector",
+                description: "Whether to divide a large problem into sectors, map each separately, and then link them, rather than mapping it all at once",
+            },
+            {
+                name: "supportsModules",
+                type: "boolean",
+                required: false,
+                uiElement: "hidden",
+                description: "Whether or not your client can handle models with modules, which sectors are returned as",
+            },
+            {
+                name: "stockFlow",
+                type: "string",
+                required: false,
+                options: [
+                    {label: "No", value: ""},
+                    {label: "Classify variables by name", value: "heuristic"},
+                    {label: "Classify variables with the LLM", value: "model"},
+                ],
+                uiElement: "combobox",
+                saveForUser: "local",
+                label: "Stock and Flow Skeleton",
+                description: "Whether to return a starting stock and flow diagram made from the causal loop diagram, with placeholder equations, instead of the diagram itself",
+            },
+            {
+                name: "promptVersion",
+                type: "string",
+                required: false,
+                uiElement: "lineedit",
+                saveForUser: "local",
+                label: "Prompt Version",
+                description: "Leave blank for the default prompts (v1), or the version to use, e.g. v2, which also considers the problem statement and current model",
+            },
+            {
+                name: "sessionId",
+                type: "string",
+                required: false,
+                uiElement: "lineedit",
+                label: "Session ID",
+                description: "Leave blank for a one-off diagram, \"new\" to start a session that later prompts can refine, or the sessionId returned by an earlier request to continue that session",
+            },
+            {
+                name: "sessionTurn",
+                type: "number",
+                required: false,
+                uiElement: "lineedit",
+                label: "Session Turn",
+                description: "Leave blank to continue from the session's latest diagram, or a turn number (from 1) to branch a new session from that turn",
+            },
         ];
     }
 
     async generate(prompt, currentModel, parameters) {
-        const resolvedParameters = {
-            ...parameters,
-            apiKey: parameters.apiKey || process.env.OPENAI_API_KEY,
-            googleKey: parameters.googleKey || process.env.GEMINI_API_KEY || process.env.GOOGLE_API_KEY,
-            anthropicKey: parameters.anthropicKey || process.env.ANTHROPIC_API_KEY,
-        };
-
+        // keys from the environment (or secret files) are resolved by the
+        // binary itself, so they never have to be written to disk
         const input = {
             prompt: prompt,
             currentModel: currentModel,
-            parameters: resolvedParameters,
+            parameters: parameters,
         };
 
         let tempDir;
@@ -135,7 +232,7 @@ focus on chains of relationships, rather then individual links.`
             // get the absolute path to this temp file
             const inputPath = path.resolve(path.join(tempDir, 'data.json'));
             // logger.log(`input path is ${inputPath}`);
-            await fs.writeFile(inputPath, JSON.stringify(input));
+            await fs.writeFile(inputPath, JSON.stringify(input), {mode: 0o600});
             const { stdout, stderr } = await promiseExec(`"${BINARY_PATH}" "${inputPath}"`, {cwd: tempDir});
             return JSON.parse(stdout.toString());
         } catch (err) {
@@ -0,0 +1,304 @@
+package causal
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Quantity is something about a map a CountConstraint counts.
+type Quantity int
+
+const (
+	// Loops counts feedback loops of any polarity.
+	Loops Quantity = iota
+	ReinforcingLoops
+	BalancingLoops
+	Variables
+)
+
+func (q Quantity) String() string {
+	switch q {
+	case Loops:
+		return "feedback loops"
+	case ReinforcingLoops:
+		return "reinforcing loops"
+	case BalancingLoops:
+		return "balancing loops"
+	case Variables:
+		return "variables"
+	default:
+		return ""
+	}
+}
+
+func (q Quantity) MarshalJSON() ([]byte, error) {
+	return []byte("\"" + q.String() + "\""), nil
+}
+
+// count describes n of the quantity, as in "1 balancing loop".
+func (q Quantity) count(n int) string {
+	noun := q.String()
+	if n == 1 {
+		noun = strings.TrimSuffix(noun, "s")
+	}
+	return fmt.Sprintf("%d %s", n, noun)
+}
+
+func (q Quantity) measure(m *Map) int {
+	switch q {
+	case Variables:
+		return len(m.Identities())
+	case Loops:
+		return len(m.Loops())
+	}
+	want := ReinforcingLoop
+	if q == BalancingLoops {
+		want = BalancingLoop
+	}
+	n := 0
+	for _, p := range m.LoopPolarities() {
+		if p == want {
+			n++
+		}
+	}
+	return n
+}
+
+// CountConstraint bounds how many of something a map has.
+type CountConstraint struct {
+	Quantity Quantity `json:"quantity"`
+	// Min and Max bound the count; Max < 0 is unbounded.
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+func (c CountConstraint) String() string {
+	switch {
+	case c.Min == c.Max:
+		return "exactly " + c.Quantity.count(c.Min)
+	case c.Max < 0:
+		return "at least " + c.Quantity.count(c.Min)
+	case c.Min <= 0:
+		return "at most " + c.Quantity.count(c.Max)
+	default:
+		return fmt.Sprintf("between %d and %s", c.Min, c.Quantity.count(c.Max))
+	}
+}
+
+// Constraints are requirements on the structure of a map, like the
+// number of loops of each polarity, stated by the user or parsed from
+// their prompt.
+type Constraints struct {
+	Counts []CountConstraint `json:"counts,omitzero"`
+	// Required are variables the map must include.
+	Required []string `json:"required,omitzero"`
+}
+
+func (c Constraints) IsZero() bool {
+	return len(c.Counts) == 0 && len(c.Required) == 0
+}
+
+// Merge returns the constraints of both c and o.
+func (c Constraints) Merge(o Constraints) Constraints {
+	return Constraints{
+		Counts:   append(append([]CountConstraint(nil), c.Counts...), o.Counts...),
+		Required: append(append([]string(nil), c.Required...), o.Required...),
+	}
+}
+
+// Strings describes each constraint, as in "at least 3 reinforcing
+// loops" or "includes the variable Tax Burden".
+func (c Constraints) Strings() []string {
+	var s []string
+	for _, count := range c.Counts {
+		s = append(s, count.String())
+	}
+	for _, v := range c.Required {
+		s = append(s, "includes the variable "+v)
+	}
+	return s
+}
+
+// Check returns how the map violates the constraints, phrased as
+// instructions for fixing it, or nothing if it meets them all.
+func (c Constraints) Check(m *Map) []string {
+	var violations []string
+	for _, count := range c.Counts {
+		n := count.Quantity.measure(m)
+		switch {
+		case n < count.Min:
+			violations = append(violations, fmt.Sprintf("The map has %s but needs %s: add %d more%s.",
+				count.Quantity.count(n), count, count.Min-n, howToAdd(count.Quantity)))
+		case count.Max >= 0 && n > count.Max:
+			violations = append(violations, fmt.Sprintf("The map has %s but needs %s: remove %d%s.",
+				count.Quantity.count(n), count, n-count.Max, howToRemove(count.Quantity)))
+		}
+	}
+
+	vars := make(Set[string])
+	for _, id := range m.Identities() {
+		vars.Add(id.Key)
+	}
+	for _, v := range c.Required {
+		if !vars.Contains(Canonicalize(v)) {
+			violations = append(violations, fmt.Sprintf("The map is missing the variable %q: add it, connected by causal relationships to the rest of the map.", v))
+		}
+	}
+	return violations
+}
+
+func howToAdd(q Quantity) string {
+	switch q {
+	case ReinforcingLoops:
+		return ", closing chains whose relationships have an even number of negative polarities"
+	case BalancingLoops:
+		return ", closing chains whose relationships have an odd number of negative polarities"
+	case Loops:
+		return ", closing chains that end at their initial_variable"
+	}
+	return ""
+}
+
+func howToRemove(q Quantity) string {
+	switch q {
+	case ReinforcingLoops, BalancingLoops, Loops:
+		return " by dropping or redirecting the relationships that close them"
+	case Variables:
+		return " by merging similar variables or dropping peripheral ones"
+	}
+	return ""
+}
+
+var (
+	numberWords = map[string]int{
+		"no": 0, "zero": 0, "a": 1, "an": 1, "one": 1, "a single": 1, "two": 2, "three": 3, "four": 4, "five": 5,
+		"six": 6, "seven": 7, "eight": 8, "nine": 9, "ten": 10, "eleven": 11, "twelve": 12,
+	}
+
+	countRe = regexp.MustCompile(`(?i)\b(at least|no fewer than|no less than|a minimum of|more than|at most|no more than|a maximum of|up to|fewer than|less than|exactly|only|between (\d+) and)?\s*\b(\d+|zero|no|an?|a single|one|two|three|four|five|six|seven|eight|nine|ten|eleven|twelve)\s+(?:(reinforcing|balancing|positive|negative|feedback|causal)\s+)?(?:feedback\s+)?(loops?|variables?)\b`)
+
+	requiredRe = regexp.MustCompile(`(?i)\b(?:include|includes|including|contain|contains|containing|add)\s+(?:the\s+|a\s+)?(variables?)\s+(?:called\s+|named\s+)?(.+?)(?:\.(?:\s|$)|[;\n]|$)`)
+	// notNames start phrases that describe variables rather than name
+	// them, as in "include variables that are polarity neutral"
+	notNames = NewSet("that", "which", "who", "whose", "for", "to", "such", "like", "in", "of", "about", "from", "with")
+	// nameEnds are words that end an unquoted name, as in "include the
+	// variable Tax Burden in the model": prepositions, except "of",
+	// which names often have, and words starting a clause
+	nameEnds  = NewSet("in", "into", "to", "for", "from", "with", "within", "on", "at", "as", "so", "that", "which", "who", "whose", "because", "since", "when", "where", "if")
+	listSepRe = regexp.MustCompile(`\s*(?:,\s*(?:and\s+|or\s+)?|\s+and\s+|\s+or\s+)\s*`)
+)
+
+const quotes = `"'“”‘’`
+
+// requiredNames returns the variables named after "variable" or
+// "variables" in a requirement.  Only "variables" introduces a list,
+// so that a name like "Research and Development Spending" stays whole.
+// An unquoted name ends at a comma or at a word in nameEnds, and a
+// list ends at an item that describes rather than names.
+func requiredNames(plural bool, text string) []string {
+	items := listSepRe.Split(text, -1)
+	if !plural {
+		items = []string{text}
+		if !quoted(text) {
+			items[0], _, _ = strings.Cut(text, ",")
+		}
+	}
+
+	var names []string
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		if quoted(item) {
+			// the name is what's up to the closing quote
+			rest := strings.TrimLeft(item, quotes)
+			if i := strings.IndexAny(rest, quotes); i >= 0 {
+				rest = rest[:i]
+			}
+			if name := strings.TrimSpace(rest); name != "" {
+				names = append(names, name)
+			}
+			continue
+		}
+		words := strings.Fields(item)
+		if len(words) == 0 {
+			continue
+		}
+		if notNames.Contains(strings.ToLower(words[0])) {
+			break
+		}
+		end := slices.IndexFunc(words, func(w string) bool { return nameEnds.Contains(strings.ToLower(w)) })
+		if end >= 0 {
+			words = words[:end]
+		}
+		names = append(names, strings.Join(words, " "))
+	}
+	return names
+}
+
+func quoted(s string) bool {
+	return strings.IndexAny(strings.TrimSpace(s), quotes) == 0
+}
+
+// ParseConstraints finds constraints stated in text, such as "at least
+// three reinforcing loops", "exactly 2 balancing loops", "no more than
+// 12 variables" or "must include the variable Tax Burden".  A bare
+// count like "two balancing loops" is taken as exact.  Required
+// variables must be introduced by the word "variable", so that "include
+// feedback" isn't mistaken for one, and names with a word like "in" or
+// "to" in them must be quoted; see requiredNames.
+func ParseConstraints(text string) Constraints {
+	var c Constraints
+	for _, match := range countRe.FindAllStringSubmatch(text, -1) {
+		word := strings.ToLower(match[3])
+		if match[1] == "" && (word == "a" || word == "an") {
+			// "with a feedback loop" is a description, not a limit
+			continue
+		}
+		n, ok := numberWords[word]
+		if !ok {
+			n, _ = strconv.Atoi(match[3])
+		}
+
+		var q Quantity
+		kind, noun := strings.ToLower(match[4]), strings.ToLower(match[5])
+		switch {
+		case strings.HasPrefix(noun, "variable"):
+			if kind != "" {
+				continue
+			}
+			q = Variables
+		case kind == "reinforcing" || kind == "positive":
+			q = ReinforcingLoops
+		case kind == "balancing" || kind == "negative":
+			q = BalancingLoops
+		default:
+			q = Loops
+		}
+
+		count := CountConstraint{Quantity: q, Min: n, Max: n}
+		switch cmp := strings.ToLower(match[1]); {
+		case cmp == "at least" || cmp == "no fewer than" || cmp == "no less than" || cmp == "a minimum of":
+			count.Max = -1
+		case cmp == "more than":
+			count.Min, count.Max = n+1, -1
+		case cmp == "at most" || cmp == "no more than" || cmp == "a maximum of" || cmp == "up to":
+			count.Min = 0
+		case cmp == "fewer than" || cmp == "less than":
+			count.Min, count.Max = 0, n-1
+		case strings.HasPrefix(cmp, "between"):
+			count.Min, _ = strconv.Atoi(match[2])
+		}
+		if count.Max >= 0 && count.Max < count.Min {
+			continue
+		}
+		c.Counts = append(c.Counts, count)
+	}
+
+	for _, match := range requiredRe.FindAllStringSubmatch(text, -1) {
+		plural := strings.EqualFold(match[1], "variables")
+		c.Required = append(c.Required, requiredNames(plural, match[2])...)
+	}
+	return c
+}
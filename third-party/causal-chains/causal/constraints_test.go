@@ -0,0 +1,100 @@
+package causal
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConstraints(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"Build a CLD with at least three reinforcing loops.", []string{"at least 3 reinforcing loops"}},
+		{"It should have exactly 2 balancing loops and no more than 12 variables", []string{"exactly 2 balancing loops", "at most 12 variables"}},
+		{"two balancing feedback loops, more than 1 positive feedback loop", []string{"exactly 2 balancing loops", "at least 2 reinforcing loops"}},
+		{"fewer than 5 loops", []string{"at most 4 feedback loops"}},
+		{"between 2 and 4 feedback loops", []string{"between 2 and 4 feedback loops"}},
+		{"no balancing loops", []string{"exactly 0 balancing loops"}},
+		{"a single reinforcing loop", []string{"exactly 1 reinforcing loop"}},
+		{"The model must include the variable Tax Burden.", []string{"includes the variable Tax Burden"}},
+		{`Include the variables "Media Coverage", Public Anger and Protest Size; keep it small`, []string{
+			"includes the variable Media Coverage", "includes the variable Public Anger", "includes the variable Protest Size",
+		}},
+		{"Please include the variable Tax Burden in the model.", []string{"includes the variable Tax Burden"}},
+		{"Include the variable Tax Burden, which drives emigration.", []string{"includes the variable Tax Burden"}},
+		{"Include the variable Research and Development Spending.", []string{"includes the variable Research and Development Spending"}},
+		{"Include the variable “Ratio of Debt to GDP” and explain it.", []string{"includes the variable Ratio of Debt to GDP"}},
+		{"Include the variables Wages and Cost of Living, which drive emigration.", []string{
+			"includes the variable Wages", "includes the variable Cost of Living",
+		}},
+		// descriptions rather than requirements
+		{"Explain the revolution with a feedback loop or two.", nil},
+		{"Include variables that are polarity neutral, and include feedback.", nil},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, ParseConstraints(tt.text).Strings(), tt.text)
+	}
+}
+
+// loopMap has the reinforcing loop A → B → A and the balancing loop
+// B → C → B.
+const loopMap = `{
+  "title": "Loops",
+  "explanation": "",
+  "causal_chains": [
+    {"initial_variable": "A", "relationships": [
+      {"variable": "B", "polarity": "+", "polarity_reasoning": ""},
+      {"variable": "A", "polarity": "+", "polarity_reasoning": ""}
+    ], "reasoning": ""},
+    {"initial_variable": "B", "relationships": [
+      {"variable": "C", "polarity": "+", "polarity_reasoning": ""},
+      {"variable": "B", "polarity": "-", "polarity_reasoning": ""}
+    ], "reasoning": ""}
+  ]
+}`
+
+func TestConstraintsCheck(t *testing.T) {
+	var m Map
+	require.NoError(t, json.Unmarshal([]byte(loopMap), &m))
+
+	met := ParseConstraints("at least 1 reinforcing loop, exactly 1 balancing loop, 2 loops, at most 3 variables, include the variable a")
+	assert.Len(t, met.Counts, 4)
+	assert.Empty(t, met.Check(&m))
+
+	violated := ParseConstraints("at least 3 reinforcing loops, no balancing loops, at most 2 variables, include the variable Tax Burden")
+	assert.Equal(t, []string{
+		"The map has 1 reinforcing loop but needs at least 3 reinforcing loops: add 2 more, closing chains whose relationships have an even number of negative polarities.",
+		"The map has 1 balancing loop but needs exactly 0 balancing loops: remove 1 by dropping or redirecting the relationships that close them.",
+		"The map has 3 variables but needs at most 2 variables: remove 1 by merging similar variables or dropping peripheral ones.",
+		`The map is missing the variable "Tax Burden": add it, connected by causal relationships to the rest of the map.`,
+	}, violated.Check(&m))
+}
+
+func TestGenerateEnforcesConstraints(t *testing.T) {
+	client := &toolClient{turns: []turn{{reply: revolution1}, {reply: loopMap}}}
+	d := NewDiagrammer(client, "", WithConstraints(ParseConstraints("exactly 1 balancing loop")))
+
+	m, err := d.Generate(context.Background(), "revolution", "")
+	require.NoError(t, err)
+	assert.Equal(t, "Loops", m.Title)
+	assert.Empty(t, m.Warnings)
+
+	require.Len(t, client.sent, 2)
+	assert.Contains(t, client.sent[0].GetText(), "The map must have:\n- exactly 1 balancing loop")
+	assert.Contains(t, client.sent[1].GetText(), "The map has 0 balancing loops but needs exactly 1 balancing loop")
+}
+
+func TestGenerateGivesUpOnConstraints(t *testing.T) {
+	client := &toolClient{turns: []turn{{reply: loopMap}, {reply: loopMap}, {reply: loopMap}, {reply: loopMap}}}
+	d := NewDiagrammer(client, "", WithConstraints(ParseConstraints("at least 5 loops")))
+
+	m, err := d.Generate(context.Background(), "loops", "")
+	require.NoError(t, err)
+	assert.Empty(t, client.turns)
+	assert.Equal(t, []string{"Unmet requirement: The map has 2 feedback loops but needs at least 5 feedback loops: add 3 more, closing chains that end at their initial_variable."}, m.Warnings)
+}
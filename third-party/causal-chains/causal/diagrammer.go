@@ -2,10 +2,11 @@ package causal
 
 import (
 	"context"
-	_ "embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"regexp"
+	"slices"
 	"strings"
 
 	"github.com/bpowers/go-agent/chat"
@@ -15,44 +16,152 @@ var codeFenceStartRe = regexp.MustCompile("^```.*\n")
 
 type Diagrammer interface {
 	Generate(ctx context.Context, prompt, backgroundKnowledge string) (*Map, error)
+	Continue(ctx context.Context, s *Session, prompt string) (*Map, error)
 }
 
 type diagrammer struct {
 	client          chat.Client
 	reasoningEffort string
+	strategy        OutputStrategy
+	prompts         *Prompts
+	// problemStatement and currentModel fill in the prompts' placeholders
+	// of the same names.
+	problemStatement string
+	currentModel     string
+	constraints      Constraints
 }
 
 var _ Diagrammer = &diagrammer{}
 
-func NewDiagrammer(client chat.Client, reasoningEffort string) Diagrammer {
-	return diagrammer{
+type Option func(*diagrammer)
+
+// WithConstraints has the map checked against the constraints, and the
+// model asked to fix any violations, up to maxConstraintRounds times.
+func WithConstraints(c Constraints) Option {
+	return func(d *diagrammer) {
+		d.constraints = c
+	}
+}
+
+// WithOutputStrategy sets how the model returns its map; the default is
+// JSONSchemaOutput.
+func WithOutputStrategy(s OutputStrategy) Option {
+	return func(d *diagrammer) {
+		d.strategy = s
+	}
+}
+
+// WithPrompts sets the prompts; the default is DefaultPromptVersion's.
+func WithPrompts(p *Prompts) Option {
+	return func(d *diagrammer) {
+		d.prompts = p
+	}
+}
+
+// WithProblemStatement gives the prompts the problem the user is
+// modeling.
+func WithProblemStatement(s string) Option {
+	return func(d *diagrammer) {
+		d.problemStatement = s
+	}
+}
+
+// WithCurrentModel gives the prompts the user's current model, as
+// SD-JSON.
+func WithCurrentModel(m string) Option {
+	return func(d *diagrammer) {
+		d.currentModel = m
+	}
+}
+
+func NewDiagrammer(client chat.Client, reasoningEffort string, opts ...Option) Diagrammer {
+	d := diagrammer{
 		client:          client,
 		reasoningEffort: reasoningEffort,
+		prompts:         defaultPrompts,
+	}
+	for _, opt := range opts {
+		opt(&d)
 	}
+	return d
 }
 
-var (
-	//go:embed system_prompt.txt
-	baseSystemPrompt string
+func (d diagrammer) Generate(ctx context.Context, prompt, backgroundKnowledge string) (*Map, error) {
+	data, err := d.promptData(backgroundKnowledge)
+	if err != nil {
+		return nil, err
+	}
+	systemPrompt, err := d.systemPrompt(data)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := d.firstMessage(prompt, data)
+	if err != nil {
+		return nil, err
+	}
 
-	//go:embed background_prompt.txt
-	backgroundPrompt string
-)
+	c := d.client.NewChat(systemPrompt)
+	return d.generate(ctx, c, msg)
+}
 
-func (d diagrammer) Generate(ctx context.Context, prompt, backgroundKnowledge string) (*Map, error) {
+func (d diagrammer) promptData(backgroundKnowledge string) (PromptData, error) {
 	schema, err := json.MarshalIndent(RelationshipsResponseSchema, "", "    ")
 	if err != nil {
-		return nil, fmt.Errorf("json.MarshalIndent: %w", err)
+		return PromptData{}, fmt.Errorf("json.MarshalIndent: %w", err)
 	}
 
-	systemPrompt := strings.ReplaceAll(baseSystemPrompt, "{schema}", string(schema))
+	return PromptData{
+		Schema:              string(schema),
+		BackgroundKnowledge: backgroundKnowledge,
+		ProblemStatement:    d.problemStatement,
+		CurrentModel:        d.currentModel,
+	}, nil
+}
 
-	msg := chat.UserMessage(fmt.Sprintf("%s\n\n%s",
-		strings.ReplaceAll(backgroundPrompt, "{backgroundKnowledge}", backgroundKnowledge),
-		prompt,
-	))
+func (d diagrammer) systemPrompt(data PromptData) (string, error) {
+	system, err := render(d.prompts.system, data)
+	if err != nil {
+		return "", err
+	}
+	return system + d.strategy.instructions(), nil
+}
 
-	c := d.client.NewChat(systemPrompt)
+func (d diagrammer) firstMessage(prompt string, data PromptData) (chat.Message, error) {
+	background, err := render(d.prompts.background, data)
+	if err != nil {
+		return chat.Message{}, err
+	}
+	prompt += d.requirements()
+	if background = strings.TrimRight(background, "\n"); background == "" {
+		return chat.UserMessage(prompt), nil
+	}
+	return chat.UserMessage(fmt.Sprintf("%s\n\n%s", background, prompt)), nil
+}
+
+// requirements restates the constraints after the user's prompt, so
+// that ones given separately from it are seen too.
+func (d diagrammer) requirements() string {
+	if d.constraints.IsZero() {
+		return ""
+	}
+	return "\n\nThe map must have:\n- " + strings.Join(d.constraints.Strings(), "\n- ")
+}
+
+// generate sends msg on c and returns the map the model answers with.
+func (d diagrammer) generate(ctx context.Context, c chat.Chat, msg chat.Message) (*Map, error) {
+	return d.extend(ctx, c, msg, nil)
+}
+
+// extend is generate for a reply that adds to base, if it isn't nil,
+// rather than being the whole map.  Its title and explanation replace
+// base's.
+func (d diagrammer) extend(ctx context.Context, c chat.Chat, msg chat.Message, base *Map) (*Map, error) {
+	out := &collector{strategy: d.strategy}
+	for _, t := range out.tools() {
+		if err := c.RegisterTool(t); err != nil {
+			return nil, fmt.Errorf("c.RegisterTool(%s): %w", t.Name(), err)
+		}
+	}
 
 	maxTokens := c.MaxTokens()
 	if maxTokens <= 0 {
@@ -60,22 +169,51 @@ func (d diagrammer) Generate(ctx context.Context, prompt, backgroundKnowledge st
 	}
 
 	opts := []chat.Option{
-		chat.WithResponseFormat("relationships_response", true, RelationshipsResponseSchema),
 		chat.WithMaxTokens(maxTokens),
 	}
 	if d.reasoningEffort != "" {
 		opts = append(opts, chat.WithReasoningEffort(d.reasoningEffort))
 	}
+	// a continuation is the rest of a response, which wouldn't match
+	// the schema on its own
+	continueOpts := opts
+	if d.strategy == JSONSchemaOutput {
+		opts = append(slices.Clip(opts), chat.WithResponseFormat("relationships_response", true, RelationshipsResponseSchema))
+	}
+
+	combine, prompt := func(m *Map) *Map { return m }, revisePrompt
+	if base != nil {
+		combine, prompt = func(m *Map) *Map {
+			merged := *base
+			merged.Title, merged.Explanation = m.Title, m.Explanation
+			merged.CausalChains = append(slices.Clip(base.CausalChains), m.CausalChains...)
+			merged.Glossary = append(slices.Clip(base.Glossary), m.Glossary...)
+			merged.Warnings = append(slices.Clip(base.Warnings), m.Warnings...)
+			return &merged
+		}, reviseLinksPrompt
+	}
+
+	result, err := d.ask(ctx, c, out, msg, opts, continueOpts)
+	if err != nil {
+		return nil, err
+	}
+	return d.enforce(ctx, c, out, combine(result), opts, continueOpts, prompt, combine), nil
+}
 
+// ask sends msg on c and returns the map in the reply, re-prompting
+// once if it can't be parsed.
+func (d diagrammer) ask(ctx context.Context, c chat.Chat, out *collector, msg chat.Message, opts, continueOpts []chat.Option) (*Map, error) {
 	resp, err := c.Message(ctx, msg, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("c.ChatCompletion: %w", err)
 	}
 
-	result, err := parseRelationshipsResponse(resp.GetText())
+	result, err := out.result(continueReply(ctx, c, resp.GetText(), continueOpts))
 	if err != nil {
 		// Some models like Anthropic's don't _actually_ support structured outputs.
 		// Retry a second time with the error we just got, hoping they can get their act together.
+		// The retry is a whole new response, so what the tools collected is dropped.
+		out.reset()
 		retryMsg := chat.UserMessage(fmt.Sprintf("Your response didn't match the required structured JSON output. The specific error was: %v\n\nRe-generate your response addressing this error, ensuring it matches the required structured JSON output format from the system prompt.", err))
 
 		resp, retryErr := c.Message(ctx, retryMsg, opts...)
@@ -83,7 +221,7 @@ func (d diagrammer) Generate(ctx context.Context, prompt, backgroundKnowledge st
 			return nil, fmt.Errorf("retry failed: %w (original error: %v)", retryErr, err)
 		}
 
-		result, err = parseRelationshipsResponse(resp.GetText())
+		result, err = out.result(continueReply(ctx, c, resp.GetText(), continueOpts))
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse response after retry: %w", err)
 		}
@@ -92,12 +230,54 @@ func (d diagrammer) Generate(ctx context.Context, prompt, backgroundKnowledge st
 	return result, nil
 }
 
+// maxConstraintRounds bounds how many times the model is asked to fix
+// the map's constraint violations.
+const maxConstraintRounds = 3
+
+const revisePrompt = "The map doesn't meet the user's requirements yet:\n- %s\n\nRevise the map to meet all of the requirements, keeping the parts that already work, and return the complete revised map."
+
+// enforce asks the model to revise m with prompt until it meets the
+// constraints or maxConstraintRounds is reached, returning the map with
+// the fewest violations, with warnings for any that remain.  combine
+// makes the map from the model's reply.
+func (d diagrammer) enforce(ctx context.Context, c chat.Chat, out *collector, m *Map, opts, continueOpts []chat.Option, prompt string, combine func(*Map) *Map) *Map {
+	violations := d.constraints.Check(m)
+	best, bestViolations := m, violations
+	for round := 0; round < maxConstraintRounds && len(violations) > 0; round++ {
+		out.reset()
+		msg := chat.UserMessage(fmt.Sprintf(prompt, strings.Join(violations, "\n- ")))
+		revised, err := d.ask(ctx, c, out, msg, opts, continueOpts)
+		if err != nil {
+			best.Warnings = append(best.Warnings, fmt.Sprintf("Revising the map to meet the requirements failed: %v", err))
+			break
+		}
+		revised = combine(revised)
+		violations = d.constraints.Check(revised)
+		if len(violations) <= len(bestViolations) {
+			best, bestViolations = revised, violations
+		}
+	}
+	for _, v := range bestViolations {
+		best.Warnings = append(best.Warnings, "Unmet requirement: "+v)
+	}
+	return best
+}
+
 func parseRelationshipsResponse(content string) (*Map, error) {
 	cleaned := stripCodeFence(content)
 	if cleaned == "" {
 		return nil, fmt.Errorf("empty response content")
 	}
 
+	// models wrap the JSON in prose and leave trailing commas often
+	// enough that it is worth repairing rather than re-prompting
+	if r, ok := repairJSON(cleaned); ok {
+		if r.truncated {
+			return nil, errTruncated
+		}
+		cleaned = r.text
+	}
+
 	var rr Map
 	if err := json.Unmarshal([]byte(cleaned), &rr); err != nil {
 		return nil, fmt.Errorf("json.Unmarshal: %w", err)
@@ -106,6 +286,18 @@ func parseRelationshipsResponse(content string) (*Map, error) {
 	return &rr, nil
 }
 
+// parseReply parses the map from a reply, salvaging what it can from
+// one that was cut off.
+func parseReply(content string) (*Map, error) {
+	m, err := parseRelationshipsResponse(content)
+	if errors.Is(err, errTruncated) {
+		if salvaged, serr := salvageRelationshipsResponse(content); serr == nil {
+			return salvaged, nil
+		}
+	}
+	return m, err
+}
+
 func stripCodeFence(s string) string {
 	trimmed := strings.TrimSpace(s)
 
@@ -7,6 +7,8 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/UB-IAD/sd-ai/third-party/causal-chains/sdjson"
 )
 
 var testMap1 *Map
@@ -329,3 +331,43 @@ func TestDiagrammerSVG(t *testing.T) {
 	// err = exec.Command("open", path).Run()
 	// require.NoError(t, err)
 }
+
+func TestLoopPolarities(t *testing.T) {
+	for _, p := range testMap1.LoopPolarities() {
+		assert.Equal(t, ReinforcingLoop, p)
+	}
+
+	causalMap := NewMap([]sdjson.Relationship{
+		{From: "Workload", To: "Stress", Polarity: sdjson.PositivePolarity},
+		{From: "Stress", To: "Productivity", Polarity: sdjson.NonmonotonicPolarity},
+		{From: "Productivity", To: "Workload", Polarity: sdjson.NegativePolarity},
+		{From: "Workload", To: "Overtime", Polarity: sdjson.PositivePolarity},
+		{From: "Overtime", To: "Workload", Polarity: sdjson.NegativePolarity},
+	})
+
+	loops := causalMap.Loops()
+	require.Len(t, loops, 2)
+	assert.Equal(t, []string{"overtime", "workload", "overtime"}, loops[0])
+	assert.Equal(t, []LoopPolarity{BalancingLoop, UndeterminedLoop}, causalMap.LoopPolarities())
+	assert.Equal(t, UndeterminedLoop, causalMap.LoopPolarity([]string{"workload", "stress", "productivity", "workload"}))
+
+	// unknown polarity survives the trip through the response schema
+	var parsed Map
+	err := json.Unmarshal([]byte(`{"causal_chains": [{"initial_variable": "a", "relationships": [{"variable": "b", "polarity": "?", "polarity_reasoning": ""}], "reasoning": ""}]}`), &parsed)
+	require.NoError(t, err)
+	assert.Equal(t, sdjson.UnknownPolarity, parsed.Compat().Relationships[0].Polarity)
+
+	// a link the chains disagree on is unknown in loops too, as it is
+	// in Compat
+	err = json.Unmarshal([]byte(`{"causal_chains": [
+		{"initial_variable": "a", "relationships": [{"variable": "b", "polarity": "+", "polarity_reasoning": ""}, {"variable": "a", "polarity": "+", "polarity_reasoning": ""}], "reasoning": ""},
+		{"initial_variable": "a", "relationships": [{"variable": "b", "polarity": "-", "polarity_reasoning": ""}], "reasoning": ""}
+	]}`), &parsed)
+	require.NoError(t, err)
+	assert.Equal(t, []LoopPolarity{UndeterminedLoop}, parsed.LoopPolarities())
+	for _, r := range parsed.Compat().Relationships {
+		if r.From == "a" {
+			assert.Equal(t, sdjson.UnknownPolarity, r.Polarity)
+		}
+	}
+}
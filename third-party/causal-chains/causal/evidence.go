@@ -0,0 +1,208 @@
+package causal
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Span is where a relationship's evidence was found in the background
+// knowledge.
+type Span struct {
+	// Start and End are byte offsets into the background knowledge.
+	Start int `json:"start"`
+	End   int `json:"end"`
+	// Similarity is how many words the quote and the span have in
+	// common, in order, relative to their lengths: 1 for a verbatim
+	// quote.
+	Similarity float64 `json:"similarity"`
+}
+
+// minEvidenceSimilarity is how much of a quote must be found for it to
+// count as found, allowing for the small slips models make copying
+// text, like dropped words and changed punctuation.
+const minEvidenceSimilarity = 0.8
+
+// Citation is a relationship and the evidence for it.
+type Citation struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Evidence string `json:"evidence,omitzero"`
+	Source   *Span  `json:"source,omitzero"`
+	// Supported is whether the evidence was found in the background
+	// knowledge.
+	Supported bool `json:"supported"`
+}
+
+type word struct {
+	text       string
+	start, end int
+}
+
+// words splits s into lowercased words, ignoring punctuation and case
+// so quotes match despite differences in either.
+func words(s string) []word {
+	var ws []word
+	start := -1
+	for i, r := range s {
+		inWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		switch {
+		case inWord && start < 0:
+			start = i
+		case !inWord && start >= 0:
+			ws = append(ws, word{strings.ToLower(s[start:i]), start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		ws = append(ws, word{strings.ToLower(s[start:]), start, len(s)})
+	}
+	return ws
+}
+
+// commonWords is the length of the longest common subsequence of a and
+// b.
+func commonWords(a, b []word) int {
+	prev, cur := make([]int, len(b)+1), make([]int, len(b)+1)
+	for i := range a {
+		for j := range b {
+			if a[i].text == b[j].text {
+				cur[j+1] = prev[j] + 1
+			} else {
+				cur[j+1] = max(prev[j+1], cur[j])
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// findQuote returns the span of text that best matches quote, or nil if
+// none is at least minEvidenceSimilarity similar.  Windows of text a
+// little longer than the quote are screened by the words they share
+// with it, in any order, and those that share enough are trimmed to
+// the words they have in common and compared word by word.
+func findQuote(text, quote string) *Span {
+	q := words(quote)
+	if len(q) == 0 {
+		return nil
+	}
+	t := words(text)
+	// leave room for the words a quote may have dropped
+	n := min(len(q)+int(float64(len(q))*(1-minEvidenceSimilarity))+1, len(t))
+	threshold := minEvidenceSimilarity * float64(len(q))
+
+	need := make(map[string]int, len(q))
+	for _, w := range q {
+		need[w.text]++
+	}
+	have := make(map[string]int, len(q))
+	shared := 0
+
+	var best *Span
+	for i, w := range t {
+		if have[w.text] < need[w.text] {
+			shared++
+		}
+		have[w.text]++
+		if i >= n {
+			old := t[i-n].text
+			have[old]--
+			if have[old] < need[old] {
+				shared--
+			}
+		}
+		if float64(shared) < threshold {
+			continue
+		}
+
+		window := t[max(i-n+1, 0) : i+1]
+		common := commonWords(q, window)
+		if float64(common) < threshold {
+			continue
+		}
+		for len(window) > 1 && commonWords(q, window[1:]) == common {
+			window = window[1:]
+		}
+		for len(window) > 1 && commonWords(q, window[:len(window)-1]) == common {
+			window = window[:len(window)-1]
+		}
+		// like the Dice coefficient, so that a span with words the quote
+		// left out is less similar
+		similarity := 2 * float64(common) / float64(len(q)+len(window))
+		if similarity >= minEvidenceSimilarity && (best == nil || similarity > best.Similarity) {
+			best = &Span{Start: window[0].start, End: window[len(window)-1].end, Similarity: similarity}
+			if similarity == 1 {
+				break
+			}
+		}
+	}
+	return best
+}
+
+// Cite looks for each relationship's evidence in the background
+// knowledge, setting the Source of those whose evidence is found.
+// Evidence that can't be found is warned about, since the model may
+// have made it up, as are relationships without any support.  Maps
+// made without background knowledge are left as they are.
+func (m *Map) Cite(background string) {
+	if strings.TrimSpace(background) == "" {
+		return
+	}
+
+	for _, c := range m.CausalChains {
+		for i := range c.Relationships {
+			r := &c.Relationships[i]
+			r.Source = nil
+			if r.Evidence != "" {
+				r.Source = findQuote(background, r.Evidence)
+				if r.Source == nil {
+					m.Warnings = append(m.Warnings, fmt.Sprintf("The evidence for %s → %s isn't in the background knowledge: %q",
+						c.From(i).Raw(), r.Variable.Raw(), r.Evidence))
+				}
+			}
+		}
+	}
+
+	citations := m.Citations()
+	unsupported := 0
+	for _, c := range citations {
+		if !c.Supported {
+			unsupported++
+		}
+	}
+	if unsupported > 0 {
+		m.Warnings = append(m.Warnings, fmt.Sprintf("%d of the %d relationships aren't supported by the background knowledge.", unsupported, len(citations)))
+	}
+}
+
+// Citations returns the evidence for each of the map's relationships,
+// named as in Compat.  A relationship repeated in several chains is
+// supported by the evidence of any of them.
+func (m *Map) Citations() []Citation {
+	display := make(map[string]string)
+	for _, id := range m.Identities() {
+		display[id.Key] = id.Display
+	}
+
+	var citations []Citation
+	index := make(map[[2]string]int)
+	for _, c := range m.CausalChains {
+		for i, r := range c.Relationships {
+			from, to := c.From(i).Name(), r.Variable.Name()
+			j, seen := index[[2]string{from, to}]
+			if !seen {
+				j = len(citations)
+				index[[2]string{from, to}] = j
+				citations = append(citations, Citation{From: display[from], To: display[to]})
+			}
+			if citations[j].Supported || (r.Evidence == "" && citations[j].Evidence != "") {
+				continue
+			}
+			citations[j].Evidence = r.Evidence
+			citations[j].Source = r.Source
+			citations[j].Supported = r.Source != nil
+		}
+	}
+	return citations
+}
@@ -0,0 +1,78 @@
+package causal
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const evidenceBackground = `Rising bread prices left many families hungry.  Hunger, in turn,
+fueled public anger at the monarchy, and the angrier the public became,
+the larger the protests grew.`
+
+func TestFindQuote(t *testing.T) {
+	tests := []struct {
+		quote      string
+		want       string
+		similarity float64
+	}{
+		{"Rising bread prices left many families hungry", "Rising bread prices left many families hungry", 1},
+		// case, punctuation and line breaks don't matter
+		{"hunger in turn fueled public anger at the monarchy", "Hunger, in turn,\nfueled public anger at the monarchy", 1},
+		// nor does a dropped word
+		{"the angrier the public became, the larger protests grew", "the angrier the public became,\nthe larger the protests grew", 18.0 / 19},
+		{"Bread prices were set by the guilds", "", 0},
+		{"", "", 0},
+	}
+	for _, tt := range tests {
+		span := findQuote(evidenceBackground, tt.quote)
+		if tt.want == "" {
+			assert.Nil(t, span, tt.quote)
+			continue
+		}
+		require.NotNil(t, span, tt.quote)
+		assert.Equal(t, tt.want, evidenceBackground[span.Start:span.End], tt.quote)
+		assert.InDelta(t, tt.similarity, span.Similarity, 1e-9, tt.quote)
+	}
+}
+
+func TestCite(t *testing.T) {
+	var m Map
+	require.NoError(t, json.Unmarshal([]byte(`{
+  "title": "Revolution",
+  "explanation": "",
+  "causal_chains": [
+    {"initial_variable": "Bread Price", "relationships": [
+      {"variable": "Hunger", "polarity": "+", "polarity_reasoning": "", "evidence": "bread prices left many families hungry"},
+      {"variable": "Public Anger", "polarity": "+", "polarity_reasoning": "", "evidence": "Hunger fueled anger at the king"},
+      {"variable": "Protest Size", "polarity": "+", "polarity_reasoning": "", "evidence": ""}
+    ], "reasoning": ""},
+    {"initial_variable": "Public Anger", "relationships": [
+      {"variable": "Protest Size", "polarity": "+", "polarity_reasoning": "", "evidence": "the angrier the public became, the larger the protests grew"}
+    ], "reasoning": ""}
+  ]
+}`), &m))
+
+	m.Cite(evidenceBackground)
+	assert.Equal(t, []string{
+		`The evidence for Hunger → Public Anger isn't in the background knowledge: "Hunger fueled anger at the king"`,
+		"1 of the 3 relationships aren't supported by the background knowledge.",
+	}, m.Warnings)
+
+	citations := m.Citations()
+	require.Len(t, citations, 3)
+	assert.Equal(t, Citation{From: "Bread Price", To: "Hunger", Evidence: "bread prices left many families hungry",
+		Source: &Span{Start: 7, End: 45, Similarity: 1}, Supported: true}, citations[0])
+	assert.False(t, citations[1].Supported)
+	// supported by the second chain's evidence
+	assert.Equal(t, "Public Anger", citations[2].From)
+	assert.True(t, citations[2].Supported)
+
+	// without background knowledge there is nothing to check
+	var bare Map
+	require.NoError(t, json.Unmarshal([]byte(loopMap), &bare))
+	bare.Cite("")
+	assert.Empty(t, bare.Warnings)
+}
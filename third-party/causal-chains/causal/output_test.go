@@ -4,12 +4,14 @@ import (
 	_ "embed"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/UB-IAD/sd-ai/third-party/causal-chains/sdjson"
+	"github.com/UB-IAD/sd-ai/third-party/causal-chains/sdjson/diff"
 )
 
 func TestCanonicalize(t *testing.T) {
@@ -115,3 +117,149 @@ func TestCompatTransformation(t *testing.T) {
 
 	assert.Equal(t, expected, actual)
 }
+
+func TestMapDiff(t *testing.T) {
+	var original Map
+	err := json.Unmarshal([]byte(compatIn1), &original)
+	require.NoError(t, err)
+
+	updated := NewMap([]sdjson.Relationship{
+		{From: "frimbulators", To: "whatajigs", Polarity: sdjson.NegativePolarity},
+		{From: "whatajigs", To: "doohickeys", Polarity: sdjson.PositivePolarity},
+	})
+
+	d := original.Diff(updated)
+	assert.Equal(t, []diff.Change{
+		{Kind: diff.VariableAdded, Variable: "doohickeys"},
+		{Kind: diff.PolarityFlipped, From: "frimbulators", To: "whatajigs", Old: "+", New: "-"},
+		{Kind: diff.RelationshipAdded, From: "whatajigs", To: "doohickeys", New: "+"},
+	}, d.Changes)
+}
+
+func TestIdentities(t *testing.T) {
+	var m Map
+	err := json.Unmarshal([]byte(`{"causal_chains": [
+		{"initial_variable": "tax burden", "relationships": [
+			{"variable": "colonist_anger", "polarity": "+", "polarity_reasoning": ""},
+			{"variable": "Tax Burden", "polarity": "+", "polarity_reasoning": ""}
+		], "reasoning": "r1"},
+		{"initial_variable": "Tax  Burden", "relationships": [
+			{"variable": "Colonist\nAnger", "polarity": "+", "polarity_reasoning": ""}
+		], "reasoning": "r2"}
+	]}`), &m)
+	require.NoError(t, err)
+
+	assert.Equal(t, []Identity{
+		{Key: "tax_burden", Display: "Tax Burden", Aliases: []string{"tax burden", "Tax  Burden"}},
+		{Key: "colonist_anger", Display: "Colonist Anger", Aliases: []string{"colonist_anger", "Colonist\nAnger"}},
+	}, m.Identities())
+	assert.Equal(t, NewSet("Colonist Anger", "Tax Burden"), m.Variables())
+	assert.Equal(t, [][]string{{"colonist_anger", "tax_burden", "colonist_anger"}}, m.Loops())
+
+	mdl := m.Compat()
+	assert.Equal(t, []sdjson.Variable{
+		{Name: "Colonist Anger", Type: sdjson.VariableTypeAux, Aliases: []string{"colonist_anger", "Colonist\nAnger"}},
+		{Name: "Tax Burden", Type: sdjson.VariableTypeAux, Aliases: []string{"tax burden", "Tax  Burden"}},
+	}, mdl.Variables)
+	// the duplicate link from the second chain is merged into the first
+	assert.Equal(t, []sdjson.Relationship{
+		{From: "Tax Burden", To: "Colonist Anger", Polarity: sdjson.PositivePolarity, Reasoning: "r1. r2.", Provenance: []sdjson.Provenance{
+			{Chain: 0, Reasoning: "r1", Loop: true},
+			{Chain: 1, Reasoning: "r2"},
+		}},
+		{From: "Colonist Anger", To: "Tax Burden", Polarity: sdjson.PositivePolarity, Reasoning: "r1", Provenance: []sdjson.Provenance{
+			{Chain: 0, Reasoning: "r1", Loop: true},
+		}},
+	}, mdl.Relationships)
+
+	// variables marshal back to their original spelling
+	b, err := json.Marshal(m.CausalChains[0].InitialVariable)
+	require.NoError(t, err)
+	assert.Equal(t, `"tax burden"`, string(b))
+}
+
+func TestGlossary(t *testing.T) {
+	var m Map
+	err := json.Unmarshal([]byte(`{"causal_chains": [
+		{"initial_variable": "Tax Burden", "relationships": [
+			{"variable": "Colonist Anger", "polarity": "+", "polarity_reasoning": ""}
+		], "reasoning": "r1"}
+	], "glossary": [
+		{"variable": "tax burden", "definition": "Taxes levied on the colonies by Parliament.", "units": "pounds/year", "exogenous": true},
+		{"variable": "Colonist Anger", "definition": " How resentful colonists are of British rule. ", "units": "dimensionless", "exogenous": false},
+		{"variable": "Colonist Anger", "definition": "A second definition.", "units": "", "exogenous": false},
+		{"variable": "King George", "definition": "Not in the map.", "units": "", "exogenous": true}
+	]}`), &m)
+	require.NoError(t, err)
+
+	defs := m.Definitions()
+	assert.Len(t, defs, 2)
+	assert.Equal(t, "How resentful colonists are of British rule.", defs["colonist_anger"].Definition)
+
+	mdl := m.Compat()
+	assert.Equal(t, []sdjson.Variable{
+		{Name: "Colonist Anger", Type: sdjson.VariableTypeAux, Documentation: "How resentful colonists are of British rule.", Units: "dimensionless"},
+		{Name: "Tax Burden", Type: sdjson.VariableTypeAux, Documentation: "Taxes levied on the colonies by Parliament. It is exogenous: set outside the system.", Units: "pounds/year"},
+	}, mdl.Variables)
+
+	// stock and flow skeletons keep the definitions and units
+	sf := m.StockFlow(m.Classify())
+	require.Len(t, sf.Variables, 2)
+	assert.Equal(t, "pounds/year", sf.Variables[1].Units)
+	assert.True(t, strings.HasPrefix(sf.Variables[1].Documentation, "Taxes levied on the colonies by Parliament."))
+}
+
+func TestProvenance(t *testing.T) {
+	var m Map
+	err := json.Unmarshal([]byte(`{"causal_chains": [
+		{"initial_variable": "Hiring", "relationships": [
+			{"variable": "Workforce", "polarity": "+", "polarity_reasoning": ""}
+		], "reasoning": "Hires join the workforce"},
+		{"initial_variable": "Workforce", "relationships": [
+			{"variable": "Output", "polarity": "+", "polarity_reasoning": "more hands"},
+			{"variable": "Revenue", "polarity": "+", "polarity_reasoning": ""},
+			{"variable": "Hiring", "polarity": "+", "polarity_reasoning": ""},
+			{"variable": "Workforce", "polarity": "+", "polarity_reasoning": ""}
+		], "reasoning": "Growth feedback loop: revenue pays for hiring."},
+		{"initial_variable": "workforce", "relationships": [
+			{"variable": "output", "polarity": "-", "polarity_reasoning": "ignored"}
+		], "reasoning": "Growth feedback loop"}
+	]}`), &m)
+	require.NoError(t, err)
+
+	assert.False(t, m.CausalChains[0].IsLoop())
+	assert.True(t, m.CausalChains[1].IsLoop())
+
+	rels := make(map[string]sdjson.Relationship)
+	for _, r := range m.Compat().Relationships {
+		rels[r.From+" -> "+r.To] = r
+	}
+	require.Len(t, rels, 4)
+
+	// the loop's reasoning comes first
+	hiring := rels["Hiring -> Workforce"]
+	assert.Equal(t, "Growth feedback loop: revenue pays for hiring. Hires join the workforce.", hiring.Reasoning)
+	assert.Equal(t, []sdjson.Provenance{
+		{Chain: 0, Reasoning: "Hires join the workforce"},
+		{Chain: 1, Reasoning: "Growth feedback loop: revenue pays for hiring.", Loop: true},
+	}, hiring.Provenance)
+
+	// reasoning contained in another chain's is left out, and the
+	// chains' conflicting polarities leave the polarity unknown
+	output := rels["Workforce -> Output"]
+	assert.Equal(t, "Growth feedback loop: revenue pays for hiring.", output.Reasoning)
+	assert.Equal(t, sdjson.UnknownPolarity, output.Polarity)
+	assert.Equal(t, "The chains disagree: chain 1 gives +, chain 2 gives -.", output.PolarityReasoning)
+	assert.Equal(t, []int{1, 2}, []int{output.Provenance[0].Chain, output.Provenance[1].Chain})
+	assert.Equal(t, []string{"The chains disagree on the polarity of Workforce → Output (chain 1 gives +, chain 2 gives -), so it is left unknown."}, m.PolarityConflicts())
+
+	// a chain that doesn't know the polarity doesn't disagree
+	m.CausalChains[2].Relationships[0].Polarity = sdjson.UnknownPolarity
+	assert.Empty(t, m.PolarityConflicts())
+	for _, r := range m.Compat().Relationships {
+		if r.From == "Workforce" && r.To == "Output" {
+			assert.Equal(t, sdjson.PositivePolarity, r.Polarity)
+			assert.Equal(t, "more hands", r.PolarityReasoning)
+		}
+	}
+}
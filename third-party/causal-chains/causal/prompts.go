@@ -0,0 +1,157 @@
+package causal
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// DefaultPromptVersion is the version of the prompts used unless
+// another is asked for.
+const DefaultPromptVersion = "v1"
+
+// builtinPrompts holds a directory of templates for each version:
+// system.tmpl for the system prompt and background.tmpl for what
+// precedes the user's prompt.
+//
+//go:embed prompts
+var builtinPrompts embed.FS
+
+// PromptData is what the prompt templates are filled in with.
+type PromptData struct {
+	// Schema is the JSON schema of the response.
+	Schema              string
+	BackgroundKnowledge string
+	ProblemStatement    string
+	// CurrentModel is the user's model as SD-JSON, or "" if they
+	// haven't got one.
+	CurrentModel string
+}
+
+// Prompts are the templates the model is prompted with.
+type Prompts struct {
+	// Version names the prompts, so their results can be compared
+	// with other versions'.
+	Version string
+
+	system     *template.Template
+	background *template.Template
+}
+
+var defaultPrompts = func() *Prompts {
+	p, err := LoadPrompts("", DefaultPromptVersion)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}()
+
+func parsePrompt(name, text string) (*template.Template, error) {
+	t, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	// catch misspelled placeholders now rather than partway through a
+	// request
+	if err := t.Execute(io.Discard, PromptData{}); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// readPrompt reads a version's template, trying dir before the built-in
+// prompts.
+func readPrompt(dir, version, name string) ([]byte, error) {
+	file := path.Join(version, name)
+	if dir != "" {
+		data, err := fs.ReadFile(os.DirFS(dir), file)
+		if !errors.Is(err, fs.ErrNotExist) {
+			return data, err
+		}
+	}
+	return fs.ReadFile(builtinPrompts, path.Join("prompts", file))
+}
+
+// LoadPrompts loads a version of the prompts, "" being
+// DefaultPromptVersion.  Versions in dir, if it isn't "", take
+// precedence over the built-in ones.  A version without one of the
+// templates uses DefaultPromptVersion's.
+func LoadPrompts(dir, version string) (*Prompts, error) {
+	if version == "" {
+		version = DefaultPromptVersion
+	}
+	if !fs.ValidPath(version) || strings.Contains(version, "/") {
+		return nil, fmt.Errorf("invalid prompt version %q", version)
+	}
+
+	p := &Prompts{Version: version}
+	found := false
+	for _, t := range []struct {
+		name string
+		tmpl **template.Template
+	}{
+		{"system.tmpl", &p.system},
+		{"background.tmpl", &p.background},
+	} {
+		data, err := readPrompt(dir, version, t.name)
+		if errors.Is(err, fs.ErrNotExist) {
+			data, err = readPrompt(dir, DefaultPromptVersion, t.name)
+		} else if err == nil {
+			found = true
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", t.name, err)
+		}
+		if *t.tmpl, err = parsePrompt(t.name, string(data)); err != nil {
+			return nil, fmt.Errorf("prompt version %s: %w", version, err)
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("unknown prompt version %q", version)
+	}
+	return p, nil
+}
+
+// WithOverrides returns p with the given templates in place of its
+// own, "" leaving p's.  Overridden prompts are versioned by a hash of
+// the overrides, as in "v1+a1b2c3d4", so that results from different
+// overrides can be told apart.
+func (p *Prompts) WithOverrides(system, background string) (*Prompts, error) {
+	if system == "" && background == "" {
+		return p, nil
+	}
+
+	o := *p
+	var err error
+	if system != "" {
+		if o.system, err = parsePrompt("system.tmpl", system); err != nil {
+			return nil, fmt.Errorf("system prompt override: %w", err)
+		}
+	}
+	if background != "" {
+		if o.background, err = parsePrompt("background.tmpl", background); err != nil {
+			return nil, fmt.Errorf("background prompt override: %w", err)
+		}
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s", system, background)
+	o.Version = p.Version + "+" + hex.EncodeToString(h.Sum(nil))[:8]
+	return &o, nil
+}
+
+func render(t *template.Template, data PromptData) (string, error) {
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("%s: %w", t.Name(), err)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,104 @@
+package causal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadPrompts(t *testing.T) {
+	data := PromptData{
+		Schema:              `{"type": "object"}`,
+		BackgroundKnowledge: "colonial history",
+		ProblemStatement:    "why did the colonies revolt?",
+		CurrentModel:        `{"variables": []}`,
+	}
+
+	v1, err := LoadPrompts("", "")
+	require.NoError(t, err)
+	assert.Equal(t, DefaultPromptVersion, v1.Version)
+	system, err := render(v1.system, data)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(system, "schema:\n\n"+data.Schema), system)
+	background, err := render(v1.background, data)
+	require.NoError(t, err)
+	assert.NotContains(t, background, data.ProblemStatement)
+
+	// v2 adds the problem statement and current model, and shares v1's
+	// system prompt
+	v2, err := LoadPrompts("", "v2")
+	require.NoError(t, err)
+	v2System, err := render(v2.system, data)
+	require.NoError(t, err)
+	assert.Equal(t, system, v2System)
+	background, err = render(v2.background, data)
+	require.NoError(t, err)
+	for _, s := range []string{data.BackgroundKnowledge, data.ProblemStatement, data.CurrentModel} {
+		assert.Contains(t, background, s)
+	}
+	background, err = render(v2.background, PromptData{})
+	require.NoError(t, err)
+	assert.Empty(t, background)
+
+	_, err = LoadPrompts("", "v0")
+	assert.ErrorContains(t, err, `unknown prompt version "v0"`)
+	_, err = LoadPrompts("", "../prompts/v1")
+	assert.ErrorContains(t, err, "invalid prompt version")
+}
+
+func TestLoadPromptsFromDir(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "terse"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "terse", "background.tmpl"), []byte("Problem: {{.ProblemStatement}}"), 0o644))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "typo"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "typo", "system.tmpl"), []byte("{{.Schemas}}"), 0o644))
+
+	p, err := LoadPrompts(dir, "terse")
+	require.NoError(t, err)
+	background, err := render(p.background, PromptData{ProblemStatement: "x"})
+	require.NoError(t, err)
+	assert.Equal(t, "Problem: x", background)
+
+	// built-in versions are still available
+	_, err = LoadPrompts(dir, "v2")
+	assert.NoError(t, err)
+
+	_, err = LoadPrompts(dir, "typo")
+	assert.ErrorContains(t, err, "Schemas")
+}
+
+func TestPromptOverrides(t *testing.T) {
+	same, err := defaultPrompts.WithOverrides("", "")
+	require.NoError(t, err)
+	assert.Same(t, defaultPrompts, same)
+
+	a, err := defaultPrompts.WithOverrides("You draw maps.\n\n{{.Schema}}", "")
+	require.NoError(t, err)
+	assert.Regexp(t, `^v1\+[0-9a-f]{8}$`, a.Version)
+	b, err := defaultPrompts.WithOverrides("You draw diagrams.\n\n{{.Schema}}", "")
+	require.NoError(t, err)
+	assert.NotEqual(t, a.Version, b.Version)
+	assert.Equal(t, DefaultPromptVersion, defaultPrompts.Version)
+
+	_, err = defaultPrompts.WithOverrides("", "{{.Background}}")
+	assert.ErrorContains(t, err, "background prompt override")
+}
+
+func TestDiagrammerPrompts(t *testing.T) {
+	p, err := defaultPrompts.WithOverrides("You draw maps.", "Problem: {{.ProblemStatement}}")
+	require.NoError(t, err)
+
+	client := &toolClient{turns: []turn{{reply: revolution1}}}
+	d := NewDiagrammer(client, "", WithPrompts(p), WithProblemStatement("taxes"))
+	_, err = d.Generate(context.Background(), "revolution", "")
+	require.NoError(t, err)
+
+	assert.Equal(t, "You draw maps.", client.systemPrompt)
+	require.Len(t, client.sent, 1)
+	assert.Equal(t, "Problem: taxes\n\nrevolution", client.sent[0].GetText())
+}
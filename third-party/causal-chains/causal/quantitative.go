@@ -0,0 +1,243 @@
+package causal
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/UB-IAD/sd-ai/third-party/causal-chains/sdjson"
+	"github.com/UB-IAD/sd-ai/third-party/causal-chains/sdjson/equation"
+	"github.com/UB-IAD/sd-ai/third-party/causal-chains/sdjson/sim"
+	"github.com/UB-IAD/sd-ai/third-party/causal-chains/units"
+	"github.com/bpowers/go-agent/chat"
+	"github.com/bpowers/go-agent/schema"
+)
+
+//go:embed sfd_schema.json
+var sfdSchemaJson string
+
+// SFDResponseSchema is the schema of a quantitative model's response.
+var SFDResponseSchema *schema.JSON
+
+func init() {
+	SFDResponseSchema = new(schema.JSON)
+	if err := json.Unmarshal([]byte(sfdSchemaJson), SFDResponseSchema); err != nil {
+		panic(err)
+	}
+}
+
+// QuantitativeModel is a stock and flow model that simulates, with the
+// model's explanation of it.
+type QuantitativeModel struct {
+	Title       string `json:"title"`
+	Explanation string `json:"explanation"`
+	sdjson.Model
+	// Warnings describe problems the model was left with, like
+	// inconsistent units.
+	Warnings []string `json:"warnings,omitzero"`
+}
+
+// Modeler builds quantitative stock and flow models.
+type Modeler interface {
+	Generate(ctx context.Context, prompt, backgroundKnowledge string) (*QuantitativeModel, error)
+}
+
+type modeler struct {
+	d diagrammer
+}
+
+var _ Modeler = modeler{}
+
+// NewModeler returns a Modeler that asks the model for a stock and flow
+// model with equations, units and specs, and checks it by simulating
+// it.  It takes the same options as NewDiagrammer, though prompts and
+// constraints, which are for maps, are ignored.  The current model, if
+// given, is revised rather than replaced.
+func NewModeler(client chat.Client, reasoningEffort string, opts ...Option) Modeler {
+	d := NewDiagrammer(client, reasoningEffort, opts...).(diagrammer)
+	return modeler{d: d}
+}
+
+const sfdSystemPrompt = `You are an experienced System Dynamics practitioner.
+You have studied under experts like Jay Forrester, John Sterman, and Pål Davidsen, and internalized the system dynamics methodology taught in Sterman's Business Dynamics textbook.
+
+The user wants a quantitative stock and flow model that simulates, to test their understanding of a system against its behavior over time.
+
+Your methodology will be roughly as follows:
+* Identify the stocks: the accumulations that give the system its memory, each changed only by its inflows and outflows.
+* Identify the flows that fill and drain each stock, and write each flow's equation in terms of the stocks and other variables that drive it, so that every feedback loop passes through a stock.
+* Give every variable an equation: each stock its initial value, and each flow and auxiliary a formula or a constant.  Equations refer to other variables by name, exactly as they are named in the model, and use only variables in the model.  No auxiliary or flow may depend on itself except through a stock.
+* Represent nonlinear effects with graphical functions, tables of points, with the effect's input as the equation.
+* Give every variable units, consistent across each equation, and each flow its stock's units per time unit.
+* Choose specs: a time unit, a start and stop time long enough to show the behavior of interest, and a dt no larger than a quarter of the shortest time constant in the model.
+* List every causal relationship between variables, with its polarity.
+
+Your responses will be JSON that correspond to the following schema:
+
+`
+
+const reviseModelPrompt = "The model doesn't simulate yet:\n- %s\n\nFix these problems, keeping the parts that already work, and return the complete revised model."
+
+func (m modeler) Generate(ctx context.Context, prompt, backgroundKnowledge string) (*QuantitativeModel, error) {
+	schemaText, err := json.MarshalIndent(SFDResponseSchema, "", "    ")
+	if err != nil {
+		return nil, fmt.Errorf("json.MarshalIndent: %w", err)
+	}
+	msg := chat.UserMessage(m.firstMessage(prompt, backgroundKnowledge))
+
+	maxTokens := 64 * 1024
+	c := m.d.client.NewChat(sfdSystemPrompt + string(schemaText))
+	if n := c.MaxTokens(); n > 0 {
+		maxTokens = n
+	}
+	opts := []chat.Option{chat.WithMaxTokens(maxTokens)}
+	if m.d.reasoningEffort != "" {
+		opts = append(opts, chat.WithReasoningEffort(m.d.reasoningEffort))
+	}
+	continueOpts := opts
+	if m.d.strategy == JSONSchemaOutput {
+		opts = append(slices.Clip(opts), chat.WithResponseFormat("sfd_response", true, SFDResponseSchema))
+	}
+
+	result, err := m.ask(ctx, c, msg, opts, continueOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	// ask the model to fix what stops it simulating, keeping the
+	// version with the fewest problems
+	issues, _ := validate(result.Model)
+	best, bestIssues := result, issues
+	for round := 0; round < maxConstraintRounds && len(issues) > 0; round++ {
+		msg := chat.UserMessage(fmt.Sprintf(reviseModelPrompt, strings.Join(issues, "\n- ")))
+		revised, err := m.ask(ctx, c, msg, opts, continueOpts)
+		if err != nil {
+			best.Warnings = append(best.Warnings, fmt.Sprintf("Revising the model to fix its problems failed: %v", err))
+			break
+		}
+		issues, _ = validate(revised.Model)
+		if len(issues) <= len(bestIssues) {
+			best, bestIssues = revised, issues
+		}
+	}
+
+	_, unsupported := validate(best.Model)
+	for _, issue := range bestIssues {
+		best.Warnings = append(best.Warnings, "The model doesn't simulate: "+issue)
+	}
+	if unsupported != nil {
+		best.Warnings = append(best.Warnings, fmt.Sprintf("The model couldn't be checked by simulating it: %v", unsupported))
+	}
+	for _, issue := range units.Check(best.Model) {
+		best.Warnings = append(best.Warnings, "Units: "+issue.String())
+	}
+	return best, nil
+}
+
+// firstMessage puts the background knowledge, problem statement and
+// current model, those there are, before the user's prompt.  The
+// prompt templates are written for maps, so they aren't used.
+func (m modeler) firstMessage(prompt, backgroundKnowledge string) string {
+	var b strings.Builder
+	if s := strings.TrimSpace(backgroundKnowledge); s != "" {
+		fmt.Fprintf(&b, "The following background knowledge is important context when generating a response for the user:\n\n%s\n\n", s)
+	}
+	if s := strings.TrimSpace(m.d.problemStatement); s != "" {
+		fmt.Fprintf(&b, "The user is building this model to better understand the following problem:\n\n%s\n\n", s)
+	}
+	if s := strings.TrimSpace(m.d.currentModel); s != "" {
+		fmt.Fprintf(&b, "The user already has the model below, in SD-JSON.  Revise it rather than starting over, keeping the names, equations and values of the variables it already has unless they need to change:\n\n%s\n\n", s)
+	}
+	b.WriteString(prompt)
+	return b.String()
+}
+
+// ask sends msg on c and returns the model in the reply, re-prompting
+// once if it can't be parsed.
+func (m modeler) ask(ctx context.Context, c chat.Chat, msg chat.Message, opts, continueOpts []chat.Option) (*QuantitativeModel, error) {
+	resp, err := c.Message(ctx, msg, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("c.Message: %w", err)
+	}
+	result, err := parseSFDResponse(continueReply(ctx, c, resp.GetText(), continueOpts))
+	if err != nil {
+		retryMsg := chat.UserMessage(fmt.Sprintf("Your response didn't match the required structured JSON output. The specific error was: %v\n\nRe-generate your response addressing this error, ensuring it matches the required structured JSON output format from the system prompt.", err))
+		resp, retryErr := c.Message(ctx, retryMsg, opts...)
+		if retryErr != nil {
+			return nil, fmt.Errorf("retry failed: %w (original error: %v)", retryErr, err)
+		}
+		result, err = parseSFDResponse(continueReply(ctx, c, resp.GetText(), continueOpts))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse response after retry: %w", err)
+		}
+	}
+	return result, nil
+}
+
+func parseSFDResponse(content string) (*QuantitativeModel, error) {
+	cleaned := stripCodeFence(content)
+	if cleaned == "" {
+		return nil, fmt.Errorf("empty response content")
+	}
+	if r, ok := repairJSON(cleaned); ok {
+		if r.truncated {
+			return nil, errTruncated
+		}
+		cleaned = r.text
+	}
+
+	var qm QuantitativeModel
+	if err := json.Unmarshal([]byte(cleaned), &qm); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	for i := range qm.Variables {
+		v := &qm.Variables[i]
+		// the schema requires a graphical function, which is empty for
+		// variables without one
+		if v.GraphicalFunction != nil && len(v.GraphicalFunction.Points) == 0 {
+			v.GraphicalFunction = nil
+		}
+		if v.Type != sdjson.VariableTypeStock {
+			v.Inflows, v.Outflows = nil, nil
+		}
+		if v.Type != sdjson.VariableTypeFlow {
+			v.Uniflow = false
+		}
+	}
+	qm.Warnings = nil
+	return &qm, nil
+}
+
+// validate returns the problems that stop the model simulating, and
+// the error wrapping sim.ErrUnsupported if it can't be simulated here.
+func validate(m sdjson.Model) (issues []string, unsupported error) {
+	if len(m.Variables) == 0 {
+		return []string{"the model has no variables"}, nil
+	}
+
+	names := NewSet[string]()
+	for _, v := range m.Variables {
+		names.Add(equation.NormalizeName(v.Name))
+	}
+	for _, r := range m.Relationships {
+		for _, name := range []string{r.From, r.To} {
+			if !names.Contains(equation.NormalizeName(name)) {
+				issues = append(issues, fmt.Sprintf("the relationship from %s to %s refers to %q, which isn't a variable in the model", r.From, r.To, name))
+			}
+		}
+	}
+
+	_, err := sim.Simulate(m)
+	switch {
+	case err == nil:
+	case errors.Is(err, sim.ErrUnsupported):
+		unsupported = err
+	default:
+		issues = append(issues, strings.Split(err.Error(), "\n")...)
+	}
+	return issues, unsupported
+}
@@ -0,0 +1,89 @@
+package causal
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/UB-IAD/sd-ai/third-party/causal-chains/sdjson"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sfdJSON(t *testing.T, birthsEquation string) string {
+	qm := QuantitativeModel{
+		Title:       "Population",
+		Explanation: "Births grow the population in a reinforcing loop.",
+		Model: sdjson.Model{
+			Variables: []sdjson.Variable{
+				{Name: "Population", Type: sdjson.VariableTypeStock, Equation: "100", Units: "people", Inflows: []string{"Births"}},
+				{Name: "Births", Type: sdjson.VariableTypeFlow, Equation: birthsEquation, Units: "people/Years", GraphicalFunction: &sdjson.GraphicalFunction{}},
+				{Name: "Birth Rate", Type: sdjson.VariableTypeAux, Equation: "0.02", Units: "1/Years", Inflows: []string{}, GraphicalFunction: &sdjson.GraphicalFunction{}},
+			},
+			Relationships: []sdjson.Relationship{
+				{From: "Population", To: "Births", Polarity: sdjson.PositivePolarity},
+				{From: "Birth Rate", To: "Births", Polarity: sdjson.PositivePolarity},
+				{From: "Births", To: "Population", Polarity: sdjson.PositivePolarity},
+			},
+			Specs: sdjson.Specs{StartTime: 0, StopTime: 50, DT: 0.25, TimeUnits: "Years"},
+		},
+	}
+	data, err := json.Marshal(qm)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestModelerRevisesUntilItSimulates(t *testing.T) {
+	client := &toolClient{turns: []turn{
+		{reply: sfdJSON(t, "Population * Fertility")},
+		{reply: sfdJSON(t, "Population * Birth Rate")},
+	}}
+	qm, err := NewModeler(client, "", WithCurrentModel(`{"variables": []}`)).Generate(context.Background(), "model population growth", "")
+	require.NoError(t, err)
+
+	require.Len(t, client.sent, 2)
+	assert.Contains(t, client.sent[0].GetText(), `{"variables": []}`)
+	assert.Contains(t, client.sent[1].GetText(), `Births: refers to "Fertility", which isn't in the model`)
+	assert.Contains(t, client.systemPrompt, `"graphicalFunction"`)
+
+	assert.Empty(t, qm.Warnings)
+	assert.Equal(t, "Population", qm.Title)
+	require.Len(t, qm.Variables, 3)
+	// empty graphical functions, and flows of non-stocks, are dropped
+	assert.Nil(t, qm.Variables[1].GraphicalFunction)
+	assert.Nil(t, qm.Variables[2].Inflows)
+}
+
+func TestModelerWarnings(t *testing.T) {
+	broken := sfdJSON(t, "Population * ")
+	client := &toolClient{turns: []turn{{reply: broken}, {reply: broken}, {reply: broken}, {reply: broken}}}
+	qm, err := NewModeler(client, "").Generate(context.Background(), "model population growth", "")
+	require.NoError(t, err)
+	assert.Len(t, client.sent, 1+maxConstraintRounds)
+	require.NotEmpty(t, qm.Warnings)
+	assert.Contains(t, qm.Warnings[0], "The model doesn't simulate: Births: equation")
+
+	// models sim can't run are returned with a warning, not revised
+	client = &toolClient{turns: []turn{{reply: sfdJSON(t, "SMTH1(Population * Birth Rate, 3)")}}}
+	qm, err = NewModeler(client, "").Generate(context.Background(), "model population growth", "")
+	require.NoError(t, err)
+	assert.Len(t, client.sent, 1)
+	require.Len(t, qm.Warnings, 1)
+	assert.Contains(t, qm.Warnings[0], "couldn't be checked by simulating it")
+}
+
+func TestValidate(t *testing.T) {
+	var qm QuantitativeModel
+	require.NoError(t, json.Unmarshal([]byte(sfdJSON(t, "Population * Birth Rate")), &qm))
+
+	issues, unsupported := validate(qm.Model)
+	assert.Empty(t, issues)
+	assert.NoError(t, unsupported)
+
+	qm.Relationships = append(qm.Relationships, sdjson.Relationship{From: "Deaths", To: "Population", Polarity: sdjson.NegativePolarity})
+	issues, _ = validate(qm.Model)
+	assert.Equal(t, []string{`the relationship from Deaths to Population refers to "Deaths", which isn't a variable in the model`}, issues)
+
+	issues, _ = validate(sdjson.Model{})
+	assert.Equal(t, []string{"the model has no variables"}, issues)
+}
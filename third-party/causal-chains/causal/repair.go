@@ -0,0 +1,197 @@
+package causal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bpowers/go-agent/chat"
+)
+
+// errTruncated is returned for replies that end partway through the
+// map, as they do when the model hits the output token limit.
+var errTruncated = errors.New("the response was cut off before the JSON was complete")
+
+// maxContinuations bounds how many times a cut off reply is continued.
+const maxContinuations = 2
+
+const continuePrompt = "Your response was cut off at the output token limit. Continue it from exactly where it stopped, without repeating anything and without any commentary, so that the two parts join into the complete JSON response."
+
+// repaired is a reply's JSON object with common defects fixed.
+type repaired struct {
+	// text is the object, with the prose around it, trailing commas
+	// and raw control characters in strings removed.
+	text string
+	// truncated is whether the object was never closed.
+	truncated bool
+	// salvage is a truncated object cut back to its last complete
+	// top-level field or causal chain and closed, or "" if nothing was
+	// complete.
+	salvage string
+}
+
+// repairJSON finds the first JSON object in s and repairs it.  It
+// returns false if s has no object at all.
+func repairJSON(s string) (repaired, bool) {
+	start := strings.IndexByte(s, '{')
+	if start < 0 {
+		return repaired{}, false
+	}
+
+	var out []byte
+	var stack []byte
+	inString, escaped := false, false
+
+	// cut is where out can be cut off, and cutStack the brackets open
+	// there.  Cuts are made only between the map's own fields and
+	// between causal chains, at a depth of at most 2, so a salvaged
+	// chain is never missing relationships.
+	cut := -1
+	var cutStack []byte
+	mark := func(at int) {
+		if len(stack) <= 2 {
+			cut = at
+			cutStack = append(cutStack[:0], stack...)
+		}
+	}
+
+scan:
+	for i := start; i < len(s); i++ {
+		ch := s[i]
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case ch == '\\':
+				escaped = true
+			case ch == '"':
+				inString = false
+			case ch == '\n':
+				out = append(out, `\n`...)
+				continue
+			case ch == '\r':
+				out = append(out, `\r`...)
+				continue
+			case ch == '\t':
+				out = append(out, `\t`...)
+				continue
+			}
+			out = append(out, ch)
+			continue
+		}
+
+		switch ch {
+		case '"':
+			inString = true
+		case '{', '[':
+			stack = append(stack, ch)
+		case '}', ']':
+			out = trimTrailingComma(out)
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+			out = append(out, ch)
+			if len(stack) == 0 {
+				break scan
+			}
+			mark(len(out))
+			continue
+		case ',':
+			mark(len(out))
+		}
+		out = append(out, ch)
+	}
+
+	r := repaired{text: string(out)}
+	if len(stack) == 0 {
+		return r, true
+	}
+
+	r.truncated = true
+	if cut >= 0 {
+		salvage := trimTrailingComma(out[:cut])
+		for i := len(cutStack) - 1; i >= 0; i-- {
+			salvage = append(salvage, closer(cutStack[i]))
+		}
+		r.salvage = string(salvage)
+	}
+	return r, true
+}
+
+func trimTrailingComma(b []byte) []byte {
+	trimmed := strings.TrimRight(string(b), " \t\r\n")
+	if strings.HasSuffix(trimmed, ",") {
+		return b[:len(trimmed)-1]
+	}
+	return b
+}
+
+func closer(open byte) byte {
+	if open == '[' {
+		return ']'
+	}
+	return '}'
+}
+
+// isTruncated is whether the reply has a JSON object that was cut off.
+func isTruncated(reply string) bool {
+	r, ok := repairJSON(stripCodeFence(reply))
+	return ok && r.truncated
+}
+
+// continueReply asks the model to continue a reply cut off at the
+// output token limit, returning the joined reply.  The chat API doesn't
+// report why a reply stopped, so a reply that ends inside its JSON
+// object is taken to have hit the limit, even if it was stopped by
+// something else, like a content filter; a reply that is complete is
+// returned as it is.  If continuing fails, the reply so far is returned
+// to be salvaged.
+func continueReply(ctx context.Context, c chat.Chat, reply string, opts []chat.Option) string {
+	for i := 0; i < maxContinuations && isTruncated(reply); i++ {
+		resp, err := c.Message(ctx, chat.UserMessage(continuePrompt), opts...)
+		if err != nil {
+			break
+		}
+		reply += stripContinuationFence(resp.GetText())
+	}
+	return reply
+}
+
+// stripContinuationFence removes a code fence the model wrapped its
+// continuation in.  Unfenced continuations are left alone, since their
+// leading whitespace may be in the middle of a string.
+func stripContinuationFence(s string) string {
+	if strings.HasPrefix(strings.TrimSpace(s), "```") {
+		return stripCodeFence(s)
+	}
+	return strings.TrimSuffix(strings.TrimRight(s, " \t\r\n"), "```")
+}
+
+// salvageRelationshipsResponse returns the complete causal chains of a
+// truncated reply, with a warning saying what was lost.
+func salvageRelationshipsResponse(content string) (*Map, error) {
+	r, ok := repairJSON(stripCodeFence(content))
+	if !ok || !r.truncated {
+		return nil, errors.New("the response wasn't cut off")
+	}
+	if r.salvage == "" {
+		return nil, errTruncated
+	}
+
+	var m Map
+	if err := json.Unmarshal([]byte(r.salvage), &m); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	if len(m.CausalChains) == 0 {
+		return nil, fmt.Errorf("%w, and no causal chain was complete", errTruncated)
+	}
+
+	warning := fmt.Sprintf("The response was cut off at the output token limit; only the %d causal chains completed before then were kept.", len(m.CausalChains))
+	if m.Title == "" || m.Explanation == "" {
+		warning += " The title or explanation was lost."
+	}
+	m.Warnings = append(m.Warnings, warning)
+	return &m, nil
+}
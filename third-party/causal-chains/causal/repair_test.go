@@ -0,0 +1,101 @@
+package causal
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRelationshipsResponseRepairs(t *testing.T) {
+	reply := "Here is the causal map you asked for:\n\n```json\n" + `{
+  "title": "Loop",
+  "explanation": "Two lines,
+with a raw newline.",
+  "causal_chains": [
+    {
+      "initial_variable": "A",
+      "relationships": [
+        {"variable": "B", "polarity": "+", "polarity_reasoning": "more A, more B",},
+        {"variable": "A", "polarity": "+", "polarity_reasoning": "more B, more A"},
+      ],
+      "reasoning": "reinforcing",
+    },
+  ],
+}` + "\n```\n\nLet me know if you'd like any changes!"
+
+	m, err := parseRelationshipsResponse(reply)
+	require.NoError(t, err)
+	assert.Equal(t, "Loop", m.Title)
+	assert.Equal(t, "Two lines,\nwith a raw newline.", m.Explanation)
+	require.Len(t, m.CausalChains, 1)
+	assert.Len(t, m.CausalChains[0].Relationships, 2)
+	assert.Empty(t, m.Warnings)
+}
+
+// truncatedRevolution is revolution1 cut off partway through its last
+// chain.
+func truncatedRevolution(t *testing.T) (string, int) {
+	data, err := json.Marshal(testMap1)
+	require.NoError(t, err)
+	s := string(data)
+
+	last := strings.LastIndex(s, `{"initial_variable"`)
+	require.Positive(t, last)
+	return s[:last+40], len(testMap1.CausalChains) - 1
+}
+
+func TestSalvageRelationshipsResponse(t *testing.T) {
+	truncated, complete := truncatedRevolution(t)
+
+	_, err := parseRelationshipsResponse(truncated)
+	assert.ErrorIs(t, err, errTruncated)
+
+	m, err := salvageRelationshipsResponse(truncated)
+	require.NoError(t, err)
+	assert.Equal(t, testMap1.Title, m.Title)
+	assert.Equal(t, testMap1.CausalChains[:complete], m.CausalChains)
+	require.Len(t, m.Warnings, 1)
+	assert.Contains(t, m.Warnings[0], "cut off at the output token limit")
+
+	// with the chains first, as the schema orders them, the title and
+	// explanation are lost
+	m, err = salvageRelationshipsResponse(`{"causal_chains": [{"initial_variable": "A", "relationships": [{"variable": "B", "polarity": "+", "polarity_reasoning": "x"}], "reasoning": "y"}, {"initial_var`)
+	require.NoError(t, err)
+	assert.Len(t, m.CausalChains, 1)
+	assert.Contains(t, m.Warnings[0], "title or explanation was lost")
+
+	_, err = salvageRelationshipsResponse(`{"title": "T", "explanation": "cut o`)
+	assert.ErrorIs(t, err, errTruncated)
+}
+
+func TestGenerateContinuesTruncatedReply(t *testing.T) {
+	data, err := json.Marshal(testMap1)
+	require.NoError(t, err)
+	s := string(data)
+	half := len(s) / 2
+
+	client := &toolClient{turns: []turn{
+		{reply: "```json\n" + s[:half]},
+		{reply: s[half:] + "\n```"},
+	}}
+	m, err := NewDiagrammer(client, "").Generate(context.Background(), "revolution", "")
+	require.NoError(t, err)
+	assert.Equal(t, testMap1, m)
+	assert.Empty(t, client.turns)
+}
+
+func TestGenerateSalvagesTruncatedReply(t *testing.T) {
+	truncated, complete := truncatedRevolution(t)
+
+	// the continuations add nothing, so the reply stays cut off
+	client := &toolClient{turns: []turn{{reply: truncated}, {}, {}}}
+	m, err := NewDiagrammer(client, "").Generate(context.Background(), "revolution", "")
+	require.NoError(t, err)
+	assert.Len(t, m.CausalChains, complete)
+	assert.Len(t, m.Warnings, 1)
+	assert.Empty(t, client.turns)
+}
@@ -0,0 +1,374 @@
+package causal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/UB-IAD/sd-ai/third-party/causal-chains/sdjson"
+	"github.com/bpowers/go-agent/chat"
+	"github.com/bpowers/go-agent/schema"
+)
+
+// Sector is a loosely coupled part of the system, like a company's
+// workforce or its finances, that was mapped on its own.
+type Sector struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitzero"`
+	// Variables are the display names of the variables in the sector.
+	Variables []string `json:"variables,omitzero"`
+}
+
+const (
+	// maxSectors bounds how many sectors a system is divided into.
+	maxSectors = 8
+	// maxParallelSectors bounds how many sectors are mapped at once.
+	maxParallelSectors = 4
+)
+
+const sectorsSystemPrompt = `You are an expert in system dynamics modeling. Divide the system the user describes into between 2 and %d sectors: loosely coupled parts of the system, like a company's production, workforce and finances, each of which can be mapped on its own. Give each sector a short name and a description of which parts of the system it covers.
+
+Respond with only a JSON object of the form {"sectors": [{"name": "...", "description": "..."}]}.`
+
+const sectorFocusPrompt = "%s\n\nMap only the %s sector of this system: %s\n\nThe other sectors (%s) are being mapped separately, so include their variables only where they directly cause, or are caused by, variables in this sector."
+
+const stitchPrompt = "%s\n\nThe system has been divided into sectors, and each has been mapped separately:\n\n%s\nFind the causal relationships between variables in different sectors, especially ones that close feedback loops spanning several sectors.  Respond with a map of only the new causal chains linking the sectors, using the existing variables' names exactly.  Its title and explanation should describe the whole system."
+
+const reviseLinksPrompt = "Together with the sectors' maps, your links don't meet the user's requirements yet:\n- %s\n\nRevise the links between sectors to meet all of the requirements, and return the complete revised set of links."
+
+var sectorsResponseSchema = &schema.JSON{
+	Type: "object",
+	Properties: map[string]*schema.JSON{
+		"sectors": {
+			Type: "array",
+			Items: &schema.JSON{
+				Type: "object",
+				Properties: map[string]*schema.JSON{
+					"name":        {Type: "string"},
+					"description": {Type: "string"},
+				},
+				Required:             []string{"name", "description"},
+				AdditionalProperties: new(bool),
+			},
+		},
+	},
+	Required:             []string{"sectors"},
+	AdditionalProperties: new(bool),
+}
+
+type sectorDiagrammer struct {
+	diagrammer
+}
+
+var _ Diagrammer = sectorDiagrammer{}
+
+// NewSectorDiagrammer returns a Diagrammer for problems too large to
+// map well in one pass.  It asks the model for the system's sectors,
+// maps each sector in a separate conversation, several at once, and
+// then asks for the links between them.  The map's Sectors say which
+// sector each variable belongs to.  Constraints are checked against the
+// whole map once it is stitched together.
+func NewSectorDiagrammer(client chat.Client, reasoningEffort string, opts ...Option) Diagrammer {
+	return sectorDiagrammer{NewDiagrammer(client, reasoningEffort, opts...).(diagrammer)}
+}
+
+func (d sectorDiagrammer) Generate(ctx context.Context, prompt, backgroundKnowledge string) (*Map, error) {
+	m, _, err := d.generateSectors(ctx, prompt, backgroundKnowledge)
+	return m, err
+}
+
+// Continue maps the first turn of a session by sector, and revises the
+// whole map on later turns, keeping the variables that remain in their
+// sectors.
+func (d sectorDiagrammer) Continue(ctx context.Context, s *Session, prompt string) (*Map, error) {
+	if len(s.Turns) > 0 {
+		sectors := s.Map().Sectors
+		m, err := d.diagrammer.Continue(ctx, s, prompt)
+		if err != nil {
+			return nil, err
+		}
+		m.Sectors = regroup(m, sectors, nil)
+		return m, nil
+	}
+
+	m, msg, err := d.generateSectors(ctx, prompt, s.Params.BackgroundKnowledge)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.record(prompt, msg, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// generateSectors maps the system by sector, returning the map and the
+// message that would have prompted it in one pass.  If the model can't
+// divide the system into sectors, it is mapped in one pass instead.
+func (d sectorDiagrammer) generateSectors(ctx context.Context, prompt, backgroundKnowledge string) (*Map, chat.Message, error) {
+	data, err := d.promptData(backgroundKnowledge)
+	if err != nil {
+		return nil, chat.Message{}, err
+	}
+	systemPrompt, err := d.systemPrompt(data)
+	if err != nil {
+		return nil, chat.Message{}, err
+	}
+	msg, err := d.firstMessage(prompt, data)
+	if err != nil {
+		return nil, chat.Message{}, err
+	}
+
+	// the requirements are for the whole map, so the sectors are mapped
+	// without them
+	sectorer := d.diagrammer
+	sectorer.constraints = Constraints{}
+	overview, err := sectorer.firstMessage(prompt, data)
+	if err != nil {
+		return nil, chat.Message{}, err
+	}
+
+	sectors, err := d.sectors(ctx, overview)
+	if err != nil {
+		m, gerr := d.generate(ctx, d.client.NewChat(systemPrompt), msg)
+		if gerr != nil {
+			return nil, chat.Message{}, gerr
+		}
+		m.Warnings = append(m.Warnings, fmt.Sprintf("Dividing the system into sectors failed, so it was mapped in one pass: %v", err))
+		return m, msg, nil
+	}
+
+	maps, errs := sectorer.mapSectors(ctx, systemPrompt, overview.GetText(), sectors)
+
+	base := &Map{}
+	var mapped []string
+	for i, sm := range maps {
+		if errs[i] != nil {
+			base.Warnings = append(base.Warnings, fmt.Sprintf("Mapping the %s sector failed, so it is missing: %v", sectors[i].Name, errs[i]))
+			continue
+		}
+		base.CausalChains = append(base.CausalChains, sm.CausalChains...)
+		base.Glossary = append(base.Glossary, sm.Glossary...)
+		for _, w := range sm.Warnings {
+			base.Warnings = append(base.Warnings, fmt.Sprintf("%s sector: %s", sectors[i].Name, w))
+		}
+		mapped = append(mapped, fmt.Sprintf("Sector %q:\n%s", sectors[i].Name, describeLinks(sm)))
+	}
+
+	if len(mapped) == 0 {
+		return nil, chat.Message{}, fmt.Errorf("mapping sectors: %w", errors.Join(errs...))
+	}
+
+	stitch := chat.UserMessage(fmt.Sprintf(stitchPrompt, msg.GetText(), strings.Join(mapped, "\n")))
+	m, err := d.extend(ctx, d.client.NewChat(systemPrompt), stitch, base)
+	if err != nil {
+		return nil, chat.Message{}, fmt.Errorf("linking sectors: %w", err)
+	}
+	m.Sectors = regroup(m, sectors, membership(sectors, maps))
+	return m, msg, nil
+}
+
+// sectors asks the model to divide the system into sectors.
+func (d sectorDiagrammer) sectors(ctx context.Context, overview chat.Message) ([]Sector, error) {
+	c := d.client.NewChat(fmt.Sprintf(sectorsSystemPrompt, maxSectors))
+	opts := []chat.Option{}
+	if d.reasoningEffort != "" {
+		opts = append(opts, chat.WithReasoningEffort(d.reasoningEffort))
+	}
+	if d.strategy == JSONSchemaOutput {
+		opts = append(opts, chat.WithResponseFormat("sectors_response", true, sectorsResponseSchema))
+	}
+	resp, err := c.Message(ctx, overview, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("c.Message: %w", err)
+	}
+	return parseSectors(resp.GetText())
+}
+
+func parseSectors(content string) ([]Sector, error) {
+	cleaned := stripCodeFence(content)
+	if r, ok := repairJSON(cleaned); ok {
+		cleaned = r.text
+	}
+	var resp struct {
+		Sectors []Sector `json:"sectors"`
+	}
+	if err := json.Unmarshal([]byte(cleaned), &resp); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+
+	var sectors []Sector
+	seen := NewSet[string]()
+	for _, s := range resp.Sectors {
+		// module names can't contain the dots that separate them
+		s.Name = strings.TrimSpace(strings.ReplaceAll(s.Name, ".", " "))
+		if s.Name == "" || seen.Contains(Canonicalize(s.Name)) {
+			continue
+		}
+		seen.Add(Canonicalize(s.Name))
+		s.Variables = nil
+		sectors = append(sectors, s)
+	}
+	if len(sectors) < 2 {
+		return nil, fmt.Errorf("got %d sectors, want at least 2", len(sectors))
+	}
+	if len(sectors) > maxSectors {
+		sectors = sectors[:maxSectors]
+	}
+	return sectors, nil
+}
+
+// mapSectors maps each sector in its own conversation, returning the
+// maps and errors in the order of sectors.
+func (d diagrammer) mapSectors(ctx context.Context, systemPrompt, overview string, sectors []Sector) ([]*Map, []error) {
+	maps := make([]*Map, len(sectors))
+	errs := make([]error, len(sectors))
+	sem := make(chan struct{}, maxParallelSectors)
+	var wg sync.WaitGroup
+	for i, s := range sectors {
+		var others []string
+		for _, o := range sectors {
+			if o.Name != s.Name {
+				others = append(others, o.Name)
+			}
+		}
+		msg := chat.UserMessage(fmt.Sprintf(sectorFocusPrompt, overview, s.Name, s.Description, strings.Join(others, ", ")))
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			maps[i], errs[i] = d.generate(ctx, d.client.NewChat(systemPrompt), msg)
+		}()
+	}
+	wg.Wait()
+	return maps, errs
+}
+
+// describeLinks lists a map's relationships, one per line, for the
+// model to link to.
+func describeLinks(m *Map) string {
+	var b strings.Builder
+	for _, r := range m.Compat().Relationships {
+		fmt.Fprintf(&b, "- %s -> %s (%s)\n", r.From, r.To, r.Polarity)
+	}
+	return b.String()
+}
+
+// membership returns, for each variable, the index of the sector whose
+// map has the most relationships with it, ties going to the earlier
+// sector, since sectors' maps also have the variables of others they
+// link to.
+func membership(sectors []Sector, maps []*Map) map[string]int {
+	counts := make(map[string][]int)
+	for i, m := range maps {
+		if m == nil {
+			continue
+		}
+		count := func(v Variable) {
+			if counts[v.Name()] == nil {
+				counts[v.Name()] = make([]int, len(sectors))
+			}
+			counts[v.Name()][i]++
+		}
+		for _, c := range m.CausalChains {
+			for i, r := range c.Relationships {
+				count(c.From(i))
+				count(r.Variable)
+			}
+		}
+	}
+
+	member := make(map[string]int, len(counts))
+	for key, n := range counts {
+		member[key] = slices.Index(n, slices.Max(n))
+	}
+	return member
+}
+
+// regroup returns the sectors with the variables of m in each, in order
+// of appearance.  A variable is in the sector member gives for it, or
+// failing that the one it is listed in already; variables in neither
+// aren't in any sector.
+func regroup(m *Map, sectors []Sector, member map[string]int) []Sector {
+	if len(sectors) == 0 {
+		return nil
+	}
+	for i, s := range sectors {
+		for _, v := range s.Variables {
+			if _, ok := member[Canonicalize(v)]; !ok {
+				if member == nil {
+					member = make(map[string]int)
+				}
+				member[Canonicalize(v)] = i
+			}
+		}
+	}
+
+	grouped := make([]Sector, len(sectors))
+	for i, s := range sectors {
+		grouped[i] = Sector{Name: s.Name, Description: s.Description}
+	}
+	for _, id := range m.Identities() {
+		if i, ok := member[id.Key]; ok {
+			grouped[i].Variables = append(grouped[i].Variables, id.Display)
+		}
+	}
+	return grouped
+}
+
+// ModularCompat is Compat with each of the map's sectors as an SD-JSON
+// module.  Variables are named for their sector's module, as in
+// "Finance.Revenue", and a relationship between sectors starts from a
+// ghost of its cause in its effect's module.  Maps without sectors are
+// the same as Compat's.
+func (m *Map) ModularCompat() sdjson.Model {
+	mdl := m.Compat()
+	if len(m.Sectors) == 0 {
+		return mdl
+	}
+
+	module := make(map[string]string)
+	for _, s := range m.Sectors {
+		mdl.Modules = append(mdl.Modules, sdjson.Module{Name: s.Name})
+		for _, v := range s.Variables {
+			module[Canonicalize(v)] = s.Name
+		}
+	}
+	// Compat names variables by their display names
+	moduleOf := make(map[string]string)
+	for _, id := range m.Identities() {
+		moduleOf[id.Display] = module[id.Key]
+	}
+	qualify := func(mod, name string) string {
+		if mod == "" {
+			return name
+		}
+		return mod + "." + name
+	}
+
+	for i, v := range mdl.Variables {
+		mdl.Variables[i].Name = qualify(moduleOf[v.Name], v.Name)
+	}
+	ghosts := NewSet[string]()
+	for i, r := range mdl.Relationships {
+		from, to := moduleOf[r.From], moduleOf[r.To]
+		cause := qualify(from, r.From)
+		r.To = qualify(to, r.To)
+		r.From = qualify(to, r.From)
+		if from != to && !ghosts.Contains(r.From) {
+			ghosts.Add(r.From)
+			mdl.Variables = append(mdl.Variables, sdjson.Variable{
+				Name:              r.From,
+				Type:              sdjson.VariableTypeAux,
+				CrossLevelGhostOf: cause,
+			})
+		}
+		mdl.Relationships[i] = r
+	}
+	return mdl
+}
@@ -0,0 +1,210 @@
+package causal
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/UB-IAD/sd-ai/third-party/causal-chains/sdjson"
+	"github.com/bpowers/go-agent/chat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sectorClient answers by what it's asked, since sectors are mapped
+// concurrently and in no particular order.
+type sectorClient struct {
+	sectors string
+	// maps are the replies to the message containing each key.
+	maps  map[string]string
+	links []string
+
+	mu   sync.Mutex
+	sent []string
+}
+
+func (c *sectorClient) NewChat(systemPrompt string, initialMsgs ...chat.Message) chat.Chat {
+	return &sectorChat{client: c, sectors: strings.Contains(systemPrompt, "sectors")}
+}
+
+type sectorChat struct {
+	chat.Chat
+	client  *sectorClient
+	sectors bool
+}
+
+func (c *sectorChat) MaxTokens() int { return 0 }
+
+func (c *sectorChat) Message(ctx context.Context, msg chat.Message, opts ...chat.Option) (chat.Message, error) {
+	c.client.mu.Lock()
+	defer c.client.mu.Unlock()
+	text := msg.GetText()
+	c.client.sent = append(c.client.sent, text)
+
+	if c.sectors {
+		return chat.AssistantMessage(c.client.sectors), nil
+	}
+	if strings.Contains(text, "mapped separately:") || strings.Contains(text, "your links") {
+		reply := c.client.links[0]
+		c.client.links = c.client.links[1:]
+		return chat.AssistantMessage(reply), nil
+	}
+	for key, reply := range c.client.maps {
+		if strings.Contains(text, key) {
+			return chat.AssistantMessage(reply), nil
+		}
+	}
+	return chat.AssistantMessage(`{"title": "", "explanation": "", "causal_chains": []}`), nil
+}
+
+const (
+	twoSectors = "```json\n" + `{"sectors": [
+  {"name": "Workforce", "description": "hiring and staff"},
+  {"name": "Finance.", "description": "revenue and spending"}
+]}` + "\n```"
+
+	workforceMap = `{"title": "Workforce", "explanation": "", "causal_chains": [
+  {"initial_variable": "Staff", "relationships": [
+    {"variable": "Output", "polarity": "+", "polarity_reasoning": ""},
+    {"variable": "Hiring", "polarity": "+", "polarity_reasoning": ""},
+    {"variable": "Staff", "polarity": "+", "polarity_reasoning": ""}
+  ], "reasoning": ""},
+  {"initial_variable": "Budget", "relationships": [
+    {"variable": "Hiring", "polarity": "+", "polarity_reasoning": ""}
+  ], "reasoning": ""}
+]}`
+
+	financeMap = `{"title": "Finance", "explanation": "", "causal_chains": [
+  {"initial_variable": "Revenue", "relationships": [
+    {"variable": "Budget", "polarity": "+", "polarity_reasoning": ""},
+    {"variable": "Spending", "polarity": "+", "polarity_reasoning": ""},
+    {"variable": "Revenue", "polarity": "-", "polarity_reasoning": ""}
+  ], "reasoning": ""}
+]}`
+
+	sectorLinks = `{"title": "Company", "explanation": "The whole company", "causal_chains": [
+  {"initial_variable": "output", "relationships": [
+    {"variable": "Revenue", "polarity": "+", "polarity_reasoning": ""}
+  ], "reasoning": "sales"}
+]}`
+)
+
+func TestSectorDiagrammer(t *testing.T) {
+	client := &sectorClient{
+		sectors: twoSectors,
+		maps: map[string]string{
+			"Map only the Workforce sector": workforceMap,
+			"Map only the Finance sector":   financeMap,
+		},
+		links: []string{sectorLinks},
+	}
+	d := NewSectorDiagrammer(client, "")
+
+	m, err := d.Generate(context.Background(), "a growing company", "")
+	require.NoError(t, err)
+	assert.Equal(t, "Company", m.Title)
+	assert.Empty(t, m.Warnings)
+	assert.Len(t, m.CausalChains, 4)
+
+	// Budget is in both maps, but has more relationships in Finance
+	assert.Equal(t, []Sector{
+		{Name: "Workforce", Description: "hiring and staff", Variables: []string{"Staff", "Output", "Hiring"}},
+		{Name: "Finance", Description: "revenue and spending", Variables: []string{"Budget", "Revenue", "Spending"}},
+	}, m.Sectors)
+
+	var stitch string
+	for _, text := range client.sent {
+		if strings.Contains(text, "mapped separately:") {
+			stitch = text
+		}
+	}
+	assert.Contains(t, stitch, "Sector \"Workforce\":\n- Staff -> Output (+)\n")
+	assert.Contains(t, stitch, "- Spending -> Revenue (-)\n")
+}
+
+func TestSectorDiagrammerEnforcesConstraints(t *testing.T) {
+	client := &sectorClient{
+		sectors: twoSectors,
+		maps: map[string]string{
+			"Map only the Workforce sector": workforceMap,
+			"Map only the Finance sector":   financeMap,
+		},
+		links: []string{`{"title": "No links", "explanation": "", "causal_chains": []}`, sectorLinks},
+	}
+	d := NewSectorDiagrammer(client, "", WithConstraints(ParseConstraints("at least 3 loops")))
+
+	m, err := d.Generate(context.Background(), "a growing company", "")
+	require.NoError(t, err)
+	assert.Equal(t, "Company", m.Title)
+	assert.Empty(t, m.Warnings)
+	assert.Len(t, m.Loops(), 3)
+
+	for _, text := range client.sent {
+		if strings.Contains(text, "Map only the") {
+			assert.NotContains(t, text, "The map must have")
+		}
+	}
+	assert.Contains(t, client.sent[len(client.sent)-1], "The map has 2 feedback loops but needs at least 3 feedback loops")
+}
+
+func TestSectorDiagrammerFallsBack(t *testing.T) {
+	client := &sectorClient{
+		sectors: `{"sectors": [{"name": "Everything", "description": ""}]}`,
+		maps:    map[string]string{"a growing company": workforceMap},
+	}
+	m, err := NewSectorDiagrammer(client, "").Generate(context.Background(), "a growing company", "")
+	require.NoError(t, err)
+	assert.Equal(t, "Workforce", m.Title)
+	assert.Empty(t, m.Sectors)
+	require.Len(t, m.Warnings, 1)
+	assert.Contains(t, m.Warnings[0], "got 1 sectors, want at least 2")
+}
+
+func TestSectorDiagrammerSession(t *testing.T) {
+	client := &sectorClient{
+		sectors: twoSectors,
+		maps: map[string]string{
+			"Map only the Workforce sector": workforceMap,
+			"Map only the Finance sector":   financeMap,
+			"Revise the causal map":         sectorLinks,
+		},
+		links: []string{sectorLinks},
+	}
+	d := NewSectorDiagrammer(client, "")
+	s := NewSession(SessionParams{})
+
+	_, err := d.Continue(context.Background(), s, "a growing company")
+	require.NoError(t, err)
+	require.Len(t, s.Turns, 1)
+	assert.NotContains(t, s.Turns[0].Messages[1].GetText(), "sectors")
+
+	m, err := d.Continue(context.Background(), s, "just the sales link")
+	require.NoError(t, err)
+	assert.Equal(t, []Sector{
+		{Name: "Workforce", Description: "hiring and staff", Variables: []string{"output"}},
+		{Name: "Finance", Description: "revenue and spending", Variables: []string{"Revenue"}},
+	}, m.Sectors)
+}
+
+func TestModularCompat(t *testing.T) {
+	var m Map
+	require.NoError(t, json.Unmarshal([]byte(sectorLinks), &m))
+	assert.Equal(t, m.Compat(), m.ModularCompat())
+
+	m.Sectors = []Sector{
+		{Name: "Workforce", Variables: []string{"Output"}},
+		{Name: "Finance", Variables: []string{"Revenue"}},
+	}
+	mdl := m.ModularCompat()
+	assert.Equal(t, []sdjson.Module{{Name: "Workforce"}, {Name: "Finance"}}, mdl.Modules)
+	assert.Equal(t, []sdjson.Variable{
+		{Name: "Finance.Revenue", Type: sdjson.VariableTypeAux},
+		{Name: "Workforce.output", Type: sdjson.VariableTypeAux},
+		{Name: "Finance.output", Type: sdjson.VariableTypeAux, CrossLevelGhostOf: "Workforce.output"},
+	}, mdl.Variables)
+	assert.Equal(t, []sdjson.Relationship{
+		{From: "Finance.output", To: "Finance.Revenue", Polarity: sdjson.PositivePolarity, Reasoning: "sales", Provenance: []sdjson.Provenance{{Chain: 0, Reasoning: "sales"}}},
+	}, mdl.Relationships)
+}
@@ -0,0 +1,263 @@
+package causal
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/bpowers/go-agent/chat"
+)
+
+// SessionParams are what a session was started with.  Only
+// BackgroundKnowledge is used by this package; the rest are kept so
+// the caller can make later turns the same way.
+type SessionParams struct {
+	Model               string `json:"model,omitzero"`
+	FallbackModels      string `json:"fallbackModels,omitzero"`
+	PromptVersion       string `json:"promptVersion,omitzero"`
+	BackgroundKnowledge string `json:"backgroundKnowledge,omitzero"`
+	ProblemStatement    string `json:"problemStatement,omitzero"`
+	// Sources identifies the background knowledge and documents as
+	// they were given, before the relevant parts were picked out into
+	// BackgroundKnowledge, so that later turns given them again can be
+	// told from ones given others.
+	Sources string `json:"sources,omitzero"`
+}
+
+// Turn is one prompt in a session and the map the model answered it
+// with.
+type Turn struct {
+	Prompt string `json:"prompt"`
+	// Messages are what the turn added to the conversation: the prompt
+	// as sent and the map as the model's reply.  Tool calls and failed
+	// attempts are left out, so that the conversation can be continued
+	// by a different model or provider.
+	Messages []chat.Message `json:"messages"`
+	Map      *Map           `json:"map"`
+	Time     time.Time      `json:"time"`
+}
+
+// Session is a conversation refining a map over several turns, kept on
+// disk by a SessionStore between them.
+type Session struct {
+	ID string `json:"id"`
+	// Parent and ParentTurn are the session and the number of its
+	// turns this one was branched from.
+	Parent     string        `json:"parent,omitzero"`
+	ParentTurn int           `json:"parentTurn,omitzero"`
+	Created    time.Time     `json:"created"`
+	Params     SessionParams `json:"params"`
+	Turns      []Turn        `json:"turns"`
+}
+
+func newSessionID() string {
+	var b [12]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+var sessionIDRe = regexp.MustCompile(`^[0-9a-f]{24}$`)
+
+// NewSession starts a session with no turns.
+func NewSession(params SessionParams) *Session {
+	return &Session{
+		ID:      newSessionID(),
+		Created: time.Now().UTC(),
+		Params:  params,
+	}
+}
+
+// Map returns the latest turn's map, or nil if there are no turns.
+func (s *Session) Map() *Map {
+	if len(s.Turns) == 0 {
+		return nil
+	}
+	return s.Turns[len(s.Turns)-1].Map
+}
+
+func (s *Session) history() []chat.Message {
+	var msgs []chat.Message
+	for _, t := range s.Turns {
+		msgs = append(msgs, t.Messages...)
+	}
+	return msgs
+}
+
+func (s *Session) checkTurn(turn int) error {
+	if turn < 1 || turn > len(s.Turns) {
+		return fmt.Errorf("session %s has no turn %d (it has %d)", s.ID, turn, len(s.Turns))
+	}
+	return nil
+}
+
+// Rollback discards the turns after the given one, numbered from 1, so
+// the next prompt continues from there.
+func (s *Session) Rollback(turn int) error {
+	if err := s.checkTurn(turn); err != nil {
+		return err
+	}
+	s.Turns = s.Turns[:turn]
+	return nil
+}
+
+// Branch returns a new session with the turns up to and including the
+// given one, numbered from 1, leaving s as it is.
+func (s *Session) Branch(turn int) (*Session, error) {
+	if err := s.checkTurn(turn); err != nil {
+		return nil, err
+	}
+	b := NewSession(s.Params)
+	b.Parent, b.ParentTurn = s.ID, turn
+	b.Turns = append([]Turn(nil), s.Turns[:turn]...)
+	return b, nil
+}
+
+const followUpPrompt = "%s\n\nRevise the causal map accordingly, and return the complete revised map as before."
+
+// Continue generates the next turn of the session, appending it to s.
+// The first turn is prompted as Generate would be; later ones ask the
+// model to revise its previous map.
+func (d diagrammer) Continue(ctx context.Context, s *Session, prompt string) (*Map, error) {
+	data, err := d.promptData(s.Params.BackgroundKnowledge)
+	if err != nil {
+		return nil, err
+	}
+	systemPrompt, err := d.systemPrompt(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var msg chat.Message
+	if len(s.Turns) == 0 {
+		if msg, err = d.firstMessage(prompt, data); err != nil {
+			return nil, err
+		}
+	} else {
+		msg = chat.UserMessage(fmt.Sprintf(followUpPrompt, prompt+d.requirements()))
+	}
+
+	c := d.client.NewChat(systemPrompt, s.history()...)
+	m, err := d.generate(ctx, c, msg)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.record(prompt, msg, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// record appends the turn that prompted with msg and got m back.
+func (s *Session) record(prompt string, msg chat.Message, m *Map) error {
+	// the reply is as the model would have written it
+	reply := *m
+	reply.Warnings, reply.Sectors = nil, nil
+	replyJSON, err := json.Marshal(reply)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+
+	s.Turns = append(s.Turns, Turn{
+		Prompt:   prompt,
+		Messages: []chat.Message{msg, chat.AssistantMessage(string(replyJSON))},
+		Map:      m,
+		Time:     time.Now().UTC(),
+	})
+	return nil
+}
+
+// ErrNoSession is returned by SessionStore.Load for sessions that don't
+// exist.
+var ErrNoSession = errors.New("no such session")
+
+// SessionStore keeps sessions as JSON files in a directory.  Sessions
+// aren't locked, so if two processes continue the same session at once
+// the last to save wins.
+type SessionStore struct {
+	Dir string
+}
+
+// DefaultSessionDir is SD_AI_SESSION_DIR, or a directory in the user's
+// cache directory.
+func DefaultSessionDir() (string, error) {
+	if dir := os.Getenv("SD_AI_SESSION_DIR"); dir != "" {
+		return dir, nil
+	}
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("os.UserCacheDir: %w", err)
+	}
+	return filepath.Join(cache, "sd-ai", "causal-chains", "sessions"), nil
+}
+
+func (st SessionStore) path(id string) (string, error) {
+	if !sessionIDRe.MatchString(id) {
+		return "", fmt.Errorf("invalid session id %q", id)
+	}
+	return filepath.Join(cmp.Or(st.Dir, "."), id+".json"), nil
+}
+
+// Load reads the session with the given ID.
+func (st SessionStore) Load(id string) (*Session, error) {
+	path, err := st.path(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNoSession, id)
+	} else if err != nil {
+		return nil, fmt.Errorf("os.ReadFile: %w", err)
+	}
+
+	var s Session
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("%s: json.Unmarshal: %w", path, err)
+	}
+	return &s, nil
+}
+
+// Save writes the session, replacing any earlier version of it.  The
+// files hold users' prompts, so they are readable only by their owner.
+func (st SessionStore) Save(s *Session) error {
+	path, err := st.path(s.ID)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("json.MarshalIndent: %w", err)
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("os.MkdirAll: %w", err)
+	}
+	// write then rename, so a session is never left half written
+	f, err := os.CreateTemp(dir, s.ID+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("os.CreateTemp: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("f.Write: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("f.Close: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("os.Rename: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package causal
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionContinue(t *testing.T) {
+	revised := *testMap1
+	revised.Title = "Revised"
+	data, err := json.Marshal(revised)
+	require.NoError(t, err)
+
+	client := &toolClient{turns: []turn{{reply: revolution1}, {reply: string(data)}}}
+	d := NewDiagrammer(client, "")
+	s := NewSession(SessionParams{Model: "gpt-5", BackgroundKnowledge: "colonial history"})
+
+	m, err := d.Continue(context.Background(), s, "revolution")
+	require.NoError(t, err)
+	assert.Equal(t, testMap1, m)
+	assert.Empty(t, client.history)
+
+	m, err = d.Continue(context.Background(), s, "add the role of the press")
+	require.NoError(t, err)
+	assert.Equal(t, "Revised", m.Title)
+	assert.Same(t, m, s.Map())
+
+	// the second turn continues the first's conversation
+	require.Len(t, client.history, 2)
+	assert.Contains(t, client.history[0].GetText(), "colonial history")
+	var previous Map
+	require.NoError(t, json.Unmarshal([]byte(client.history[1].GetText()), &previous))
+	assert.Equal(t, testMap1, &previous)
+
+	require.Len(t, s.Turns, 2)
+	assert.Equal(t, "add the role of the press", s.Turns[1].Prompt)
+	assert.Contains(t, s.Turns[1].Messages[0].GetText(), "Revise the causal map")
+}
+
+func TestSessionBranchAndRollback(t *testing.T) {
+	s := NewSession(SessionParams{})
+	for _, title := range []string{"one", "two", "three"} {
+		s.Turns = append(s.Turns, Turn{Prompt: title, Map: &Map{Title: title}})
+	}
+
+	b, err := s.Branch(2)
+	require.NoError(t, err)
+	assert.NotEqual(t, s.ID, b.ID)
+	assert.Equal(t, s.ID, b.Parent)
+	assert.Equal(t, 2, b.ParentTurn)
+	assert.Equal(t, "two", b.Map().Title)
+	assert.Len(t, s.Turns, 3)
+
+	require.NoError(t, s.Rollback(1))
+	assert.Equal(t, "one", s.Map().Title)
+
+	assert.ErrorContains(t, s.Rollback(2), "has no turn 2")
+	_, err = s.Branch(0)
+	assert.Error(t, err)
+}
+
+func TestSessionStore(t *testing.T) {
+	store := SessionStore{Dir: filepath.Join(t.TempDir(), "sessions")}
+
+	s := NewSession(SessionParams{Model: "claude-sonnet-4-5 high"})
+	s.Turns = append(s.Turns, Turn{Prompt: "revolution", Map: testMap1})
+	require.NoError(t, store.Save(s))
+
+	fi, err := os.Stat(filepath.Join(store.Dir, s.ID+".json"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+
+	loaded, err := store.Load(s.ID)
+	require.NoError(t, err)
+	assert.Equal(t, s.Params, loaded.Params)
+	assert.Equal(t, testMap1, loaded.Map())
+
+	_, err = store.Load(NewSession(SessionParams{}).ID)
+	assert.ErrorIs(t, err, ErrNoSession)
+
+	_, err = store.Load("../../etc/passwd")
+	assert.ErrorContains(t, err, "invalid session id")
+}
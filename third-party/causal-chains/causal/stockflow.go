@@ -0,0 +1,290 @@
+package causal
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/UB-IAD/sd-ai/third-party/causal-chains/sdjson"
+	"github.com/bpowers/go-agent/chat"
+)
+
+// VariableClass is what a map's variable becomes in a stock and flow
+// model.
+type VariableClass struct {
+	Type  sdjson.VariableType `json:"type"`
+	Units string              `json:"units,omitzero"`
+}
+
+// Classification is how a map's variables are to be converted to a
+// stock and flow model.
+type Classification struct {
+	// Variables are keyed by canonical name.
+	Variables map[string]VariableClass `json:"variables"`
+	TimeUnits string                   `json:"timeUnits,omitzero"`
+}
+
+// defaultTimeUnits are the time units of a model when nothing says
+// otherwise.
+const defaultTimeUnits = "Months"
+
+// stockWords and flowWords are words in variable names that suggest
+// accumulations and rates of change.  A flow word wins over a stock
+// word, as in "Population Growth".
+var (
+	stockWords = NewSet(
+		"accumulated", "assets", "backlog", "balance", "capacity", "capital", "cumulative", "debt", "employees",
+		"infected", "inventory", "knowledge", "level", "pollution", "pool", "population", "recovered", "reputation",
+		"reserves", "resources", "savings", "staff", "stock", "susceptible", "trust", "wealth", "workforce",
+	)
+	flowWords = NewSet(
+		"adoption", "arrivals", "attrition", "births", "consumption", "deaths", "decrease", "departures",
+		"depreciation", "emissions", "flow", "growth", "hires", "hiring", "increase", "inflow", "investment", "layoffs",
+		"new", "outflow", "production", "quits", "rate", "sales", "shipments", "spending",
+	)
+)
+
+// Classify guesses which of the map's variables are stocks, flows and
+// auxiliaries from the words in their names.  A variable whose name has
+// neither stock nor flow words is an auxiliary.
+func (m *Map) Classify() Classification {
+	c := Classification{Variables: make(map[string]VariableClass), TimeUnits: defaultTimeUnits}
+	for _, id := range m.Identities() {
+		class := VariableClass{Type: sdjson.VariableTypeAux}
+		ws := strings.Fields(strings.ToLower(strings.ReplaceAll(id.Key, "_", " ")))
+		switch {
+		case slices.ContainsFunc(ws, flowWords.Contains):
+			class.Type = sdjson.VariableTypeFlow
+		case slices.ContainsFunc(ws, stockWords.Contains):
+			class.Type = sdjson.VariableTypeStock
+		}
+		c.Variables[id.Key] = class
+	}
+	return c
+}
+
+const classifySystemPrompt = "You are an expert in system dynamics modeling, helping a student turn their causal loop diagram into a stock and flow diagram."
+
+const classifyPrompt = `Classify each variable of this causal loop diagram as a "stock" (an accumulation that persists over time, like Population or Inventory), a "flow" (a rate at which a stock changes, like Births or Hiring Rate) or a "variable" (an auxiliary: anything else).  Every feedback loop should pass through a stock.  Give the units of each variable, with each flow in its stock's units per time unit, and the time unit of the model.
+
+The diagram's relationships are:
+%s
+A first guess at the types, which you should correct where it is wrong:
+%s
+Respond with only a JSON object of the form {"time_units": "...", "variables": [{"name": "...", "type": "stock", "units": "..."}]}, using the variables' names exactly.`
+
+// ClassifyWithModel asks the model to correct guess, a classification
+// of the map's variables, and to give their units.  Variables the model
+// leaves out or misnames keep their guessed classes.
+func ClassifyWithModel(ctx context.Context, client chat.Client, reasoningEffort string, m *Map, guess Classification) (Classification, error) {
+	var guesses strings.Builder
+	for _, id := range m.Identities() {
+		fmt.Fprintf(&guesses, "- %s: %s\n", id.Display, guess.Variables[id.Key].Type)
+	}
+
+	var opts []chat.Option
+	if reasoningEffort != "" {
+		opts = append(opts, chat.WithReasoningEffort(reasoningEffort))
+	}
+	c := client.NewChat(classifySystemPrompt)
+	resp, err := c.Message(ctx, chat.UserMessage(fmt.Sprintf(classifyPrompt, describeLinks(m), guesses.String())), opts...)
+	if err != nil {
+		return guess, fmt.Errorf("c.Message: %w", err)
+	}
+
+	cleaned := stripCodeFence(resp.GetText())
+	if r, ok := repairJSON(cleaned); ok {
+		cleaned = r.text
+	}
+	var reply struct {
+		TimeUnits string `json:"time_units"`
+		Variables []struct {
+			Name  string          `json:"name"`
+			Type  json.RawMessage `json:"type"`
+			Units string          `json:"units"`
+		} `json:"variables"`
+	}
+	if err := json.Unmarshal([]byte(cleaned), &reply); err != nil {
+		return guess, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+
+	classified := Classification{
+		Variables: maps.Clone(guess.Variables),
+		TimeUnits: cmp.Or(strings.TrimSpace(reply.TimeUnits), guess.TimeUnits),
+	}
+	for _, v := range reply.Variables {
+		key := Canonicalize(v.Name)
+		class, ok := classified.Variables[key]
+		if !ok {
+			continue
+		}
+		var t sdjson.VariableType
+		if err := json.Unmarshal(v.Type, &t); err == nil {
+			class.Type = t
+		}
+		class.Units = cmp.Or(strings.TrimSpace(v.Units), class.Units)
+		classified.Variables[key] = class
+	}
+	return classified, nil
+}
+
+// placeholderDoc marks the equations StockFlow makes up, so that they
+// aren't mistaken for real ones.
+const placeholderDoc = "Placeholder equation"
+
+// StockFlow converts the map to a stock and flow skeleton, with its
+// variables classified as c says.  A link from a flow to a stock
+// becomes a material connection: the flow is an inflow of the stock if
+// the link is positive and an outflow if it is negative.  A stock with
+// no flows gets a net flow, "Change in" the stock, which its causes are
+// linked to instead.  Other causes of a stock, which can only change
+// through its flows, are linked to its first inflow, or otherwise to
+// its first outflow with the polarity reversed.  The remaining links
+// are information connections.
+//
+// The equations are placeholders that simulate but do nothing: stocks
+// start at 100, flows are 0 and auxiliaries are 1.  Each is documented
+// with the variables it should be written in terms of, after the
+// variable's definition from the glossary.  Units the classification
+// doesn't give are taken from the glossary too.
+func (m *Map) StockFlow(c Classification) sdjson.Model {
+	ids := m.Identities()
+	defs := m.Definitions()
+	display := make(map[string]string, len(ids))
+	classes := make(map[string]VariableClass, len(ids))
+	for _, id := range ids {
+		display[id.Key] = id.Display
+		// unclassified variables are auxiliaries, the zero type
+		class := c.Variables[id.Key]
+		class.Units = cmp.Or(class.Units, defs[id.Key].Units)
+		classes[id.Key] = class
+	}
+	timeUnits := cmp.Or(c.TimeUnits, defaultTimeUnits)
+
+	links := m.links()
+
+	// material connections
+	inflows := make(map[string][]string)
+	outflows := make(map[string][]string)
+	material := NewSet[string]()
+	for _, l := range links {
+		if classes[l.from].Type != sdjson.VariableTypeFlow || classes[l.to].Type != sdjson.VariableTypeStock {
+			continue
+		}
+		if l.polarity.IsNegative() {
+			outflows[l.to] = append(outflows[l.to], l.from)
+		} else {
+			inflows[l.to] = append(inflows[l.to], l.from)
+		}
+		material.Add((&sdjson.Relationship{From: l.from, To: l.to}).Key())
+	}
+
+	// net flows for stocks without any
+	for _, id := range ids {
+		if classes[id.Key].Type != sdjson.VariableTypeStock || len(inflows[id.Key]) > 0 || len(outflows[id.Key]) > 0 {
+			continue
+		}
+		name := "Change in " + id.Display
+		key := Canonicalize(name)
+		if _, ok := classes[key]; ok {
+			continue
+		}
+		classes[key] = VariableClass{Type: sdjson.VariableTypeFlow}
+		display[key] = name
+		ids = append(ids, Identity{Key: key, Display: name})
+		inflows[id.Key] = []string{key}
+	}
+
+	// information connections, with causes of stocks moved to their flows
+	inputs := make(map[string][]string)
+	var relationships []sdjson.Relationship
+	seen := NewSet[string]()
+	for _, l := range links {
+		if material.Contains((&sdjson.Relationship{From: l.from, To: l.to}).Key()) {
+			continue
+		}
+		to, polarity := l.to, l.polarity
+		if classes[to].Type == sdjson.VariableTypeStock {
+			switch {
+			case len(inflows[to]) > 0:
+				to = inflows[to][0]
+			case len(outflows[to]) > 0:
+				to, polarity = outflows[to][0], l.polarity.Times(sdjson.NegativePolarity)
+			}
+		}
+		rk := (&sdjson.Relationship{From: l.from, To: to}).Key()
+		if l.from == to || seen.Contains(rk) {
+			continue
+		}
+		seen.Add(rk)
+		inputs[to] = append(inputs[to], fmt.Sprintf("%s (%s)", display[l.from], polarity.Symbol()))
+		relationships = append(relationships, sdjson.Relationship{
+			From:              display[l.from],
+			To:                display[to],
+			Polarity:          polarity,
+			Reasoning:         l.reasoning(),
+			PolarityReasoning: l.polarityReasoning,
+			Provenance:        l.provenance,
+		})
+	}
+
+	// flows are in their stock's units per time unit
+	for _, id := range ids {
+		stock := id.Key
+		for _, f := range append(slices.Clip(inflows[stock]), outflows[stock]...) {
+			if class := classes[f]; class.Units == "" && classes[stock].Units != "" {
+				class.Units = classes[stock].Units + "/" + timeUnits
+				classes[f] = class
+			}
+		}
+	}
+
+	slices.SortFunc(ids, func(a, b Identity) int {
+		return cmp.Compare(a.Display, b.Display)
+	})
+	names := func(keys []string) []string {
+		var ns []string
+		for _, k := range keys {
+			ns = append(ns, display[k])
+		}
+		return ns
+	}
+
+	mdl := sdjson.Model{
+		Variables:     make([]sdjson.Variable, 0, len(ids)),
+		Relationships: relationships,
+		Specs:         sdjson.Specs{StartTime: 0, StopTime: 100, DT: 1, TimeUnits: timeUnits},
+	}
+	for _, id := range ids {
+		class := classes[id.Key]
+		v := sdjson.Variable{
+			Name:     id.Display,
+			Type:     class.Type,
+			Units:    class.Units,
+			Aliases:  id.Aliases,
+			Equation: "1",
+		}
+		doc := placeholderDoc + "."
+		if len(inputs[id.Key]) > 0 {
+			doc = fmt.Sprintf("%s: write it in terms of %s.", placeholderDoc, strings.Join(inputs[id.Key], ", "))
+		}
+		switch class.Type {
+		case sdjson.VariableTypeStock:
+			v.Equation = "100"
+			doc = placeholderDoc + ": set the initial value."
+			v.Inflows, v.Outflows = names(inflows[id.Key]), names(outflows[id.Key])
+		case sdjson.VariableTypeFlow:
+			v.Equation = "0"
+		}
+		if def := defs[id.Key].documentation(); def != "" {
+			doc = def + "\n\n" + doc
+		}
+		v.Documentation = doc
+		mdl.Variables = append(mdl.Variables, v)
+	}
+	return mdl
+}
@@ -0,0 +1,119 @@
+package causal
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/UB-IAD/sd-ai/third-party/causal-chains/sdjson"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// workforce has a stock with flows, Workforce; a stock without, Morale;
+// and auxiliaries.
+const workforce = `{"title": "Workforce", "explanation": "", "causal_chains": [
+  {"initial_variable": "Workforce", "relationships": [
+    {"variable": "Output", "polarity": "+", "polarity_reasoning": ""},
+    {"variable": "Hiring", "polarity": "+", "polarity_reasoning": ""},
+    {"variable": "Workforce", "polarity": "+", "polarity_reasoning": ""}
+  ], "reasoning": "growth"},
+  {"initial_variable": "Workforce", "relationships": [
+    {"variable": "Quits", "polarity": "+", "polarity_reasoning": ""},
+    {"variable": "Workforce", "polarity": "-", "polarity_reasoning": ""}
+  ], "reasoning": "attrition"},
+  {"initial_variable": "Workload", "relationships": [
+    {"variable": "Morale", "polarity": "-", "polarity_reasoning": ""},
+    {"variable": "Quits", "polarity": "-", "polarity_reasoning": ""}
+  ], "reasoning": ""},
+  {"initial_variable": "Output", "relationships": [
+    {"variable": "Workforce", "polarity": "+", "polarity_reasoning": ""}
+  ], "reasoning": ""}
+]}`
+
+func TestClassify(t *testing.T) {
+	var m Map
+	require.NoError(t, json.Unmarshal([]byte(workforce), &m))
+
+	c := m.Classify()
+	assert.Equal(t, "Months", c.TimeUnits)
+	types := make(map[string]sdjson.VariableType)
+	for key, class := range c.Variables {
+		types[key] = class.Type
+	}
+	assert.Equal(t, map[string]sdjson.VariableType{
+		"workforce": sdjson.VariableTypeStock,
+		"output":    sdjson.VariableTypeAux,
+		"hiring":    sdjson.VariableTypeFlow,
+		"quits":     sdjson.VariableTypeFlow,
+		"workload":  sdjson.VariableTypeAux,
+		"morale":    sdjson.VariableTypeAux,
+	}, types)
+}
+
+func TestStockFlow(t *testing.T) {
+	var m Map
+	require.NoError(t, json.Unmarshal([]byte(workforce), &m))
+	c := m.Classify()
+	c.Variables["morale"] = VariableClass{Type: sdjson.VariableTypeStock}
+	c.Variables["workforce"] = VariableClass{Type: sdjson.VariableTypeStock, Units: "people"}
+
+	mdl := m.StockFlow(c)
+	assert.Equal(t, sdjson.Specs{StartTime: 0, StopTime: 100, DT: 1, TimeUnits: "Months"}, mdl.Specs)
+
+	vars := make(map[string]sdjson.Variable)
+	var names []string
+	for _, v := range mdl.Variables {
+		vars[v.Name] = v
+		names = append(names, v.Name)
+	}
+	assert.Equal(t, []string{"Change in Morale", "Hiring", "Morale", "Output", "Quits", "Workforce", "Workload"}, names)
+
+	assert.Equal(t, sdjson.Variable{
+		Name:          "Workforce",
+		Type:          sdjson.VariableTypeStock,
+		Equation:      "100",
+		Units:         "people",
+		Inflows:       []string{"Hiring"},
+		Outflows:      []string{"Quits"},
+		Documentation: "Placeholder equation: set the initial value.",
+	}, vars["Workforce"])
+	assert.Equal(t, "people/Months", vars["Hiring"].Units)
+	assert.Equal(t, "0", vars["Hiring"].Equation)
+	assert.Equal(t, "Placeholder equation: write it in terms of Output (+).", vars["Hiring"].Documentation)
+	assert.Equal(t, []string{"Change in Morale"}, vars["Morale"].Inflows)
+	assert.Equal(t, "1", vars["Output"].Equation)
+
+	var links []string
+	for _, r := range mdl.Relationships {
+		links = append(links, r.From+" -> "+r.To+" ("+r.Polarity.Symbol()+")")
+	}
+	// Output's link to Workforce is moved to its inflow, where there
+	// already is one, and Workload's to Morale goes to its net flow
+	assert.Equal(t, []string{
+		"Workforce -> Output (+)",
+		"Output -> Hiring (+)",
+		"Workforce -> Quits (+)",
+		"Workload -> Change in Morale (-)",
+		"Morale -> Quits (-)",
+	}, links)
+}
+
+func TestClassifyWithModel(t *testing.T) {
+	var m Map
+	require.NoError(t, json.Unmarshal([]byte(workforce), &m))
+
+	client := &toolClient{turns: []turn{{reply: "```json\n" + `{"time_units": "weeks", "variables": [
+  {"name": "Morale", "type": "stock", "units": "dmnl"},
+  {"name": "Output", "type": "auxiliary", "units": "widgets/week"},
+  {"name": "Nonexistent", "type": "flow", "units": ""}
+]}` + "\n```"}}}
+	c, err := ClassifyWithModel(context.Background(), client, "", &m, m.Classify())
+	require.NoError(t, err)
+	assert.Equal(t, "weeks", c.TimeUnits)
+	assert.Equal(t, VariableClass{Type: sdjson.VariableTypeStock, Units: "dmnl"}, c.Variables["morale"])
+	// an unknown type keeps the guess, but the units are taken
+	assert.Equal(t, VariableClass{Type: sdjson.VariableTypeAux, Units: "widgets/week"}, c.Variables["output"])
+	assert.Len(t, c.Variables, 6)
+	assert.Contains(t, client.sent[0].GetText(), "- Hiring: flow\n")
+}
@@ -13,6 +13,7 @@ import (
 	"strings"
 
 	"github.com/UB-IAD/sd-ai/third-party/causal-chains/sdjson"
+	"github.com/UB-IAD/sd-ai/third-party/causal-chains/sdjson/diff"
 	"github.com/bpowers/go-agent/schema"
 )
 
@@ -58,21 +59,37 @@ func init() {
 	}
 }
 
+// Variable is a variable name as the model spelled it, along with the
+// canonical key that identifies it.
 type Variable struct {
 	raw       string
 	canonical string
 }
 
-func (v *Variable) Name() string {
+func NewVariable(name string) Variable {
+	return Variable{raw: name, canonical: Canonicalize(name)}
+}
+
+// Name returns the variable's canonical key.
+func (v Variable) Name() string {
 	return v.canonical
 }
 
+// Raw returns the variable's name as it was spelled.
+func (v Variable) Raw() string {
+	return v.raw
+}
+
+func (v Variable) MarshalJSON() ([]byte, error) {
+	return json.Marshal(v.raw)
+}
+
 func (v *Variable) UnmarshalJSON(bytes []byte) error {
-	if len(bytes) < 2 || bytes[0] != '"' || bytes[len(bytes)-1] != '"' {
+	var raw string
+	if err := json.Unmarshal(bytes, &raw); err != nil {
 		return fmt.Errorf("expected a JSON string, got %q", string(bytes))
 	}
-	v.raw = string(bytes[1 : len(bytes)-1])
-	v.canonical = Canonicalize(v.raw)
+	*v = NewVariable(raw)
 	return nil
 }
 
@@ -116,80 +133,342 @@ func Canonicalize(name string) string {
 	return canonicalized
 }
 
-var _ json.Unmarshaler = (*Variable)(nil)
+var (
+	_ json.Unmarshaler = (*Variable)(nil)
+	_ json.Marshaler   = Variable{}
+)
 
 type RelationshipEntry struct {
-	Variable          string `json:"variable"`
-	Polarity          string `json:"polarity"` // "+", or "-"
-	PolarityReasoning string `json:"polarity_reasoning"`
+	Variable          Variable        `json:"variable"`
+	Polarity          sdjson.Polarity `json:"polarity"`
+	PolarityReasoning string          `json:"polarity_reasoning"`
+	// Evidence is a passage of the background knowledge the model
+	// quoted in support of the relationship, and Source is where Cite
+	// found it.  Source isn't part of the response schema.
+	Evidence string `json:"evidence,omitzero"`
+	Source   *Span  `json:"source,omitzero"`
 }
 
 type Chain struct {
-	InitialVariable string              `json:"initial_variable"`
+	InitialVariable Variable            `json:"initial_variable"`
 	Relationships   []RelationshipEntry `json:"relationships"`
 	Reasoning       string              `json:"reasoning"`
 }
 
+// From returns the variable at the start of the chain's i'th
+// relationship.
+func (c *Chain) From(i int) Variable {
+	if i == 0 {
+		return c.InitialVariable
+	}
+	return c.Relationships[i-1].Variable
+}
+
+// GlossaryEntry defines one of a map's variables.
+type GlossaryEntry struct {
+	Variable   Variable `json:"variable"`
+	Definition string   `json:"definition"`
+	Units      string   `json:"units"`
+	// Exogenous is whether the variable is set outside the system.
+	Exogenous bool `json:"exogenous"`
+}
+
+// IsLoop returns whether the chain is a feedback loop, ending where it
+// starts.
+func (c *Chain) IsLoop() bool {
+	n := len(c.Relationships)
+	return n > 0 && c.Relationships[n-1].Variable.Name() == c.InitialVariable.Name()
+}
+
 type Map struct {
-	Title        string  `json:"title"`
-	Explanation  string  `json:"explanation"`
-	CausalChains []Chain `json:"causal_chains"`
+	Title        string          `json:"title"`
+	Explanation  string          `json:"explanation"`
+	CausalChains []Chain         `json:"causal_chains"`
+	Glossary     []GlossaryEntry `json:"glossary,omitzero"`
+	// Warnings describe problems with the response the map was
+	// recovered from, like being cut off.  They aren't part of the
+	// response schema.
+	Warnings []string `json:"warnings,omitzero"`
+	// Sectors group the variables of a map made by sector; see
+	// NewSectorDiagrammer.  They aren't part of the response schema
+	// either.
+	Sectors []Sector `json:"sectors,omitzero"`
+}
+
+// Identity is a single variable in a map: the canonical key that
+// identifies it, the name to display it with, and the other spellings
+// the map used for it.
+type Identity struct {
+	Key     string
+	Display string
+	Aliases []string
+}
+
+// displayName picks the name to show for a variable given the ways it
+// was spelled, in order of appearance.  The first capitalized spelling
+// wins, since a model that writes both "Tax Burden" and "tax burden"
+// meant the former.  Line breaks and repeated spaces are collapsed, and
+// spellings that look like canonical keys ("tax_burden") are
+// prettyized.
+func displayName(spellings []string) string {
+	name := spellings[0]
+	for _, s := range spellings {
+		if strings.ToLower(s) != s {
+			name = s
+			break
+		}
+	}
+	name = underscoreRe.ReplaceAllString(name, " ")
+	if strings.Contains(name, "_") {
+		name = Prettyize(name)
+	}
+	return name
 }
 
+// Identities returns one Identity per variable in the map, in order of
+// first appearance.
+func (m *Map) Identities() []Identity {
+	var keys []string
+	spellings := make(map[string][]string)
+	add := func(v Variable) {
+		raw := strings.TrimSpace(v.Raw())
+		if _, ok := spellings[v.Name()]; !ok {
+			keys = append(keys, v.Name())
+		}
+		if !slices.Contains(spellings[v.Name()], raw) {
+			spellings[v.Name()] = append(spellings[v.Name()], raw)
+		}
+	}
+	for _, c := range m.CausalChains {
+		add(c.InitialVariable)
+		for _, next := range c.Relationships {
+			add(next.Variable)
+		}
+	}
+
+	ids := make([]Identity, 0, len(keys))
+	for _, key := range keys {
+		display := displayName(spellings[key])
+		var aliases []string
+		for _, s := range spellings[key] {
+			if s != display {
+				aliases = append(aliases, s)
+			}
+		}
+		ids = append(ids, Identity{Key: key, Display: display, Aliases: aliases})
+	}
+	return ids
+}
+
+// Definitions returns the map's glossary keyed by canonical name.  The
+// first entry for a variable wins, and entries for variables that
+// aren't in the map are left out.
+func (m *Map) Definitions() map[string]GlossaryEntry {
+	keys := NewSet[string]()
+	for _, id := range m.Identities() {
+		keys.Add(id.Key)
+	}
+	defs := make(map[string]GlossaryEntry, len(m.Glossary))
+	for _, g := range m.Glossary {
+		key := g.Variable.Name()
+		if _, ok := defs[key]; ok || !keys.Contains(key) {
+			continue
+		}
+		g.Definition, g.Units = strings.TrimSpace(g.Definition), strings.TrimSpace(g.Units)
+		defs[key] = g
+	}
+	return defs
+}
+
+// documentation is a variable's documentation from its glossary entry.
+func (g GlossaryEntry) documentation() string {
+	if !g.Exogenous {
+		return g.Definition
+	}
+	return strings.TrimSpace(g.Definition + " It is exogenous: set outside the system.")
+}
+
+// Compat converts the map to SD-JSON, with every variable an auxiliary
+// documented from the glossary.
 func (m *Map) Compat() sdjson.Model {
-	vars := m.Variables()
+	ids := m.Identities()
+	defs := m.Definitions()
+	slices.SortFunc(ids, func(a, b Identity) int {
+		return cmp.Compare(a.Display, b.Display)
+	})
+
 	mdl := sdjson.Model{
-		Variables: make([]sdjson.Variable, 0, len(vars)),
+		Variables: make([]sdjson.Variable, 0, len(ids)),
 	}
 
-	for _, name := range m.Variables().Slice() {
+	display := make(map[string]string, len(ids))
+	for _, id := range ids {
+		display[id.Key] = id.Display
 		mdl.Variables = append(mdl.Variables,
 			sdjson.Variable{
-				Name: name,
-				Type: sdjson.VariableTypeAux,
+				Name:          id.Display,
+				Type:          sdjson.VariableTypeAux,
+				Documentation: defs[id.Key].documentation(),
+				Units:         defs[id.Key].Units,
+				Aliases:       id.Aliases,
 			},
 		)
 	}
 
-	seenRelationships := NewSet[string]()
+	for _, l := range m.links() {
+		mdl.Relationships = append(mdl.Relationships, sdjson.Relationship{
+			From:              display[l.from],
+			To:                display[l.to],
+			Polarity:          l.polarity,
+			PolarityReasoning: l.polarityReasoning,
+			Reasoning:         l.reasoning(),
+			Provenance:        l.provenance,
+		})
+	}
 
-	for _, chain := range m.CausalChains {
+	return mdl
+}
+
+// link is one of a map's relationships, between canonical names, with
+// every chain it appears in.
+type link struct {
+	from, to          string
+	polarity          sdjson.Polarity
+	polarityReasoning string
+	provenance        []sdjson.Provenance
+	// given are the polarities the chains gave the link, other than
+	// UnknownPolarity, and the first chain to give each.
+	given []givenPolarity
+}
+
+type givenPolarity struct {
+	polarity sdjson.Polarity
+	chain    int
+}
+
+// links returns the map's relationships in order of first appearance.
+// A relationship in several chains, however they spell its variables,
+// is one link.  Its polarity is the one the chains give it, or
+// UnknownPolarity if they disagree; see PolarityConflicts.
+func (m *Map) links() []*link {
+	var links []*link
+	byKey := make(map[string]*link)
+	for ci, chain := range m.CausalChains {
+		loop := chain.IsLoop()
 		for i, r := range chain.Relationships {
-			var from string
-			if i == 0 {
-				from = chain.InitialVariable
-			} else {
-				from = chain.Relationships[i-1].Variable
+			from, to := chain.From(i).Name(), r.Variable.Name()
+			rk := (&sdjson.Relationship{From: from, To: to}).Key()
+			l, ok := byKey[rk]
+			if !ok {
+				l = &link{from: from, to: to}
+				byKey[rk] = l
+				links = append(links, l)
 			}
-			to := r.Variable
-			relationship := sdjson.Relationship{
-				From:              from,
-				To:                to,
-				Polarity:          r.Polarity,
-				PolarityReasoning: r.PolarityReasoning,
-				// use the overall reasoning for the chain for this relationship
-				Reasoning: chain.Reasoning,
+			if r.Polarity != sdjson.UnknownPolarity && !slices.ContainsFunc(l.given, func(g givenPolarity) bool { return g.polarity == r.Polarity }) {
+				l.given = append(l.given, givenPolarity{polarity: r.Polarity, chain: ci})
 			}
-			rk := relationship.Key()
-			if seenRelationships.Contains(rk) {
+			l.polarityReasoning = cmp.Or(l.polarityReasoning, r.PolarityReasoning)
+			// a chain that passes through a link twice is listed once
+			if n := len(l.provenance); n > 0 && l.provenance[n-1].Chain == ci {
 				continue
 			}
+			l.provenance = append(l.provenance, sdjson.Provenance{Chain: ci, Reasoning: chain.Reasoning, Loop: loop})
+		}
+	}
+	for _, l := range links {
+		switch {
+		case len(l.given) == 1:
+			l.polarity = l.given[0].polarity
+		case len(l.given) > 1:
+			l.polarity = sdjson.UnknownPolarity
+			l.polarityReasoning = "The chains disagree: " + l.disagreement() + "."
+		}
+	}
+	return links
+}
+
+// disagreement lists the polarities the chains gave the link, like
+// "chain 1 gives +, chain 2 gives -", with the chains' indexes as in
+// the relationship's provenance.
+func (l *link) disagreement() string {
+	parts := make([]string, 0, len(l.given))
+	for _, g := range l.given {
+		parts = append(parts, fmt.Sprintf("chain %d gives %s", g.chain, g.polarity))
+	}
+	return strings.Join(parts, ", ")
+}
 
-			seenRelationships.Add(rk)
-			mdl.Relationships = append(mdl.Relationships, relationship)
+// PolarityConflicts returns a warning for each relationship the chains
+// give different polarities, whose polarity is left unknown in Compat.
+func (m *Map) PolarityConflicts() []string {
+	display := make(map[string]string)
+	for _, id := range m.Identities() {
+		display[id.Key] = id.Display
+	}
+	var warnings []string
+	for _, l := range m.links() {
+		if len(l.given) > 1 {
+			warnings = append(warnings, fmt.Sprintf("The chains disagree on the polarity of %s → %s (%s), so it is left unknown.", display[l.from], display[l.to], l.disagreement()))
 		}
 	}
+	return warnings
+}
 
-	return mdl
+// reasoning combines the reasoning of the chains the link is in,
+// loops' first since they say what depends on the link.  Repeated
+// reasoning, and reasoning contained in another's, is left out.
+func (l *link) reasoning() string {
+	var loops, others []string
+	for _, p := range l.provenance {
+		r := strings.TrimSpace(p.Reasoning)
+		if r == "" {
+			continue
+		}
+		if p.Loop {
+			loops = append(loops, r)
+		} else {
+			others = append(others, r)
+		}
+	}
+	all := append(loops, others...)
+
+	var kept []string
+	for i, r := range all {
+		contained := slices.ContainsFunc(all, func(o string) bool {
+			return o != r && strings.Contains(o, r)
+		})
+		if !contained && !slices.Contains(all[:i], r) {
+			kept = append(kept, r)
+		}
+	}
+	if len(kept) == 1 {
+		return kept[0]
+	}
+	for i, r := range kept {
+		kept[i] = sentence(r)
+	}
+	return strings.Join(kept, " ")
+}
+
+// sentence ends s with a full stop if it has no closing punctuation.
+func sentence(s string) string {
+	if strings.HasSuffix(s, ".") || strings.HasSuffix(s, "!") || strings.HasSuffix(s, "?") {
+		return s
+	}
+	return s + "."
 }
 
+// Diff computes the structural differences between this map and an
+// updated version of it, such as the result of a follow-up request.
+func (m *Map) Diff(updated *Map) *diff.Diff {
+	return diff.Models(m.Compat(), updated.Compat())
+}
+
+// Variables returns the display names of the map's variables.
 func (m *Map) Variables() (vars Set[string]) {
 	vars = make(Set[string])
-	for _, c := range m.CausalChains {
-		vars.Add(c.InitialVariable)
-		for _, next := range c.Relationships {
-			vars.Add(next.Variable)
-		}
+	for _, id := range m.Identities() {
+		vars.Add(id.Display)
 	}
 	return vars
 }
@@ -254,15 +533,8 @@ func (m *Map) Loops() [][]string {
 	outgoing := make(map[string][]string)
 	for _, chain := range m.CausalChains {
 		for i, r := range chain.Relationships {
-			var from string
-			if i == 0 {
-				from = chain.InitialVariable
-			} else {
-				from = chain.Relationships[i-1].Variable
-			}
-			from = Canonicalize(from)
-			to := Canonicalize(r.Variable)
-			outgoing[from] = append(outgoing[from], to)
+			from := chain.From(i).Name()
+			outgoing[from] = append(outgoing[from], r.Variable.Name())
 		}
 	}
 
@@ -287,13 +559,98 @@ func (m *Map) Loops() [][]string {
 	return allLoops
 }
 
+type LoopPolarity int
+
+const (
+	ReinforcingLoop LoopPolarity = iota
+	BalancingLoop
+	// UndeterminedLoop is a loop containing at least one link with
+	// unknown or nonmonotonic polarity.
+	UndeterminedLoop
+)
+
+func (p LoopPolarity) String() string {
+	switch p {
+	case ReinforcingLoop:
+		return "reinforcing"
+	case BalancingLoop:
+		return "balancing"
+	case UndeterminedLoop:
+		return "undetermined"
+	default:
+		return ""
+	}
+}
+
+func (p LoopPolarity) MarshalJSON() ([]byte, error) {
+	return []byte("\"" + p.String() + "\""), nil
+}
+
+var _ json.Marshaler = LoopPolarity(0)
+
+// linkPolarities returns the polarity of each link in the map, keyed
+// by the canonicalized from and to variables.  They are the links'
+// polarities as in Compat, so unknown where the chains disagree.
+func (m *Map) linkPolarities() map[[2]string]sdjson.Polarity {
+	polarities := make(map[[2]string]sdjson.Polarity)
+	for _, l := range m.links() {
+		polarities[[2]string{l.from, l.to}] = l.polarity
+	}
+	return polarities
+}
+
+// LoopPolarity computes the polarity of a loop as returned by Loops:
+// reinforcing if it has an even number of negative links, balancing if
+// odd, and undetermined if any link's polarity is unknown or
+// nonmonotonic.
+func (m *Map) LoopPolarity(loop []string) LoopPolarity {
+	return loopPolarity(m.linkPolarities(), loop)
+}
+
+func loopPolarity(polarities map[[2]string]sdjson.Polarity, loop []string) LoopPolarity {
+	polarity := sdjson.PositivePolarity
+	for i := 0; i+1 < len(loop); i++ {
+		link, ok := polarities[[2]string{loop[i], loop[i+1]}]
+		if !ok {
+			link = sdjson.UnknownPolarity
+		}
+		polarity = polarity.Times(link)
+	}
+
+	switch polarity {
+	case sdjson.PositivePolarity:
+		return ReinforcingLoop
+	case sdjson.NegativePolarity:
+		return BalancingLoop
+	default:
+		return UndeterminedLoop
+	}
+}
+
+// LoopPolarities returns the polarity of each loop returned by Loops,
+// in the same order.
+func (m *Map) LoopPolarities() []LoopPolarity {
+	polarities := m.linkPolarities()
+	loops := m.Loops()
+	result := make([]LoopPolarity, 0, len(loops))
+	for _, loop := range loops {
+		result = append(result, loopPolarity(polarities, loop))
+	}
+	return result
+}
+
 func (m *Map) VisualSVG() ([]byte, error) {
 	var b strings.Builder
 
 	b.WriteString("digraph {\n\tsplines=curved\n\toverlap=false\n\tmode=KK\n")
 
 	for _, r := range m.Compat().Relationships {
-		b.WriteString(fmt.Sprintf("\t%q -> %q\n", r.From, r.To))
+		// links of unknown or nonmonotonic polarity are dashed
+		style := "solid"
+		if !r.Polarity.IsDetermined() {
+			style = "dashed"
+		}
+		b.WriteString(fmt.Sprintf("\t%q -> %q [label=%q, style=%s]\n", r.From, r.To, r.Polarity.Symbol(), style))
 	}
 
 	b.WriteString("}\n")
@@ -328,10 +685,10 @@ func NewMap(relationships []sdjson.Relationship) *Map {
 
 	for _, r := range relationships {
 		m.CausalChains = append(m.CausalChains, Chain{
-			InitialVariable: r.From,
+			InitialVariable: NewVariable(r.From),
 			Relationships: []RelationshipEntry{
 				{
-					Variable:          r.To,
+					Variable:          NewVariable(r.To),
 					Polarity:          r.Polarity,
 					PolarityReasoning: r.PolarityReasoning,
 				},
@@ -0,0 +1,312 @@
+package causal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/bpowers/go-agent/chat"
+)
+
+// OutputStrategy is how the model is asked to return its map.
+type OutputStrategy int
+
+const (
+	// JSONSchemaOutput asks for the map as the reply itself,
+	// constrained by a JSON schema response format.
+	JSONSchemaOutput OutputStrategy = iota
+	// PromptedToolOutput asks for the map as the arguments to a single
+	// submit_map tool call, for models whose tool arguments follow a
+	// schema more reliably than their replies do.  The call is asked
+	// for in the system prompt rather than forced with the providers'
+	// tool_choice, which go-agent's chat options have no way to set, so
+	// a model may still reply with the map as text.  That is accepted,
+	// with a warning saying the strategy wasn't followed.
+	PromptedToolOutput
+	// ChainToolsOutput has the model add the map a chain at a time
+	// with add_chain tool calls and then call finish_map, so that
+	// mistakes are caught and corrected one chain at a time.  Like
+	// PromptedToolOutput, the calls are asked for, not forced.
+	ChainToolsOutput
+)
+
+func (s OutputStrategy) String() string {
+	switch s {
+	case JSONSchemaOutput:
+		return "json_schema"
+	case PromptedToolOutput:
+		return "prompted_tool"
+	case ChainToolsOutput:
+		return "chains"
+	default:
+		return ""
+	}
+}
+
+func (s OutputStrategy) MarshalJSON() ([]byte, error) {
+	return []byte("\"" + s.String() + "\""), nil
+}
+
+// ParseOutputStrategy parses a strategy's String form; "" is
+// JSONSchemaOutput, and "tool", PromptedToolOutput's old name, is
+// still accepted.
+func ParseOutputStrategy(s string) (OutputStrategy, error) {
+	switch s {
+	case "", "json_schema":
+		return JSONSchemaOutput, nil
+	case "prompted_tool", "tool":
+		return PromptedToolOutput, nil
+	case "chains":
+		return ChainToolsOutput, nil
+	}
+	return 0, fmt.Errorf("unknown output strategy %q", s)
+}
+
+// instructions are appended to the system prompt for the strategy.
+func (s OutputStrategy) instructions() string {
+	switch s {
+	case PromptedToolOutput:
+		return "\n\nDo not reply with the JSON directly. Instead, call the submit_map tool exactly once, passing the complete response in the format above as its arguments. If the tool reports an error, fix the problem and call it again."
+	case ChainToolsOutput:
+		return "\n\nDo not reply with the JSON directly. Instead, call the add_chain tool once for each causal chain, passing one entry of causal_chains in the format above as its arguments, then call the finish_map tool with the title, explanation and glossary. If a tool reports an error, fix the problem and call it again."
+	default:
+		return ""
+	}
+}
+
+// tool is a chat.Tool calling a Go function with the raw JSON
+// arguments.
+type tool struct {
+	name        string
+	description string
+	inputSchema json.RawMessage
+	call        func(input string) (string, error)
+}
+
+var _ chat.Tool = tool{}
+
+func (t tool) Name() string        { return t.name }
+func (t tool) Description() string { return t.description }
+
+func (t tool) MCPJsonSchema() string {
+	def, err := json.Marshal(map[string]any{
+		"name":        t.name,
+		"description": t.description,
+		"inputSchema": t.inputSchema,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return string(def)
+}
+
+func (t tool) Call(ctx context.Context, input string) string {
+	result, err := t.call(input)
+	if err != nil {
+		return fmt.Sprintf("Error: %s. Fix the arguments and call %s again.", err, t.name)
+	}
+	return result
+}
+
+// toolSchemas are the input schemas of the tools, cut from the
+// response schema.
+var toolSchemas = func() (s struct{ submitMap, addChain, finishMap json.RawMessage }) {
+	var response struct {
+		Properties struct {
+			CausalChains struct {
+				Items json.RawMessage `json:"items"`
+			} `json:"causal_chains"`
+			Explanation json.RawMessage `json:"explanation"`
+			Title       json.RawMessage `json:"title"`
+			Glossary    json.RawMessage `json:"glossary"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal([]byte(responseSchemaJson), &response); err != nil {
+		panic(err)
+	}
+
+	var full map[string]any
+	if err := json.Unmarshal([]byte(responseSchemaJson), &full); err != nil {
+		panic(err)
+	}
+	delete(full, "$schema")
+
+	finish := map[string]any{
+		"type": "object",
+		"properties": map[string]json.RawMessage{
+			"title":       response.Properties.Title,
+			"explanation": response.Properties.Explanation,
+			"glossary":    response.Properties.Glossary,
+		},
+		"required":             []string{"title", "explanation", "glossary"},
+		"additionalProperties": false,
+	}
+
+	var err error
+	if s.submitMap, err = json.Marshal(full); err != nil {
+		panic(err)
+	}
+	if s.finishMap, err = json.Marshal(finish); err != nil {
+		panic(err)
+	}
+	s.addChain = response.Properties.CausalChains.Items
+	return s
+}()
+
+func validateChain(c Chain) error {
+	if strings.TrimSpace(c.InitialVariable.Raw()) == "" {
+		return errors.New("initial_variable is empty")
+	}
+	if len(c.Relationships) == 0 {
+		return errors.New("relationships is empty")
+	}
+	for i, r := range c.Relationships {
+		if strings.TrimSpace(r.Variable.Raw()) == "" {
+			return fmt.Errorf("relationships[%d].variable is empty", i)
+		}
+	}
+	return nil
+}
+
+// collector gathers the map from the model's reply or tool calls,
+// according to the strategy.
+type collector struct {
+	strategy OutputStrategy
+
+	// tools may be called concurrently
+	mu sync.Mutex
+
+	submitted *Map
+
+	chains      []Chain
+	title       string
+	explanation string
+	glossary    []GlossaryEntry
+	finished    bool
+}
+
+func (c *collector) tools() []chat.Tool {
+	switch c.strategy {
+	case PromptedToolOutput:
+		return []chat.Tool{tool{
+			name:        "submit_map",
+			description: "Submit the complete causal map.  Call this exactly once.",
+			inputSchema: toolSchemas.submitMap,
+			call: func(input string) (string, error) {
+				m, err := parseRelationshipsResponse(input)
+				if err != nil {
+					return "", err
+				}
+				if len(m.CausalChains) == 0 {
+					return "", errors.New("causal_chains is empty")
+				}
+				for i, chain := range m.CausalChains {
+					if err := validateChain(chain); err != nil {
+						return "", fmt.Errorf("causal_chains[%d]: %w", i, err)
+					}
+				}
+				c.mu.Lock()
+				defer c.mu.Unlock()
+				c.submitted = m
+				return "The map was received.", nil
+			},
+		}}
+
+	case ChainToolsOutput:
+		return []chat.Tool{
+			tool{
+				name:        "add_chain",
+				description: "Add one causal chain to the map.",
+				inputSchema: toolSchemas.addChain,
+				call: func(input string) (string, error) {
+					var chain Chain
+					if err := json.Unmarshal([]byte(input), &chain); err != nil {
+						return "", fmt.Errorf("json.Unmarshal: %w", err)
+					}
+					if err := validateChain(chain); err != nil {
+						return "", err
+					}
+					c.mu.Lock()
+					defer c.mu.Unlock()
+					c.chains = append(c.chains, chain)
+					return fmt.Sprintf("Chain %d was added.", len(c.chains)), nil
+				},
+			},
+			tool{
+				name:        "finish_map",
+				description: "Finish the map with its title, explanation and glossary, after every chain has been added.",
+				inputSchema: toolSchemas.finishMap,
+				call: func(input string) (string, error) {
+					var args struct {
+						Title       string          `json:"title"`
+						Explanation string          `json:"explanation"`
+						Glossary    []GlossaryEntry `json:"glossary"`
+					}
+					if err := json.Unmarshal([]byte(input), &args); err != nil {
+						return "", fmt.Errorf("json.Unmarshal: %w", err)
+					}
+					c.mu.Lock()
+					defer c.mu.Unlock()
+					if len(c.chains) == 0 {
+						return "", errors.New("no chains have been added yet; call add_chain first")
+					}
+					c.title, c.explanation, c.glossary, c.finished = args.Title, args.Explanation, args.Glossary, true
+					return "The map is finished.", nil
+				},
+			},
+		}
+	}
+	return nil
+}
+
+// reset forgets what the tools were called with, for a new request on
+// the same chat.
+func (c *collector) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.submitted = nil
+	c.chains, c.title, c.explanation, c.glossary, c.finished = nil, "", "", nil, false
+}
+
+// result returns the map the model produced.  Models sometimes answer
+// in their reply despite being asked to use the tools, so the reply is
+// used if the tools weren't, and the map warns that they weren't.
+func (c *collector) result(reply string) (*Map, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.strategy {
+	case PromptedToolOutput:
+		if c.submitted != nil {
+			return c.submitted, nil
+		}
+		if m, err := parseRelationshipsResponse(reply); err == nil {
+			return m.warnToolsUnused("submit_map"), nil
+		}
+		return nil, errors.New("the submit_map tool was never called")
+
+	case ChainToolsOutput:
+		if c.finished {
+			return &Map{Title: c.title, Explanation: c.explanation, CausalChains: c.chains, Glossary: c.glossary}, nil
+		}
+		if len(c.chains) == 0 {
+			if m, err := parseReply(reply); err == nil {
+				return m.warnToolsUnused("add_chain"), nil
+			}
+			return nil, errors.New("the add_chain tool was never called")
+		}
+		return nil, fmt.Errorf("%d chains were added, but the finish_map tool was never called", len(c.chains))
+	}
+
+	return parseReply(reply)
+}
+
+// warnToolsUnused notes on m that the model gave it as a reply rather
+// than by calling the named tool.
+func (m *Map) warnToolsUnused(tool string) *Map {
+	m.Warnings = append(m.Warnings, fmt.Sprintf("The model replied with the map as text instead of calling %s; tool calls can be asked for but not forced.", tool))
+	return m
+}
@@ -0,0 +1,170 @@
+package causal
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"github.com/bpowers/go-agent/chat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// call is a tool call the fake model makes.
+type call struct {
+	tool, input string
+}
+
+// turn is the fake model's tool calls and reply for one message.
+type turn struct {
+	calls []call
+	reply string
+}
+
+// toolClient plays back turns, calling the registered tools the way a
+// provider's tool loop would.
+type toolClient struct {
+	turns []turn
+
+	systemPrompt string
+	history      []chat.Message
+	sent         []chat.Message
+	tools        []string
+	// results are what the tools returned, in order.
+	results []string
+}
+
+func (c *toolClient) NewChat(systemPrompt string, initialMsgs ...chat.Message) chat.Chat {
+	c.systemPrompt = systemPrompt
+	c.history = initialMsgs
+	return &toolChat{client: c, tools: map[string]chat.Tool{}}
+}
+
+type toolChat struct {
+	chat.Chat
+	client *toolClient
+	tools  map[string]chat.Tool
+}
+
+func (c *toolChat) MaxTokens() int { return 0 }
+
+func (c *toolChat) RegisterTool(tool chat.Tool) error {
+	c.tools[tool.Name()] = tool
+	c.client.tools = append(c.client.tools, tool.Name())
+	return nil
+}
+
+func (c *toolChat) Message(ctx context.Context, msg chat.Message, opts ...chat.Option) (chat.Message, error) {
+	c.client.sent = append(c.client.sent, msg)
+	t := c.client.turns[0]
+	c.client.turns = c.client.turns[1:]
+	for _, call := range t.calls {
+		c.client.results = append(c.client.results, c.tools[call.tool].Call(ctx, call.input))
+	}
+	return chat.AssistantMessage(t.reply), nil
+}
+
+func chainJSON(t *testing.T, chain Chain) string {
+	data, err := json.Marshal(chain)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestParseOutputStrategy(t *testing.T) {
+	for _, s := range []OutputStrategy{JSONSchemaOutput, PromptedToolOutput, ChainToolsOutput} {
+		got, err := ParseOutputStrategy(s.String())
+		require.NoError(t, err)
+		assert.Equal(t, s, got)
+	}
+
+	got, err := ParseOutputStrategy("")
+	require.NoError(t, err)
+	assert.Equal(t, JSONSchemaOutput, got)
+
+	// the old name of PromptedToolOutput
+	got, err = ParseOutputStrategy("tool")
+	require.NoError(t, err)
+	assert.Equal(t, PromptedToolOutput, got)
+
+	_, err = ParseOutputStrategy("xml")
+	assert.ErrorContains(t, err, `unknown output strategy "xml"`)
+}
+
+func TestPromptedToolOutput(t *testing.T) {
+	client := &toolClient{turns: []turn{{
+		calls: []call{
+			{"submit_map", `{"title": "x", "explanation": "y", "causal_chains": []}`},
+			{"submit_map", revolution1},
+		},
+		reply: "Done.",
+	}}}
+
+	m, err := NewDiagrammer(client, "", WithOutputStrategy(PromptedToolOutput)).Generate(context.Background(), "revolution", "")
+	require.NoError(t, err)
+	assert.Equal(t, testMap1, m)
+
+	assert.Equal(t, []string{"submit_map"}, client.tools)
+	assert.Contains(t, client.systemPrompt, "call the submit_map tool")
+	require.Len(t, client.results, 2)
+	assert.Equal(t, "Error: causal_chains is empty. Fix the arguments and call submit_map again.", client.results[0])
+	assert.Equal(t, "The map was received.", client.results[1])
+}
+
+func TestPromptedToolOutputFallsBackToReply(t *testing.T) {
+	client := &toolClient{turns: []turn{{reply: revolution1}}}
+
+	m, err := NewDiagrammer(client, "", WithOutputStrategy(PromptedToolOutput)).Generate(context.Background(), "revolution", "")
+	require.NoError(t, err)
+	assert.Equal(t, testMap1.CausalChains, m.CausalChains)
+	assert.Equal(t, []string{"The model replied with the map as text instead of calling submit_map; tool calls can be asked for but not forced."}, m.Warnings)
+}
+
+func TestChainToolsOutput(t *testing.T) {
+	calls := []call{
+		{"finish_map", `{"title": "early", "explanation": "too soon"}`},
+		{"add_chain", `{"initial_variable": "", "relationships": []}`},
+	}
+	for _, chain := range testMap1.CausalChains {
+		calls = append(calls, call{"add_chain", chainJSON(t, chain)})
+	}
+
+	finish := call{"finish_map", `{"title": "` + testMap1.Title + `", "explanation": "` + testMap1.Explanation + `"}`}
+	client := &toolClient{turns: []turn{
+		// the model forgets to finish, and is asked again for the
+		// whole map, which doesn't duplicate the chains it first added
+		{calls: calls, reply: "I've added the chains."},
+		{calls: append(slices.Clone(calls[2:]), finish)},
+	}}
+
+	m, err := NewDiagrammer(client, "", WithOutputStrategy(ChainToolsOutput)).Generate(context.Background(), "revolution", "")
+	require.NoError(t, err)
+	assert.Equal(t, testMap1, m)
+
+	assert.Equal(t, []string{"add_chain", "finish_map"}, client.tools)
+	require.Len(t, client.results, 2*len(calls)-1)
+	assert.Contains(t, client.results[0], "call add_chain first")
+	assert.Contains(t, client.results[1], "initial_variable is empty")
+	assert.Equal(t, "Chain 1 was added.", client.results[2])
+	assert.Equal(t, "Chain 1 was added.", client.results[len(calls)])
+	assert.Equal(t, "The map is finished.", client.results[len(client.results)-1])
+}
+
+func TestToolSchemas(t *testing.T) {
+	for name, s := range map[string]json.RawMessage{
+		"submit_map": toolSchemas.submitMap,
+		"add_chain":  toolSchemas.addChain,
+		"finish_map": toolSchemas.finishMap,
+	} {
+		var schema map[string]any
+		require.NoError(t, json.Unmarshal(s, &schema), name)
+		assert.Equal(t, "object", schema["type"], name)
+		assert.NotContains(t, schema, "$schema", name)
+	}
+
+	var finish struct {
+		Required []string `json:"required"`
+	}
+	require.NoError(t, json.Unmarshal(toolSchemas.finishMap, &finish))
+	assert.Equal(t, []string{"title", "explanation", "glossary"}, finish.Required)
+}
@@ -0,0 +1,114 @@
+package corpus
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// BM25's parameters, at their usual values: k1 limits how much a term
+// repeated in a chunk counts, and b how much long chunks are penalized.
+const (
+	k1 = 1.2
+	b  = 0.75
+)
+
+// stopWords are too common to say anything about relevance.
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true, "but": true, "by": true,
+	"for": true, "from": true, "has": true, "have": true, "how": true, "i": true, "in": true, "is": true, "it": true,
+	"its": true, "of": true, "on": true, "or": true, "that": true, "the": true, "their": true, "this": true, "to": true,
+	"was": true, "we": true, "were": true, "what": true, "which": true, "with": true, "you": true,
+}
+
+// terms splits text into lowercased words, leaving out stop words and
+// stripping a plural s, so "Workers" and "worker" are the same term.
+func terms(text string) []string {
+	var ts []string
+	for _, w := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if stopWords[w] {
+			continue
+		}
+		if len(w) > 3 && strings.HasSuffix(w, "s") && !strings.HasSuffix(w, "ss") {
+			w = w[:len(w)-1]
+		}
+		ts = append(ts, w)
+	}
+	return ts
+}
+
+// Index ranks chunks against queries with BM25.
+type Index struct {
+	chunks []Chunk
+	// freqs are the term frequencies of each chunk.
+	freqs   []map[string]int
+	lengths []int
+	avgLen  float64
+	// docFreqs are how many chunks each term is in.
+	docFreqs map[string]int
+}
+
+// NewIndex indexes the chunks.
+func NewIndex(chunks []Chunk) *Index {
+	idx := &Index{
+		chunks:   chunks,
+		freqs:    make([]map[string]int, len(chunks)),
+		lengths:  make([]int, len(chunks)),
+		docFreqs: make(map[string]int),
+	}
+	total := 0
+	for i, c := range chunks {
+		ts := terms(c.Text)
+		idx.freqs[i] = make(map[string]int)
+		for _, t := range ts {
+			if idx.freqs[i][t] == 0 {
+				idx.docFreqs[t]++
+			}
+			idx.freqs[i][t]++
+		}
+		idx.lengths[i] = len(ts)
+		total += len(ts)
+	}
+	if len(chunks) > 0 {
+		idx.avgLen = float64(total) / float64(len(chunks))
+	}
+	return idx
+}
+
+// Result is a chunk and its relevance to a query.
+type Result struct {
+	Chunk Chunk
+	Score float64
+}
+
+// Search returns every chunk, most relevant to the query first.  Chunks
+// that score the same, such as those sharing no terms with the query,
+// stay in their original order.
+func (idx *Index) Search(query string) []Result {
+	qs := terms(query)
+	n := float64(len(idx.chunks))
+
+	results := make([]Result, len(idx.chunks))
+	for i, c := range idx.chunks {
+		score := 0.0
+		for _, t := range qs {
+			f := float64(idx.freqs[i][t])
+			if f == 0 {
+				continue
+			}
+			df := float64(idx.docFreqs[t])
+			idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+			norm := 1 - b + b*float64(idx.lengths[i])/idx.avgLen
+			score += idf * f * (k1 + 1) / (f + k1*norm)
+		}
+		results[i] = Result{Chunk: c, Score: score}
+	}
+	slices.SortStableFunc(results, func(x, y Result) int {
+		return cmp.Compare(y.Score, x.Score)
+	})
+	return results
+}
@@ -0,0 +1,260 @@
+// Package corpus splits documents like interview transcripts and
+// reports into chunks, and picks the chunks most relevant to a prompt
+// with BM25, a local lexical ranking, so that a set of documents too
+// large for a model's context can still inform a map.
+//
+// The chosen chunks are laid out as text for the prompt, each under a
+// header naming its document and where it came from, so that a
+// position in the text can be traced back to its document with Locate.
+package corpus
+
+import (
+	"cmp"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Document is a named text, such as a report or a transcript.
+type Document struct {
+	Name string `json:"name"`
+	Text string `json:"text"`
+}
+
+// Chunk is a contiguous part of a document.
+type Chunk struct {
+	Document string `json:"document"`
+	// Start and End are byte offsets into the document's text.
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+	Text  string `json:"-"`
+}
+
+const (
+	// DefaultChunkTokens is the size chunks are split to.
+	DefaultChunkTokens = 300
+	// DefaultBudget is how many tokens of chunks are given to the
+	// model.
+	DefaultBudget = 16000
+)
+
+// EstimateTokens roughly counts the tokens in text, at about four
+// characters per token.
+func EstimateTokens(text string) int {
+	return len(text)/4 + 1
+}
+
+// separators are where chunks are preferably split, from paragraphs
+// down to words; transcripts often have a line per speaker and no
+// blank lines.
+var separators = []string{"\n\n", "\n", ". ", " "}
+
+// Split splits a document into chunks of at most maxTokens, breaking
+// at paragraphs where it can, then lines, sentences and words.  Small
+// paragraphs are kept together, and whitespace between chunks is
+// dropped.
+func Split(doc Document, maxTokens int) []Chunk {
+	if maxTokens <= 0 {
+		maxTokens = DefaultChunkTokens
+	}
+	var chunks []Chunk
+	for _, p := range split(doc.Text, 0, len(doc.Text), maxTokens*4, 0) {
+		start, end := trim(doc.Text, p[0], p[1])
+		if start < end {
+			chunks = append(chunks, Chunk{Document: doc.Name, Start: start, End: end, Text: doc.Text[start:end]})
+		}
+	}
+	return chunks
+}
+
+// split returns the [start, end) byte ranges of text[start:end] split
+// into pieces of at most maxBytes, using separators from sep on.
+func split(text string, start, end, maxBytes, sep int) [][2]int {
+	if end-start <= maxBytes {
+		return [][2]int{{start, end}}
+	}
+	if sep == len(separators) {
+		// no separator left, so cut mid-word, but not mid-character
+		cut := start + maxBytes
+		for cut > start+1 && !isRuneStart(text[cut]) {
+			cut--
+		}
+		return append([][2]int{{start, cut}}, split(text, cut, end, maxBytes, sep)...)
+	}
+
+	// the pieces between separators, with the separators kept at the
+	// end of each
+	var pieces [][2]int
+	for i := start; i < end; {
+		j := strings.Index(text[i:end], separators[sep])
+		if j < 0 {
+			pieces = append(pieces, [2]int{i, end})
+			break
+		}
+		next := i + j + len(separators[sep])
+		pieces = append(pieces, [2]int{i, next})
+		i = next
+	}
+
+	// pack the pieces greedily, splitting any too big on their own
+	var packed [][2]int
+	cur := [2]int{start, start}
+	for _, p := range pieces {
+		switch {
+		case p[1]-cur[0] <= maxBytes:
+			cur[1] = p[1]
+		case p[1]-p[0] > maxBytes:
+			if cur[0] < cur[1] {
+				packed = append(packed, cur)
+			}
+			packed = append(packed, split(text, p[0], p[1], maxBytes, sep+1)...)
+			cur = [2]int{p[1], p[1]}
+		default:
+			packed = append(packed, cur)
+			cur = p
+		}
+	}
+	if cur[0] < cur[1] {
+		packed = append(packed, cur)
+	}
+	return packed
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+func trim(text string, start, end int) (int, int) {
+	for start < end && isSpace(text[start]) {
+		start++
+	}
+	for end > start && isSpace(text[end-1]) {
+		end--
+	}
+	return start, end
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\n' || b == '\r' || b == '\t'
+}
+
+// Select ranks the documents' chunks against query and returns as many
+// of the best as fit in budget tokens, back in the order they appear in
+// their documents.  If all of the documents fit, they are all returned.
+func Select(docs []Document, query string, chunkTokens, budget int) []Chunk {
+	if budget <= 0 {
+		budget = DefaultBudget
+	}
+	var chunks []Chunk
+	for _, doc := range docs {
+		chunks = append(chunks, Split(doc, chunkTokens)...)
+	}
+
+	ranked := chunks
+	total := 0
+	for _, c := range chunks {
+		total += EstimateTokens(c.Text) + headerTokens
+	}
+	if total > budget {
+		ranked = nil
+		for _, r := range NewIndex(chunks).Search(query) {
+			ranked = append(ranked, r.Chunk)
+		}
+	}
+
+	var selected []Chunk
+	used := 0
+	for _, c := range ranked {
+		tokens := EstimateTokens(c.Text) + headerTokens
+		if used+tokens > budget {
+			continue
+		}
+		selected = append(selected, c)
+		used += tokens
+	}
+
+	order := make(map[string]int, len(docs))
+	for i, doc := range docs {
+		if _, ok := order[doc.Name]; !ok {
+			order[doc.Name] = i
+		}
+	}
+	slices.SortFunc(selected, func(a, b Chunk) int {
+		return cmp.Or(cmp.Compare(order[a.Document], order[b.Document]), cmp.Compare(a.Start, b.Start))
+	})
+	return selected
+}
+
+// headerTokens is about how many tokens each chunk's header takes.
+const headerTokens = 16
+
+var headerRe = regexp.MustCompile(`(?m)^\[from (".*?") at (\d+)\]\n`)
+
+// headerLikeRe matches the start of a line of a chunk's text that
+// could be taken for a header, once escaped or not: backslashes before
+// "[from ".
+var headerLikeRe = regexp.MustCompile(`(?m)^\\*\[from `)
+
+// Format lays the chunks out as text for a prompt, each under a header
+// like [from "interview-3.txt" at 1200], giving its document and byte
+// offset.  Lines of the chunks that start like a header get another
+// backslash before them, so that Locate can't mistake them for one.
+func Format(chunks []Chunk) string {
+	var b strings.Builder
+	for i, c := range chunks {
+		if i > 0 {
+			b.WriteString("\n\n")
+		}
+		text := headerLikeRe.ReplaceAllStringFunc(c.Text, func(line string) string { return `\` + line })
+		fmt.Fprintf(&b, "[from %q at %d]\n%s", c.Document, c.Start, text)
+	}
+	return b.String()
+}
+
+// Location is a span of a document.
+type Location struct {
+	Document string `json:"document"`
+	// Start and End are byte offsets into the document's text.
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// Locate returns where the span [start, end) of text laid out by Format
+// came from, or nil if it isn't within a single chunk.
+func Locate(text string, start, end int) *Location {
+	var loc *Location
+	for _, m := range headerRe.FindAllStringSubmatchIndex(text, -1) {
+		if m[1] > start {
+			break
+		}
+		name, err := strconv.Unquote(text[m[2]:m[3]])
+		if err != nil {
+			continue
+		}
+		offset, _ := strconv.Atoi(text[m[4]:m[5]])
+		// the chunk's text starts after the header, less the
+		// backslashes Format added
+		escapes := headerLikeRe.FindAllStringIndex(text[m[1]:], -1)
+		escaped := func(pos int) int {
+			n := 0
+			for _, e := range escapes {
+				// later chunks' headers aren't escapes
+				if m[1]+e[0] < pos && text[m[1]+e[0]] == '\\' {
+					n++
+				}
+			}
+			return n
+		}
+		loc = &Location{Document: name, Start: offset + start - m[1] - escaped(start), End: offset + end - m[1] - escaped(end)}
+	}
+	if loc == nil {
+		return nil
+	}
+	// the span must end before the next chunk
+	if next := strings.Index(text[start:], "\n\n[from "); next >= 0 && start+next < end {
+		return nil
+	}
+	return loc
+}
@@ -0,0 +1,92 @@
+package corpus
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func chunkTexts(chunks []Chunk) []string {
+	var texts []string
+	for _, c := range chunks {
+		texts = append(texts, c.Text)
+	}
+	return texts
+}
+
+func TestSplit(t *testing.T) {
+	doc := Document{Name: "notes", Text: "First paragraph.\n\nSecond one.  It is longer than the rest of them.\n\nThird.\n"}
+
+	// 5 tokens is about 20 bytes
+	chunks := Split(doc, 5)
+	assert.Equal(t, []string{"First paragraph.", "Second one.", "It is longer than", "the rest of them.", "Third."}, chunkTexts(chunks))
+	for _, c := range chunks {
+		assert.Equal(t, "notes", c.Document)
+		assert.Equal(t, c.Text, doc.Text[c.Start:c.End])
+	}
+
+	assert.Equal(t, []string{strings.TrimSpace(doc.Text)}, chunkTexts(Split(doc, 100)))
+
+	// transcripts have a line per speaker
+	transcript := Document{Name: "interview", Text: "Q: How has hiring gone?\nA: Slowly, since the budget was cut.\nQ: And morale?\nA: Low."}
+	assert.Equal(t, []string{"Q: How has hiring gone?", "A: Slowly, since the budget was cut.", "Q: And morale?\nA: Low."}, chunkTexts(Split(transcript, 10)))
+
+	// words longer than a chunk are cut between characters
+	long := Split(Document{Text: strings.Repeat("é", 10)}, 1)
+	assert.Equal(t, []string{"éé", "éé", "éé", "éé", "éé"}, chunkTexts(long))
+}
+
+func TestSearch(t *testing.T) {
+	chunks := []Chunk{
+		{Document: "a", Text: "The weather was fine all summer."},
+		{Document: "b", Text: "Workers quit when the budget for wages was cut, and hiring stalled."},
+		{Document: "c", Text: "Hiring picked up once wages rose."},
+		{Document: "d", Text: "Nothing relevant here."},
+	}
+	var order []string
+	for _, r := range NewIndex(chunks).Search("why do workers quit, and how does hiring respond?") {
+		order = append(order, r.Chunk.Document)
+	}
+	assert.Equal(t, []string{"b", "c", "a", "d"}, order)
+}
+
+func TestSelect(t *testing.T) {
+	docs := []Document{
+		{Name: "weather.txt", Text: "The weather was fine all summer.\n\nIt rained in the autumn."},
+		{Name: "interview.txt", Text: "Workers quit when wages were cut.\n\nHiring stalled after that."},
+	}
+
+	// everything fits, so nothing is ranked
+	assert.Len(t, Select(docs, "workers", 10, 1000), 4)
+
+	selected := Select(docs, "why did workers quit and hiring stall", 10, 2*(10+headerTokens))
+	assert.Equal(t, []string{"Workers quit when wages were cut.", "Hiring stalled after that."}, chunkTexts(selected))
+
+	text := Format(selected)
+	assert.Equal(t, "[from \"interview.txt\" at 0]\nWorkers quit when wages were cut.\n\n[from \"interview.txt\" at 35]\nHiring stalled after that.", text)
+
+	start := strings.Index(text, "stalled")
+	loc := Locate(text, start, start+len("stalled"))
+	require.NotNil(t, loc)
+	assert.Equal(t, Location{Document: "interview.txt", Start: 42, End: 49}, *loc)
+	assert.Equal(t, "stalled", docs[1].Text[loc.Start:loc.End])
+
+	// spans across chunks, or outside any, aren't in one place
+	assert.Nil(t, Locate(text, strings.Index(text, "cut"), start))
+	assert.Nil(t, Locate("no headers here", 0, 2))
+}
+
+func TestFormatEscapesHeaders(t *testing.T) {
+	doc := Document{Name: "notes.txt", Text: "Intro.\n[from \"fake.txt\" at 99]\n\\[from x\nWages fell."}
+	text := Format([]Chunk{{Document: doc.Name, Start: 0, Text: doc.Text}})
+	assert.Equal(t, "[from \"notes.txt\" at 0]\nIntro.\n\\[from \"fake.txt\" at 99]\n\\\\[from x\nWages fell.", text)
+
+	// a header-like line in a document doesn't take over its citations
+	start := strings.Index(text, "Wages")
+	loc := Locate(text, start, start+len("Wages"))
+	require.NotNil(t, loc)
+	assert.Equal(t, "notes.txt", loc.Document)
+	assert.Equal(t, "Wages", doc.Text[loc.Start:loc.End])
+}
@@ -0,0 +1,237 @@
+// Package llmtest provides a local stand-in for the OpenAI, Anthropic,
+// and Gemini APIs, so that clients can be exercised end to end without
+// network access.
+//
+// A Server speaks the OpenAI chat completions and responses APIs, the
+// Anthropic messages API, and the Gemini generateContent API, answering
+// each request with the next scripted Response in the wire format of
+// the API it was sent to, streamed if the request asked for a stream:
+//
+//	srv := llmtest.NewServer(
+//		llmtest.RateLimited(2*time.Second),
+//		llmtest.Reply(`{"title": "..."}`),
+//	)
+//	defer srv.Close()
+//
+//	client, _, err := provider.NewClient(provider.Config{
+//		Model:   "gpt-4.1",
+//		APIBase: srv.URL + "/v1",
+//		APIKey:  "test",
+//	})
+//
+// Requests are matched on their path suffix, so any base path works.
+package llmtest
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Protocol is the wire protocol a request was made with.
+type Protocol string
+
+const (
+	ChatCompletions Protocol = "chat_completions"
+	Responses       Protocol = "responses"
+	Messages        Protocol = "messages"
+	GenerateContent Protocol = "generate_content"
+)
+
+// Response is a scripted answer to a single request.
+type Response struct {
+	// Text is the assistant's reply.
+	Text string `json:"text,omitzero"`
+	// Truncated marks the reply as cut off by the output token limit.
+	Truncated bool `json:"truncated,omitzero"`
+	// Status, if not 2xx, makes the response an API error with Error
+	// as its message.
+	Status int    `json:"status,omitzero"`
+	Error  string `json:"error,omitzero"`
+	// Header is added to the response, for instance Retry-After.
+	Header http.Header `json:"header,omitzero"`
+	// Body, if set, is served verbatim in place of a response built
+	// from the fields above, for replaying recorded responses.
+	Body json.RawMessage `json:"body,omitzero"`
+
+	InputTokens  int `json:"inputTokens,omitzero"`
+	OutputTokens int `json:"outputTokens,omitzero"`
+}
+
+// Reply returns a successful response with the given text.
+func Reply(text string) Response {
+	return Response{Text: text}
+}
+
+// Fail returns an API error response.
+func Fail(status int, message string) Response {
+	return Response{Status: status, Error: message}
+}
+
+// RateLimited returns a 429 response asking the client to wait for
+// retryAfter.
+func RateLimited(retryAfter time.Duration) Response {
+	r := Fail(http.StatusTooManyRequests, "rate limit exceeded")
+	r.Header = http.Header{"Retry-After": {strconv.FormatFloat(retryAfter.Seconds(), 'f', -1, 64)}}
+	return r
+}
+
+// Overloaded returns the 529 response Anthropic sends when it is out of
+// capacity.
+func Overloaded() Response {
+	return Fail(529, "overloaded")
+}
+
+// LoadScript reads a JSON array of responses, such as one recorded
+// from a real API, from path.
+func LoadScript(path string) ([]Response, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile: %w", err)
+	}
+	var script []Response
+	if err := json.Unmarshal(data, &script); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	return script, nil
+}
+
+// Request is a request the server received.
+type Request struct {
+	Protocol Protocol
+	Path     string
+	Header   http.Header
+	Body     json.RawMessage
+	Model    string
+	Stream   bool
+}
+
+// Server is a scripted stand-in for the providers' APIs.
+type Server struct {
+	// URL is the server's base URL, with no trailing slash.
+	URL string
+
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	script   []Response
+	requests []Request
+}
+
+// NewServer starts a server that answers requests with the given
+// responses, in order.  Requests beyond the end of the script fail with
+// a 500 error.
+func NewServer(script ...Response) *Server {
+	s := &Server{script: script}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.srv.URL
+	return s
+}
+
+// Enqueue appends responses to the script.
+func (s *Server) Enqueue(responses ...Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.script = append(s.script, responses...)
+}
+
+// Requests returns the requests received so far.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.requests)
+}
+
+// Pending returns the number of scripted responses not yet served.
+func (s *Server) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.script)
+}
+
+// Close shuts the server down.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req := Request{Path: r.URL.Path, Header: r.Header.Clone(), Body: body}
+	var fields struct {
+		Model  string `json:"model"`
+		Stream bool   `json:"stream"`
+	}
+	// Gemini puts the model and method in the path
+	// (/v1beta/models/gemini-2.5-flash:streamGenerateContent)
+	if model, method, ok := strings.Cut(path.Base(r.URL.Path), ":"); ok {
+		req.Protocol = GenerateContent
+		req.Model = model
+		req.Stream = method == "streamGenerateContent"
+	} else {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/chat/completions"):
+			req.Protocol = ChatCompletions
+		case strings.HasSuffix(r.URL.Path, "/responses"):
+			req.Protocol = Responses
+		case strings.HasSuffix(r.URL.Path, "/messages"):
+			req.Protocol = Messages
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if err := json.Unmarshal(body, &fields); err != nil {
+			writeError(w, req.Protocol, Fail(http.StatusBadRequest, "invalid JSON body: "+err.Error()))
+			return
+		}
+		req.Model, req.Stream = fields.Model, fields.Stream
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	resp := Fail(http.StatusInternalServerError, "llmtest: no scripted response left")
+	if len(s.script) > 0 {
+		resp = s.script[0]
+		s.script = s.script[1:]
+	}
+	s.mu.Unlock()
+
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+
+	switch {
+	case resp.Body != nil:
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.WriteHeader(cmp.Or(resp.Status, http.StatusOK))
+		w.Write(resp.Body)
+	case resp.Status >= 300:
+		writeError(w, req.Protocol, resp)
+	case req.Stream:
+		writeStream(w, req, resp)
+	default:
+		writeJSON(w, http.StatusOK, complete(req, resp))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,157 @@
+package llmtest
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func post(t *testing.T, url, body string) (*http.Response, string) {
+	t.Helper()
+	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(data)
+}
+
+func TestServerProtocols(t *testing.T) {
+	const reply = `{"title": "Cüstomer churn and the feedback between price and demand"}`
+
+	tests := []struct {
+		protocol Protocol
+		path     string
+		body     string
+		model    string
+	}{
+		{ChatCompletions, "/v1/chat/completions", `{"model": "gpt-4.1", "messages": []}`, "gpt-4.1"},
+		{Responses, "/v1/responses", `{"model": "gpt-5", "input": []}`, "gpt-5"},
+		{Messages, "/v1/messages", `{"model": "claude-sonnet-4-5", "messages": []}`, "claude-sonnet-4-5"},
+		{GenerateContent, "/v1beta/models/gemini-2.5-flash:generateContent", `{"contents": []}`, "gemini-2.5-flash"},
+	}
+
+	for _, tt := range tests {
+		for _, stream := range []bool{false, true} {
+			name := string(tt.protocol)
+			path, body := tt.path, tt.body
+			if stream {
+				name += "/stream"
+				if tt.protocol == GenerateContent {
+					path = strings.Replace(path, ":generateContent", ":streamGenerateContent", 1) + "?alt=sse"
+				} else {
+					body = strings.Replace(body, "{", `{"stream": true, `, 1)
+				}
+			}
+
+			t.Run(name, func(t *testing.T) {
+				srv := NewServer(Reply(reply))
+				defer srv.Close()
+
+				resp, data := post(t, srv.URL+path, body)
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("status = %d: %s", resp.StatusCode, data)
+				}
+				wantType := "application/json"
+				if stream {
+					wantType = "text/event-stream"
+				}
+				if got := resp.Header.Get("Content-Type"); got != wantType {
+					t.Errorf("Content-Type = %q, want %q", got, wantType)
+				}
+
+				text, err := Text(tt.protocol, []byte(data))
+				if err != nil || text != reply {
+					t.Errorf("Text() = %q, %v; want %q", text, err, reply)
+				}
+
+				reqs := srv.Requests()
+				if len(reqs) != 1 || reqs[0].Protocol != tt.protocol || reqs[0].Model != tt.model || reqs[0].Stream != stream {
+					t.Errorf("Requests() = %+v", reqs)
+				}
+			})
+		}
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	srv := NewServer(RateLimited(1500*time.Millisecond), Overloaded(), Fail(http.StatusBadRequest, "prompt is too long"))
+	defer srv.Close()
+
+	resp, data := post(t, srv.URL+"/v1/chat/completions", `{"model": "gpt-4.1"}`)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "1.5" {
+		t.Errorf("rate limit = %d (Retry-After %q)", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if !strings.Contains(data, `"type":"rate_limit_exceeded"`) {
+		t.Errorf("OpenAI error body = %s", data)
+	}
+
+	resp, data = post(t, srv.URL+"/v1/messages", `{"model": "claude-3-haiku"}`)
+	if resp.StatusCode != 529 || !strings.Contains(data, `"type":"overloaded_error"`) {
+		t.Errorf("overloaded = %d: %s", resp.StatusCode, data)
+	}
+
+	resp, data = post(t, srv.URL+"/v1beta/models/gemini-2.5-pro:generateContent", `{}`)
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(data, `"status":"INVALID_ARGUMENT"`) {
+		t.Errorf("bad request = %d: %s", resp.StatusCode, data)
+	}
+
+	// the script has run out
+	resp, data = post(t, srv.URL+"/v1/responses", `{"model": "gpt-5"}`)
+	if resp.StatusCode != http.StatusInternalServerError || !strings.Contains(data, "no scripted response") {
+		t.Errorf("exhausted script = %d: %s", resp.StatusCode, data)
+	}
+}
+
+func TestServerTruncated(t *testing.T) {
+	srv := NewServer(Response{Text: `{"relationships": [`, Truncated: true})
+	defer srv.Close()
+
+	_, data := post(t, srv.URL+"/v1/messages", `{"model": "claude-3-haiku"}`)
+	var msg struct {
+		StopReason string `json:"stop_reason"`
+	}
+	if err := json.Unmarshal([]byte(data), &msg); err != nil || msg.StopReason != "max_tokens" {
+		t.Errorf("stop_reason = %q, %v", msg.StopReason, err)
+	}
+}
+
+func TestServerRecordedScript(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "script.json")
+	err := os.WriteFile(path, []byte(`[
+		{"body": {"id": "chatcmpl-recorded", "choices": [{"message": {"role": "assistant", "content": "recorded"}}]}},
+		{"status": 503, "error": "upstream connect error", "header": {"Retry-After": ["2"]}}
+	]`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	script, err := LoadScript(path)
+	if err != nil {
+		t.Fatalf("LoadScript() error = %v", err)
+	}
+	srv := NewServer(script...)
+	defer srv.Close()
+
+	_, data := post(t, srv.URL+"/v1/chat/completions", `{"model": "gpt-4o"}`)
+	if text, _ := Text(ChatCompletions, []byte(data)); text != "recorded" || !strings.Contains(data, "chatcmpl-recorded") {
+		t.Errorf("recorded body = %s", data)
+	}
+
+	resp, _ := post(t, srv.URL+"/v1/chat/completions", `{"model": "gpt-4o"}`)
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "2" {
+		t.Errorf("recorded error = %d (Retry-After %q)", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if srv.Pending() != 0 {
+		t.Errorf("Pending() = %d, want 0", srv.Pending())
+	}
+}
@@ -0,0 +1,415 @@
+package llmtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type object = map[string]any
+
+// errorTypes maps status codes onto the error types OpenAI and
+// Anthropic report, and the status names Gemini reports.
+var errorTypes = map[int][3]string{
+	http.StatusBadRequest:          {"invalid_request_error", "invalid_request_error", "INVALID_ARGUMENT"},
+	http.StatusUnauthorized:        {"invalid_api_key", "authentication_error", "UNAUTHENTICATED"},
+	http.StatusForbidden:           {"permission_denied", "permission_error", "PERMISSION_DENIED"},
+	http.StatusNotFound:            {"not_found", "not_found_error", "NOT_FOUND"},
+	http.StatusTooManyRequests:     {"rate_limit_exceeded", "rate_limit_error", "RESOURCE_EXHAUSTED"},
+	http.StatusInternalServerError: {"server_error", "api_error", "INTERNAL"},
+	http.StatusServiceUnavailable:  {"server_error", "overloaded_error", "UNAVAILABLE"},
+	529:                            {"server_error", "overloaded_error", "UNAVAILABLE"},
+}
+
+func writeError(w http.ResponseWriter, protocol Protocol, resp Response) {
+	types, ok := errorTypes[resp.Status]
+	if !ok {
+		types = [3]string{"error", "api_error", "UNKNOWN"}
+	}
+
+	switch protocol {
+	case Messages:
+		writeJSON(w, resp.Status, object{
+			"type":  "error",
+			"error": object{"type": types[1], "message": resp.Error},
+		})
+	case GenerateContent:
+		writeJSON(w, resp.Status, object{
+			"error": object{"code": resp.Status, "message": resp.Error, "status": types[2]},
+		})
+	default:
+		writeJSON(w, resp.Status, object{
+			"error": object{"message": resp.Error, "type": types[0], "code": types[0], "param": nil},
+		})
+	}
+}
+
+// complete builds the non-streaming response body for req.
+func complete(req Request, resp Response) object {
+	inputTokens, outputTokens := usage(req, resp)
+	created := time.Now().Unix()
+
+	switch req.Protocol {
+	case ChatCompletions:
+		return object{
+			"id":      "chatcmpl-llmtest",
+			"object":  "chat.completion",
+			"created": created,
+			"model":   req.Model,
+			"choices": []object{{
+				"index":         0,
+				"message":       object{"role": "assistant", "content": resp.Text, "refusal": nil},
+				"finish_reason": finishReason(req.Protocol, resp.Truncated),
+				"logprobs":      nil,
+			}},
+			"usage": object{
+				"prompt_tokens":     inputTokens,
+				"completion_tokens": outputTokens,
+				"total_tokens":      inputTokens + outputTokens,
+			},
+		}
+
+	case Responses:
+		r := responseObject(req, "completed", created)
+		r["output"] = []object{responseMessage(resp.Text, "completed")}
+		r["usage"] = object{
+			"input_tokens":  inputTokens,
+			"output_tokens": outputTokens,
+			"total_tokens":  inputTokens + outputTokens,
+		}
+		if resp.Truncated {
+			r["status"] = "incomplete"
+			r["incomplete_details"] = object{"reason": "max_output_tokens"}
+		}
+		return r
+
+	case Messages:
+		return object{
+			"id":            "msg_llmtest",
+			"type":          "message",
+			"role":          "assistant",
+			"model":         req.Model,
+			"content":       []object{{"type": "text", "text": resp.Text}},
+			"stop_reason":   finishReason(req.Protocol, resp.Truncated),
+			"stop_sequence": nil,
+			"usage":         object{"input_tokens": inputTokens, "output_tokens": outputTokens},
+		}
+
+	default:
+		return geminiChunk(req, resp.Text, finishReason(req.Protocol, resp.Truncated), inputTokens, outputTokens)
+	}
+}
+
+func finishReason(protocol Protocol, truncated bool) string {
+	switch protocol {
+	case Messages:
+		if truncated {
+			return "max_tokens"
+		}
+		return "end_turn"
+	case GenerateContent:
+		if truncated {
+			return "MAX_TOKENS"
+		}
+		return "STOP"
+	default:
+		if truncated {
+			return "length"
+		}
+		return "stop"
+	}
+}
+
+// usage returns the scripted token counts, or rough estimates of them
+// from the request and reply sizes.
+func usage(req Request, resp Response) (input, output int) {
+	input, output = resp.InputTokens, resp.OutputTokens
+	if input == 0 {
+		input = len(req.Body)/4 + 1
+	}
+	if output == 0 {
+		output = len(resp.Text)/4 + 1
+	}
+	return input, output
+}
+
+func responseObject(req Request, status string, created int64) object {
+	return object{
+		"id":                 "resp_llmtest",
+		"object":             "response",
+		"created_at":         created,
+		"status":             status,
+		"model":              req.Model,
+		"output":             []object{},
+		"error":              nil,
+		"incomplete_details": nil,
+	}
+}
+
+func responseMessage(text, status string) object {
+	return object{
+		"type":    "message",
+		"id":      "msg_llmtest",
+		"status":  status,
+		"role":    "assistant",
+		"content": []object{{"type": "output_text", "text": text, "annotations": []object{}}},
+	}
+}
+
+func geminiChunk(req Request, text, finishReason string, inputTokens, outputTokens int) object {
+	candidate := object{
+		"content": object{"role": "model", "parts": []object{{"text": text}}},
+		"index":   0,
+	}
+	if finishReason != "" {
+		candidate["finishReason"] = finishReason
+	}
+	return object{
+		"candidates": []object{candidate},
+		"usageMetadata": object{
+			"promptTokenCount":     inputTokens,
+			"candidatesTokenCount": outputTokens,
+			"totalTokenCount":      inputTokens + outputTokens,
+		},
+		"modelVersion": req.Model,
+	}
+}
+
+// chunks splits text into the pieces it is streamed in.
+func chunks(text string) []string {
+	const size = 16
+	var pieces []string
+	for len(text) > size {
+		// don't split UTF-8 sequences
+		n := size
+		for n < len(text) && text[n]&0xC0 == 0x80 {
+			n++
+		}
+		pieces = append(pieces, text[:n])
+		text = text[n:]
+	}
+	return append(pieces, text)
+}
+
+// sse writes server-sent events.
+type sse struct {
+	w http.ResponseWriter
+}
+
+func (s sse) event(name string, data any) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		panic(err)
+	}
+	if name != "" {
+		fmt.Fprintf(s.w, "event: %s\n", name)
+	}
+	fmt.Fprintf(s.w, "data: %s\n\n", b)
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func writeStream(w http.ResponseWriter, req Request, resp Response) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	s := sse{w}
+	inputTokens, outputTokens := usage(req, resp)
+	created := time.Now().Unix()
+	pieces := chunks(resp.Text)
+
+	switch req.Protocol {
+	case ChatCompletions:
+		chunk := func(delta object, finishReason any) object {
+			return object{
+				"id":      "chatcmpl-llmtest",
+				"object":  "chat.completion.chunk",
+				"created": created,
+				"model":   req.Model,
+				"choices": []object{{"index": 0, "delta": delta, "finish_reason": finishReason}},
+			}
+		}
+		s.event("", chunk(object{"role": "assistant", "content": ""}, nil))
+		for _, p := range pieces {
+			s.event("", chunk(object{"content": p}, nil))
+		}
+		s.event("", chunk(object{}, finishReason(req.Protocol, resp.Truncated)))
+		final := chunk(object{}, nil)
+		final["choices"] = []object{}
+		final["usage"] = object{
+			"prompt_tokens":     inputTokens,
+			"completion_tokens": outputTokens,
+			"total_tokens":      inputTokens + outputTokens,
+		}
+		s.event("", final)
+		fmt.Fprint(w, "data: [DONE]\n\n")
+
+	case Responses:
+		seq := 0
+		event := func(name string, data object) {
+			data["type"] = name
+			data["sequence_number"] = seq
+			seq++
+			s.event(name, data)
+		}
+		event("response.created", object{"response": responseObject(req, "in_progress", created)})
+		event("response.output_item.added", object{"output_index": 0, "item": responseMessage("", "in_progress")})
+		part := object{"type": "output_text", "text": "", "annotations": []object{}}
+		event("response.content_part.added", object{"item_id": "msg_llmtest", "output_index": 0, "content_index": 0, "part": part})
+		for _, p := range pieces {
+			event("response.output_text.delta", object{"item_id": "msg_llmtest", "output_index": 0, "content_index": 0, "delta": p})
+		}
+		event("response.output_text.done", object{"item_id": "msg_llmtest", "output_index": 0, "content_index": 0, "text": resp.Text})
+		part = object{"type": "output_text", "text": resp.Text, "annotations": []object{}}
+		event("response.content_part.done", object{"item_id": "msg_llmtest", "output_index": 0, "content_index": 0, "part": part})
+		event("response.output_item.done", object{"output_index": 0, "item": responseMessage(resp.Text, "completed")})
+		r := complete(req, resp)
+		if resp.Truncated {
+			event("response.incomplete", object{"response": r})
+		} else {
+			event("response.completed", object{"response": r})
+		}
+
+	case Messages:
+		message := object{
+			"id":            "msg_llmtest",
+			"type":          "message",
+			"role":          "assistant",
+			"model":         req.Model,
+			"content":       []object{},
+			"stop_reason":   nil,
+			"stop_sequence": nil,
+			"usage":         object{"input_tokens": inputTokens, "output_tokens": 1},
+		}
+		s.event("message_start", object{"type": "message_start", "message": message})
+		s.event("content_block_start", object{"type": "content_block_start", "index": 0, "content_block": object{"type": "text", "text": ""}})
+		for _, p := range pieces {
+			s.event("content_block_delta", object{"type": "content_block_delta", "index": 0, "delta": object{"type": "text_delta", "text": p}})
+		}
+		s.event("content_block_stop", object{"type": "content_block_stop", "index": 0})
+		s.event("message_delta", object{
+			"type":  "message_delta",
+			"delta": object{"stop_reason": finishReason(req.Protocol, resp.Truncated), "stop_sequence": nil},
+			"usage": object{"output_tokens": outputTokens},
+		})
+		s.event("message_stop", object{"type": "message_stop"})
+
+	default:
+		for i, p := range pieces {
+			reason := ""
+			if i == len(pieces)-1 {
+				reason = finishReason(req.Protocol, resp.Truncated)
+			}
+			s.event("", geminiChunk(req, p, reason, inputTokens, outputTokens*(i+1)/len(pieces)))
+		}
+	}
+}
+
+// Text extracts the assistant's reply from a response body in the given
+// protocol's wire format, streamed or not.  It is meant for checking
+// what a server (this one or a real one being recorded) sent.
+func Text(protocol Protocol, body []byte) (string, error) {
+	if strings.HasPrefix(strings.TrimSpace(string(body)), "{") {
+		return completeText(protocol, body)
+	}
+
+	var text strings.Builder
+	for line := range strings.Lines(string(body)) {
+		data, ok := strings.CutPrefix(strings.TrimSpace(line), "data:")
+		data = strings.TrimSpace(data)
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var event struct {
+			Type    string `json:"type"`
+			Delta   any    `json:"delta"`
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return "", fmt.Errorf("json.Unmarshal: %w", err)
+		}
+		switch protocol {
+		case ChatCompletions:
+			for _, c := range event.Choices {
+				text.WriteString(c.Delta.Content)
+			}
+		case Responses:
+			if s, ok := event.Delta.(string); ok && event.Type == "response.output_text.delta" {
+				text.WriteString(s)
+			}
+		case Messages:
+			if d, ok := event.Delta.(map[string]any); ok && d["type"] == "text_delta" {
+				s, _ := d["text"].(string)
+				text.WriteString(s)
+			}
+		case GenerateContent:
+			s, err := completeText(protocol, []byte(data))
+			if err != nil {
+				return "", err
+			}
+			text.WriteString(s)
+		}
+	}
+	return text.String(), nil
+}
+
+func completeText(protocol Protocol, body []byte) (string, error) {
+	var r struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+		Output []struct {
+			Content []struct {
+				Text string `json:"text"`
+			} `json:"content"`
+		} `json:"output"`
+		Content []struct {
+			Text string `json:"text"`
+		} `json:"content"`
+		Candidates []struct {
+			Content struct {
+				Parts []struct {
+					Text string `json:"text"`
+				} `json:"parts"`
+			} `json:"content"`
+		} `json:"candidates"`
+	}
+	if err := json.Unmarshal(body, &r); err != nil {
+		return "", fmt.Errorf("json.Unmarshal: %w", err)
+	}
+
+	var text strings.Builder
+	switch protocol {
+	case ChatCompletions:
+		for _, c := range r.Choices {
+			text.WriteString(c.Message.Content)
+		}
+	case Responses:
+		for _, o := range r.Output {
+			for _, c := range o.Content {
+				text.WriteString(c.Text)
+			}
+		}
+	case Messages:
+		for _, c := range r.Content {
+			text.WriteString(c.Text)
+		}
+	case GenerateContent:
+		for _, c := range r.Candidates {
+			for _, p := range c.Content.Parts {
+				text.WriteString(p.Text)
+			}
+		}
+	}
+	return text.String(), nil
+}
@@ -0,0 +1,110 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultSecretsDir is where Docker and Kubernetes mount secrets.
+const DefaultSecretsDir = "/run/secrets"
+
+// envVars are the environment variables holding each provider's key, in
+// order of preference.
+var envVars = map[Provider][]string{
+	ProviderAnthropic: {"ANTHROPIC_API_KEY"},
+	ProviderGoogle:    {"GEMINI_API_KEY", "GOOGLE_API_KEY"},
+	ProviderOpenAI:    {"OPENAI_API_KEY"},
+	ProviderOllama:    {"OLLAMA_API_KEY"},
+}
+
+// Credentials resolves providers' API keys.  A provider's key is the
+// first of:
+//
+//   - its entry in Keys, such as a key the user entered;
+//   - its environment variable, like OPENAI_API_KEY;
+//   - the contents of the file named by that variable with a _FILE
+//     suffix, like OPENAI_API_KEY_FILE;
+//   - the contents of the file named after the variable in lower case
+//     in SecretsDir, like /run/secrets/openai_api_key.
+//
+// Every key resolved is registered with AddSecret, so that it is
+// scrubbed by Redact.
+type Credentials struct {
+	Keys map[Provider]string
+	// SecretsDir is searched for key files; "" disables the search.
+	SecretsDir string
+
+	// getenv is replaced by tests.
+	getenv func(string) string
+}
+
+// NewCredentials returns credentials preferring keys over the
+// environment and secret files in DefaultSecretsDir.
+func NewCredentials(keys map[Provider]string) *Credentials {
+	return &Credentials{Keys: keys, SecretsDir: DefaultSecretsDir}
+}
+
+// APIKey returns the provider's key, or "" if none is configured.  It
+// fails if a key file was named but can't be read.
+func (c *Credentials) APIKey(p Provider) (string, error) {
+	key, err := c.lookup(p)
+	if err != nil {
+		return "", err
+	}
+	AddSecret(key)
+	return key, nil
+}
+
+func (c *Credentials) lookup(p Provider) (string, error) {
+	if key := strings.TrimSpace(c.Keys[p]); key != "" {
+		return key, nil
+	}
+
+	getenv := c.getenv
+	if getenv == nil {
+		getenv = os.Getenv
+	}
+
+	for _, name := range envVars[p] {
+		if key := strings.TrimSpace(getenv(name)); key != "" {
+			return key, nil
+		}
+		if path := getenv(name + "_FILE"); path != "" {
+			key, err := readKeyFile(path)
+			if err != nil {
+				return "", fmt.Errorf("%s_FILE: %w", name, err)
+			}
+			return key, nil
+		}
+	}
+
+	if c.SecretsDir == "" {
+		return "", nil
+	}
+	for _, name := range envVars[p] {
+		key, err := readKeyFile(filepath.Join(c.SecretsDir, strings.ToLower(name)))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		return key, nil
+	}
+	return "", nil
+}
+
+func readKeyFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("os.ReadFile: %w", err)
+	}
+	key := strings.TrimSpace(string(data))
+	if key == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return key, nil
+}
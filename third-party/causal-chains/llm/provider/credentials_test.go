@@ -0,0 +1,91 @@
+package provider
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCredentialsAPIKey(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	secrets := filepath.Join(dir, "secrets")
+	if err := os.Mkdir(secrets, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	write("secrets/anthropic_api_key", "sk-ant-from-secret\n")
+	write("secrets/google_api_key", "google-from-secret")
+	keyFile := write("openai.key", "  sk-from-file\n")
+
+	env := map[string]string{
+		"OPENAI_API_KEY_FILE": keyFile,
+		"GEMINI_API_KEY":      "gemini-from-env",
+	}
+	creds := &Credentials{
+		Keys:       map[Provider]string{ProviderOllama: "ollama-from-input"},
+		SecretsDir: secrets,
+		getenv:     func(name string) string { return env[name] },
+	}
+
+	tests := []struct {
+		provider Provider
+		want     string
+	}{
+		{ProviderOllama, "ollama-from-input"},
+		{ProviderGoogle, "gemini-from-env"},
+		{ProviderOpenAI, "sk-from-file"},
+		{ProviderAnthropic, "sk-ant-from-secret"},
+	}
+	for _, tt := range tests {
+		if got, err := creds.APIKey(tt.provider); err != nil || got != tt.want {
+			t.Errorf("APIKey(%s) = %q, %v; want %q", tt.provider, got, err, tt.want)
+		}
+	}
+
+	// explicit keys win over everything
+	creds.Keys[ProviderGoogle] = "google-from-input"
+	if got, _ := creds.APIKey(ProviderGoogle); got != "google-from-input" {
+		t.Errorf("APIKey(google) = %q, want the explicit key", got)
+	}
+
+	// the lower-priority variable's secret file is used when the
+	// environment is empty
+	env = nil
+	delete(creds.Keys, ProviderGoogle)
+	if got, _ := creds.APIKey(ProviderGoogle); got != "google-from-secret" {
+		t.Errorf("APIKey(google) = %q, want google-from-secret", got)
+	}
+	if got, err := creds.APIKey(ProviderOpenAI); err != nil || got != "" {
+		t.Errorf("APIKey(openai) = %q, %v; want no key", got, err)
+	}
+}
+
+func TestCredentialsMissingKeyFile(t *testing.T) {
+	creds := &Credentials{getenv: func(name string) string {
+		if name == "ANTHROPIC_API_KEY_FILE" {
+			return "/nonexistent/anthropic.key"
+		}
+		return ""
+	}}
+	_, err := creds.APIKey(ProviderAnthropic)
+	if err == nil || !strings.Contains(err.Error(), "ANTHROPIC_API_KEY_FILE") {
+		t.Errorf("APIKey() error = %v, want a key file error", err)
+	}
+}
+
+func TestCredentialsRegistersSecrets(t *testing.T) {
+	creds := &Credentials{Keys: map[Provider]string{ProviderOpenAI: "sk-registered-0123"}}
+	if _, err := creds.APIKey(ProviderOpenAI); err != nil {
+		t.Fatal(err)
+	}
+	if got := Redact("key was sk-registered-0123."); got != "key was [REDACTED]." {
+		t.Errorf("Redact() = %q", got)
+	}
+}
@@ -1,8 +1,8 @@
 package provider
 
 import (
+	"cmp"
 	"fmt"
-	"os"
 	"strings"
 
 	"github.com/bpowers/go-agent/chat"
@@ -17,122 +17,162 @@ type Config struct {
 	APIKey        string
 	Debug         bool
 	ThinkingLevel string
+	// Registry resolves model names to providers; nil uses
+	// DefaultRegistry.
+	Registry *Registry
+	// Fallbacks are models to fail over to, in order, when Model's
+	// provider can't answer.  Each may carry its own thinking level
+	// ("gemini-2.5-pro low").  APIBase and APIKey apply only to Model.
+	Fallbacks []string
+	// Credentials resolve the keys for each provider when APIKey isn't
+	// set (or, for fallbacks, doesn't apply); nil uses the environment
+	// and DefaultSecretsDir.
+	Credentials *Credentials
+	// Limits override the registry's limits for requests to each
+	// model's provider.
+	Limits Limits
 }
 
+// NewClient returns a client for cfg.Model, and the reasoning effort to
+// request from it (see Thinking.Effort).  With fallbacks, the client is
+// a *FallbackClient; fallback models that can't be set up, for instance
+// because no API key is available for their provider, are left out.
+// Fallbacks without a thinking level of their own get Model's.
 func NewClient(cfg Config) (chat.Client, string, error) {
-	// Parse model name and thinking level from the model string
-	model, thinkingLevel := parseModelAndThinkingLevel(cfg.Model)
-	if thinkingLevel == "" && cfg.ThinkingLevel != "" {
-		thinkingLevel = cfg.ThinkingLevel
+	for _, fallback := range cfg.Fallbacks {
+		if _, level := parseModelAndThinkingLevel(fallback); level != "" {
+			if _, err := ParseThinkingLevel(level); err != nil {
+				return nil, "", fmt.Errorf("fallback %s: %w", fallback, err)
+			}
+		}
 	}
 
-	modelLower := strings.ToLower(model)
+	client, info, thinking, err := newClient(cfg)
+	if err != nil || len(cfg.Fallbacks) == 0 {
+		return client, thinking.Effort, err
+	}
 
-	if isClaudeModel(modelLower) {
-		apiKey := cfg.APIKey
-		if apiKey == "" {
-			apiKey = os.Getenv("ANTHROPIC_API_KEY")
-		}
-		if apiKey == "" {
-			return nil, "", fmt.Errorf("Anthropic API key required for model %s", model)
+	fc := &FallbackClient{models: []fallbackModel{{name: info.Name, thinking: thinking, client: client}}}
+	for _, fallback := range cfg.Fallbacks {
+		fcfg := cfg
+		fcfg.Model, fcfg.APIBase, fcfg.APIKey, fcfg.ThinkingLevel = fallback, "", "", string(thinking.Requested)
+		client, info, thinking, err := newClient(fcfg)
+		if err != nil {
+			continue
 		}
+		fc.models = append(fc.models, fallbackModel{name: info.Name, thinking: thinking, client: client})
+	}
+	return fc, thinking.Effort, nil
+}
 
-		apiBase := cfg.APIBase
-		if apiBase == "" {
-			apiBase = claude.AnthropicURL
-		}
+// Resolve returns what the registry knows about cfg.Model and how its
+// thinking level applies to it, without creating a client.  It fails if
+// the thinking level is unknown.
+func Resolve(cfg Config) (ModelInfo, Thinking, error) {
+	// Parse model name and thinking level from the model string
+	model, requested := parseModelAndThinkingLevel(cfg.Model)
+	requested = cmp.Or(requested, cfg.ThinkingLevel)
 
-		opts := []claude.Option{
-			claude.WithModel(model),
+	registry := cfg.Registry
+	if registry == nil {
+		registry = DefaultRegistry
+	}
+	info, _ := registry.Lookup(model)
+
+	level, err := ParseThinkingLevel(requested)
+	if err != nil {
+		return info, Thinking{}, fmt.Errorf("model %s: %w", info.Name, err)
+	}
+	return info, ResolveThinking(level, info), nil
+}
+
+// newClient creates a client for a single model.
+func newClient(cfg Config) (_ chat.Client, _ ModelInfo, _ Thinking, err error) {
+	info, thinking, err := Resolve(cfg)
+	if err != nil {
+		return nil, info, thinking, err
+	}
+
+	apiBase := cmp.Or(cfg.APIBase, info.APIBase)
+	apiKey := cfg.APIKey
+	if apiKey != "" {
+		AddSecret(apiKey)
+	} else {
+		creds := cfg.Credentials
+		if creds == nil {
+			creds = NewCredentials(nil)
 		}
-		if cfg.Debug {
-			opts = append(opts, claude.WithDebug(true))
+		if apiKey, err = creds.APIKey(info.Provider); err != nil {
+			return nil, info, thinking, fmt.Errorf("%s credentials: %w", info.Provider, err)
 		}
+	}
 
-		client, err := claude.NewClient(apiBase, apiKey, opts...)
-		return client, thinkingLevel, err
+	client, err := newProviderClient(info, apiBase, apiKey, cfg.Debug)
+	if err != nil {
+		return nil, info, thinking, err
 	}
+	if limits := cfg.Limits.Or(info.Limits); !limits.IsZero() {
+		client = WithLimiter(client, SharedLimiter(info.Provider, apiKey, limits))
+	}
+	return client, info, thinking, nil
+}
+
+// newProviderClient creates the provider's client for the model.
+func newProviderClient(info ModelInfo, apiBase, apiKey string, debug bool) (chat.Client, error) {
+	model := info.Name
 
-	if isGeminiModel(modelLower) {
-		apiKey := cfg.APIKey
+	switch info.Provider {
+	case ProviderAnthropic:
 		if apiKey == "" {
-			apiKey = os.Getenv("GEMINI_API_KEY")
+			return nil, fmt.Errorf("Anthropic API key required for model %s", model)
 		}
 
-		if apiKey == "" {
-			apiKey = os.Getenv("GOOGLE_API_KEY")
+		opts := []claude.Option{
+			claude.WithModel(model),
 		}
+		if debug {
+			opts = append(opts, claude.WithDebug(true))
+		}
+
+		return claude.NewClient(cmp.Or(apiBase, claude.AnthropicURL), apiKey, opts...)
 
+	case ProviderGoogle:
 		if apiKey == "" {
-			return nil, "", fmt.Errorf("Google API key required for model %s", model)
+			return nil, fmt.Errorf("Google API key required for model %s", model)
 		}
 
 		opts := []gemini.Option{
 			gemini.WithModel(model),
 		}
-		if cfg.Debug {
+		if debug {
 			opts = append(opts, gemini.WithDebug(true))
 		}
 
-		client, err := gemini.NewClient(apiKey, opts...)
-		return client, thinkingLevel, err
-	}
-
-	// Default to OpenAI-compatible
-	apiBase := cfg.APIBase
-	apiKey := cfg.APIKey
-
-	if apiBase == "" {
-		if isOpenAIModel(modelLower) {
-			apiBase = openai.OpenAIURL
-		} else {
-			apiBase = openai.OllamaURL
-		}
+		return gemini.NewClient(apiKey, opts...)
 	}
 
-	if apiKey == "" && isOpenAIModel(modelLower) {
-		apiKey = os.Getenv("OPENAI_API_KEY")
+	// OpenAI, or an OpenAI-compatible local server
+	if info.Provider == ProviderOpenAI {
+		apiBase = cmp.Or(apiBase, openai.OpenAIURL)
 		if apiKey == "" {
-			return nil, "", fmt.Errorf("OpenAI API key required for model %s", model)
+			return nil, fmt.Errorf("OpenAI API key required for model %s", model)
 		}
+	} else {
+		apiBase = cmp.Or(apiBase, openai.OllamaURL)
 	}
 
 	opts := []openai.Option{
 		openai.WithModel(model),
 	}
-	if cfg.Debug {
+	if debug {
 		opts = append(opts, openai.WithDebug(true))
 	}
 
-	// Use Responses API for o1/o3 models, ChatCompletions for others
-	if isOpenAIReasoningModel(modelLower) {
+	if info.API == ResponsesAPI {
 		opts = append(opts, openai.WithAPI(openai.Responses))
 	}
 
-	client, err := openai.NewClient(apiBase, apiKey, opts...)
-	return client, thinkingLevel, err
-}
-
-func isClaudeModel(model string) bool {
-	return strings.HasPrefix(model, "claude-")
-}
-
-func isGeminiModel(model string) bool {
-	return strings.HasPrefix(model, "gemini-") ||
-		strings.HasPrefix(model, "models/gemini-")
-}
-
-func isOpenAIModel(model string) bool {
-	return strings.HasPrefix(model, "gpt") ||
-		strings.HasPrefix(model, "chatgpt") ||
-		strings.HasPrefix(model, "o1") ||
-		strings.HasPrefix(model, "o3") ||
-		strings.HasPrefix(model, "o4")
-}
-
-func isOpenAIReasoningModel(model string) bool {
-	return strings.HasPrefix(model, "o1-") ||
-		strings.HasPrefix(model, "o3-")
+	return openai.NewClient(apiBase, apiKey, opts...)
 }
 
 // parseModelAndThinkingLevel extracts the model name and thinking level from a model string.
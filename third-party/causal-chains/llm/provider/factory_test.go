@@ -331,10 +331,16 @@ func TestNewClientWithThinkingLevel(t *testing.T) {
 		},
 		{
 			name:              "GPT with thinking level",
-			model:             "gpt-4 high",
+			model:             "gpt-5 high",
 			apiKey:            "test-openai-key",
 			wantThinkingLevel: "high",
 		},
+		{
+			name:              "GPT without thinking support",
+			model:             "gpt-4 high",
+			apiKey:            "test-openai-key",
+			wantThinkingLevel: "",
+		},
 		{
 			name:              "Model without thinking level",
 			model:             "gemini-2.5-flash",
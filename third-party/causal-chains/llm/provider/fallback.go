@@ -0,0 +1,169 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/bpowers/go-agent/chat"
+)
+
+// FallbackClient is a chat.Client backed by an ordered list of models.
+// Each chat starts with the first model and fails over to the next one
+// when a message fails with a provider-level error (rate limits,
+// overloads, network failures, or rejected credentials), continuing the
+// conversation where it left off.  Once a chat has failed over it
+// stays with the model it failed over to, but the models before it
+// are tried again, the first model first, if that model fails too, so
+// that retrying a message that failed on every model starts over with
+// the first model rather than only ever trying the last.
+type FallbackClient struct {
+	models []fallbackModel
+
+	mu       sync.Mutex
+	answered *fallbackModel
+}
+
+type fallbackModel struct {
+	name     string
+	thinking Thinking
+	client   chat.Client
+}
+
+// AnsweredBy returns the name of the model that answered the most
+// recent message sent through any of the client's chats, or "" if none
+// has been answered yet.
+func (c *FallbackClient) AnsweredBy() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.answered == nil {
+		return ""
+	}
+	return c.answered.name
+}
+
+// AnsweredThinking returns the thinking setting of the model that
+// answered the most recent message.
+func (c *FallbackClient) AnsweredThinking() Thinking {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.answered == nil {
+		return Thinking{}
+	}
+	return c.answered.thinking
+}
+
+// Models returns the names of the client's models, in order.
+func (c *FallbackClient) Models() []string {
+	names := make([]string, 0, len(c.models))
+	for _, m := range c.models {
+		names = append(names, m.name)
+	}
+	return names
+}
+
+func (c *FallbackClient) NewChat(systemPrompt string, initialMsgs ...chat.Message) chat.Chat {
+	return &fallbackChat{
+		Chat:         c.models[0].client.NewChat(systemPrompt, initialMsgs...),
+		client:       c,
+		systemPrompt: systemPrompt,
+		history:      slices.Clone(initialMsgs),
+	}
+}
+
+// shouldFailOver reports whether another provider might answer a
+// message that failed with err.  Requests the provider rejected as
+// malformed or too long would most likely be rejected everywhere.
+func shouldFailOver(err error) bool {
+	class := Classify(err).Class
+	return class.Retryable() || class == ErrorAuth || class == ErrorQuotaExhausted
+}
+
+// fallbackChat keeps its own transcript rather than relying on the
+// current model's History, so that a replacement chat can be started
+// with exactly the messages that were answered.
+type fallbackChat struct {
+	// Chat is the current model's chat.  Methods not overridden here,
+	// like History and MaxTokens, describe the current model.
+	chat.Chat
+
+	client       *FallbackClient
+	systemPrompt string
+	history      []chat.Message
+	tools        []chat.Tool
+	current      int
+}
+
+func (c *fallbackChat) Message(ctx context.Context, msg chat.Message, opts ...chat.Option) (chat.Message, error) {
+	var errs []error
+	n := len(c.client.models)
+	order := make([]int, 0, n)
+	for i := c.current; i < n; i++ {
+		order = append(order, i)
+	}
+	for i := 0; i < c.current; i++ {
+		order = append(order, i)
+	}
+	for _, i := range order {
+		m := c.client.models[i]
+		if i != c.current {
+			if err := c.switchTo(i); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", m.name, err))
+				continue
+			}
+		}
+
+		// opts carry the first model's reasoning effort, which may mean
+		// something else, or nothing, to this one
+		modelOpts := opts
+		if i > 0 {
+			modelOpts = append(slices.Clip(opts), chat.WithReasoningEffort(m.thinking.Effort))
+		}
+
+		resp, err := c.Chat.Message(ctx, msg, modelOpts...)
+		if err == nil {
+			c.history = append(c.history, msg, resp)
+			c.client.mu.Lock()
+			c.client.answered = &c.client.models[i]
+			c.client.mu.Unlock()
+			return resp, nil
+		}
+
+		errs = append(errs, fmt.Errorf("%s: %w", m.name, err))
+		if !shouldFailOver(err) || ctx.Err() != nil {
+			break
+		}
+	}
+	return chat.Message{}, errors.Join(errs...)
+}
+
+// switchTo replaces the current chat with one on the i'th model,
+// carrying over the transcript and registered tools.
+func (c *fallbackChat) switchTo(i int) error {
+	next := c.client.models[i].client.NewChat(c.systemPrompt, c.history...)
+	for _, tool := range c.tools {
+		if err := next.RegisterTool(tool); err != nil {
+			return fmt.Errorf("RegisterTool(%s): %w", tool.Name(), err)
+		}
+	}
+	c.Chat = next
+	c.current = i
+	return nil
+}
+
+func (c *fallbackChat) RegisterTool(tool chat.Tool) error {
+	if err := c.Chat.RegisterTool(tool); err != nil {
+		return err
+	}
+	c.tools = append(c.tools, tool)
+	return nil
+}
+
+func (c *fallbackChat) DeregisterTool(name string) {
+	c.Chat.DeregisterTool(name)
+	c.tools = slices.DeleteFunc(c.tools, func(t chat.Tool) bool {
+		return t.Name() == name
+	})
+}
@@ -0,0 +1,157 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bpowers/go-agent/chat"
+)
+
+type namedTool struct {
+	chat.Tool
+	name string
+}
+
+func (t namedTool) Name() string { return t.name }
+
+func newFallbackClient(clients ...*fakeClient) *FallbackClient {
+	fc := &FallbackClient{}
+	for _, c := range clients {
+		fc.models = append(fc.models, fallbackModel{name: c.name, client: c})
+	}
+	return fc
+}
+
+func TestFallbackFailsOver(t *testing.T) {
+	primary := &fakeClient{name: "claude"}
+	secondary := &fakeClient{name: "gemini"}
+	fc := newFallbackClient(primary, secondary)
+
+	c := fc.NewChat("system", chat.UserMessage("context"))
+	if err := c.RegisterTool(namedTool{name: "lookup"}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := c.Message(context.Background(), chat.UserMessage("one"))
+	if err != nil || resp.GetText() != "claude: one" || fc.AnsweredBy() != "claude" {
+		t.Fatalf("first message = %q, %v (answered by %q)", resp.GetText(), err, fc.AnsweredBy())
+	}
+
+	primary.errs = []error{errors.New("status code 529: overloaded")}
+	resp, err = c.Message(context.Background(), chat.UserMessage("two"))
+	if err != nil || resp.GetText() != "gemini: two" || fc.AnsweredBy() != "gemini" {
+		t.Fatalf("second message = %q, %v (answered by %q)", resp.GetText(), err, fc.AnsweredBy())
+	}
+
+	// the replacement chat picks up the conversation and tools
+	if len(secondary.started) != 1 {
+		t.Fatalf("secondary started %d chats, want 1", len(secondary.started))
+	}
+	var transcript []string
+	for _, m := range secondary.started[0] {
+		transcript = append(transcript, m.GetText())
+	}
+	if got := strings.Join(transcript, "|"); got != "context|one|claude: one" {
+		t.Errorf("secondary transcript = %q", got)
+	}
+	if len(secondary.tools) != 1 || secondary.tools[0] != "lookup" {
+		t.Errorf("secondary tools = %v", secondary.tools)
+	}
+
+	// the chat stays with the secondary
+	resp, _ = c.Message(context.Background(), chat.UserMessage("three"))
+	if resp.GetText() != "gemini: three" {
+		t.Errorf("third message = %q", resp.GetText())
+	}
+}
+
+func TestFallbackReturnsToPrimary(t *testing.T) {
+	primary := &fakeClient{name: "claude", errs: []error{errors.New("status code 529: overloaded")}}
+	secondary := &fakeClient{name: "gpt", errs: []error{errors.New("status code 429"), errors.New("status code 429")}}
+	fc := newFallbackClient(primary, secondary)
+
+	// the first attempt fails on both models; the retry goes back to
+	// the primary, which has recovered, rather than only the fallback
+	var delays []time.Duration
+	c := WithRetry(fc, testPolicy(&delays)).NewChat("system")
+	resp, err := c.Message(context.Background(), chat.UserMessage("hi"))
+	if err != nil || resp.GetText() != "claude: hi" || fc.AnsweredBy() != "claude" {
+		t.Fatalf("Message() = %q, %v (answered by %q), want the primary's answer", resp.GetText(), err, fc.AnsweredBy())
+	}
+	if len(delays) != 1 {
+		t.Errorf("retried %d times, want 1", len(delays))
+	}
+}
+
+func TestFallbackStopsOnRequestErrors(t *testing.T) {
+	primary := &fakeClient{name: "claude", errs: []error{errors.New("status code 400: invalid_request_error")}}
+	secondary := &fakeClient{name: "gemini"}
+	fc := newFallbackClient(primary, secondary)
+
+	_, err := fc.NewChat("system").Message(context.Background(), chat.UserMessage("hi"))
+	if err == nil || Classify(err).Class != ErrorInvalidRequest {
+		t.Fatalf("Message() error = %v, want an invalid request error", err)
+	}
+	if len(secondary.started) != 0 || fc.AnsweredBy() != "" {
+		t.Errorf("failed over on an invalid request")
+	}
+}
+
+func TestFallbackExhausted(t *testing.T) {
+	primary := &fakeClient{name: "claude", errs: []error{errors.New("status code 529")}}
+	secondary := &fakeClient{name: "gpt", errs: []error{errors.New("status code 429")}}
+	fc := newFallbackClient(primary, secondary)
+
+	_, err := fc.NewChat("system").Message(context.Background(), chat.UserMessage("hi"))
+	if err == nil || !strings.Contains(err.Error(), "claude: status code 529") || !strings.Contains(err.Error(), "gpt: status code 429") {
+		t.Fatalf("Message() error = %v, want both models' errors", err)
+	}
+	// still retryable, so WithRetry around the chain tries again
+	if !Classify(err).Class.Retryable() {
+		t.Errorf("Classify(err) = %s, want retryable", Classify(err).Class)
+	}
+}
+
+func TestNewClientWithFallbacks(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "")
+	t.Setenv("ANTHROPIC_API_KEY", "")
+	t.Setenv("GEMINI_API_KEY", "")
+	t.Setenv("GOOGLE_API_KEY", "")
+
+	c, level, err := NewClient(Config{
+		Model:       "claude-sonnet-4-5 high",
+		Fallbacks:   []string{"gpt-5", "gemini-2.5-flash low", "llama3.1"},
+		Credentials: &Credentials{Keys: map[Provider]string{ProviderAnthropic: "sk-ant", ProviderGoogle: "goog"}},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	if level != "high" {
+		t.Errorf("thinking level = %q, want high", level)
+	}
+
+	fc, ok := c.(*FallbackClient)
+	if !ok {
+		t.Fatalf("NewClient() = %T, want *FallbackClient", c)
+	}
+	// gpt-5 is skipped for want of an OpenAI key
+	want := []string{"claude-sonnet-4-5-20250929", "gemini-2.5-flash", "llama3.1"}
+	if got := fc.Models(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Models() = %v, want %v", got, want)
+	}
+	if got := fc.models[1].thinking.Level; got != ThinkingLow {
+		t.Errorf("fallback thinking level = %q, want low", got)
+	}
+	// fallbacks without a level inherit the primary's
+	if got := fc.models[2].thinking.Level; got != ThinkingHigh {
+		t.Errorf("inherited thinking level = %q, want high", got)
+	}
+
+	_, _, err = NewClient(Config{Model: "claude-sonnet-4-5", Fallbacks: []string{"gemini-2.5-flash lots"}})
+	if err == nil || !strings.Contains(err.Error(), `unknown thinking level "lots"`) {
+		t.Errorf("NewClient() error = %v, want an unknown thinking level", err)
+	}
+}
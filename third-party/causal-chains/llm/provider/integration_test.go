@@ -0,0 +1,140 @@
+//go:build integration
+
+package provider
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bpowers/go-agent/chat"
+
+	"github.com/UB-IAD/sd-ai/third-party/causal-chains/causal"
+	"github.com/UB-IAD/sd-ai/third-party/causal-chains/llm/llmtest"
+)
+
+// These tests drive the real provider clients against llmtest's
+// stand-in server: go test -tags integration ./llm/...
+
+const integrationReply = `{
+  "title": "Price and demand",
+  "explanation": "Higher prices reduce demand, which lowers prices.",
+  "causal_chains": [
+    {
+      "initial_variable": "Price",
+      "relationships": [
+        {"variable": "Demand", "polarity": "-", "polarityReasoning": ""},
+        {"variable": "Price", "polarity": "+", "polarityReasoning": ""}
+      ]
+    }
+  ]
+}`
+
+// newIntegrationClient returns a client for model that talks to srv.
+func newIntegrationClient(t *testing.T, srv *llmtest.Server, model string) chat.Client {
+	t.Helper()
+	// the Gemini client has no endpoint option, but its SDK honors this
+	t.Setenv("GOOGLE_GEMINI_BASE_URL", srv.URL)
+
+	apiBase := srv.URL + "/v1"
+	if info, _ := DefaultRegistry.Lookup(model); info.Provider == ProviderAnthropic {
+		apiBase = srv.URL
+	}
+	c, _, err := NewClient(Config{Model: model, APIBase: apiBase, APIKey: "test-key"})
+	if err != nil {
+		t.Fatalf("NewClient(%s) error = %v", model, err)
+	}
+	return c
+}
+
+var integrationModels = map[llmtest.Protocol]string{
+	llmtest.ChatCompletions: "gpt-4.1",
+	llmtest.Responses:       "gpt-5",
+	llmtest.Messages:        "claude-sonnet-4-5",
+	llmtest.GenerateContent: "gemini-2.5-flash",
+}
+
+func TestIntegrationClients(t *testing.T) {
+	for protocol, model := range integrationModels {
+		t.Run(string(protocol), func(t *testing.T) {
+			srv := llmtest.NewServer(llmtest.Reply("hello from " + model))
+			defer srv.Close()
+
+			c := newIntegrationClient(t, srv, model)
+			resp, err := c.NewChat("system").Message(context.Background(), chat.UserMessage("hi"))
+			if err != nil {
+				t.Fatalf("Message() error = %v", err)
+			}
+			if resp.GetText() != "hello from "+model {
+				t.Errorf("Message() = %q", resp.GetText())
+			}
+
+			reqs := srv.Requests()
+			if len(reqs) != 1 || reqs[0].Protocol != protocol {
+				t.Fatalf("Requests() = %+v, want one %s request", reqs, protocol)
+			}
+			if !strings.Contains(string(reqs[0].Body), "hi") {
+				t.Errorf("request body doesn't contain the message: %s", reqs[0].Body)
+			}
+		})
+	}
+}
+
+func TestIntegrationRetry(t *testing.T) {
+	for protocol, model := range integrationModels {
+		t.Run(string(protocol), func(t *testing.T) {
+			srv := llmtest.NewServer(
+				llmtest.RateLimited(10*time.Millisecond),
+				llmtest.Overloaded(),
+				llmtest.Reply("ok"),
+			)
+			defer srv.Close()
+
+			policy := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond, MaxDelay: 50 * time.Millisecond}
+			c := WithRetry(newIntegrationClient(t, srv, model), policy)
+			resp, err := c.NewChat("system").Message(context.Background(), chat.UserMessage("hi"))
+			if err != nil || resp.GetText() != "ok" {
+				t.Fatalf("Message() = %q, %v", resp.GetText(), err)
+			}
+			// the SDKs may retry on their own, but every scripted
+			// response must have been used
+			if srv.Pending() != 0 {
+				t.Errorf("Pending() = %d, want 0", srv.Pending())
+			}
+		})
+	}
+}
+
+func TestIntegrationInvalidRequest(t *testing.T) {
+	srv := llmtest.NewServer(llmtest.Fail(http.StatusBadRequest, "prompt is too long: 210000 tokens > 200000 maximum"))
+	defer srv.Close()
+
+	c := newIntegrationClient(t, srv, "claude-sonnet-4-5")
+	_, err := c.NewChat("system").Message(context.Background(), chat.UserMessage("hi"))
+	if err == nil {
+		t.Fatal("Message() succeeded, want error")
+	}
+	if class := Classify(err).Class; class != ErrorContextLength {
+		t.Errorf("Classify(%v) = %s, want %s", err, class, ErrorContextLength)
+	}
+}
+
+func TestIntegrationGenerate(t *testing.T) {
+	for protocol, model := range integrationModels {
+		t.Run(string(protocol), func(t *testing.T) {
+			srv := llmtest.NewServer(llmtest.Reply(integrationReply))
+			defer srv.Close()
+
+			d := causal.NewDiagrammer(newIntegrationClient(t, srv, model), "")
+			m, err := d.Generate(context.Background(), "price and demand", "")
+			if err != nil {
+				t.Fatalf("Generate() error = %v", err)
+			}
+			if m.Title != "Price and demand" || len(m.Loops()) != 1 {
+				t.Errorf("Generate() = %+v", m)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package provider
+
+import (
+	"cmp"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bpowers/go-agent/chat"
+)
+
+// Limits is a client-side budget for requests to a provider.  Zero
+// fields are unlimited.
+type Limits struct {
+	RequestsPerMinute int `json:"requestsPerMinute,omitzero"`
+	// TokensPerMinute budgets prompt and reply tokens together, as
+	// providers' quotas do.  Prompts are estimated before they are sent
+	// and replies charged after they arrive.
+	TokensPerMinute int `json:"tokensPerMinute,omitzero"`
+	// MaxInFlight caps the number of requests awaiting a reply.
+	MaxInFlight int `json:"maxInFlight,omitzero"`
+}
+
+func (l Limits) IsZero() bool {
+	return l == Limits{}
+}
+
+// Or returns l with its unset fields taken from d.
+func (l Limits) Or(d Limits) Limits {
+	return Limits{
+		RequestsPerMinute: cmp.Or(l.RequestsPerMinute, d.RequestsPerMinute),
+		TokensPerMinute:   cmp.Or(l.TokensPerMinute, d.TokensPerMinute),
+		MaxInFlight:       cmp.Or(l.MaxInFlight, d.MaxInFlight),
+	}
+}
+
+// bucket is a token bucket holding up to a minute's worth of tokens.
+// Reservations may overdraw it, which makes later callers wait for it
+// to refill.
+type bucket struct {
+	capacity float64
+	perSec   float64
+	tokens   float64
+	last     time.Time
+}
+
+func newBucket(perMinute int, now time.Time) *bucket {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &bucket{
+		capacity: float64(perMinute),
+		perSec:   float64(perMinute) / 60,
+		tokens:   float64(perMinute),
+		last:     now,
+	}
+}
+
+// reserve takes n tokens, returning how long the caller must wait
+// before using them.  Requests bigger than the whole bucket take all of
+// it rather than waiting forever.
+func (b *bucket) reserve(now time.Time, n float64) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.tokens = min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.perSec)
+	b.last = now
+	b.tokens -= min(n, b.capacity)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.perSec * float64(time.Second))
+}
+
+func (b *bucket) refund(n float64) {
+	if b != nil {
+		b.tokens = min(b.capacity, b.tokens+min(n, b.capacity))
+	}
+}
+
+// Limiter enforces Limits across all the goroutines sharing it.
+type Limiter struct {
+	limits   Limits
+	inFlight chan struct{}
+
+	mu       sync.Mutex
+	requests *bucket
+	tokens   *bucket
+
+	// now and sleep are replaced by tests.
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func NewLimiter(limits Limits) *Limiter {
+	l := &Limiter{
+		limits: limits,
+		now:    time.Now,
+		sleep:  sleep,
+	}
+	if limits.MaxInFlight > 0 {
+		l.inFlight = make(chan struct{}, limits.MaxInFlight)
+	}
+	l.requests = newBucket(limits.RequestsPerMinute, l.now())
+	l.tokens = newBucket(limits.TokensPerMinute, l.now())
+	return l
+}
+
+// Limits returns the limits l enforces.
+func (l *Limiter) Limits() Limits {
+	return l.limits
+}
+
+// Acquire waits until a request estimated to use tokens tokens fits in
+// the budget, or ctx is done.  On success the caller must call release
+// once the request completes with the number of tokens it actually
+// used, or 0 if that isn't known.
+func (l *Limiter) Acquire(ctx context.Context, tokens int) (release func(used int), err error) {
+	if l.inFlight != nil {
+		select {
+		case l.inFlight <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	done := func() {
+		if l.inFlight != nil {
+			<-l.inFlight
+		}
+	}
+
+	l.mu.Lock()
+	now := l.now()
+	wait := max(l.requests.reserve(now, 1), l.tokens.reserve(now, float64(tokens)))
+	l.mu.Unlock()
+
+	if wait > 0 {
+		if err := l.sleep(ctx, wait); err != nil {
+			l.mu.Lock()
+			l.requests.refund(1)
+			l.tokens.refund(float64(tokens))
+			l.mu.Unlock()
+			done()
+			return nil, err
+		}
+	}
+
+	return func(used int) {
+		if extra := used - tokens; extra > 0 {
+			l.mu.Lock()
+			l.tokens.reserve(l.now(), float64(extra))
+			l.mu.Unlock()
+		}
+		done()
+	}, nil
+}
+
+type limiterKey struct {
+	provider Provider
+	apiKey   string
+}
+
+var (
+	limitersMu sync.Mutex
+	limiters   = make(map[limiterKey]*Limiter)
+)
+
+// SharedLimiter returns the process-wide limiter for requests to the
+// provider with the given API key, so that every client using the same
+// quota draws on the same budget.  The limiter is created with limits
+// the first time it is asked for; later callers share it regardless of
+// the limits they pass.
+func SharedLimiter(p Provider, apiKey string, limits Limits) *Limiter {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+
+	key := limiterKey{provider: p, apiKey: apiKey}
+	l, ok := limiters[key]
+	if !ok {
+		l = NewLimiter(limits)
+		limiters[key] = l
+	}
+	return l
+}
+
+// estimateTokens roughly counts the tokens in text, at about four
+// characters per token.
+func estimateTokens(text string) int {
+	return len(text)/4 + 1
+}
+
+// WithLimiter wraps a client so that each message waits for room in
+// the limiter's budget before it is sent.
+func WithLimiter(client chat.Client, limiter *Limiter) chat.Client {
+	return limitedClient{Client: client, limiter: limiter}
+}
+
+type limitedClient struct {
+	chat.Client
+	limiter *Limiter
+}
+
+func (c limitedClient) NewChat(systemPrompt string, initialMsgs ...chat.Message) chat.Chat {
+	// the whole transcript is resent with every message
+	transcript := estimateTokens(systemPrompt)
+	for _, m := range initialMsgs {
+		transcript += estimateTokens(m.GetText())
+	}
+	return &limitedChat{
+		Chat:       c.Client.NewChat(systemPrompt, initialMsgs...),
+		limiter:    c.limiter,
+		transcript: transcript,
+	}
+}
+
+type limitedChat struct {
+	chat.Chat
+	limiter    *Limiter
+	transcript int
+}
+
+func (c *limitedChat) Message(ctx context.Context, msg chat.Message, opts ...chat.Option) (chat.Message, error) {
+	prompt := c.transcript + estimateTokens(msg.GetText())
+	release, err := c.limiter.Acquire(ctx, prompt)
+	if err != nil {
+		return chat.Message{}, err
+	}
+
+	resp, err := c.Chat.Message(ctx, msg, opts...)
+	if err != nil {
+		release(0)
+		return resp, err
+	}
+
+	reply := estimateTokens(resp.GetText())
+	release(prompt + reply)
+	c.transcript = prompt + reply
+	return resp, nil
+}
@@ -0,0 +1,150 @@
+package provider
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bpowers/go-agent/chat"
+)
+
+// testLimiter returns a limiter on a fake clock that advances as the
+// limiter sleeps, recording each sleep.
+func testLimiter(limits Limits, delays *[]time.Duration) *Limiter {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := NewLimiter(limits)
+	l.now = func() time.Time { return now }
+	l.sleep = func(ctx context.Context, d time.Duration) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		*delays = append(*delays, d)
+		now = now.Add(d)
+		return nil
+	}
+	l.requests = newBucket(limits.RequestsPerMinute, now)
+	l.tokens = newBucket(limits.TokensPerMinute, now)
+	return l
+}
+
+func TestLimiterRequestsPerMinute(t *testing.T) {
+	var delays []time.Duration
+	l := testLimiter(Limits{RequestsPerMinute: 60}, &delays)
+
+	for range 61 {
+		release, err := l.Acquire(context.Background(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		release(0)
+	}
+	// a minute's burst, then one request a second
+	if len(delays) != 1 || delays[0] != time.Second {
+		t.Errorf("delays = %v, want [1s]", delays)
+	}
+}
+
+func TestLimiterTokensPerMinute(t *testing.T) {
+	var delays []time.Duration
+	l := testLimiter(Limits{TokensPerMinute: 600}, &delays)
+
+	release, _ := l.Acquire(context.Background(), 500)
+	// the reply used more than estimated
+	release(550)
+
+	release, _ = l.Acquire(context.Background(), 100)
+	release(0)
+	// 50 tokens short at 10 tokens a second
+	if len(delays) != 1 || delays[0] != 5*time.Second {
+		t.Errorf("delays = %v, want [5s]", delays)
+	}
+
+	// prompts bigger than the budget wait for all of it rather than
+	// forever
+	delays = nil
+	release, _ = l.Acquire(context.Background(), 10000)
+	release(0)
+	if len(delays) != 1 || delays[0] != time.Minute {
+		t.Errorf("delays = %v, want [1m]", delays)
+	}
+}
+
+func TestLimiterCanceledRefunds(t *testing.T) {
+	var delays []time.Duration
+	l := testLimiter(Limits{RequestsPerMinute: 1, MaxInFlight: 1}, &delays)
+
+	release, _ := l.Acquire(context.Background(), 0)
+	release(0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.Acquire(ctx, 0); err == nil {
+		t.Fatal("Acquire() with a canceled context succeeded")
+	}
+
+	// the canceled request gave back its slot and its place in line
+	release, err := l.Acquire(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release(0)
+	if len(delays) != 1 || delays[0] != time.Minute {
+		t.Errorf("delays = %v, want [1m]", delays)
+	}
+}
+
+func TestWithLimiterMaxInFlight(t *testing.T) {
+	fake := &fakeClient{delay: 5 * time.Millisecond}
+	c := WithLimiter(fake, NewLimiter(Limits{MaxInFlight: 2}))
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.NewChat("system").Message(context.Background(), chat.UserMessage("hi")); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := fake.maxInFlight.Load(); got != 2 {
+		t.Errorf("max in flight = %d, want 2", got)
+	}
+}
+
+func TestNewClientSharesLimiter(t *testing.T) {
+	r := &Registry{Models: []ModelInfo{
+		{Name: "claude-a", Provider: ProviderAnthropic, Limits: Limits{RequestsPerMinute: 50}},
+		{Name: "claude-b", Provider: ProviderAnthropic},
+	}}
+	limiter := func(model string, limits Limits) *Limiter {
+		t.Helper()
+		c, _, err := NewClient(Config{Model: model, APIKey: "sk-ant-shared", Registry: r, Limits: limits})
+		if err != nil {
+			t.Fatal(err)
+		}
+		lc, ok := c.(limitedClient)
+		if !ok {
+			t.Fatalf("NewClient(%s) = %T, want a limited client", model, c)
+		}
+		return lc.limiter
+	}
+
+	a := limiter("claude-a", Limits{MaxInFlight: 4})
+	if got := a.Limits(); got != (Limits{RequestsPerMinute: 50, MaxInFlight: 4}) {
+		t.Errorf("Limits() = %+v", got)
+	}
+	// same provider and key, same budget
+	if b := limiter("claude-b", Limits{MaxInFlight: 1}); b != a {
+		t.Errorf("models sharing a key got different limiters")
+	}
+
+	if c, _, _ := NewClient(Config{Model: "claude-b", APIKey: "sk-ant-other", Registry: r}); c == nil {
+		t.Fatal("NewClient() failed")
+	} else if _, ok := c.(limitedClient); ok {
+		t.Errorf("unlimited model got a limiter")
+	}
+}
@@ -0,0 +1,446 @@
+package provider
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// LocalKind is the software serving a local server's models.
+type LocalKind string
+
+const (
+	Ollama   LocalKind = "ollama"
+	LMStudio LocalKind = "lmstudio"
+)
+
+// LocalServer is a local model server.
+type LocalServer struct {
+	Kind LocalKind
+	// URL is the server's root, without the OpenAI-compatible /v1.
+	URL string
+}
+
+// DefaultLocalServers returns Ollama and LM Studio at their default
+// addresses, or those given by OLLAMA_HOST and LM_STUDIO_BASE_URL.
+func DefaultLocalServers() []LocalServer {
+	ollama := cmp.Or(os.Getenv("OLLAMA_HOST"), "http://localhost:11434")
+	if !strings.Contains(ollama, "://") {
+		ollama = "http://" + ollama
+	}
+	return []LocalServer{
+		{Kind: Ollama, URL: strings.TrimSuffix(ollama, "/")},
+		{Kind: LMStudio, URL: strings.TrimSuffix(cmp.Or(os.Getenv("LM_STUDIO_BASE_URL"), "http://localhost:1234"), "/")},
+	}
+}
+
+// LocalModel is a model available on a local server.
+type LocalModel struct {
+	Name   string    `json:"name"`
+	Server LocalKind `json:"server"`
+	// APIBase is the server's OpenAI-compatible endpoint.
+	APIBase       string `json:"apiBase"`
+	ContextWindow int    `json:"contextWindow,omitzero"`
+	// Loaded is whether the model is in memory, as far as the server
+	// says.
+	Loaded       bool     `json:"loaded,omitzero"`
+	Capabilities []string `json:"capabilities,omitzero"`
+	// StructuredOutput is set by ProbeStructuredOutput.
+	StructuredOutput bool `json:"structuredOutput,omitzero"`
+}
+
+// ModelInfo describes the model for the registry.
+func (m LocalModel) ModelInfo() ModelInfo {
+	info := ModelInfo{
+		Name:             m.Name,
+		Provider:         ProviderOllama,
+		APIBase:          m.APIBase,
+		API:              ChatCompletionsAPI,
+		StructuredOutput: m.StructuredOutput,
+		Thinking:         slices.Contains(m.Capabilities, "thinking") || slices.Contains(m.Capabilities, "reasoning"),
+		ContextWindow:    m.ContextWindow,
+	}
+	// a model that ignores the response format may still fill in tool
+	// arguments properly
+	if !m.StructuredOutput && (slices.Contains(m.Capabilities, "tools") || slices.Contains(m.Capabilities, "tool_use")) {
+		info.OutputStrategy = "prompted_tool"
+	}
+	return info
+}
+
+// discoveryClient bounds how long an unresponsive server can hold up
+// discovery, and probeClient how long a probe can, allowing for the
+// server loading the model first.
+var (
+	discoveryClient = &http.Client{Timeout: 10 * time.Second}
+	probeClient     = &http.Client{Timeout: 2 * time.Minute}
+)
+
+func getJSON(ctx context.Context, client *http.Client, method, url string, body, v any) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("json.Marshal: %w", err)
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: status %d: %s", method, url, resp.StatusCode, bytes.TrimSpace(data))
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	return nil
+}
+
+// Models lists the models available on the server.
+func (s LocalServer) Models(ctx context.Context) ([]LocalModel, error) {
+	switch s.Kind {
+	case Ollama:
+		return s.ollamaModels(ctx)
+	case LMStudio:
+		return s.lmStudioModels(ctx)
+	}
+	return nil, fmt.Errorf("unknown local server kind %q", s.Kind)
+}
+
+func (s LocalServer) ollamaModels(ctx context.Context) ([]LocalModel, error) {
+	var tags struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := getJSON(ctx, discoveryClient, http.MethodGet, s.URL+"/api/tags", nil, &tags); err != nil {
+		return nil, err
+	}
+	var running struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	// older servers don't list running models
+	_ = getJSON(ctx, discoveryClient, http.MethodGet, s.URL+"/api/ps", nil, &running)
+
+	var models []LocalModel
+	for _, tag := range tags.Models {
+		var show struct {
+			ModelInfo    map[string]any `json:"model_info"`
+			Capabilities []string       `json:"capabilities"`
+		}
+		if err := getJSON(ctx, discoveryClient, http.MethodPost, s.URL+"/api/show", map[string]string{"model": tag.Name}, &show); err != nil {
+			return nil, err
+		}
+
+		m := LocalModel{
+			Name:         tag.Name,
+			Server:       Ollama,
+			APIBase:      s.URL + "/v1",
+			Capabilities: show.Capabilities,
+		}
+		// the key is prefixed with the architecture, as in
+		// llama.context_length
+		for k, v := range show.ModelInfo {
+			if n, ok := v.(float64); ok && strings.HasSuffix(k, ".context_length") {
+				m.ContextWindow = int(n)
+			}
+		}
+		for _, r := range running.Models {
+			m.Loaded = m.Loaded || r.Name == tag.Name
+		}
+		models = append(models, m)
+	}
+	return models, nil
+}
+
+func (s LocalServer) lmStudioModels(ctx context.Context) ([]LocalModel, error) {
+	var list struct {
+		Data []struct {
+			ID               string   `json:"id"`
+			Type             string   `json:"type"`
+			State            string   `json:"state"`
+			MaxContextLength int      `json:"max_context_length"`
+			LoadedContext    int      `json:"loaded_context_length"`
+			Capabilities     []string `json:"capabilities"`
+		} `json:"data"`
+	}
+	if err := getJSON(ctx, discoveryClient, http.MethodGet, s.URL+"/api/v0/models", nil, &list); err != nil {
+		return nil, err
+	}
+
+	var models []LocalModel
+	for _, d := range list.Data {
+		if d.Type == "embeddings" {
+			continue
+		}
+		models = append(models, LocalModel{
+			Name:    d.ID,
+			Server:  LMStudio,
+			APIBase: s.URL + "/v1",
+			// a loaded model is limited to the context it was loaded
+			// with
+			ContextWindow: cmp.Or(d.LoadedContext, d.MaxContextLength),
+			Loaded:        d.State == "loaded",
+			Capabilities:  d.Capabilities,
+		})
+	}
+	return models, nil
+}
+
+// DiscoverLocalModels lists the models on each of the servers.
+// Servers that aren't running are skipped; other failures are returned
+// along with the models from the servers that answered.
+func DiscoverLocalModels(ctx context.Context, servers []LocalServer) ([]LocalModel, error) {
+	var models []LocalModel
+	var errs []error
+	for _, s := range servers {
+		ms, err := s.Models(ctx)
+		if err != nil {
+			if Classify(err).Class != ErrorTransport {
+				errs = append(errs, fmt.Errorf("%s at %s: %w", s.Kind, s.URL, err))
+			}
+			continue
+		}
+		models = append(models, ms...)
+	}
+	return models, errors.Join(errs...)
+}
+
+var probeSchema = map[string]any{
+	"type":                 "object",
+	"properties":           map[string]any{"ok": map[string]any{"type": "boolean"}},
+	"required":             []string{"ok"},
+	"additionalProperties": false,
+}
+
+// ProbeStructuredOutput checks that the model honors a JSON schema
+// response format by asking it for a tiny object, setting
+// m.StructuredOutput accordingly.  It returns an error only if the
+// model couldn't be asked at all.  Probing may load the model, which
+// can take a while.
+func ProbeStructuredOutput(ctx context.Context, m *LocalModel) error {
+	req := map[string]any{
+		"model": m.Name,
+		"messages": []map[string]string{
+			{"role": "user", "content": `Reply with a JSON object whose "ok" field is true.`},
+		},
+		"response_format": map[string]any{
+			"type": "json_schema",
+			"json_schema": map[string]any{
+				"name":   "probe",
+				"strict": true,
+				"schema": probeSchema,
+			},
+		},
+		"temperature": 0,
+		"max_tokens":  256,
+	}
+	var resp struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	err := getJSON(ctx, probeClient, http.MethodPost, m.APIBase+"/chat/completions", req, &resp)
+	if err != nil {
+		// servers reject response formats they don't support
+		switch Classify(err).Class {
+		case ErrorInvalidRequest, ErrorUnknown:
+			if ctx.Err() == nil {
+				m.StructuredOutput = false
+				return nil
+			}
+		}
+		return err
+	}
+
+	m.StructuredOutput = false
+	if len(resp.Choices) > 0 {
+		var probe struct {
+			OK *bool `json:"ok"`
+		}
+		content := stripThinking(resp.Choices[0].Message.Content)
+		m.StructuredOutput = json.Unmarshal([]byte(content), &probe) == nil && probe.OK != nil
+	}
+	return nil
+}
+
+// stripThinking removes the <think> block reasoning models put before
+// their answer.
+func stripThinking(s string) string {
+	if _, after, ok := strings.Cut(s, "</think>"); ok {
+		s = after
+	}
+	return strings.TrimSpace(s)
+}
+
+// FindLocalModel finds the named model among models, matching Ollama's
+// implicit :latest tag.
+func FindLocalModel(models []LocalModel, name string) (LocalModel, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for _, m := range models {
+		n := strings.ToLower(m.Name)
+		if n == name || n == name+":latest" {
+			return m, true
+		}
+	}
+	return LocalModel{}, false
+}
+
+// WithLocalModels returns a registry with the local models added ahead
+// of r's own entries.
+func (r *Registry) WithLocalModels(models ...LocalModel) *Registry {
+	local := make([]ModelInfo, 0, len(models))
+	for _, m := range models {
+		local = append(local, m.ModelInfo())
+	}
+	return &Registry{Models: slices.Concat(local, r.Models)}
+}
+
+// ErrNotLocal is returned by ResolveLocalModel for models none of the
+// running local servers have.
+var ErrNotLocal = errors.New("model isn't available locally")
+
+// ResolveLocalModel looks for a model the registry doesn't know on the
+// local servers, returning a registry that routes it to the server
+// that has it and records its context window and whether it supports
+// structured output, as probed or remembered by cache (which may be
+// nil).  If no server is running r is returned unchanged, leaving the
+// request to fail or succeed against the default endpoint; if the
+// servers are running but none has the model, the error wraps
+// ErrNotLocal.  Other errors, like a server that answers badly, also
+// leave r unchanged.
+func ResolveLocalModel(ctx context.Context, r *Registry, model string, servers []LocalServer, cache *ProbeCache) (*Registry, error) {
+	if _, found := r.Lookup(model); found || strings.TrimSpace(model) == "" {
+		return r, nil
+	}
+
+	models, err := DiscoverLocalModels(ctx, servers)
+	m, found := FindLocalModel(models, model)
+	if !found {
+		// the model may be on the server that couldn't be asked
+		if err != nil {
+			return r, err
+		}
+		if len(models) == 0 {
+			return r, nil
+		}
+		names := make([]string, 0, len(models))
+		for _, m := range models {
+			names = append(names, m.Name)
+		}
+		return r, fmt.Errorf("%w: %q (have %s)", ErrNotLocal, model, strings.Join(names, ", "))
+	}
+
+	if err := cache.Probe(ctx, &m); err != nil {
+		return r, fmt.Errorf("probing %s: %w", m.Name, err)
+	}
+	// the server's id is kept as it has it, and what the user asked for
+	// (say without Ollama's :latest tag) made an alias
+	info := m.ModelInfo()
+	if !strings.EqualFold(info.Name, strings.TrimSpace(model)) {
+		info.Aliases = append(info.Aliases, strings.TrimSpace(model))
+	}
+	return &Registry{Models: slices.Concat([]ModelInfo{info}, r.Models)}, nil
+}
+
+// ProbeCache remembers the results of ProbeStructuredOutput in a JSON
+// file, so that each run needn't wait on the model to find out again.
+// Like sessions, the file isn't locked; concurrent runs at worst probe
+// again.
+type ProbeCache struct {
+	Path string
+	// TTL is how long a result is trusted, since a model may be
+	// replaced under the same name.
+	TTL time.Duration
+}
+
+type probeResult struct {
+	StructuredOutput bool      `json:"structuredOutput"`
+	Time             time.Time `json:"time"`
+}
+
+// DefaultProbeCache returns a cache in the user's cache directory that
+// trusts results for a day, or nil if there is no cache directory.
+func DefaultProbeCache() *ProbeCache {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return nil
+	}
+	return &ProbeCache{Path: filepath.Join(dir, "sd-ai", "causal-chains", "probes.json"), TTL: 24 * time.Hour}
+}
+
+// Probe sets m.StructuredOutput from the cache, or by probing the model
+// and remembering the result.  A nil cache always probes.  The cache
+// failing to save isn't an error, as the probe itself succeeded.
+func (c *ProbeCache) Probe(ctx context.Context, m *LocalModel) error {
+	if c == nil {
+		return ProbeStructuredOutput(ctx, m)
+	}
+	key := m.APIBase + " " + m.Name
+	results := c.load()
+	if res, ok := results[key]; ok && time.Since(res.Time) < c.TTL {
+		m.StructuredOutput = res.StructuredOutput
+		return nil
+	}
+
+	if err := ProbeStructuredOutput(ctx, m); err != nil {
+		return err
+	}
+	results[key] = probeResult{StructuredOutput: m.StructuredOutput, Time: time.Now().UTC()}
+	_ = c.save(results)
+	return nil
+}
+
+// load returns the cached results, or none if the file is missing or
+// unreadable.
+func (c *ProbeCache) load() map[string]probeResult {
+	results := make(map[string]probeResult)
+	if data, err := os.ReadFile(c.Path); err == nil {
+		_ = json.Unmarshal(data, &results)
+	}
+	return results
+}
+
+func (c *ProbeCache) save(results map[string]probeResult) error {
+	data, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return fmt.Errorf("json.MarshalIndent: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(c.Path), 0o700); err != nil {
+		return fmt.Errorf("os.MkdirAll: %w", err)
+	}
+	if err := os.WriteFile(c.Path, data, 0o600); err != nil {
+		return fmt.Errorf("os.WriteFile: %w", err)
+	}
+	return nil
+}
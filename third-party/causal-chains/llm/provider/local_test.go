@@ -0,0 +1,186 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/UB-IAD/sd-ai/third-party/causal-chains/llm/llmtest"
+)
+
+// newOllama serves Ollama's model listing endpoints, forwarding the
+// OpenAI-compatible API to chat.
+func newOllama(t *testing.T, chat *llmtest.Server) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/tags", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"models": [{"name": "llama3.1:latest"}, {"name": "qwen3:32b"}]}`))
+	})
+	mux.HandleFunc("GET /api/ps", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"models": [{"name": "qwen3:32b"}]}`))
+	})
+	mux.HandleFunc("POST /api/show", func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ Model string }
+		json.NewDecoder(r.Body).Decode(&req)
+		switch req.Model {
+		case "llama3.1:latest":
+			w.Write([]byte(`{"model_info": {"general.architecture": "llama", "llama.context_length": 131072}, "capabilities": ["completion", "tools"]}`))
+		case "qwen3:32b":
+			w.Write([]byte(`{"model_info": {"general.architecture": "qwen3", "qwen3.context_length": 40960}, "capabilities": ["completion", "tools", "thinking"]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	if chat != nil {
+		mux.HandleFunc("/v1/", func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, chat.URL+r.URL.Path, http.StatusTemporaryRedirect)
+		})
+	}
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newLMStudio(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v0/models" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"data": [
+			{"id": "qwen/qwen3-coder-30b", "type": "llm", "state": "loaded", "max_context_length": 262144, "loaded_context_length": 32768, "capabilities": ["tool_use"]},
+			{"id": "text-embedding-nomic-embed-text-v1.5", "type": "embeddings", "state": "not-loaded", "max_context_length": 2048}
+		]}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestDiscoverLocalModels(t *testing.T) {
+	ollama, lmstudio := newOllama(t, nil), newLMStudio(t)
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	models, err := DiscoverLocalModels(context.Background(), []LocalServer{
+		{Kind: Ollama, URL: ollama.URL},
+		{Kind: LMStudio, URL: lmstudio.URL},
+		// servers that aren't running are skipped
+		{Kind: Ollama, URL: down.URL},
+	})
+	if err != nil {
+		t.Fatalf("DiscoverLocalModels() error = %v", err)
+	}
+
+	want := []LocalModel{
+		{Name: "llama3.1:latest", Server: Ollama, APIBase: ollama.URL + "/v1", ContextWindow: 131072, Capabilities: []string{"completion", "tools"}},
+		{Name: "qwen3:32b", Server: Ollama, APIBase: ollama.URL + "/v1", ContextWindow: 40960, Loaded: true, Capabilities: []string{"completion", "tools", "thinking"}},
+		{Name: "qwen/qwen3-coder-30b", Server: LMStudio, APIBase: lmstudio.URL + "/v1", ContextWindow: 32768, Loaded: true, Capabilities: []string{"tool_use"}},
+	}
+	got, _ := json.Marshal(models)
+	wantJSON, _ := json.Marshal(want)
+	if string(got) != string(wantJSON) {
+		t.Errorf("DiscoverLocalModels() = %s\nwant %s", got, wantJSON)
+	}
+
+	if info := models[1].ModelInfo(); !info.Thinking || info.Provider != ProviderOllama || info.API != ChatCompletionsAPI {
+		t.Errorf("ModelInfo() = %+v", info)
+	}
+	// tool-capable models that ignore the response format use tool calls
+	if info := models[2].ModelInfo(); info.OutputStrategy != "prompted_tool" {
+		t.Errorf("ModelInfo().OutputStrategy = %q, want tool", info.OutputStrategy)
+	}
+}
+
+func TestProbeStructuredOutput(t *testing.T) {
+	srv := llmtest.NewServer(
+		llmtest.Reply(`<think>they want ok</think>{"ok": true}`),
+		llmtest.Reply(`Sure! Here is the JSON: ok = true`),
+		llmtest.Fail(http.StatusBadRequest, "'response_format.type' must be 'json_schema' or 'text'"),
+	)
+	defer srv.Close()
+
+	for _, want := range []bool{true, false, false} {
+		m := LocalModel{Name: "llama3.1", APIBase: srv.URL + "/v1", StructuredOutput: !want}
+		if err := ProbeStructuredOutput(context.Background(), &m); err != nil {
+			t.Fatalf("ProbeStructuredOutput() error = %v", err)
+		}
+		if m.StructuredOutput != want {
+			t.Errorf("StructuredOutput = %v, want %v", m.StructuredOutput, want)
+		}
+	}
+
+	reqs := srv.Requests()
+	if len(reqs) != 3 || !strings.Contains(string(reqs[0].Body), `"json_schema"`) {
+		t.Errorf("probe requests = %+v", reqs)
+	}
+}
+
+func TestResolveLocalModel(t *testing.T) {
+	chat := llmtest.NewServer(llmtest.Reply(`{"ok": true}`))
+	defer chat.Close()
+	servers := []LocalServer{{Kind: Ollama, URL: newOllama(t, chat).URL}}
+
+	r, err := ResolveLocalModel(context.Background(), DefaultRegistry, "llama3.1", servers, nil)
+	if err != nil {
+		t.Fatalf("ResolveLocalModel() error = %v", err)
+	}
+	info, found := r.Lookup("llama3.1")
+	if !found || info.Name != "llama3.1:latest" || info.APIBase != servers[0].URL+"/v1" || info.ContextWindow != 131072 || !info.StructuredOutput {
+		t.Errorf("Lookup(llama3.1) = %+v, %v", info, found)
+	}
+
+	// known models aren't looked for
+	if r, err := ResolveLocalModel(context.Background(), DefaultRegistry, "gpt-5", servers, nil); err != nil || r != DefaultRegistry {
+		t.Errorf("ResolveLocalModel(gpt-5) = %v, %v", r, err)
+	}
+
+	_, err = ResolveLocalModel(context.Background(), DefaultRegistry, "mistral", servers, nil)
+	if !errors.Is(err, ErrNotLocal) || !strings.Contains(err.Error(), "have llama3.1:latest, qwen3:32b") {
+		t.Errorf("ResolveLocalModel(mistral) error = %v, want the available models", err)
+	}
+
+	// a server that answers badly isn't taken to lack the model
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+	servers = append(servers, LocalServer{Kind: LMStudio, URL: broken.URL})
+	r, err = ResolveLocalModel(context.Background(), DefaultRegistry, "mistral", servers, nil)
+	if err == nil || errors.Is(err, ErrNotLocal) || r != DefaultRegistry {
+		t.Errorf("ResolveLocalModel(mistral) = %v, %v; want the server's error", r, err)
+	}
+}
+
+func TestProbeCache(t *testing.T) {
+	srv := llmtest.NewServer(llmtest.Reply(`{"ok": true}`), llmtest.Reply(`{"ok": true}`))
+	defer srv.Close()
+	cache := &ProbeCache{Path: filepath.Join(t.TempDir(), "probes.json"), TTL: time.Hour}
+
+	for range 2 {
+		m := LocalModel{Name: "llama3.1", APIBase: srv.URL + "/v1"}
+		if err := cache.Probe(context.Background(), &m); err != nil {
+			t.Fatalf("Probe() error = %v", err)
+		}
+		if !m.StructuredOutput {
+			t.Errorf("StructuredOutput = false, want true")
+		}
+	}
+	if n := len(srv.Requests()); n != 1 {
+		t.Errorf("probed %d times, want once", n)
+	}
+
+	// stale results are probed again
+	cache.TTL = 0
+	m := LocalModel{Name: "llama3.1", APIBase: srv.URL + "/v1"}
+	if err := cache.Probe(context.Background(), &m); err != nil || !m.StructuredOutput {
+		t.Errorf("Probe() = %v, %v", m.StructuredOutput, err)
+	}
+	if n := len(srv.Requests()); n != 2 {
+		t.Errorf("probed %d times, want twice", n)
+	}
+}
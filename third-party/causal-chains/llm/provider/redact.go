@@ -0,0 +1,153 @@
+package provider
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const redacted = "[REDACTED]"
+
+var (
+	secretsMu sync.RWMutex
+	secrets   []string
+)
+
+// AddSecret registers a secret for Redact to scrub.  Values too short
+// to be keys are ignored, as scrubbing them would mangle ordinary text.
+func AddSecret(secret string) {
+	if len(secret) < 8 {
+		return
+	}
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	if !slices.Contains(secrets, secret) {
+		secrets = append(secrets, secret)
+	}
+}
+
+// secretPatterns catch keys that were never registered, like ones
+// echoed back in a provider's error.  The first group of each pattern,
+// if any, is kept.
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`sk-[A-Za-z0-9_\-]{16,}`),
+	regexp.MustCompile(`AIza[0-9A-Za-z_\-]{30,}`),
+	regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/\-]{16,}=*`),
+	regexp.MustCompile(`(?i)((?:x-api-key|x-goog-api-key|api[_-]?key)"?\s*[:=]\s*"?)[^\s"'&,}]{8,}`),
+	regexp.MustCompile(`([?&]key=)[^&\s"]+`),
+}
+
+// keyValuePattern catches other settings named like keys, such as
+// anthropicKey=..., whose values are redacted only if they look like
+// secrets, so that prose like "monkey: ..." is left alone.
+var keyValuePattern = regexp.MustCompile(`(?i)([a-z]+key"?\s*[:=]\s*"?)([A-Za-z0-9._~+/\-]+)`)
+
+// looksLikeSecret reports whether s is long and mixes letters and
+// digits, as keys do and words don't.
+func looksLikeSecret(s string) bool {
+	return len(s) >= 16 && strings.ContainsAny(s, "0123456789") && strings.IndexFunc(s, unicode.IsLetter) >= 0
+}
+
+// Redact returns s with registered secrets and anything that looks like
+// an API key replaced by [REDACTED].
+func Redact(s string) string {
+	secretsMu.RLock()
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	secretsMu.RUnlock()
+
+	for _, re := range secretPatterns {
+		s = re.ReplaceAllStringFunc(s, func(match string) string {
+			groups := re.FindStringSubmatch(match)
+			if len(groups) > 1 {
+				return groups[1] + redacted
+			}
+			return redacted
+		})
+	}
+	return keyValuePattern.ReplaceAllStringFunc(s, func(match string) string {
+		groups := keyValuePattern.FindStringSubmatch(match)
+		if !looksLikeSecret(groups[2]) {
+			return match
+		}
+		return groups[1] + redacted
+	})
+}
+
+// RedactError returns err with its message redacted.  errors.Is and
+// errors.As still see the original error.
+func RedactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return redactedError{err}
+}
+
+type redactedError struct {
+	err error
+}
+
+func (e redactedError) Error() string { return Redact(e.err.Error()) }
+func (e redactedError) Unwrap() error { return e.err }
+
+// RedactWriter returns a writer that redacts what is written to w.
+// Secrets split across writes aren't caught, so it suits writers that
+// are given whole lines, like a log.Logger's.
+func RedactWriter(w io.Writer) io.Writer {
+	return redactWriter{w}
+}
+
+type redactWriter struct {
+	w io.Writer
+}
+
+func (w redactWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// RedactDir redacts the files under dir modified since the given time
+// in place, such as the transcripts chat.WithDebugDir leaves behind.
+// Everything in dir is rewritten, so it should hold nothing else.
+func RedactDir(dir string, since time.Time) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().Before(since) {
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("os.ReadFile: %w", err)
+		}
+		clean := []byte(Redact(string(data)))
+		if bytes.Equal(clean, data) {
+			return nil
+		}
+		if err := os.WriteFile(path, clean, info.Mode().Perm()); err != nil {
+			return fmt.Errorf("os.WriteFile: %w", err)
+		}
+		return nil
+	})
+}
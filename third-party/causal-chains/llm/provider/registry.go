@@ -0,0 +1,177 @@
+package provider
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Provider is the service (or local server) that hosts a model.
+type Provider string
+
+const (
+	ProviderAnthropic Provider = "anthropic"
+	ProviderGoogle    Provider = "google"
+	ProviderOpenAI    Provider = "openai"
+	// ProviderOllama is any local OpenAI-compatible server, and the
+	// provider of models the registry doesn't know.
+	ProviderOllama Provider = "ollama"
+)
+
+// APIStyle is which of OpenAI's APIs a model is served through.
+type APIStyle string
+
+const (
+	ChatCompletionsAPI APIStyle = "chat_completions"
+	ResponsesAPI       APIStyle = "responses"
+)
+
+// ModelInfo describes a model, or a family of models when Name is a
+// glob pattern like "claude-*".
+type ModelInfo struct {
+	Name     string   `json:"name"`
+	Provider Provider `json:"provider"`
+	// APIBase overrides the provider's default endpoint.
+	APIBase string   `json:"apiBase,omitzero"`
+	API     APIStyle `json:"api,omitzero"`
+	// StructuredOutput is whether the model reliably honors a JSON
+	// schema response format.
+	StructuredOutput bool `json:"structuredOutput,omitzero"`
+	// Thinking is whether the model can reason before answering; see
+	// ResolveThinking.
+	Thinking bool `json:"thinking,omitzero"`
+	// ThinkingOff is whether a thinking model can have thinking turned
+	// off entirely, like Gemini 2.5 Flash with a thinking budget of 0.
+	ThinkingOff bool `json:"thinkingOff,omitzero"`
+	// OutputStrategy is how the model returns its map: "json_schema"
+	// (the default), "prompted_tool" for a single tool call, or
+	// "chains" for a tool call per chain; see causal.OutputStrategy.
+	OutputStrategy  string `json:"outputStrategy,omitzero"`
+	ContextWindow   int    `json:"contextWindow,omitzero"`
+	MaxOutputTokens int    `json:"maxOutputTokens,omitzero"`
+	// Limits budgets requests made with the model's provider and API
+	// key; see SharedLimiter.
+	Limits Limits `json:"limits,omitzero"`
+	// Aliases are other names the model can be requested by.
+	Aliases []string `json:"aliases,omitzero"`
+}
+
+func (m *ModelInfo) isPattern() bool {
+	return strings.ContainsAny(m.Name, "*?[")
+}
+
+// Registry maps model names onto what we know about them.
+type Registry struct {
+	Models []ModelInfo `json:"models"`
+}
+
+//go:embed models.json
+var defaultModelsJSON []byte
+
+// DefaultRegistry is the registry built into the binary.
+var DefaultRegistry = mustParseRegistry(defaultModelsJSON)
+
+func mustParseRegistry(data []byte) *Registry {
+	r, err := ParseRegistry(data)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// ParseRegistry parses a registry from its JSON form.
+func ParseRegistry(data []byte) (*Registry, error) {
+	var r Registry
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	for i := range r.Models {
+		m := &r.Models[i]
+		switch m.Provider {
+		case ProviderAnthropic, ProviderGoogle, ProviderOpenAI, ProviderOllama:
+		default:
+			return nil, fmt.Errorf("model %q: unknown provider %q", m.Name, m.Provider)
+		}
+		switch m.API {
+		case "", ChatCompletionsAPI, ResponsesAPI:
+		default:
+			return nil, fmt.Errorf("model %q: unknown api %q", m.Name, m.API)
+		}
+		switch m.OutputStrategy {
+		case "", "json_schema", "prompted_tool", "tool", "chains":
+		default:
+			return nil, fmt.Errorf("model %q: unknown output strategy %q", m.Name, m.OutputStrategy)
+		}
+		if l := m.Limits; l.RequestsPerMinute < 0 || l.TokensPerMinute < 0 || l.MaxInFlight < 0 {
+			return nil, fmt.Errorf("model %q: negative limits", m.Name)
+		}
+		if _, err := path.Match(m.Name, ""); err != nil {
+			return nil, fmt.Errorf("model %q: %w", m.Name, err)
+		}
+	}
+	return &r, nil
+}
+
+// LoadRegistry returns the default registry extended by the user's
+// registry file at path, whose entries take precedence over the
+// built-in ones.  An empty path returns the default registry.
+func LoadRegistry(path string) (*Registry, error) {
+	if path == "" {
+		return DefaultRegistry, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile: %w", err)
+	}
+	user, err := ParseRegistry(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &Registry{Models: slices.Concat(user.Models, DefaultRegistry.Models)}, nil
+}
+
+// Lookup returns what the registry knows about the named model, with
+// Name set to the model's canonical name (resolving aliases and
+// patterns), and whether the model was found.  Exact names and aliases
+// are preferred over patterns; otherwise the first match wins.  Names
+// are matched ignoring case, but the canonical name keeps the case it
+// was written with, since some servers' model ids are case-sensitive.
+// Gemini models may be named with the "models/" prefix its API uses.
+// Unknown models are assumed to be served by a local OpenAI-compatible
+// server.
+func (r *Registry) Lookup(model string) (ModelInfo, bool) {
+	model = strings.TrimSpace(model)
+	if m, ok := r.lookup(model); ok {
+		return m, true
+	}
+	// Gemini's API also names its models "models/gemini-..."
+	if name, ok := strings.CutPrefix(model, "models/"); ok {
+		if m, ok := r.lookup(name); ok && m.Provider == ProviderGoogle {
+			m.Name = "models/" + m.Name
+			return m, true
+		}
+	}
+	return ModelInfo{Name: model, Provider: ProviderOllama, API: ChatCompletionsAPI}, false
+}
+
+func (r *Registry) lookup(model string) (ModelInfo, bool) {
+	name := strings.ToLower(model)
+	for _, m := range r.Models {
+		if !m.isPattern() && (strings.EqualFold(m.Name, name) || slices.ContainsFunc(m.Aliases, func(alias string) bool {
+			return strings.EqualFold(alias, name)
+		})) {
+			return m, true
+		}
+	}
+	for _, m := range r.Models {
+		if ok, _ := path.Match(strings.ToLower(m.Name), name); ok && m.isPattern() {
+			m.Name = model
+			return m, true
+		}
+	}
+	return ModelInfo{}, false
+}
@@ -0,0 +1,122 @@
+package provider
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRegistryLookup(t *testing.T) {
+	tests := []struct {
+		model    string
+		name     string
+		provider Provider
+		api      APIStyle
+		found    bool
+	}{
+		{model: "claude-sonnet-4-5", name: "claude-sonnet-4-5-20250929", provider: ProviderAnthropic, found: true},
+		{model: "claude-3-haiku", name: "claude-3-haiku", provider: ProviderAnthropic, found: true},
+		{model: "Gemini-2.5-Flash", name: "gemini-2.5-flash", provider: ProviderGoogle, found: true},
+		{model: "models/gemini-1.5-pro", name: "models/gemini-1.5-pro", provider: ProviderGoogle, found: true},
+		{model: "models/gemini-2.5-flash", name: "models/gemini-2.5-flash", provider: ProviderGoogle, found: true},
+		{model: "models/llama3.1", name: "models/llama3.1", provider: ProviderOllama, api: ChatCompletionsAPI},
+		{model: "gpt-5-mini", name: "gpt-5-mini", provider: ProviderOpenAI, api: ResponsesAPI, found: true},
+		{model: "o4-mini", name: "o4-mini", provider: ProviderOpenAI, api: ResponsesAPI, found: true},
+		{model: "o1", name: "o1", provider: ProviderOpenAI, api: ResponsesAPI, found: true},
+		{model: "gpt-4.1", name: "gpt-4.1", provider: ProviderOpenAI, api: ChatCompletionsAPI, found: true},
+		{model: "llama3.1", name: "llama3.1", provider: ProviderOllama, api: ChatCompletionsAPI},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			info, found := DefaultRegistry.Lookup(tt.model)
+			if found != tt.found || info.Name != tt.name || info.Provider != tt.provider || info.API != tt.api {
+				t.Errorf("Lookup(%q) = %s/%s/%s (found %v), want %s/%s/%s (found %v)",
+					tt.model, info.Name, info.Provider, info.API, found, tt.name, tt.provider, tt.api, tt.found)
+			}
+		})
+	}
+}
+
+func TestDefaultRegistryLimits(t *testing.T) {
+	info, _ := DefaultRegistry.Lookup("gemini-2.5-pro")
+	if !info.StructuredOutput || info.ContextWindow != 1048576 || info.MaxOutputTokens != 65536 {
+		t.Errorf("unexpected gemini-2.5-pro entry: %+v", info)
+	}
+}
+
+func TestLoadRegistryOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "models.json")
+	err := os.WriteFile(path, []byte(`{"models": [
+		{"name": "qwen3:32b", "provider": "ollama", "apiBase": "http://gpu-box:11434/v1", "contextWindow": 40960, "aliases": ["qwen"]},
+		{"name": "gpt-5*", "provider": "openai", "api": "chat_completions"},
+		{"name": "Org/Model-Name", "provider": "ollama", "aliases": ["Model-Name"]}
+	]}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := LoadRegistry(path)
+	if err != nil {
+		t.Fatalf("LoadRegistry() error = %v", err)
+	}
+
+	info, found := r.Lookup("qwen")
+	if !found || info.Name != "qwen3:32b" || info.APIBase != "http://gpu-box:11434/v1" || info.ContextWindow != 40960 {
+		t.Errorf("Lookup(qwen) = %+v, %v", info, found)
+	}
+	if info, _ := r.Lookup("gpt-5"); info.API != ChatCompletionsAPI {
+		t.Errorf("user entry should override the default gpt-5 entry, got %+v", info)
+	}
+	// names and aliases match ignoring case, but keep the case of the id
+	for _, model := range []string{"org/model-name", "ORG/MODEL-NAME", "model-name"} {
+		if info, found := r.Lookup(model); !found || info.Name != "Org/Model-Name" {
+			t.Errorf("Lookup(%s) = %+v, %v; want Org/Model-Name", model, info, found)
+		}
+	}
+	// defaults are still there
+	if info, _ := r.Lookup("claude-3-haiku"); info.Provider != ProviderAnthropic {
+		t.Errorf("Lookup(claude-3-haiku) = %+v", info)
+	}
+
+	if r, err := LoadRegistry(""); err != nil || r != DefaultRegistry {
+		t.Errorf("LoadRegistry(\"\") = %v, %v; want the default registry", r, err)
+	}
+}
+
+func TestParseRegistryErrors(t *testing.T) {
+	tests := map[string]string{
+		"bad json":     `{"models": [`,
+		"bad provider": `{"models": [{"name": "x", "provider": "acme"}]}`,
+		"bad api":      `{"models": [{"name": "x", "provider": "openai", "api": "grpc"}]}`,
+		"bad pattern":  `{"models": [{"name": "x[", "provider": "openai"}]}`,
+		"bad limits":   `{"models": [{"name": "x", "provider": "openai", "limits": {"maxInFlight": -1}}]}`,
+		"bad strategy": `{"models": [{"name": "x", "provider": "openai", "outputStrategy": "xml"}]}`,
+	}
+
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseRegistry([]byte(data)); err == nil {
+				t.Errorf("ParseRegistry() succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestNewClientUsesRegistry(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "")
+
+	// gpt-5 used to fall through to the local server
+	_, _, err := NewClient(Config{Model: "gpt-5"})
+	if err == nil || !strings.Contains(err.Error(), "OpenAI API key required") {
+		t.Errorf("NewClient(gpt-5) error = %v, want missing OpenAI key", err)
+	}
+
+	r := &Registry{Models: []ModelInfo{{Name: "house-model", Provider: ProviderAnthropic}}}
+	t.Setenv("ANTHROPIC_API_KEY", "")
+	_, _, err = NewClient(Config{Model: "house-model", Registry: r})
+	if err == nil || !strings.Contains(err.Error(), "Anthropic API key required") {
+		t.Errorf("NewClient(house-model) error = %v, want missing Anthropic key", err)
+	}
+}
@@ -0,0 +1,320 @@
+package provider
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bpowers/go-agent/chat"
+)
+
+// ErrorClass is the kind of failure a provider reported.
+type ErrorClass int
+
+const (
+	ErrorUnknown ErrorClass = iota
+	ErrorRateLimited
+	ErrorOverloaded
+	ErrorAuth
+	ErrorInvalidRequest
+	ErrorContextLength
+	// ErrorTransport is a network failure before the provider answered,
+	// like a reset connection or a timed out dial.
+	ErrorTransport
+	// ErrorQuotaExhausted is an account out of credit or over its
+	// billing quota, which waiting won't fix, unlike a rate limit.
+	ErrorQuotaExhausted
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorRateLimited:
+		return "rate limited"
+	case ErrorOverloaded:
+		return "overloaded"
+	case ErrorAuth:
+		return "auth"
+	case ErrorInvalidRequest:
+		return "invalid request"
+	case ErrorContextLength:
+		return "context length"
+	case ErrorTransport:
+		return "transport"
+	case ErrorQuotaExhausted:
+		return "quota exhausted"
+	default:
+		return "unknown"
+	}
+}
+
+// Retryable reports whether a request that failed this way may succeed
+// if sent again unchanged.
+func (c ErrorClass) Retryable() bool {
+	return c == ErrorRateLimited || c == ErrorOverloaded || c == ErrorTransport
+}
+
+// Error is a provider error along with its classification.
+type Error struct {
+	Class ErrorClass
+	// RetryAfter is how long the provider asked us to wait before
+	// retrying, or zero if it didn't say.
+	RetryAfter time.Duration
+	// Attempts is the number of requests made before giving up.
+	Attempts int
+	Err      error
+}
+
+// Error describes the error with any API keys in it redacted, as
+// providers sometimes echo back the request that failed.
+func (e *Error) Error() string {
+	if e.Attempts > 1 {
+		return fmt.Sprintf("%s error after %d attempts: %s", e.Class, e.Attempts, Redact(e.Err.Error()))
+	}
+	return fmt.Sprintf("%s error: %s", e.Class, Redact(e.Err.Error()))
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// contextLengthRe matches the ways providers say a request was too
+// long.  They report it as an invalid request, so it's checked first.
+var contextLengthRe = regexp.MustCompile(`(?i)context[_ ]length|context window|maximum context|prompt is too long|too many tokens|input token count`)
+
+// quotaExhaustedRe matches the ways providers say an account has run
+// out of credit.  OpenAI reports it with a 429 like a rate limit, so
+// it's checked before the status code too.
+var quotaExhaustedRe = regexp.MustCompile(`(?i)insufficient[_ ]quota|exceeded your current quota|credit balance is too low|billing`)
+
+// errorPatterns match the error types that the providers' APIs put in
+// their error messages.  go-agent doesn't expose structured errors, so
+// the message text is often all we have.
+var errorPatterns = []struct {
+	class ErrorClass
+	re    *regexp.Regexp
+}{
+	{ErrorRateLimited, regexp.MustCompile(`(?i)rate[_ ]limit|too many requests|resource[_ ]exhausted|quota`)},
+	{ErrorOverloaded, regexp.MustCompile(`(?i)overloaded|unavailable|server[_ ]error|internal error|bad gateway|gateway timeout`)},
+	{ErrorAuth, regexp.MustCompile(`(?i)unauthori[sz]ed|unauthenticated|authentication|permission[_ ]denied|invalid[_ ]api[_ ]key|incorrect api key`)},
+	{ErrorInvalidRequest, regexp.MustCompile(`(?i)invalid[_ ]request|invalid[_ ]argument|bad request|not[_ ]found`)},
+}
+
+// statusRe finds an HTTP status code in an error message, like
+// "status code 429" or "HTTP 503".
+var statusRe = regexp.MustCompile(`(?i)(?:status|code|http)\D{0,12}\b([45]\d\d)\b`)
+
+var retryAfterPatterns = []*regexp.Regexp{
+	// a Retry-After header echoed into the message
+	regexp.MustCompile(`(?i)retry-after:?\s*"?([0-9.]+)`),
+	// "please retry after 20 seconds", "try again in 1.5s"
+	regexp.MustCompile(`(?i)(?:retry|try again)(?: after| in)\s+([0-9.]+)\s*(s|sec|secs|seconds?|ms)?\b`),
+	// Gemini's RetryInfo detail: "retryDelay": "12s"
+	regexp.MustCompile(`(?i)"retryDelay":\s*"([0-9.]+)(s)"`),
+}
+
+// Classify determines what kind of failure err is.  Errors exposing a
+// StatusCode() int or RetryAfter() time.Duration method are classified
+// from those, and anything else from its message.  The result is the
+// caller's to change, even if err already holds an *Error.
+func Classify(err error) *Error {
+	var perr *Error
+	if errors.As(err, &perr) {
+		e := *perr
+		return &e
+	}
+
+	e := &Error{Err: err, Class: classify(err)}
+
+	var withRetryAfter interface{ RetryAfter() time.Duration }
+	if errors.As(err, &withRetryAfter) {
+		e.RetryAfter = withRetryAfter.RetryAfter()
+	} else {
+		e.RetryAfter = parseRetryAfter(err.Error())
+	}
+
+	return e
+}
+
+func classify(err error) ErrorClass {
+	msg := err.Error()
+
+	var withStatus interface{ StatusCode() int }
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		// the caller gave up; that's not the provider's fault
+		return ErrorUnknown
+	case contextLengthRe.MatchString(msg):
+		return ErrorContextLength
+	case quotaExhaustedRe.MatchString(msg):
+		return ErrorQuotaExhausted
+	case errors.As(err, &withStatus):
+		return classifyStatus(withStatus.StatusCode())
+	case errors.As(err, &netErr), errors.Is(err, io.ErrUnexpectedEOF),
+		strings.Contains(msg, "connection reset"), strings.Contains(msg, "connection refused"):
+		return ErrorTransport
+	}
+
+	if m := statusRe.FindStringSubmatch(msg); m != nil {
+		code, _ := strconv.Atoi(m[1])
+		return classifyStatus(code)
+	}
+	for _, p := range errorPatterns {
+		if p.re.MatchString(msg) {
+			return p.class
+		}
+	}
+	return ErrorUnknown
+}
+
+func classifyStatus(code int) ErrorClass {
+	switch {
+	case code == http.StatusTooManyRequests:
+		return ErrorRateLimited
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return ErrorAuth
+	case code == http.StatusRequestEntityTooLarge:
+		return ErrorContextLength
+	case code >= 500:
+		return ErrorOverloaded
+	case code >= 400:
+		return ErrorInvalidRequest
+	}
+	return ErrorUnknown
+}
+
+// parseRetryAfter finds a Retry-After delay in an error message, either
+// in seconds or as an HTTP date.
+func parseRetryAfter(msg string) time.Duration {
+	for _, re := range retryAfterPatterns {
+		m := re.FindStringSubmatch(msg)
+		if m == nil {
+			continue
+		}
+		n, err := strconv.ParseFloat(m[1], 64)
+		if err != nil {
+			continue
+		}
+		unit := time.Second
+		if len(m) > 2 && m[2] == "ms" {
+			unit = time.Millisecond
+		}
+		return time.Duration(n * float64(unit))
+	}
+
+	if _, date, ok := strings.Cut(msg, "Retry-After: "); ok {
+		if t, err := http.ParseTime(strings.TrimSpace(strings.SplitN(date, "\n", 2)[0])); err == nil {
+			return max(time.Until(t), 0)
+		}
+	}
+	return 0
+}
+
+// RetryPolicy controls how WithRetry retries failed requests.
+type RetryPolicy struct {
+	// MaxAttempts caps the total number of requests, including the
+	// first.
+	MaxAttempts int
+	// BaseDelay is the backoff before the first retry, doubling with
+	// each further retry up to MaxDelay.  The actual delay is drawn
+	// uniformly from zero to the backoff (full jitter) so that many
+	// clients limited at once don't retry in lockstep.
+	BaseDelay time.Duration
+	// MaxDelay is the longest wait before a retry.  A provider asking
+	// for a longer one with Retry-After isn't retried, so that a
+	// fallback model can take over instead.
+	MaxDelay time.Duration
+
+	// sleep waits for d or until ctx is done; tests replace it.
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// DefaultRetryPolicy rides out short rate limits and overloads without
+// making a workshop participant wait more than about a minute.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   time.Second,
+	MaxDelay:    30 * time.Second,
+}
+
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := p.BaseDelay << min(retry, 30)
+	// d <= 0 catches overflow of the shift
+	if d <= 0 || d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return rand.N(d + 1)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// WithRetry wraps a client so that messages failing with a retryable
+// error (rate limits, overloads, and network failures) are resent with
+// exponential backoff, waiting at least as long as any Retry-After the
+// provider sent.  Errors returned from the wrapped client's chats are
+// *Error values carrying their classification.
+func WithRetry(client chat.Client, policy RetryPolicy) chat.Client {
+	policy.MaxAttempts = cmp.Or(policy.MaxAttempts, DefaultRetryPolicy.MaxAttempts)
+	policy.BaseDelay = cmp.Or(policy.BaseDelay, DefaultRetryPolicy.BaseDelay)
+	policy.MaxDelay = cmp.Or(policy.MaxDelay, DefaultRetryPolicy.MaxDelay)
+	if policy.sleep == nil {
+		policy.sleep = sleep
+	}
+	return retryClient{Client: client, policy: policy}
+}
+
+type retryClient struct {
+	chat.Client
+	policy RetryPolicy
+}
+
+func (c retryClient) NewChat(systemPrompt string, initialMsgs ...chat.Message) chat.Chat {
+	return &retryChat{
+		Chat:   c.Client.NewChat(systemPrompt, initialMsgs...),
+		policy: c.policy,
+	}
+}
+
+type retryChat struct {
+	chat.Chat
+	policy RetryPolicy
+}
+
+func (c *retryChat) Message(ctx context.Context, msg chat.Message, opts ...chat.Option) (chat.Message, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := c.Chat.Message(ctx, msg, opts...)
+		if err == nil {
+			return resp, nil
+		}
+
+		perr := Classify(err)
+		perr.Attempts = attempt
+		if !perr.Class.Retryable() || attempt >= c.policy.MaxAttempts || ctx.Err() != nil ||
+			perr.RetryAfter > c.policy.MaxDelay {
+			return chat.Message{}, perr
+		}
+
+		delay := max(perr.RetryAfter, c.policy.backoff(attempt-1))
+		if err := c.policy.sleep(ctx, delay); err != nil {
+			return chat.Message{}, perr
+		}
+	}
+}
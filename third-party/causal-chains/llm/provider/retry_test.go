@@ -0,0 +1,326 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bpowers/go-agent/chat"
+)
+
+type statusError struct {
+	code       int
+	retryAfter time.Duration
+}
+
+func (e statusError) Error() string             { return fmt.Sprintf("request failed with %d", e.code) }
+func (e statusError) StatusCode() int           { return e.code }
+func (e statusError) RetryAfter() time.Duration { return e.retryAfter }
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		class      ErrorClass
+		retryAfter time.Duration
+	}{
+		{
+			name:  "anthropic rate limit",
+			err:   errors.New(`POST "https://api.anthropic.com/v1/messages": 429 Too Many Requests {"type":"error","error":{"type":"rate_limit_error"}}`),
+			class: ErrorRateLimited,
+		},
+		{
+			name:  "anthropic overloaded",
+			err:   errors.New(`status code 529: {"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`),
+			class: ErrorOverloaded,
+		},
+		{
+			name:       "gemini quota with retry delay",
+			err:        errors.New(`googleapi: Error 429: RESOURCE_EXHAUSTED, details: [{"@type": "type.googleapis.com/google.rpc.RetryInfo", "retryDelay": "12s"}]`),
+			class:      ErrorRateLimited,
+			retryAfter: 12 * time.Second,
+		},
+		{
+			name:       "openai rate limit with retry hint",
+			err:        errors.New(`Rate limit reached for gpt-4.1. Please try again in 1.5s.`),
+			class:      ErrorRateLimited,
+			retryAfter: 1500 * time.Millisecond,
+		},
+		{
+			name:  "openai billing quota reported as a rate limit",
+			err:   errors.New(`status code 429: {"error": {"message": "You exceeded your current quota, please check your plan and billing details.", "type": "insufficient_quota"}}`),
+			class: ErrorQuotaExhausted,
+		},
+		{
+			name:  "anthropic out of credit",
+			err:   errors.New(`status code 400: {"type":"error","error":{"type":"invalid_request_error","message":"Your credit balance is too low to access the Anthropic API."}}`),
+			class: ErrorQuotaExhausted,
+		},
+		{
+			name:  "auth",
+			err:   errors.New(`http status 401: invalid x-api-key`),
+			class: ErrorAuth,
+		},
+		{
+			name:  "bad api key",
+			err:   errors.New(`Incorrect API key provided: sk-...`),
+			class: ErrorAuth,
+		},
+		{
+			name:  "context length reported as a bad request",
+			err:   errors.New(`status code 400: This model's maximum context length is 128000 tokens (context_length_exceeded)`),
+			class: ErrorContextLength,
+		},
+		{
+			name:  "invalid request",
+			err:   errors.New(`status code 400: {"error": {"type": "invalid_request_error"}}`),
+			class: ErrorInvalidRequest,
+		},
+		{
+			name:  "numbers that aren't status codes",
+			err:   errors.New(`max_tokens: 500 is too small`),
+			class: ErrorUnknown,
+		},
+		{
+			name:       "structured error",
+			err:        fmt.Errorf("c.Message: %w", statusError{code: 503, retryAfter: 2 * time.Second}),
+			class:      ErrorOverloaded,
+			retryAfter: 2 * time.Second,
+		},
+		{
+			name:  "network",
+			err:   &net.OpError{Op: "dial", Err: errors.New("connection refused")},
+			class: ErrorTransport,
+		},
+		{
+			name:  "canceled",
+			err:   fmt.Errorf("request: %w", context.Canceled),
+			class: ErrorUnknown,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := Classify(tt.err)
+			if e.Class != tt.class {
+				t.Errorf("Classify() class = %s, want %s", e.Class, tt.class)
+			}
+			if e.RetryAfter != tt.retryAfter {
+				t.Errorf("Classify() RetryAfter = %s, want %s", e.RetryAfter, tt.retryAfter)
+			}
+			if !errors.Is(e, tt.err) {
+				t.Errorf("Classify() doesn't wrap the original error")
+			}
+		})
+	}
+}
+
+func TestClassifyCopiesError(t *testing.T) {
+	orig := &Error{Class: ErrorOverloaded, Attempts: 1, Err: errors.New("overloaded")}
+	e := Classify(fmt.Errorf("c.Message: %w", orig))
+	e.Attempts = 3
+	if e.Class != ErrorOverloaded || orig.Attempts != 1 {
+		t.Errorf("Classify() = %+v, and changing it changed the original to %+v", e, orig)
+	}
+}
+
+// fakeClient is the provider tests' stand-in for a model.  Its chats
+// fail with the queued errors first, then answer with the client's name
+// and the message, or "ok" if it has no name.  It records the
+// transcripts its chats were started with and the tools registered on
+// them, and how many messages were in flight at once, each taking
+// delay.
+type fakeClient struct {
+	name  string
+	delay time.Duration
+
+	mu      sync.Mutex
+	errs    []error
+	calls   int
+	started [][]chat.Message
+	tools   []string
+
+	inFlight, maxInFlight atomic.Int32
+}
+
+func (c *fakeClient) NewChat(systemPrompt string, initialMsgs ...chat.Message) chat.Chat {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.started = append(c.started, initialMsgs)
+	return &fakeChat{client: c}
+}
+
+type fakeChat struct {
+	chat.Chat
+	client *fakeClient
+}
+
+func (c *fakeChat) Message(ctx context.Context, msg chat.Message, opts ...chat.Option) (chat.Message, error) {
+	n := c.client.inFlight.Add(1)
+	defer c.client.inFlight.Add(-1)
+	for {
+		m := c.client.maxInFlight.Load()
+		if n <= m || c.client.maxInFlight.CompareAndSwap(m, n) {
+			break
+		}
+	}
+	time.Sleep(c.client.delay)
+
+	c.client.mu.Lock()
+	defer c.client.mu.Unlock()
+	c.client.calls++
+	if len(c.client.errs) > 0 {
+		err := c.client.errs[0]
+		c.client.errs = c.client.errs[1:]
+		return chat.Message{}, err
+	}
+	if c.client.name == "" {
+		return chat.AssistantMessage("ok"), nil
+	}
+	return chat.AssistantMessage(c.client.name + ": " + msg.GetText()), nil
+}
+
+func (c *fakeChat) RegisterTool(tool chat.Tool) error {
+	c.client.mu.Lock()
+	defer c.client.mu.Unlock()
+	c.client.tools = append(c.client.tools, tool.Name())
+	return nil
+}
+
+func (c *fakeChat) DeregisterTool(name string) {}
+
+func testPolicy(delays *[]time.Duration) RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   time.Second,
+		MaxDelay:    4 * time.Second,
+		sleep: func(ctx context.Context, d time.Duration) error {
+			*delays = append(*delays, d)
+			return ctx.Err()
+		},
+	}
+}
+
+func TestWithRetryRecovers(t *testing.T) {
+	var delays []time.Duration
+	fake := &fakeClient{errs: []error{
+		errors.New("status code 529: overloaded"),
+		statusError{code: 429, retryAfter: 3 * time.Second},
+	}}
+
+	c := WithRetry(fake, testPolicy(&delays)).NewChat("system")
+	resp, err := c.Message(context.Background(), chat.UserMessage("hi"))
+	if err != nil {
+		t.Fatalf("Message() error = %v", err)
+	}
+	if resp.GetText() != "ok" || fake.calls != 3 {
+		t.Fatalf("Message() = %q after %d calls, want ok after 3", resp.GetText(), fake.calls)
+	}
+
+	if len(delays) != 2 {
+		t.Fatalf("slept %d times, want 2", len(delays))
+	}
+	if delays[0] < 0 || delays[0] > time.Second {
+		t.Errorf("first backoff %s outside [0, 1s]", delays[0])
+	}
+	// Retry-After is a floor on the wait
+	if delays[1] != 3*time.Second {
+		t.Errorf("second delay %s, want the 3s Retry-After", delays[1])
+	}
+}
+
+func TestWithRetryDoesNotWaitPastMaxDelay(t *testing.T) {
+	var delays []time.Duration
+	fake := &fakeClient{errs: []error{statusError{code: 429, retryAfter: 10 * time.Second}}}
+
+	c := WithRetry(fake, testPolicy(&delays)).NewChat("system")
+	_, err := c.Message(context.Background(), chat.UserMessage("hi"))
+
+	var perr *Error
+	if !errors.As(err, &perr) {
+		t.Fatalf("Message() error = %v, want *Error", err)
+	}
+	if perr.Class != ErrorRateLimited || perr.RetryAfter != 10*time.Second || fake.calls != 1 || len(delays) != 0 {
+		t.Errorf("got %s, Retry-After %s after %d calls and %d waits, want rate limited, 10s, after one call and no wait",
+			perr.Class, perr.RetryAfter, fake.calls, len(delays))
+	}
+}
+
+func TestWithRetryGivesUp(t *testing.T) {
+	var delays []time.Duration
+	fake := &fakeClient{errs: []error{
+		errors.New("status code 503"),
+		errors.New("status code 503"),
+		errors.New("status code 503"),
+		errors.New("status code 503"),
+	}}
+
+	c := WithRetry(fake, testPolicy(&delays)).NewChat("system")
+	_, err := c.Message(context.Background(), chat.UserMessage("hi"))
+
+	var perr *Error
+	if !errors.As(err, &perr) {
+		t.Fatalf("Message() error = %v, want *Error", err)
+	}
+	if perr.Class != ErrorOverloaded || perr.Attempts != 3 || fake.calls != 3 {
+		t.Errorf("got %s after %d attempts (%d calls), want overloaded after 3", perr.Class, perr.Attempts, fake.calls)
+	}
+}
+
+func TestWithRetryDoesNotRetryPermanentErrors(t *testing.T) {
+	var delays []time.Duration
+	fake := &fakeClient{errs: []error{errors.New("status code 401: unauthorized")}}
+
+	c := WithRetry(fake, testPolicy(&delays)).NewChat("system")
+	_, err := c.Message(context.Background(), chat.UserMessage("hi"))
+	if err == nil || fake.calls != 1 || len(delays) != 0 {
+		t.Fatalf("Message() error = %v after %d calls, want one failed call", err, fake.calls)
+	}
+	if Classify(err).Class != ErrorAuth {
+		t.Errorf("Classify(err) = %s, want auth", Classify(err).Class)
+	}
+}
+
+func TestWithRetryDoesNotRetryExhaustedQuota(t *testing.T) {
+	var delays []time.Duration
+	fake := &fakeClient{errs: []error{errors.New(`status code 429: {"error": {"type": "insufficient_quota"}}`)}}
+
+	c := WithRetry(fake, testPolicy(&delays)).NewChat("system")
+	_, err := c.Message(context.Background(), chat.UserMessage("hi"))
+	if err == nil || fake.calls != 1 || len(delays) != 0 {
+		t.Fatalf("Message() error = %v after %d calls, want one failed call", err, fake.calls)
+	}
+	if !shouldFailOver(err) {
+		t.Errorf("shouldFailOver(%v) = false, want true", err)
+	}
+}
+
+func TestWithRetryStopsWhenCanceled(t *testing.T) {
+	var delays []time.Duration
+	fake := &fakeClient{errs: []error{errors.New("status code 529"), errors.New("status code 529")}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	c := WithRetry(fake, testPolicy(&delays)).NewChat("system")
+	if _, err := c.Message(ctx, chat.UserMessage("hi")); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if fake.calls != 1 {
+		t.Errorf("made %d calls after cancellation, want 1", fake.calls)
+	}
+}
+
+func TestBackoffIsCapped(t *testing.T) {
+	p := RetryPolicy{BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+	for retry := range 70 {
+		if d := p.backoff(retry); d < 0 || d > 5*time.Second {
+			t.Fatalf("backoff(%d) = %s, outside [0, 5s]", retry, d)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package provider
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ThinkingLevel is a provider-independent request for how much a model
+// should reason before answering.
+type ThinkingLevel string
+
+const (
+	// ThinkingDefault leaves the choice to the provider.
+	ThinkingDefault ThinkingLevel = ""
+	ThinkingNone    ThinkingLevel = "none"
+	ThinkingLow     ThinkingLevel = "low"
+	ThinkingMedium  ThinkingLevel = "medium"
+	ThinkingHigh    ThinkingLevel = "high"
+	// ThinkingMax is the most reasoning the model offers.
+	ThinkingMax ThinkingLevel = "max"
+)
+
+// thinkingAliases are other spellings users reach for, mostly
+// providers' own names for the levels.
+var thinkingAliases = map[string]ThinkingLevel{
+	"off":      ThinkingNone,
+	"disabled": ThinkingNone,
+	"minimal":  ThinkingNone,
+	"maximum":  ThinkingMax,
+	"xhigh":    ThinkingMax,
+}
+
+// ParseThinkingLevel normalizes a thinking level, rejecting unknown
+// ones.  The empty string is ThinkingDefault.
+func ParseThinkingLevel(s string) (ThinkingLevel, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	switch level := ThinkingLevel(s); level {
+	case ThinkingDefault, ThinkingNone, ThinkingLow, ThinkingMedium, ThinkingHigh, ThinkingMax:
+		return level, nil
+	}
+	if level, ok := thinkingAliases[s]; ok {
+		return level, nil
+	}
+	return "", fmt.Errorf("unknown thinking level %q (want none, low, medium, high, or max)", s)
+}
+
+// Thinking is a thinking level as it applies to a particular model.
+type Thinking struct {
+	// Requested is the level asked for.
+	Requested ThinkingLevel
+	// Level is the level in effect, which differs from Requested when
+	// the model can't do what was asked.
+	Level ThinkingLevel
+	// Effort is passed to chat.WithReasoningEffort, which the clients
+	// translate into the provider's own setting: OpenAI's reasoning
+	// effort, Anthropic's extended thinking budget, or Gemini's
+	// thinking config.  "" sends no setting.
+	Effort string
+	// Note explains why Level differs from Requested.
+	Note string
+}
+
+func (t Thinking) String() string {
+	level := string(t.Level)
+	if t.Level == ThinkingDefault {
+		level = "default"
+	}
+	if t.Note != "" {
+		return fmt.Sprintf("%s (%s)", level, t.Note)
+	}
+	return level
+}
+
+// ResolveThinking maps a normalized thinking level onto the model.
+// Models on local servers are assumed to understand the level as is.
+func ResolveThinking(level ThinkingLevel, info ModelInfo) Thinking {
+	t := Thinking{Requested: level, Level: level, Effort: string(level)}
+	if level == ThinkingDefault {
+		return t
+	}
+	if level == ThinkingMax {
+		// the clients' effort scales top out at high
+		t.Effort = string(ThinkingHigh)
+	}
+
+	if !info.Thinking && info.Provider != ProviderOllama {
+		t.Level, t.Effort = ThinkingNone, ""
+		if level != ThinkingNone {
+			t.Note = fmt.Sprintf("%s doesn't support thinking", info.Name)
+		}
+		return t
+	}
+
+	switch info.Provider {
+	case ProviderOpenAI:
+		if level == ThinkingNone {
+			if strings.HasPrefix(strings.ToLower(info.Name), "gpt-5") {
+				t.Effort = "minimal"
+			} else {
+				t.Level, t.Effort = ThinkingLow, string(ThinkingLow)
+				t.Note = fmt.Sprintf("the least %s supports", info.Name)
+			}
+		}
+	case ProviderAnthropic:
+		// extended thinking is off unless asked for
+		if level == ThinkingNone {
+			t.Effort = ""
+		}
+	case ProviderGoogle:
+		name := strings.TrimPrefix(strings.ToLower(info.Name), "models/")
+		switch {
+		case level == ThinkingNone && info.ThinkingOff:
+			// the client sends a thinking budget of 0
+		case level == ThinkingNone:
+			t.Level, t.Effort = ThinkingLow, string(ThinkingLow)
+			t.Note = fmt.Sprintf("thinking can't be turned off for %s", info.Name)
+		case level == ThinkingMedium && strings.HasPrefix(name, "gemini-3"):
+			t.Level, t.Effort = ThinkingHigh, string(ThinkingHigh)
+			t.Note = fmt.Sprintf("%s offers only low and high", info.Name)
+		}
+	}
+	return t
+}
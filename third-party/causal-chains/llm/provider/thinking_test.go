@@ -0,0 +1,72 @@
+package provider
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseThinkingLevel(t *testing.T) {
+	tests := map[string]ThinkingLevel{
+		"":        ThinkingDefault,
+		"none":    ThinkingNone,
+		"Off":     ThinkingNone,
+		"minimal": ThinkingNone,
+		"LOW":     ThinkingLow,
+		"medium":  ThinkingMedium,
+		" high ":  ThinkingHigh,
+		"max":     ThinkingMax,
+		"xhigh":   ThinkingMax,
+	}
+	for in, want := range tests {
+		if got, err := ParseThinkingLevel(in); err != nil || got != want {
+			t.Errorf("ParseThinkingLevel(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+
+	for _, in := range []string{"5", "custom-effort", "ultra"} {
+		if _, err := ParseThinkingLevel(in); err == nil || !strings.Contains(err.Error(), "want none, low, medium, high, or max") {
+			t.Errorf("ParseThinkingLevel(%q) error = %v, want unknown level", in, err)
+		}
+	}
+}
+
+func TestResolveThinking(t *testing.T) {
+	tests := []struct {
+		model  string
+		level  ThinkingLevel
+		want   ThinkingLevel
+		effort string
+		str    string
+	}{
+		{"claude-sonnet-4-5", ThinkingDefault, ThinkingDefault, "", "default"},
+		{"claude-sonnet-4-5", ThinkingNone, ThinkingNone, "", "none"},
+		{"claude-sonnet-4-5", ThinkingMedium, ThinkingMedium, "medium", "medium"},
+		{"claude-opus-4-1", ThinkingMax, ThinkingMax, "high", "max"},
+		{"claude-3-haiku", ThinkingHigh, ThinkingNone, "", "none (claude-3-haiku doesn't support thinking)"},
+		{"gpt-5-mini", ThinkingNone, ThinkingNone, "minimal", "none"},
+		{"o3", ThinkingNone, ThinkingLow, "low", "low (the least o3 supports)"},
+		{"gpt-4.1", ThinkingHigh, ThinkingNone, "", "none (gpt-4.1 doesn't support thinking)"},
+		{"gemini-2.5-pro", ThinkingNone, ThinkingLow, "low", "low (thinking can't be turned off for gemini-2.5-pro)"},
+		{"gemini-2.5-flash", ThinkingHigh, ThinkingHigh, "high", "high"},
+		{"models/gemini-2.5-pro", ThinkingHigh, ThinkingHigh, "high", "high"},
+		{"gemini-2.5-flash", ThinkingNone, ThinkingNone, "none", "none"},
+		{"gemini-2.5-flash-lite", ThinkingNone, ThinkingNone, "none", "none"},
+		{"gemini-3-flash-preview", ThinkingMedium, ThinkingHigh, "high", "high (gemini-3-flash-preview offers only low and high)"},
+		{"gemini-3-flash-preview", ThinkingLow, ThinkingLow, "low", "low"},
+		{"qwen3:32b", ThinkingHigh, ThinkingHigh, "high", "high"},
+	}
+	for _, tt := range tests {
+		info, _ := DefaultRegistry.Lookup(tt.model)
+		got := ResolveThinking(tt.level, info)
+		if got.Level != tt.want || got.Effort != tt.effort || got.String() != tt.str || got.Requested != tt.level {
+			t.Errorf("ResolveThinking(%s, %s) = %+v (%q), want %s/%q (%q)", tt.level, tt.model, got, got, tt.want, tt.effort, tt.str)
+		}
+	}
+}
+
+func TestNewClientRejectsUnknownThinkingLevel(t *testing.T) {
+	_, _, err := NewClient(Config{Model: "claude-sonnet-4-5 extreme", APIKey: "sk-ant-test"})
+	if err == nil || !strings.Contains(err.Error(), `unknown thinking level "extreme"`) {
+		t.Errorf("NewClient() error = %v, want unknown thinking level", err)
+	}
+}
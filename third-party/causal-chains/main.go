@@ -1,15 +1,23 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
-	"path"
+	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/UB-IAD/sd-ai/third-party/causal-chains/causal"
+	"github.com/UB-IAD/sd-ai/third-party/causal-chains/corpus"
 	"github.com/UB-IAD/sd-ai/third-party/causal-chains/llm/provider"
 	"github.com/UB-IAD/sd-ai/third-party/causal-chains/sdjson"
 	"github.com/bpowers/go-agent/chat"
@@ -22,6 +30,63 @@ type parameters struct {
 	UnderlyingModel     string `json:"underlyingModel"`
 	ProblemStatement    string `json:"problemStatement"`
 	BackgroundKnowledge string `json:"backgroundKnowledge"`
+	// FallbackModels is a comma-separated list of models to fail over
+	// to if the underlying model's provider is unavailable.
+	FallbackModels string `json:"fallbackModels"`
+	// PromptVersion picks a version of the prompts, and SystemPrompt
+	// and BackgroundPrompt replace its templates, to compare prompts.
+	PromptVersion    string `json:"promptVersion"`
+	SystemPrompt     string `json:"systemPrompt"`
+	BackgroundPrompt string `json:"backgroundPrompt"`
+	// Constraints are structural requirements on the map, like "at
+	// least 3 reinforcing loops; no more than 12 variables", in addition
+	// to those stated in the prompt.
+	Constraints string `json:"constraints"`
+	// SessionID continues a session, or starts one if it is "new".
+	SessionID string `json:"sessionId"`
+	// SessionTurn, if set, branches the session from that turn,
+	// numbered from 1, instead of continuing from its latest.
+	SessionTurn int `json:"sessionTurn"`
+	// Sectors maps the problem by sector; see causal.NewSectorDiagrammer.
+	Sectors bool `json:"sectors"`
+	// SupportsModules is whether the client can handle SD-JSON modules,
+	// which the sectors are returned as if it can.
+	SupportsModules bool `json:"supportsModules"`
+	// Documents are background knowledge in several parts, like
+	// interview transcripts, which are searched along with
+	// BackgroundKnowledge for the parts relevant to the prompt.
+	Documents documents `json:"documents"`
+	// ContextTokens bounds the background knowledge given to the model,
+	// defaulting to corpus.DefaultBudget.
+	ContextTokens int `json:"contextTokens"`
+	// StockFlow, if set, returns a stock and flow skeleton of the map:
+	// "heuristic" classifies its variables by their names, and "model"
+	// has the LLM correct that and give their units.
+	StockFlow string `json:"stockFlow"`
+	// Mode is "cld" for a causal loop diagram, the default, or "sfd"
+	// for a quantitative stock and flow model.
+	Mode string `json:"mode"`
+}
+
+// documents are given as a JSON array of {"name", "text"} objects, or a
+// string holding one, since engine parameters are usually strings.
+type documents []corpus.Document
+
+func (d *documents) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		if strings.TrimSpace(s) == "" {
+			*d = nil
+			return nil
+		}
+		data = []byte(s)
+	}
+	var docs []corpus.Document
+	if err := json.Unmarshal(data, &docs); err != nil {
+		return fmt.Errorf("documents: %w", err)
+	}
+	*d = docs
+	return nil
 }
 
 type input struct {
@@ -33,6 +98,36 @@ type input struct {
 type supportingInfo struct {
 	Title       string `json:"title"`
 	Explanation string `json:"explanation"`
+	// UnderlyingModel is the model that actually answered, which
+	// differs from the requested one after a fallback.
+	UnderlyingModel string `json:"underlyingModel,omitzero"`
+	// ThinkingLevel is the thinking level in effect for that model,
+	// with a note if it isn't the one asked for.
+	ThinkingLevel string `json:"thinkingLevel,omitzero"`
+	// PromptVersion is the version of the prompts used, with a hash
+	// of any overrides.
+	PromptVersion string `json:"promptVersion,omitzero"`
+	// Constraints are the requirements the map was checked against;
+	// any it doesn't meet are among the warnings.
+	Constraints []string `json:"constraints,omitzero"`
+	// SessionID and SessionTurn identify the map within its session,
+	// which is new if the session was branched.
+	SessionID   string `json:"sessionId,omitzero"`
+	SessionTurn int    `json:"sessionTurn,omitzero"`
+	// Sectors are the map's sectors and the variables in each.
+	Sectors []causal.Sector `json:"sectors,omitzero"`
+	// Citations are the passages of the background knowledge that
+	// support each relationship, and which relationships have none.
+	Citations []citation `json:"citations,omitzero"`
+	// Warnings describe problems with the model's response, like a map
+	// salvaged from a response cut off at the output token limit.
+	Warnings []string `json:"warnings,omitzero"`
+}
+
+// citation is a relationship's evidence and the document it is from.
+type citation struct {
+	causal.Citation
+	Location *corpus.Location `json:"location,omitzero"`
 }
 
 type output struct {
@@ -40,23 +135,164 @@ type output struct {
 	Model          sdjson.Model   `json:"model"`
 }
 
-func selectAPIKey(model string, params parameters) string {
-	switch {
-	case strings.HasPrefix(model, "claude-"):
-		return params.AnthropicKey
-	case strings.HasPrefix(model, "models/gemini-") || strings.HasPrefix(model, "gemini-"):
-		return params.GoogleKey
-	default:
-		return params.ApiKey
+func apiKeys(params parameters) map[provider.Provider]string {
+	return map[provider.Provider]string{
+		provider.ProviderAnthropic: params.AnthropicKey,
+		provider.ProviderGoogle:    params.GoogleKey,
+		provider.ProviderOpenAI:    params.ApiKey,
+		provider.ProviderOllama:    params.ApiKey,
+	}
+}
+
+func splitModels(list string) []string {
+	var models []string
+	for _, m := range strings.Split(list, ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			models = append(models, m)
+		}
+	}
+	return models
+}
+
+// loadPrompts loads the prompts the parameters ask for, from
+// SD_AI_PROMPT_DIR or the built-in ones.
+func loadPrompts(params parameters) (*causal.Prompts, error) {
+	p, err := causal.LoadPrompts(os.Getenv("SD_AI_PROMPT_DIR"), params.PromptVersion)
+	if err != nil {
+		return nil, err
+	}
+	return p.WithOverrides(params.SystemPrompt, params.BackgroundPrompt)
+}
+
+// currentModelJSON returns the user's current model as indented
+// SD-JSON, or "" if it is empty.
+func currentModelJSON(m map[string]any) (string, error) {
+	empty := true
+	for _, v := range m {
+		if items, ok := v.([]any); !ok || len(items) > 0 {
+			empty = false
+		}
+	}
+	if empty {
+		return "", nil
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("json.MarshalIndent: %w", err)
+	}
+	return string(data), nil
+}
+
+// gatherBackground returns the background knowledge to prompt with:
+// the parameter as it is if there are no documents and it fits in the
+// budget, or else the chunks of it and the documents most relevant to
+// the prompt, laid out by corpus.Format.
+func gatherBackground(prompt string, params parameters) string {
+	budget := cmp.Or(params.ContextTokens, corpus.DefaultBudget)
+	if len(params.Documents) == 0 && corpus.EstimateTokens(params.BackgroundKnowledge) <= budget {
+		return params.BackgroundKnowledge
 	}
+
+	docs := slices.Clone(params.Documents)
+	if strings.TrimSpace(params.BackgroundKnowledge) != "" {
+		docs = append([]corpus.Document{{Name: "background knowledge", Text: params.BackgroundKnowledge}}, docs...)
+	}
+	query := prompt + "\n" + params.ProblemStatement
+	return corpus.Format(corpus.Select(docs, query, corpus.DefaultChunkTokens, budget))
+}
+
+// backgroundSources identifies the background knowledge and documents
+// given in params, before gatherBackground picks from them, or is ""
+// if there are none.
+func backgroundSources(params parameters) string {
+	if strings.TrimSpace(params.BackgroundKnowledge) == "" && len(params.Documents) == 0 {
+		return ""
+	}
+	h := sha256.New()
+	json.NewEncoder(h).Encode([]any{params.BackgroundKnowledge, params.Documents})
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// openSession returns the session the parameters ask for, or nil if
+// they don't name one.  sources is backgroundSources of the parameters
+// as given, which a continued session's must match, and
+// params.BackgroundKnowledge is as gathered by gatherBackground for a
+// new session.
+func openSession(store causal.SessionStore, params parameters, sources string) (*causal.Session, error) {
+	switch params.SessionID {
+	case "":
+		return nil, nil
+	case "new":
+		return causal.NewSession(causal.SessionParams{
+			Model:               params.UnderlyingModel,
+			FallbackModels:      params.FallbackModels,
+			PromptVersion:       params.PromptVersion,
+			BackgroundKnowledge: params.BackgroundKnowledge,
+			ProblemStatement:    params.ProblemStatement,
+			Sources:             sources,
+		}), nil
+	}
+
+	s, err := store.Load(params.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	// the session keeps the background knowledge it was started with;
+	// giving it again is fine, but giving other knowledge is an error
+	// rather than being ignored
+	if sources != "" && sources != s.Params.Sources {
+		return nil, errors.New("documents and backgroundKnowledge can't be changed once a session has started; start a new session to use others")
+	}
+	if params.SessionTurn > 0 {
+		return s.Branch(params.SessionTurn)
+	}
+	return s, nil
+}
+
+// listLocalModels prints the locally available models, probing each
+// for structured output support, so the engine can offer them.
+func listLocalModels(ctx context.Context) {
+	models, err := provider.DiscoverLocalModels(ctx, provider.DefaultLocalServers())
+	if err != nil {
+		log.Printf("provider.DiscoverLocalModels: %s", err)
+	}
+	if models == nil {
+		models = []provider.LocalModel{}
+	}
+	for i := range models {
+		if err := provider.ProbeStructuredOutput(ctx, &models[i]); err != nil {
+			log.Printf("provider.ProbeStructuredOutput(%s): %s", models[i].Name, err)
+		}
+	}
+
+	outputBytes, err := json.MarshalIndent(models, "", "    ")
+	if err != nil {
+		log.Fatalf("json.MarshalIndent: %s", err)
+	}
+	fmt.Printf("%s\n", string(outputBytes))
 }
 
 func main() {
-	argv := os.Args
-	if len(argv) < 2 {
-		log.Fatalf("usage: %s input_path", argv[0])
+	var limits provider.Limits
+	flag.IntVar(&limits.RequestsPerMinute, "rpm", 0, "maximum `requests` per minute to each provider, overriding the model registry")
+	flag.IntVar(&limits.TokensPerMinute, "tpm", 0, "maximum `tokens` per minute to each provider, overriding the model registry")
+	flag.IntVar(&limits.MaxInFlight, "max-in-flight", 0, "maximum concurrent `requests` to each provider, overriding the model registry")
+	listLocal := flag.Bool("list-local-models", false, "print the models on the local Ollama and LM Studio servers as JSON and exit")
+	flag.Parse()
+	start := time.Now()
+
+	// stderr is shown to users when we fail, so keep keys out of it
+	log.SetOutput(provider.RedactWriter(os.Stderr))
+
+	if *listLocal {
+		listLocalModels(context.Background())
+		return
+	}
+
+	if flag.NArg() < 1 {
+		log.Fatalf("usage: %s [flags] input_path", os.Args[0])
 	}
-	inputPath := argv[1]
+	inputPath := flag.Arg(0)
 	inputBytes, err := os.ReadFile(inputPath)
 	if err != nil {
 		log.Fatalf("os.ReadFile(%q): %s", inputPath, err)
@@ -67,43 +303,231 @@ func main() {
 		log.Fatalf("json.Unmarshal: %s", err)
 	}
 
-	if input.Parameters.ApiKey == "" {
-		input.Parameters.ApiKey = os.Getenv("OPENAI_API_KEY")
+	switch input.Parameters.StockFlow {
+	case "", "heuristic", "model":
+	default:
+		log.Fatalf("unknown stockFlow %q: want heuristic or model", input.Parameters.StockFlow)
 	}
-	if input.Parameters.GoogleKey == "" {
-		input.Parameters.GoogleKey = os.Getenv("GEMINI_API_KEY")
+
+	switch input.Parameters.Mode {
+	case "", "cld":
+	case "sfd":
+		if input.Parameters.SessionID != "" {
+			log.Fatalf("sessions are only for cld mode")
+		}
+	default:
+		log.Fatalf("unknown mode %q: want cld or sfd", input.Parameters.Mode)
 	}
-	if input.Parameters.AnthropicKey == "" {
-		input.Parameters.AnthropicKey = os.Getenv("ANTHROPIC_API_KEY")
+
+	// a new session keeps the background knowledge it was started
+	// with, picked for its first prompt, and a continued one already
+	// has it
+	sources := backgroundSources(input.Parameters)
+	if input.Parameters.SessionID == "" || input.Parameters.SessionID == "new" {
+		input.Parameters.BackgroundKnowledge = gatherBackground(input.Prompt, input.Parameters)
 	}
 
-	model := strings.ToLower(strings.TrimSpace(input.Parameters.UnderlyingModel))
-	c, thinkingLevel, err := provider.NewClient(provider.Config{
-		Model:  input.Parameters.UnderlyingModel,
-		APIKey: selectAPIKey(model, input.Parameters),
-		Debug:  os.Getenv("SD_AI_DEBUG") != "",
-	})
+	var store causal.SessionStore
+	if input.Parameters.SessionID != "" {
+		if store.Dir, err = causal.DefaultSessionDir(); err != nil {
+			log.Fatalf("causal.DefaultSessionDir: %s", err)
+		}
+	}
+	session, err := openSession(store, input.Parameters, sources)
+	if err != nil {
+		log.Fatalf("openSession: %s", err)
+	}
+	if session != nil {
+		// later turns are made with the session's models unless others
+		// are asked for
+		input.Parameters.UnderlyingModel = cmp.Or(input.Parameters.UnderlyingModel, session.Params.Model)
+		input.Parameters.FallbackModels = cmp.Or(input.Parameters.FallbackModels, session.Params.FallbackModels)
+		input.Parameters.PromptVersion = cmp.Or(input.Parameters.PromptVersion, session.Params.PromptVersion)
+		input.Parameters.ProblemStatement = cmp.Or(input.Parameters.ProblemStatement, session.Params.ProblemStatement)
+		// and a map made by sector stays that way
+		if m := session.Map(); m != nil && len(m.Sectors) > 0 {
+			input.Parameters.Sectors = true
+		}
+	}
+
+	prompts, err := loadPrompts(input.Parameters)
+	if err != nil {
+		log.Fatalf("loadPrompts: %s", err)
+	}
+
+	// keys given in the input take precedence over the environment
+	// and secret files
+	creds := provider.NewCredentials(apiKeys(input.Parameters))
+	for _, key := range creds.Keys {
+		provider.AddSecret(key)
+	}
+
+	registry, err := provider.LoadRegistry(os.Getenv("SD_AI_MODEL_REGISTRY"))
+	if err != nil {
+		log.Fatalf("provider.LoadRegistry: %s", err)
+	}
+
+	// models the registry doesn't know may be on a local server
+	probeCache := provider.DefaultProbeCache()
+	for _, model := range append([]string{input.Parameters.UnderlyingModel}, splitModels(input.Parameters.FallbackModels)...) {
+		model, _, _ = strings.Cut(strings.TrimSpace(model), " ")
+		registry, err = provider.ResolveLocalModel(context.Background(), registry, model, provider.DefaultLocalServers(), probeCache)
+		if errors.Is(err, provider.ErrNotLocal) {
+			log.Fatalf("provider.ResolveLocalModel: %s", err)
+		} else if err != nil {
+			// a misbehaving server shouldn't stop a model from elsewhere
+			log.Printf("provider.ResolveLocalModel: %s", err)
+		}
+	}
+
+	cfg := provider.Config{
+		Model:       input.Parameters.UnderlyingModel,
+		Debug:       os.Getenv("SD_AI_DEBUG") != "",
+		Registry:    registry,
+		Fallbacks:   splitModels(input.Parameters.FallbackModels),
+		Credentials: creds,
+		Limits:      limits,
+	}
+	c, reasoningEffort, err := provider.NewClient(cfg)
 	if err != nil {
 		log.Fatalf("provider.NewClient: %s", err)
 	}
 
-	d := causal.NewDiagrammer(c, thinkingLevel)
+	info, thinking, _ := provider.Resolve(cfg)
+	answeredBy := func() string { return info.Name }
+	answeredThinking := func() provider.Thinking { return thinking }
+	if fc, ok := c.(*provider.FallbackClient); ok {
+		answeredBy = fc.AnsweredBy
+		answeredThinking = fc.AnsweredThinking
+	}
 
-	debugDir := path.Dir(inputPath)
+	// retry the whole fallback chain, so an outage fails over at once
+	c = provider.WithRetry(c, provider.DefaultRetryPolicy)
+
+	// the primary model's strategy is used for its fallbacks too
+	strategy, err := causal.ParseOutputStrategy(info.OutputStrategy)
+	if err != nil {
+		log.Fatalf("causal.ParseOutputStrategy: %s", err)
+	}
+	currentModel, err := currentModelJSON(input.CurrentModel)
+	if err != nil {
+		log.Fatalf("currentModelJSON: %s", err)
+	}
+	constraints := causal.ParseConstraints(input.Prompt).Merge(causal.ParseConstraints(input.Parameters.Constraints))
+	opts := []causal.Option{
+		causal.WithOutputStrategy(strategy),
+		causal.WithPrompts(prompts),
+		causal.WithProblemStatement(input.Parameters.ProblemStatement),
+		causal.WithCurrentModel(currentModel),
+		causal.WithConstraints(constraints),
+	}
+	d := causal.NewDiagrammer(c, reasoningEffort, opts...)
+	if input.Parameters.Sectors {
+		d = causal.NewSectorDiagrammer(c, reasoningEffort, opts...)
+	}
+
+	// transcripts get a directory of their own, so that scrubbing them
+	// can't touch anything else next to the input
+	debugDir := strings.TrimSuffix(inputPath, filepath.Ext(inputPath)) + ".debug"
+	if err := os.MkdirAll(debugDir, 0o700); err != nil {
+		log.Fatalf("os.MkdirAll: %s", err)
+	}
 
 	ctx := chat.WithDebugDir(context.Background(), debugDir)
 
-	result, err := d.Generate(ctx, input.Prompt, input.Parameters.BackgroundKnowledge)
+	if input.Parameters.Mode == "sfd" {
+		qm, err := causal.NewModeler(c, reasoningEffort, opts...).Generate(ctx, input.Prompt, input.Parameters.BackgroundKnowledge)
+		if rerr := provider.RedactDir(debugDir, start); rerr != nil {
+			log.Printf("provider.RedactDir: %s", rerr)
+		}
+		if err != nil {
+			log.Fatalf("m.Generate: %s", err)
+		}
+
+		output := new(output)
+		output.SupportingInfo.Title = qm.Title
+		output.SupportingInfo.Explanation = qm.Explanation
+		output.SupportingInfo.UnderlyingModel = answeredBy()
+		output.SupportingInfo.ThinkingLevel = answeredThinking().String()
+		output.SupportingInfo.Warnings = qm.Warnings
+		output.Model = qm.Model
+		printOutput(output)
+		return
+	}
+
+	var result *causal.Map
+	if session != nil {
+		result, err = d.Continue(ctx, session, input.Prompt)
+	} else {
+		result, err = d.Generate(ctx, input.Prompt, input.Parameters.BackgroundKnowledge)
+	}
+	var classes causal.Classification
+	if err == nil && input.Parameters.StockFlow != "" {
+		classes = result.Classify()
+		if input.Parameters.StockFlow == "model" {
+			if classes, err = causal.ClassifyWithModel(ctx, c, reasoningEffort, result, classes); err != nil {
+				result.Warnings = append(result.Warnings, fmt.Sprintf("Classifying the variables with the model failed, so they were classified by name: %v", err))
+				err = nil
+			}
+		}
+	}
+	// scrub the debug transcripts
+	if rerr := provider.RedactDir(debugDir, start); rerr != nil {
+		log.Printf("provider.RedactDir: %s", rerr)
+	}
 	if err != nil {
 		log.Fatalf("d.Generate: %s", err)
 	}
 
+	// sessions keep the background knowledge they were started with
+	background := input.Parameters.BackgroundKnowledge
+	if session != nil {
+		background = session.Params.BackgroundKnowledge
+	}
+	result.Cite(background)
+	result.Warnings = append(result.Warnings, result.PolarityConflicts()...)
+
+	if session != nil {
+		if err := store.Save(session); err != nil {
+			log.Fatalf("store.Save: %s", err)
+		}
+	}
+
 	output := new(output)
 	output.SupportingInfo.Title = result.Title
 	output.SupportingInfo.Explanation = result.Explanation
-	output.Model = result.Compat()
+	output.SupportingInfo.UnderlyingModel = answeredBy()
+	output.SupportingInfo.ThinkingLevel = answeredThinking().String()
+	output.SupportingInfo.Warnings = result.Warnings
+	output.SupportingInfo.PromptVersion = prompts.Version
+	output.SupportingInfo.Constraints = constraints.Strings()
+	if session != nil {
+		output.SupportingInfo.SessionID = session.ID
+		output.SupportingInfo.SessionTurn = len(session.Turns)
+	}
+	output.SupportingInfo.Sectors = result.Sectors
+	if strings.TrimSpace(background) != "" {
+		for _, c := range result.Citations() {
+			cite := citation{Citation: c}
+			if c.Source != nil {
+				cite.Location = corpus.Locate(background, c.Source.Start, c.Source.End)
+			}
+			output.SupportingInfo.Citations = append(output.SupportingInfo.Citations, cite)
+		}
+	}
+	switch {
+	case input.Parameters.StockFlow != "":
+		output.Model = result.StockFlow(classes)
+	case input.Parameters.SupportsModules:
+		output.Model = result.ModularCompat()
+	default:
+		output.Model = result.Compat()
+	}
+	printOutput(output)
+}
 
-	outputBytes, err := json.MarshalIndent(output, "", "    ")
+func printOutput(o *output) {
+	outputBytes, err := json.MarshalIndent(o, "", "    ")
 	if err != nil {
 		log.Fatalf("json.MarshalIndent: %s", err)
 	}
@@ -0,0 +1,354 @@
+// Package diff computes the structural differences between two
+// SD-JSON models: added, removed and renamed variables, added and
+// removed relationships, polarity flips, and equation, unit and type
+// changes.  A Diff can be rendered as a human-readable change log or
+// as an RFC 6902 JSON Patch against the original model.
+package diff
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/UB-IAD/sd-ai/third-party/causal-chains/sdjson"
+)
+
+type Kind int
+
+const (
+	VariableAdded Kind = iota
+	VariableRemoved
+	VariableRenamed
+	VariableTypeChanged
+	EquationChanged
+	UnitsChanged
+	RelationshipAdded
+	RelationshipRemoved
+	PolarityFlipped
+)
+
+func (k Kind) String() string {
+	switch k {
+	case VariableAdded:
+		return "variable_added"
+	case VariableRemoved:
+		return "variable_removed"
+	case VariableRenamed:
+		return "variable_renamed"
+	case VariableTypeChanged:
+		return "variable_type_changed"
+	case EquationChanged:
+		return "equation_changed"
+	case UnitsChanged:
+		return "units_changed"
+	case RelationshipAdded:
+		return "relationship_added"
+	case RelationshipRemoved:
+		return "relationship_removed"
+	case PolarityFlipped:
+		return "polarity_flipped"
+	default:
+		return ""
+	}
+}
+
+func (k Kind) MarshalJSON() ([]byte, error) {
+	return []byte("\"" + k.String() + "\""), nil
+}
+
+var _ json.Marshaler = Kind(0)
+
+// Change is a single semantic difference between two models.
+type Change struct {
+	Kind Kind `json:"kind"`
+	// Variable is the variable the change applies to: its new name,
+	// or its old name if it was removed.
+	Variable string `json:"variable,omitzero"`
+	// From and To identify the relationship the change applies to,
+	// using the new model's names.
+	From string `json:"from,omitzero"`
+	To   string `json:"to,omitzero"`
+	// Old and New are the before and after values: the names for a
+	// rename, polarities for a flip, equations for an equation change,
+	// and so on.
+	Old string `json:"old,omitzero"`
+	New string `json:"new,omitzero"`
+}
+
+func (c Change) String() string {
+	switch c.Kind {
+	case VariableAdded:
+		return fmt.Sprintf("added variable %q", c.Variable)
+	case VariableRemoved:
+		return fmt.Sprintf("removed variable %q", c.Variable)
+	case VariableRenamed:
+		return fmt.Sprintf("renamed variable %q to %q", c.Old, c.New)
+	case VariableTypeChanged:
+		return fmt.Sprintf("changed type of %q from %s to %s", c.Variable, c.Old, c.New)
+	case EquationChanged:
+		return fmt.Sprintf("changed equation of %q from %q to %q", c.Variable, c.Old, c.New)
+	case UnitsChanged:
+		return fmt.Sprintf("changed units of %q from %q to %q", c.Variable, c.Old, c.New)
+	case RelationshipAdded:
+		return fmt.Sprintf("added relationship %q -> %q (%s)", c.From, c.To, c.New)
+	case RelationshipRemoved:
+		return fmt.Sprintf("removed relationship %q -> %q (%s)", c.From, c.To, c.Old)
+	case PolarityFlipped:
+		return fmt.Sprintf("flipped polarity of %q -> %q from %s to %s", c.From, c.To, c.Old, c.New)
+	default:
+		return ""
+	}
+}
+
+// Diff is the difference between an original and an updated model.
+type Diff struct {
+	Changes []Change `json:"changes"`
+
+	old, new sdjson.Model
+	// varPairs maps indexes of matched variables in the old model to
+	// their index in the new model, and relPairs does the same for
+	// relationships.
+	varPairs map[int]int
+	relPairs map[int]int
+}
+
+// Empty reports whether the models are structurally identical.
+func (d *Diff) Empty() bool {
+	return len(d.Changes) == 0 && len(d.Patch()) == 0
+}
+
+// Log returns the change log, one change per line.
+func (d *Diff) Log() string {
+	var b strings.Builder
+	for _, c := range d.Changes {
+		b.WriteString(c.String())
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// key is the identity under which variable names are matched between
+// models: case, whitespace and underscores are not significant.
+func key(name string) string {
+	name = strings.ReplaceAll(name, "_", " ")
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// Models computes the differences between old and new.
+func Models(old, new sdjson.Model) *Diff {
+	d := &Diff{
+		old:      old,
+		new:      new,
+		varPairs: make(map[int]int),
+		relPairs: make(map[int]int),
+	}
+
+	// first match variables by name
+	newByKey := make(map[string]int, len(new.Variables))
+	for i, v := range new.Variables {
+		newByKey[key(v.Name)] = i
+	}
+	matchedNew := make(map[int]bool)
+	for i, v := range old.Variables {
+		if j, ok := newByKey[key(v.Name)]; ok && !matchedNew[j] {
+			d.varPairs[i] = j
+			matchedNew[j] = true
+		}
+	}
+
+	renames := d.matchRenames(matchedNew)
+
+	// rename maps old variable keys to the key of the name they have
+	// in the new model.
+	rename := make(map[string]string, len(old.Variables))
+	for i, j := range d.varPairs {
+		rename[key(old.Variables[i].Name)] = key(new.Variables[j].Name)
+	}
+
+	for i, v := range old.Variables {
+		if _, ok := d.varPairs[i]; !ok {
+			d.add(Change{Kind: VariableRemoved, Variable: v.Name})
+		}
+	}
+	for _, i := range renames {
+		j := d.varPairs[i]
+		d.add(Change{
+			Kind:     VariableRenamed,
+			Variable: new.Variables[j].Name,
+			Old:      old.Variables[i].Name,
+			New:      new.Variables[j].Name,
+		})
+	}
+	for j, v := range new.Variables {
+		if !matchedNew[j] {
+			d.add(Change{Kind: VariableAdded, Variable: v.Name})
+		}
+	}
+
+	for _, i := range sortedKeys(d.varPairs) {
+		ov, nv := old.Variables[i], new.Variables[d.varPairs[i]]
+		if ov.Type != nv.Type {
+			d.add(Change{Kind: VariableTypeChanged, Variable: nv.Name, Old: ov.Type.String(), New: nv.Type.String()})
+		}
+		if ov.Equation != nv.Equation {
+			d.add(Change{Kind: EquationChanged, Variable: nv.Name, Old: ov.Equation, New: nv.Equation})
+		}
+		if ov.Units != nv.Units {
+			d.add(Change{Kind: UnitsChanged, Variable: nv.Name, Old: ov.Units, New: nv.Units})
+		}
+	}
+
+	// then relationships, by their (renamed) endpoints
+	relKey := func(from, to string) string {
+		return from + "\x00" + to
+	}
+	newRels := make(map[string]int, len(new.Relationships))
+	for j, r := range new.Relationships {
+		newRels[relKey(key(r.From), key(r.To))] = j
+	}
+	matchedRels := make(map[int]bool)
+	for i, r := range old.Relationships {
+		from, to := key(r.From), key(r.To)
+		if renamed, ok := rename[from]; ok {
+			from = renamed
+		}
+		if renamed, ok := rename[to]; ok {
+			to = renamed
+		}
+		j, ok := newRels[relKey(from, to)]
+		if !ok || matchedRels[j] {
+			d.add(Change{Kind: RelationshipRemoved, From: r.From, To: r.To, Old: r.Polarity.Symbol()})
+			continue
+		}
+		d.relPairs[i] = j
+		matchedRels[j] = true
+
+		nr := new.Relationships[j]
+		if r.Polarity != nr.Polarity {
+			d.add(Change{Kind: PolarityFlipped, From: nr.From, To: nr.To, Old: r.Polarity.Symbol(), New: nr.Polarity.Symbol()})
+		}
+	}
+	for j, r := range new.Relationships {
+		if !matchedRels[j] {
+			d.add(Change{Kind: RelationshipAdded, From: r.From, To: r.To, New: r.Polarity.Symbol()})
+		}
+	}
+
+	return d
+}
+
+func (d *Diff) add(c Change) {
+	d.Changes = append(d.Changes, c)
+}
+
+func sortedKeys(m map[int]int) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// neighborhood describes a variable by its relationships to other
+// variables, under the names they have in the new model.  Polarity is
+// ignored, as flips are reported separately.
+func neighborhood(m sdjson.Model, name string, rename func(string) string) []string {
+	k := key(name)
+	var sig []string
+	for _, r := range m.Relationships {
+		switch {
+		case key(r.From) == k && key(r.To) != k:
+			sig = append(sig, "->"+rename(key(r.To)))
+		case key(r.To) == k && key(r.From) != k:
+			sig = append(sig, "<-"+rename(key(r.From)))
+		}
+	}
+	slices.Sort(sig)
+	return slices.Compact(sig)
+}
+
+// unmatched marks neighbors that have no counterpart in the new model.
+const unmatched = "\x00"
+
+// matchRenames pairs up unmatched old and new variables that are
+// unambiguously the same variable under a different name: first those
+// with the same type and (non-empty) equation, then those with the same
+// type and exactly the same relationships to variables that have
+// already been matched.  It returns the indexes of the renamed old
+// variables.
+func (d *Diff) matchRenames(matchedNew map[int]bool) []int {
+	byEquation := func(_ sdjson.Model, v sdjson.Variable, _ bool) string {
+		if v.Equation == "" {
+			return ""
+		}
+		return v.Type.String() + "|" + v.Equation
+	}
+
+	byNeighbors := func(m sdjson.Model, v sdjson.Variable, isOld bool) string {
+		rename := func(k string) string {
+			return k
+		}
+		if isOld {
+			toNewKey := make(map[string]string, len(d.varPairs))
+			for i, j := range d.varPairs {
+				toNewKey[key(d.old.Variables[i].Name)] = key(d.new.Variables[j].Name)
+			}
+			rename = func(k string) string {
+				if nk, ok := toNewKey[k]; ok {
+					return nk
+				}
+				return unmatched + k
+			}
+		}
+
+		nbrs := neighborhood(m, v.Name, rename)
+		if len(nbrs) == 0 {
+			return ""
+		}
+		for _, n := range nbrs {
+			// a neighbor without a counterpart in the other model
+			// means the signatures can't match
+			if strings.Contains(n, unmatched) {
+				return ""
+			}
+		}
+		return v.Type.String() + "|" + strings.Join(nbrs, ",")
+	}
+
+	var renamed []int
+	for _, signature := range []func(sdjson.Model, sdjson.Variable, bool) string{byEquation, byNeighbors} {
+		oldSigs := make(map[string][]int)
+		for i, v := range d.old.Variables {
+			if _, ok := d.varPairs[i]; ok {
+				continue
+			}
+			if sig := signature(d.old, v, true); sig != "" {
+				oldSigs[sig] = append(oldSigs[sig], i)
+			}
+		}
+		newSigs := make(map[string][]int)
+		for j, v := range d.new.Variables {
+			if matchedNew[j] {
+				continue
+			}
+			if sig := signature(d.new, v, false); sig != "" {
+				newSigs[sig] = append(newSigs[sig], j)
+			}
+		}
+
+		for sig, olds := range oldSigs {
+			news := newSigs[sig]
+			if len(olds) != 1 || len(news) != 1 {
+				continue
+			}
+			d.varPairs[olds[0]] = news[0]
+			matchedNew[news[0]] = true
+			renamed = append(renamed, olds[0])
+		}
+	}
+	slices.Sort(renamed)
+
+	return renamed
+}
@@ -0,0 +1,202 @@
+package diff
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/UB-IAD/sd-ai/third-party/causal-chains/sdjson"
+)
+
+// apply is a minimal RFC 6902 implementation covering the operations
+// Patch emits, used to check patches against the updated model.
+func apply(t *testing.T, doc any, patch Patch) any {
+	t.Helper()
+
+	for _, op := range patch {
+		tokens := strings.Split(op.Path, "/")[1:]
+		for i, tok := range tokens {
+			tokens[i] = strings.ReplaceAll(strings.ReplaceAll(tok, "~1", "/"), "~0", "~")
+		}
+
+		var value any
+		if len(op.Value) > 0 {
+			require.NoError(t, json.Unmarshal(op.Value, &value))
+		}
+
+		var set func(node any, tokens []string) any
+		set = func(node any, tokens []string) any {
+			tok := tokens[0]
+			last := len(tokens) == 1
+			switch n := node.(type) {
+			case map[string]any:
+				if !last {
+					n[tok] = set(n[tok], tokens[1:])
+					return n
+				}
+				if op.Op == "remove" {
+					_, ok := n[tok]
+					require.True(t, ok, "remove of missing member %s", op.Path)
+					delete(n, tok)
+				} else {
+					n[tok] = value
+				}
+				return n
+			case []any:
+				if last && tok == "-" {
+					require.Equal(t, "add", op.Op)
+					return append(n, value)
+				}
+				i, err := strconv.Atoi(tok)
+				require.NoError(t, err)
+				require.Less(t, i, len(n), "index out of range in %s", op.Path)
+				if !last {
+					n[i] = set(n[i], tokens[1:])
+					return n
+				}
+				switch op.Op {
+				case "remove":
+					return append(n[:i], n[i+1:]...)
+				case "replace":
+					n[i] = value
+					return n
+				default:
+					return append(n[:i], append([]any{value}, n[i:]...)...)
+				}
+			default:
+				t.Fatalf("can't apply %s %s", op.Op, op.Path)
+				return nil
+			}
+		}
+		doc = set(doc, tokens)
+	}
+
+	return doc
+}
+
+func toDoc(t *testing.T, m sdjson.Model) map[string]any {
+	t.Helper()
+	b, err := json.Marshal(m)
+	require.NoError(t, err)
+	var doc map[string]any
+	require.NoError(t, json.Unmarshal(b, &doc))
+	return doc
+}
+
+func assertPatchApplies(t *testing.T, old, new sdjson.Model) {
+	t.Helper()
+
+	d := Models(old, new)
+	patched := apply(t, toDoc(t, old), d.Patch())
+
+	b, err := json.Marshal(patched)
+	require.NoError(t, err)
+	var actual sdjson.Model
+	require.NoError(t, json.Unmarshal(b, &actual))
+
+	assert.ElementsMatch(t, new.Variables, actual.Variables)
+	assert.ElementsMatch(t, new.Relationships, actual.Relationships)
+	assert.Equal(t, new.Specs, actual.Specs)
+	assert.Equal(t, new.Modules, actual.Modules)
+}
+
+var baseModel = sdjson.Model{
+	Variables: []sdjson.Variable{
+		{Name: "population", Type: sdjson.VariableTypeStock, Equation: "100", Units: "people", Inflows: []string{"births"}},
+		{Name: "births", Type: sdjson.VariableTypeFlow, Equation: "population * birth_rate", Units: "people/year"},
+		{Name: "birth_rate", Type: sdjson.VariableTypeAux, Equation: "0.02", Units: "1/year"},
+		{Name: "crowding", Type: sdjson.VariableTypeAux},
+	},
+	Relationships: []sdjson.Relationship{
+		{From: "births", To: "population", Polarity: sdjson.PositivePolarity},
+		{From: "population", To: "births", Polarity: sdjson.PositivePolarity},
+		{From: "birth_rate", To: "births", Polarity: sdjson.PositivePolarity},
+		{From: "population", To: "crowding", Polarity: sdjson.PositivePolarity},
+	},
+}
+
+func TestIdenticalModels(t *testing.T) {
+	d := Models(baseModel, baseModel)
+	assert.True(t, d.Empty())
+	assert.Empty(t, d.Changes)
+	assert.Empty(t, d.Patch())
+	assert.Equal(t, "", d.Log())
+}
+
+func TestNamesMatchIgnoringCaseAndSpacing(t *testing.T) {
+	updated := baseModel
+	updated.Variables = append([]sdjson.Variable(nil), baseModel.Variables...)
+	updated.Variables[2].Name = "Birth Rate"
+
+	d := Models(baseModel, updated)
+	assert.Empty(t, d.Changes)
+	// the display name still changed, and the patch says so
+	assert.Equal(t, Patch{{Op: "replace", Path: "/variables/2/name", Value: json.RawMessage(`"Birth Rate"`)}}, d.Patch())
+}
+
+func TestStructuralChanges(t *testing.T) {
+	updated := sdjson.Model{
+		Variables: []sdjson.Variable{
+			{Name: "population", Type: sdjson.VariableTypeStock, Equation: "100", Units: "persons", Inflows: []string{"births"}},
+			{Name: "births", Type: sdjson.VariableTypeFlow, Equation: "population * fertility", Units: "people/year"},
+			{Name: "fertility", Type: sdjson.VariableTypeAux, Equation: "0.02", Units: "1/year"},
+			{Name: "resources", Type: sdjson.VariableTypeAux},
+		},
+		Relationships: []sdjson.Relationship{
+			{From: "births", To: "population", Polarity: sdjson.PositivePolarity},
+			{From: "population", To: "births", Polarity: sdjson.PositivePolarity},
+			{From: "fertility", To: "births", Polarity: sdjson.NegativePolarity},
+			{From: "resources", To: "births", Polarity: sdjson.PositivePolarity},
+		},
+		Specs: sdjson.Specs{StartTime: 0, StopTime: 50, TimeUnits: "years"},
+	}
+
+	d := Models(baseModel, updated)
+
+	assert.Equal(t, []Change{
+		{Kind: VariableRemoved, Variable: "crowding"},
+		{Kind: VariableRenamed, Variable: "fertility", Old: "birth_rate", New: "fertility"},
+		{Kind: VariableAdded, Variable: "resources"},
+		{Kind: UnitsChanged, Variable: "population", Old: "people", New: "persons"},
+		{Kind: EquationChanged, Variable: "births", Old: "population * birth_rate", New: "population * fertility"},
+		{Kind: PolarityFlipped, From: "fertility", To: "births", Old: "+", New: "-"},
+		{Kind: RelationshipRemoved, From: "population", To: "crowding", Old: "+"},
+		{Kind: RelationshipAdded, From: "resources", To: "births", New: "+"},
+	}, d.Changes)
+
+	assert.Contains(t, d.Log(), `renamed variable "birth_rate" to "fertility"`)
+	assert.Contains(t, d.Log(), `flipped polarity of "fertility" -> "births" from + to -`)
+
+	assertPatchApplies(t, baseModel, updated)
+}
+
+func TestTypeChange(t *testing.T) {
+	updated := baseModel
+	updated.Variables = append([]sdjson.Variable(nil), baseModel.Variables...)
+	updated.Variables[3].Type = sdjson.VariableTypeStock
+
+	d := Models(baseModel, updated)
+	assert.Equal(t, []Change{
+		{Kind: VariableTypeChanged, Variable: "crowding", Old: "variable", New: "stock"},
+	}, d.Changes)
+
+	assertPatchApplies(t, baseModel, updated)
+}
+
+func TestPatchFromAndToEmpty(t *testing.T) {
+	assertPatchApplies(t, sdjson.Model{}, baseModel)
+	assertPatchApplies(t, baseModel, sdjson.Model{})
+
+	d := Models(sdjson.Model{}, baseModel)
+	assert.Len(t, d.Changes, len(baseModel.Variables)+len(baseModel.Relationships))
+}
+
+func TestChangeJSON(t *testing.T) {
+	b, err := json.Marshal(Change{Kind: PolarityFlipped, From: "a", To: "b", Old: "+", New: "-"})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"kind": "polarity_flipped", "from": "a", "to": "b", "old": "+", "new": "-"}`, string(b))
+}
@@ -0,0 +1,147 @@
+package diff
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// Operation is a single RFC 6902 JSON Patch operation.
+type Operation struct {
+	Op    string          `json:"op"` // "add", "remove", or "replace"
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitzero"`
+}
+
+// Patch is an RFC 6902 JSON Patch document.
+type Patch []Operation
+
+// pointerEscape escapes a JSON Pointer reference token (RFC 6901).
+func pointerEscape(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
+
+func mustMarshal(v any) json.RawMessage {
+	b, err := json.Marshal(v)
+	if err != nil {
+		// sdjson types always marshal successfully
+		panic(fmt.Errorf("json.Marshal: %w", err))
+	}
+	return b
+}
+
+func fields(v any) map[string]json.RawMessage {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(mustMarshal(v), &m); err != nil {
+		panic(fmt.Errorf("json.Unmarshal: %w", err))
+	}
+	return m
+}
+
+// objectOps appends the operations that turn the JSON object old into
+// new, at the given path.
+func objectOps(ops Patch, path string, old, new any) Patch {
+	of, nf := fields(old), fields(new)
+
+	names := make([]string, 0, len(of)+len(nf))
+	for name := range of {
+		names = append(names, name)
+	}
+	for name := range nf {
+		if _, ok := of[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		p := path + "/" + pointerEscape(name)
+		ov, inOld := of[name]
+		nv, inNew := nf[name]
+		switch {
+		case inOld && !inNew:
+			ops = append(ops, Operation{Op: "remove", Path: p})
+		case !inOld && inNew:
+			ops = append(ops, Operation{Op: "add", Path: p, Value: nv})
+		case !bytes.Equal(ov, nv):
+			ops = append(ops, Operation{Op: "replace", Path: p, Value: nv})
+		}
+	}
+	return ops
+}
+
+// arrayOps appends the operations that turn the array at path into the
+// new array, given which old elements are matched to which new ones.
+// Matched elements are patched in place, unmatched old elements are
+// removed (from the highest index down so that indexes stay valid) and
+// unmatched new elements are appended, so the patched array has the
+// same elements as the new one but not necessarily in the same order.
+func arrayOps[T any](ops Patch, path string, old, new []T, pairs map[int]int) Patch {
+	switch {
+	case len(old) == 0 && len(new) == 0:
+		return ops
+	case len(old) == 0:
+		// the array is omitted from the JSON when it is empty
+		return append(ops, Operation{Op: "add", Path: path, Value: mustMarshal(new)})
+	case len(new) == 0:
+		return append(ops, Operation{Op: "remove", Path: path})
+	}
+
+	for _, i := range sortedKeys(pairs) {
+		ops = objectOps(ops, fmt.Sprintf("%s/%d", path, i), old[i], new[pairs[i]])
+	}
+
+	for i := len(old) - 1; i >= 0; i-- {
+		if _, ok := pairs[i]; !ok {
+			ops = append(ops, Operation{Op: "remove", Path: fmt.Sprintf("%s/%d", path, i)})
+		}
+	}
+
+	matched := make(map[int]bool, len(pairs))
+	for _, j := range pairs {
+		matched[j] = true
+	}
+	for j, e := range new {
+		if !matched[j] {
+			ops = append(ops, Operation{Op: "add", Path: path + "/-", Value: mustMarshal(e)})
+		}
+	}
+
+	return ops
+}
+
+// valueOps appends the operation that turns the (possibly omitted)
+// member at path from old into new.
+func valueOps(ops Patch, path string, old, new any) Patch {
+	ob, nb := mustMarshal(old), mustMarshal(new)
+	if bytes.Equal(ob, nb) {
+		return ops
+	}
+
+	// mirror sdjson's omitzero tags: the zero value isn't serialized
+	oz, nz := reflect.ValueOf(old).IsZero(), reflect.ValueOf(new).IsZero()
+	switch {
+	case oz:
+		return append(ops, Operation{Op: "add", Path: path, Value: nb})
+	case nz:
+		return append(ops, Operation{Op: "remove", Path: path})
+	default:
+		return append(ops, Operation{Op: "replace", Path: path, Value: nb})
+	}
+}
+
+// Patch returns an RFC 6902 JSON Patch that, applied to the original
+// model's JSON, produces the updated model.  Matched variables and
+// relationships are patched in place, so element order may differ from
+// the updated model's.
+func (d *Diff) Patch() Patch {
+	var ops Patch
+	ops = arrayOps(ops, "/variables", d.old.Variables, d.new.Variables, d.varPairs)
+	ops = arrayOps(ops, "/relationships", d.old.Relationships, d.new.Relationships, d.relPairs)
+	ops = valueOps(ops, "/specs", d.old.Specs, d.new.Specs)
+	ops = valueOps(ops, "/modules", d.old.Modules, d.new.Modules)
+	return ops
+}
@@ -0,0 +1,125 @@
+// Package equation parses the equations attached to SD-JSON variables.
+//
+// The accepted syntax is the common subset of XMILE and Vensim
+// equations that sd-ai's engines produce: arithmetic and comparison
+// operators, AND/OR/NOT, IF ... THEN ... ELSE, function calls, array
+// subscripts, and variable names that may contain spaces, underscores,
+// or be double-quoted.
+package equation
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Node is a node in a parsed equation.
+type Node interface {
+	node()
+}
+
+// Number is a numeric literal.
+type Number struct {
+	Value float64
+}
+
+// Ident is a reference to a variable (or a zero-argument builtin like
+// TIME or DT).
+type Ident struct {
+	Name       string
+	Subscripts []string
+}
+
+// Call is a function call, with the function name upper-cased and
+// spaces replaced by underscores (IF THEN ELSE -> IF_THEN_ELSE).
+type Call struct {
+	Func string
+	Args []Node
+}
+
+// Unary is a prefix operator: "-", "+", or "NOT".
+type Unary struct {
+	Op string
+	X  Node
+}
+
+// Binary is an infix operator: one of + - * / // ^ MOD = <> < <= > >=
+// AND OR.
+type Binary struct {
+	Op   string
+	L, R Node
+}
+
+// If is an IF cond THEN a ELSE b expression.
+type If struct {
+	Cond, Then, Else Node
+}
+
+func (Number) node() {}
+func (Ident) node()  {}
+func (Call) node()   {}
+func (Unary) node()  {}
+func (Binary) node() {}
+func (If) node()     {}
+
+// Parse parses an equation.
+func Parse(eqn string) (Node, error) {
+	toks, err := lex(eqn)
+	if err != nil {
+		return nil, err
+	}
+	p := parser{toks: toks}
+	n, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at offset %d", t.text, t.pos)
+	}
+	return n, nil
+}
+
+// NormalizeName returns the key under which variable names are
+// compared in equations: case-insensitive, with runs of whitespace and
+// underscores equivalent to a single space.
+func NormalizeName(name string) string {
+	name = strings.Trim(name, `"`)
+	name = strings.NewReplacer("_", " ", `\n`, " ", `\r`, " ").Replace(name)
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// Walk calls fn for n and each of its descendants, depth first.
+func Walk(n Node, fn func(Node)) {
+	if n == nil {
+		return
+	}
+	fn(n)
+	switch n := n.(type) {
+	case Call:
+		for _, arg := range n.Args {
+			Walk(arg, fn)
+		}
+	case Unary:
+		Walk(n.X, fn)
+	case Binary:
+		Walk(n.L, fn)
+		Walk(n.R, fn)
+	case If:
+		Walk(n.Cond, fn)
+		Walk(n.Then, fn)
+		Walk(n.Else, fn)
+	}
+}
+
+// Idents returns the names referenced in an equation, in order of
+// first appearance and without duplicates.
+func Idents(n Node) []string {
+	var names []string
+	seen := make(map[string]bool)
+	Walk(n, func(n Node) {
+		if id, ok := n.(Ident); ok && !seen[NormalizeName(id.Name)] {
+			seen[NormalizeName(id.Name)] = true
+			names = append(names, id.Name)
+		}
+	})
+	return names
+}
@@ -0,0 +1,94 @@
+package equation
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		eqn  string
+		want Node
+	}{
+		{
+			eqn:  "population * birth_rate",
+			want: Binary{Op: "*", L: Ident{Name: "population"}, R: Ident{Name: "birth_rate"}},
+		},
+		{
+			eqn: "1 + 2 * 3 ^ 2",
+			want: Binary{Op: "+", L: Number{Value: 1}, R: Binary{
+				Op: "*", L: Number{Value: 2}, R: Binary{Op: "^", L: Number{Value: 3}, R: Number{Value: 2}},
+			}},
+		},
+		{
+			eqn:  "Teacup Temperature - \"Room Temperature\"",
+			want: Binary{Op: "-", L: Ident{Name: "Teacup Temperature"}, R: Ident{Name: "Room Temperature"}},
+		},
+		{
+			eqn:  "-x ^ 2",
+			want: Unary{Op: "-", X: Binary{Op: "^", L: Ident{Name: "x"}, R: Number{Value: 2}}},
+		},
+		{
+			eqn:  "a // b",
+			want: Binary{Op: "//", L: Ident{Name: "a"}, R: Ident{Name: "b"}},
+		},
+		{
+			eqn: "IF stock > 0 AND NOT open THEN 1 ELSE 0",
+			want: If{
+				Cond: Binary{Op: "AND",
+					L: Binary{Op: ">", L: Ident{Name: "stock"}, R: Number{Value: 0}},
+					R: Unary{Op: "NOT", X: Ident{Name: "open"}},
+				},
+				Then: Number{Value: 1},
+				Else: Number{Value: 0},
+			},
+		},
+		{
+			eqn: "IF THEN ELSE(x <> 1, SMOOTH(y, 3), 1.5e2)",
+			want: Call{Func: "IF_THEN_ELSE", Args: []Node{
+				Binary{Op: "<>", L: Ident{Name: "x"}, R: Number{Value: 1}},
+				Call{Func: "SMOOTH", Args: []Node{Ident{Name: "y"}, Number{Value: 3}}},
+				Number{Value: 150},
+			}},
+		},
+		{
+			eqn:  "effect of price(price[North, Small])",
+			want: Call{Func: "EFFECT_OF_PRICE", Args: []Node{Ident{Name: "price", Subscripts: []string{"North", "Small"}}}},
+		},
+		{
+			eqn:  "TIME()",
+			want: Call{Func: "TIME"},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.eqn, func(t *testing.T) {
+			n, err := Parse(tt.eqn)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, n)
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, eqn := range []string{"", "a +", "(a", "a b)", "IF a THEN b", `"unterminated`, "a # b", "f(a,"} {
+		t.Run(eqn, func(t *testing.T) {
+			_, err := Parse(eqn)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestIdents(t *testing.T) {
+	n, err := Parse("MAX(Birth_Rate * population, birth rate + TIME)")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Birth_Rate", "population", "TIME"}, Idents(n))
+}
+
+func TestNormalizeName(t *testing.T) {
+	assert.Equal(t, "birth rate", NormalizeName("Birth_Rate"))
+	assert.Equal(t, "birth rate", NormalizeName(`"birth  rate"`))
+	assert.Equal(t, "heat loss to room", NormalizeName(`Heat Loss\nto Room`))
+}
@@ -0,0 +1,370 @@
+package equation
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokWord
+	tokQuoted
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+var keywords = map[string]bool{
+	"AND":  true,
+	"OR":   true,
+	"NOT":  true,
+	"IF":   true,
+	"THEN": true,
+	"ELSE": true,
+	"MOD":  true,
+}
+
+// opAliases maps C-style spellings onto the canonical operators.
+var opAliases = map[string]string{
+	"==": "=",
+	"!=": "<>",
+	"&&": "AND",
+	"||": "OR",
+	"!":  "NOT",
+}
+
+func isWordStart(r rune) bool {
+	return unicode.IsLetter(r) || r == '_' || r == '$'
+}
+
+func isWordPart(r rune) bool {
+	return isWordStart(r) || unicode.IsDigit(r) || r == '.' || r == '\''
+}
+
+func lex(s string) ([]token, error) {
+	var toks []token
+	rs := []rune(s)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '\\' && i+1 < len(rs) && (rs[i+1] == 'n' || rs[i+1] == 'r'):
+			// escaped line breaks in names exported from diagram editors
+			i += 2
+		case unicode.IsDigit(r) || (r == '.' && i+1 < len(rs) && unicode.IsDigit(rs[i+1])):
+			start := i
+			for i < len(rs) && (unicode.IsDigit(rs[i]) || rs[i] == '.') {
+				i++
+			}
+			if i < len(rs) && (rs[i] == 'e' || rs[i] == 'E') {
+				j := i + 1
+				if j < len(rs) && (rs[j] == '+' || rs[j] == '-') {
+					j++
+				}
+				if j < len(rs) && unicode.IsDigit(rs[j]) {
+					for i = j; i < len(rs) && unicode.IsDigit(rs[i]); i++ {
+					}
+				}
+			}
+			toks = append(toks, token{kind: tokNumber, text: string(rs[start:i]), pos: start})
+		case isWordStart(r):
+			start := i
+			for i < len(rs) && isWordPart(rs[i]) {
+				i++
+			}
+			toks = append(toks, token{kind: tokWord, text: string(rs[start:i]), pos: start})
+		case r == '"':
+			start := i
+			end := strings.IndexRune(string(rs[i+1:]), '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quoted name at offset %d", start)
+			}
+			name := []rune(string(rs[i+1:])[:end])
+			i += len(name) + 2
+			toks = append(toks, token{kind: tokQuoted, text: string(name), pos: start})
+		default:
+			start := i
+			op := string(r)
+			if i+1 < len(rs) {
+				switch two := string(rs[i : i+2]); two {
+				case "//", "<>", "<=", ">=", "==", "!=", "&&", "||":
+					op = two
+				}
+			}
+			if !strings.Contains("+-*/^=<>(),[]!", string(r)) && len([]rune(op)) == 1 {
+				return nil, fmt.Errorf("unexpected character %q at offset %d", r, start)
+			}
+			i += len([]rune(op))
+			if alias, ok := opAliases[op]; ok {
+				op = alias
+			}
+			toks = append(toks, token{kind: tokOp, text: op, pos: start})
+		}
+	}
+	return append(toks, token{kind: tokEOF, pos: len(rs)}), nil
+}
+
+type parser struct {
+	toks []token
+	i    int
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.i]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+// isOp reports whether t is the operator or keyword op.
+func isOp(t token, op string) bool {
+	switch t.kind {
+	case tokOp:
+		return t.text == op
+	case tokWord:
+		return strings.ToUpper(t.text) == op && keywords[op]
+	}
+	return false
+}
+
+func (p *parser) accept(op string) bool {
+	if isOp(p.peek(), op) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(op string) error {
+	if t := p.next(); !isOp(t, op) {
+		return unexpected(t, op)
+	}
+	return nil
+}
+
+func unexpected(t token, want string) error {
+	if t.kind == tokEOF {
+		return fmt.Errorf("unexpected end of equation, expected %s", want)
+	}
+	return fmt.Errorf("unexpected %q at offset %d, expected %s", t.text, t.pos, want)
+}
+
+func (p *parser) expr() (Node, error) {
+	return p.binary(0)
+}
+
+// precedence lists the binary operators from loosest to tightest.
+var precedence = [][]string{
+	{"OR"},
+	{"AND"},
+	{"=", "<>", "<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "//", "MOD"},
+}
+
+func (p *parser) binary(level int) (Node, error) {
+	if level == len(precedence) {
+		return p.unary()
+	}
+	// NOT binds looser than comparisons but tighter than AND
+	if precedence[level][0] == "=" && p.accept("NOT") {
+		x, err := p.binary(level)
+		if err != nil {
+			return nil, err
+		}
+		return Unary{Op: "NOT", X: x}, nil
+	}
+
+	l, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := ""
+		for _, candidate := range precedence[level] {
+			if isOp(p.peek(), candidate) {
+				op = candidate
+				break
+			}
+		}
+		if op == "" {
+			return l, nil
+		}
+		p.next()
+		r, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		l = Binary{Op: op, L: l, R: r}
+	}
+}
+
+func (p *parser) unary() (Node, error) {
+	for _, op := range []string{"-", "+"} {
+		if p.accept(op) {
+			x, err := p.unary()
+			if err != nil {
+				return nil, err
+			}
+			return Unary{Op: op, X: x}, nil
+		}
+	}
+	return p.power()
+}
+
+func (p *parser) power() (Node, error) {
+	base, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	if !p.accept("^") {
+		return base, nil
+	}
+	// right associative, and -x^2 is -(x^2) but x^-2 is allowed
+	exp, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	return Binary{Op: "^", L: base, R: exp}, nil
+}
+
+func (p *parser) primary() (Node, error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokNumber:
+		p.next()
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("strconv.ParseFloat: %w", err)
+		}
+		return Number{Value: v}, nil
+	case isOp(t, "("):
+		p.next()
+		n, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return n, p.expect(")")
+	case isOp(t, "IF"):
+		return p.ifExpr()
+	case t.kind == tokQuoted:
+		p.next()
+		return p.reference(t.text)
+	case t.kind == tokWord && !keywords[strings.ToUpper(t.text)]:
+		// unquoted names may contain spaces: join adjacent words
+		words := []string{p.next().text}
+		for p.peek().kind == tokWord && !keywords[strings.ToUpper(p.peek().text)] {
+			words = append(words, p.next().text)
+		}
+		return p.reference(strings.Join(words, " "))
+	}
+	return nil, unexpected(t, "a number, name, or '('")
+}
+
+// ifExpr parses both IF c THEN a ELSE b and the Vensim-style
+// IF THEN ELSE(c, a, b) function.
+func (p *parser) ifExpr() (Node, error) {
+	p.next()
+	if isOp(p.peek(), "THEN") {
+		p.next()
+		if err := p.expect("ELSE"); err != nil {
+			return nil, err
+		}
+		args, err := p.args()
+		if err != nil {
+			return nil, err
+		}
+		return Call{Func: "IF_THEN_ELSE", Args: args}, nil
+	}
+
+	cond, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("THEN"); err != nil {
+		return nil, err
+	}
+	then, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("ELSE"); err != nil {
+		return nil, err
+	}
+	els, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	return If{Cond: cond, Then: then, Else: els}, nil
+}
+
+// reference parses what follows a name: a call's arguments or an
+// array subscript.
+func (p *parser) reference(name string) (Node, error) {
+	if isOp(p.peek(), "(") {
+		args, err := p.args()
+		if err != nil {
+			return nil, err
+		}
+		return Call{Func: strings.ToUpper(strings.ReplaceAll(name, " ", "_")), Args: args}, nil
+	}
+
+	id := Ident{Name: name}
+	if p.accept("[") {
+		for {
+			var parts []string
+			for t := p.peek(); t.kind == tokWord || t.kind == tokNumber || t.kind == tokQuoted; t = p.peek() {
+				parts = append(parts, p.next().text)
+			}
+			if len(parts) == 0 {
+				return nil, unexpected(p.peek(), "a subscript")
+			}
+			id.Subscripts = append(id.Subscripts, strings.Join(parts, " "))
+			if p.accept("]") {
+				break
+			}
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return id, nil
+}
+
+func (p *parser) args() ([]Node, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	var args []Node
+	if p.accept(")") {
+		return args, nil
+	}
+	for {
+		arg, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.accept(")") {
+			return args, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -3,13 +3,23 @@ package sdjson
 import (
 	"encoding/json"
 	"fmt"
+	"slices"
+	"strings"
 )
 
 type Polarity int
 
 const (
-	NegativePolarity Polarity = iota
+	// UnknownPolarity is a link whose direction of effect isn't known.
+	// It is the zero value, so that a link made without a polarity
+	// doesn't claim a direction.
+	UnknownPolarity Polarity = iota
+	NegativePolarity
 	PositivePolarity
+	// NonmonotonicPolarity is a link whose direction of effect depends
+	// on the operating region, e.g. positive at low values and negative
+	// at high values.
+	NonmonotonicPolarity
 )
 
 func (p Polarity) MarshalJSON() ([]byte, error) {
@@ -22,6 +32,10 @@ func (p *Polarity) UnmarshalJSON(b []byte) error {
 		*p = PositivePolarity
 	case `"-"`:
 		*p = NegativePolarity
+	case `"?"`:
+		*p = UnknownPolarity
+	case `"±"`, `"+/-"`:
+		*p = NonmonotonicPolarity
 	default:
 		return fmt.Errorf("unknown polarity: %q", string(b))
 	}
@@ -38,15 +52,38 @@ func (p Polarity) IsPositive() bool {
 }
 
 func (p Polarity) IsNegative() bool {
-	return !p.IsPositive()
+	return p == NegativePolarity
+}
+
+// IsDetermined reports whether the polarity is either positive or
+// negative.
+func (p Polarity) IsDetermined() bool {
+	return p == PositivePolarity || p == NegativePolarity
+}
+
+// Times returns the polarity of two links in series: the product of
+// two determined polarities, or UnknownPolarity if either is
+// undetermined.
+func (p Polarity) Times(q Polarity) Polarity {
+	if !p.IsDetermined() || !q.IsDetermined() {
+		return UnknownPolarity
+	}
+	if p == q {
+		return PositivePolarity
+	}
+	return NegativePolarity
 }
 
 func (p Polarity) Symbol() string {
 	switch p {
 	case PositivePolarity:
 		return "+"
-	default:
+	case NegativePolarity:
 		return "-"
+	case NonmonotonicPolarity:
+		return "±"
+	default:
+		return "?"
 	}
 }
 
@@ -107,6 +144,13 @@ type GraphicalFunction struct {
 	Points []Point `json:"points"`
 }
 
+// ArrayEquation is the equation for a specific element (or set of
+// elements, one per dimension) of an arrayed variable.
+type ArrayEquation struct {
+	Equation    string   `json:"equation"`
+	ForElements []string `json:"forElements"`
+}
+
 type Variable struct {
 	Name              string             `json:"name"`
 	Type              VariableType       `json:"type"`
@@ -116,14 +160,35 @@ type Variable struct {
 	Inflows           []string           `json:"inflows,omitzero"`
 	Outflows          []string           `json:"outflows,omitzero"`
 	GraphicalFunction *GraphicalFunction `json:"graphicalFunction,omitzero"`
+	Uniflow           bool               `json:"uniflow,omitzero"`
+	Dimensions        []string           `json:"dimensions,omitzero"`
+	ArrayEquations    []ArrayEquation    `json:"arrayEquations,omitzero"`
+	// CrossLevelGhostOf names the variable in another module that this
+	// variable is an input alias (ghost) of.
+	CrossLevelGhostOf string `json:"crossLevelGhostOf,omitzero"`
+	// Aliases are other spellings of Name that refer to this variable,
+	// such as "tax burden" for "Tax Burden".
+	Aliases []string `json:"aliases,omitzero"`
 }
 
 type Relationship struct {
-	From              string `json:"from"`
-	To                string `json:"to"`
-	Polarity          string `json:"polarity"` // "+", or "-"
-	Reasoning         string `json:"reasoning,omitzero"`
-	PolarityReasoning string `json:"polarityReasoning,omitzero"`
+	From              string   `json:"from"`
+	To                string   `json:"to"`
+	Polarity          Polarity `json:"polarity"`
+	Reasoning         string   `json:"reasoning,omitzero"`
+	PolarityReasoning string   `json:"polarityReasoning,omitzero"`
+	// Provenance lists the causal chains of a causal map the
+	// relationship was converted from.
+	Provenance []Provenance `json:"provenance,omitzero"`
+}
+
+// Provenance is one causal chain a relationship appears in.
+type Provenance struct {
+	// Chain is the chain's index in the map's causal chains.
+	Chain     int    `json:"chain"`
+	Reasoning string `json:"reasoning,omitzero"`
+	// Loop is whether the chain is a feedback loop.
+	Loop bool `json:"loop"`
 }
 
 func (r *Relationship) Key() string {
@@ -131,12 +196,52 @@ func (r *Relationship) Key() string {
 	return fmt.Sprintf("%q->%q", r.From, r.To)
 }
 
+// Dimension is an array dimension, either a numeric range (1..Size) or
+// a list of named elements.
+type Dimension struct {
+	Type     string   `json:"type"` // "labels", or "numeric"
+	Name     string   `json:"name"`
+	Size     int      `json:"size,omitzero"`
+	Elements []string `json:"elements,omitzero"`
+}
+
 type Specs struct {
-	StartTime float64 `json:"startTime"`
-	StopTime  float64 `json:"stopTime"`
-	DT        float64 `json:"dt,omitzero"`
-	SaveStep  float64 `json:"saveStep,omitzero"`
-	TimeUnits string  `json:"timeUnits,omitzero"`
+	StartTime       float64     `json:"startTime"`
+	StopTime        float64     `json:"stopTime"`
+	DT              float64     `json:"dt,omitzero"`
+	SaveStep        float64     `json:"saveStep,omitzero"`
+	TimeUnits       string      `json:"timeUnits,omitzero"`
+	ArrayDimensions []Dimension `json:"arrayDimensions,omitzero"`
+}
+
+// Module declares a module and its position in the module hierarchy.
+// Variables belong to a module by prefixing their name with the
+// module's name, e.g. "Finance.revenue".
+type Module struct {
+	Name string `json:"name"`
+	// ParentModule is the name of the module this one is in, or empty
+	// for a top-level module.
+	ParentModule string `json:"parentModule,omitzero"`
+}
+
+// Path returns the full, dot-separated path of the module, following
+// its parents through modules, the model's modules.  A parent that
+// isn't among them is taken to be top-level.
+func (m *Module) Path(modules []Module) string {
+	path, parent := m.Name, m.ParentModule
+	// the bound stops at a cycle of parents
+	for range len(modules) + 1 {
+		if parent == "" {
+			break
+		}
+		path = parent + "." + path
+		i := slices.IndexFunc(modules, func(p Module) bool { return strings.EqualFold(p.Name, parent) })
+		if i < 0 {
+			break
+		}
+		parent = modules[i].ParentModule
+	}
+	return path
 }
 
 // Model is the format that sd-ai expects to talk about models.
@@ -144,4 +249,5 @@ type Model struct {
 	Variables     []Variable     `json:"variables,omitzero"`
 	Relationships []Relationship `json:"relationships,omitzero"`
 	Specs         Specs          `json:"specs,omitzero"`
+	Modules       []Module       `json:"modules,omitzero"`
 }
@@ -24,6 +24,16 @@ func TestPolarityRoundtrip(t *testing.T) {
 			polarity: NegativePolarity,
 			expected: `"-"`,
 		},
+		{
+			name:     "unknown polarity",
+			polarity: UnknownPolarity,
+			expected: `"?"`,
+		},
+		{
+			name:     "nonmonotonic polarity",
+			polarity: NonmonotonicPolarity,
+			expected: `"±"`,
+		},
 	}
 
 	for _, tt := range tests {
@@ -44,7 +54,7 @@ func TestPolarityRoundtrip(t *testing.T) {
 
 func TestPolarityUnmarshalError(t *testing.T) {
 	invalidInputs := []string{
-		`"?"`,
+		`"!"`,
 		`"positive"`,
 		`""`,
 		`null`,
@@ -62,25 +72,44 @@ func TestPolarityUnmarshalError(t *testing.T) {
 
 func TestPolarityMethods(t *testing.T) {
 	tests := []struct {
-		polarity   Polarity
-		isPositive bool
-		isNegative bool
-		symbol     string
-		str        string
+		polarity     Polarity
+		isPositive   bool
+		isNegative   bool
+		isDetermined bool
+		symbol       string
+		str          string
 	}{
 		{
-			polarity:   PositivePolarity,
-			isPositive: true,
-			isNegative: false,
-			symbol:     "+",
-			str:        "+",
+			polarity:     PositivePolarity,
+			isPositive:   true,
+			isNegative:   false,
+			isDetermined: true,
+			symbol:       "+",
+			str:          "+",
 		},
 		{
-			polarity:   NegativePolarity,
-			isPositive: false,
-			isNegative: true,
-			symbol:     "-",
-			str:        "-",
+			polarity:     NegativePolarity,
+			isPositive:   false,
+			isNegative:   true,
+			isDetermined: true,
+			symbol:       "-",
+			str:          "-",
+		},
+		{
+			polarity:     UnknownPolarity,
+			isPositive:   false,
+			isNegative:   false,
+			isDetermined: false,
+			symbol:       "?",
+			str:          "?",
+		},
+		{
+			polarity:     NonmonotonicPolarity,
+			isPositive:   false,
+			isNegative:   false,
+			isDetermined: false,
+			symbol:       "±",
+			str:          "±",
 		},
 	}
 
@@ -88,12 +117,51 @@ func TestPolarityMethods(t *testing.T) {
 		t.Run(tt.str, func(t *testing.T) {
 			assert.Equal(t, tt.isPositive, tt.polarity.IsPositive())
 			assert.Equal(t, tt.isNegative, tt.polarity.IsNegative())
+			assert.Equal(t, tt.isDetermined, tt.polarity.IsDetermined())
 			assert.Equal(t, tt.symbol, tt.polarity.Symbol())
 			assert.Equal(t, tt.str, tt.polarity.String())
 		})
 	}
 }
 
+func TestPolarityAlternateSpelling(t *testing.T) {
+	var p Polarity
+	require.NoError(t, json.Unmarshal([]byte(`"+/-"`), &p))
+	assert.Equal(t, NonmonotonicPolarity, p)
+}
+
+func TestPolarityZeroValue(t *testing.T) {
+	// a link made without a polarity doesn't claim a direction
+	data, err := json.Marshal(Relationship{From: "cause", To: "effect"})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"from": "cause", "to": "effect", "polarity": "?"}`, string(data))
+
+	var r Relationship
+	require.NoError(t, json.Unmarshal([]byte(`{"from": "cause", "to": "effect"}`), &r))
+	assert.Equal(t, UnknownPolarity, r.Polarity)
+}
+
+func TestPolarityTimes(t *testing.T) {
+	tests := []struct {
+		a, b     Polarity
+		expected Polarity
+	}{
+		{PositivePolarity, PositivePolarity, PositivePolarity},
+		{PositivePolarity, NegativePolarity, NegativePolarity},
+		{NegativePolarity, NegativePolarity, PositivePolarity},
+		{NegativePolarity, UnknownPolarity, UnknownPolarity},
+		{NonmonotonicPolarity, PositivePolarity, UnknownPolarity},
+		{NonmonotonicPolarity, NonmonotonicPolarity, UnknownPolarity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.a.Symbol()+tt.b.Symbol(), func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.a.Times(tt.b))
+			assert.Equal(t, tt.expected, tt.b.Times(tt.a))
+		})
+	}
+}
+
 func TestVariableTypeRoundtrip(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -330,7 +398,7 @@ func TestRelationshipRoundtrip(t *testing.T) {
 			relationship: Relationship{
 				From:     "cause",
 				To:       "effect",
-				Polarity: "+",
+				Polarity: PositivePolarity,
 			},
 		},
 		{
@@ -338,7 +406,7 @@ func TestRelationshipRoundtrip(t *testing.T) {
 			relationship: Relationship{
 				From:              "temperature",
 				To:                "ice_cream_sales",
-				Polarity:          "+",
+				Polarity:          PositivePolarity,
 				Reasoning:         "Higher temperatures increase ice cream demand",
 				PolarityReasoning: "As temperature goes up, sales go up",
 			},
@@ -365,11 +433,11 @@ func TestRelationshipKey(t *testing.T) {
 		expectedKey  string
 	}{
 		{
-			relationship: Relationship{From: "A", To: "B", Polarity: "+"},
+			relationship: Relationship{From: "A", To: "B", Polarity: PositivePolarity},
 			expectedKey:  `"A"->"B"`,
 		},
 		{
-			relationship: Relationship{From: "A", To: "B", Polarity: "-"},
+			relationship: Relationship{From: "A", To: "B", Polarity: NegativePolarity},
 			expectedKey:  `"A"->"B"`, // polarity is ignored in key
 		},
 	}
@@ -471,13 +539,13 @@ func TestModelRoundtrip(t *testing.T) {
 					{
 						From:              "population",
 						To:                "births",
-						Polarity:          "+",
+						Polarity:          PositivePolarity,
 						PolarityReasoning: "Births come from individuals in the population",
 					},
 					{
 						From:      "birth_rate",
 						To:        "births",
-						Polarity:  "+",
+						Polarity:  PositivePolarity,
 						Reasoning: "need a rate for births",
 					},
 				},
@@ -574,3 +642,28 @@ func TestModelRoundtrip(t *testing.T) {
 		})
 	}
 }
+
+func TestModulePath(t *testing.T) {
+	tests := []struct {
+		module   Module
+		expected string
+	}{
+		{Module{Name: "Finance"}, "Finance"},
+		{Module{Name: "Operations", ParentModule: "Finance"}, "Finance.Operations"},
+		{Module{Name: "Plant", ParentModule: "Operations"}, "Finance.Operations.Plant"},
+		// a cycle of parents ends rather than looping forever
+		{Module{Name: "Loop", ParentModule: "Cycle"}, "Cycle.Loop.Cycle.Loop.Cycle.Loop"},
+	}
+	modules := []Module{
+		{Name: "Finance"},
+		{Name: "Operations", ParentModule: "Finance"},
+		{Name: "Cycle", ParentModule: "Loop"},
+		{Name: "Loop", ParentModule: "Cycle"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expected, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.module.Path(modules))
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package sim
+
+import (
+	"fmt"
+	"math"
+)
+
+// function is a builtin, called with its arguments already evaluated.
+type function struct {
+	// maxArgs is -1 for functions taking any number of arguments.
+	minArgs, maxArgs int
+	fn               func(s *sim, args []float64) float64
+}
+
+func (f function) arity() string {
+	switch {
+	case f.maxArgs < 0:
+		return fmt.Sprintf("at least %d arguments", f.minArgs)
+	case f.minArgs == f.maxArgs:
+		return fmt.Sprintf("%d arguments", f.minArgs)
+	}
+	return fmt.Sprintf("%d to %d arguments", f.minArgs, f.maxArgs)
+}
+
+func unary(fn func(float64) float64) function {
+	return function{1, 1, func(_ *sim, args []float64) float64 { return fn(args[0]) }}
+}
+
+// functions are the builtins, keyed by name as the equation parser
+// gives them.
+var functions = map[string]function{
+	"ABS":     unary(math.Abs),
+	"EXP":     unary(math.Exp),
+	"LN":      unary(math.Log),
+	"LOG10":   unary(math.Log10),
+	"SQRT":    unary(math.Sqrt),
+	"SIN":     unary(math.Sin),
+	"COS":     unary(math.Cos),
+	"TAN":     unary(math.Tan),
+	"ARCTAN":  unary(math.Atan),
+	"INT":     unary(math.Floor),
+	"INTEGER": unary(math.Floor),
+	"ROUND":   unary(math.Round),
+	"MIN": {1, -1, func(_ *sim, args []float64) float64 {
+		m := args[0]
+		for _, x := range args[1:] {
+			m = min(m, x)
+		}
+		return m
+	}},
+	"MAX": {1, -1, func(_ *sim, args []float64) float64 {
+		m := args[0]
+		for _, x := range args[1:] {
+			m = max(m, x)
+		}
+		return m
+	}},
+	"MOD": {2, 2, func(_ *sim, args []float64) float64 { return math.Mod(args[0], args[1]) }},
+	"IF_THEN_ELSE": {3, 3, func(_ *sim, args []float64) float64 {
+		if args[0] != 0 {
+			return args[1]
+		}
+		return args[2]
+	}},
+	// SAFEDIV(a, b, x) and XIDZ(a, b, x) are x when b is 0, and ZIDZ(a, b)
+	// and SAFEDIV(a, b) are 0
+	"SAFEDIV": {2, 3, func(_ *sim, args []float64) float64 {
+		if args[1] == 0 {
+			if len(args) == 3 {
+				return args[2]
+			}
+			return 0
+		}
+		return args[0] / args[1]
+	}},
+	"XIDZ": {3, 3, func(_ *sim, args []float64) float64 {
+		if args[1] == 0 {
+			return args[2]
+		}
+		return args[0] / args[1]
+	}},
+	"ZIDZ": {2, 2, func(_ *sim, args []float64) float64 {
+		if args[1] == 0 {
+			return 0
+		}
+		return args[0] / args[1]
+	}},
+	// STEP(height, time)
+	"STEP": {2, 2, func(s *sim, args []float64) float64 {
+		if s.time >= args[1] {
+			return args[0]
+		}
+		return 0
+	}},
+	// RAMP(slope, start[, end])
+	"RAMP": {2, 3, func(s *sim, args []float64) float64 {
+		t := s.time
+		if len(args) == 3 {
+			t = min(t, args[2])
+		}
+		if t <= args[1] {
+			return 0
+		}
+		return args[0] * (t - args[1])
+	}},
+	// PULSE(magnitude, first[, interval]), spread over one DT so that a
+	// stock it flows into changes by the magnitude
+	"PULSE": {2, 3, func(s *sim, args []float64) float64 {
+		since := s.time - args[1]
+		if since < -s.dt/2 {
+			return 0
+		}
+		if len(args) == 3 && args[2] > 0 {
+			since = math.Mod(since+s.dt/2, args[2]) - s.dt/2
+		}
+		if math.Abs(since) < s.dt/2 {
+			return args[0] / s.dt
+		}
+		return 0
+	}},
+}
@@ -0,0 +1,415 @@
+// Package sim simulates SD-JSON stock and flow models with Euler's
+// method, to check that a generated model runs: that its equations
+// parse, refer only to variables that exist, have no algebraic loops,
+// and stay finite.
+//
+// Only scalar models without modules are simulated, with the builtins
+// that need no state of their own; models using arrays, modules, or
+// functions like SMTH1 and DELAY3 return an error wrapping
+// ErrUnsupported.  Functions follow XMILE, so PULSE(magnitude, first,
+// interval) is magnitude/DT at first and every interval after it.
+package sim
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/UB-IAD/sd-ai/third-party/causal-chains/sdjson"
+	"github.com/UB-IAD/sd-ai/third-party/causal-chains/sdjson/equation"
+)
+
+// ErrUnsupported is wrapped by the errors for models that use features
+// sim can't simulate, which doesn't mean the model is wrong.
+var ErrUnsupported = errors.New("unsupported")
+
+// maxSteps bounds the length of a simulation.
+const maxSteps = 100_000
+
+// Results are a model's values over time.
+type Results struct {
+	Time []float64
+	// Values are each variable's value at each time, keyed by its name
+	// in the model.
+	Values map[string][]float64
+}
+
+type variable struct {
+	v   sdjson.Variable
+	eqn equation.Node
+	gf  []sdjson.Point
+}
+
+type state int
+
+const (
+	unevaluated state = iota
+	evaluating
+	evaluated
+)
+
+type sim struct {
+	vars map[string]*variable
+	// names are the variables' normalized names, in model order.
+	names []string
+
+	time, dt, start, stop float64
+	// stocks are the stocks' current values.
+	stocks map[string]float64
+	// values and states are this step's values of the other variables.
+	values map[string]float64
+	states map[string]state
+	// initial is whether stocks are being given their initial values.
+	initial bool
+}
+
+// Simulate runs the model from Specs.StartTime to Specs.StopTime,
+// returning the values of every variable at every step, or an error
+// describing what stops the model from running.  Problems with the
+// equations are all reported at once.
+func Simulate(m sdjson.Model) (*Results, error) {
+	if len(m.Modules) > 0 {
+		return nil, fmt.Errorf("modules: %w", ErrUnsupported)
+	}
+	if len(m.Specs.ArrayDimensions) > 0 {
+		return nil, fmt.Errorf("arrays: %w", ErrUnsupported)
+	}
+
+	s := &sim{
+		vars:   make(map[string]*variable, len(m.Variables)),
+		start:  m.Specs.StartTime,
+		stop:   m.Specs.StopTime,
+		dt:     cmp.Or(m.Specs.DT, 1),
+		stocks: make(map[string]float64),
+	}
+	if s.dt <= 0 || s.stop < s.start {
+		return nil, fmt.Errorf("specs: need dt > 0 and stopTime >= startTime, got dt %g from %g to %g", s.dt, s.start, s.stop)
+	}
+	steps := int(math.Round((s.stop - s.start) / s.dt))
+	if steps > maxSteps {
+		return nil, fmt.Errorf("specs: %d steps is more than %d", steps, maxSteps)
+	}
+
+	if err := s.compile(m); err != nil {
+		return nil, err
+	}
+
+	res := &Results{Values: make(map[string][]float64, len(s.names))}
+	s.time = s.start
+	s.initial = true
+	s.reset()
+	for _, name := range s.names {
+		if s.vars[name].v.Type == sdjson.VariableTypeStock {
+			if _, err := s.value(name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	s.initial = false
+
+	for step := 0; ; step++ {
+		s.time = s.start + float64(step)*s.dt
+		s.reset()
+		res.Time = append(res.Time, s.time)
+		for _, name := range s.names {
+			x, err := s.value(name)
+			if err != nil {
+				return nil, err
+			}
+			res.Values[s.vars[name].v.Name] = append(res.Values[s.vars[name].v.Name], x)
+		}
+		if step == steps {
+			break
+		}
+
+		// each stock changes by the flows computed from this step's values
+		next := make(map[string]float64, len(s.stocks))
+		for name, x := range s.stocks {
+			v := s.vars[name].v
+			for _, f := range v.Inflows {
+				x += s.dt * s.values[equation.NormalizeName(f)]
+			}
+			for _, f := range v.Outflows {
+				x -= s.dt * s.values[equation.NormalizeName(f)]
+			}
+			if math.IsNaN(x) || math.IsInf(x, 0) {
+				return nil, fmt.Errorf("%s is %g at time %g", v.Name, x, s.time+s.dt)
+			}
+			next[name] = x
+		}
+		s.stocks = next
+	}
+	return res, nil
+}
+
+// compile parses the model's equations and checks their references.
+func (s *sim) compile(m sdjson.Model) error {
+	var errs []error
+	for _, v := range m.Variables {
+		name := equation.NormalizeName(v.Name)
+		if _, ok := s.vars[name]; ok {
+			errs = append(errs, fmt.Errorf("%s: defined more than once", v.Name))
+			continue
+		}
+		if len(v.Dimensions) > 0 || len(v.ArrayEquations) > 0 {
+			return fmt.Errorf("%s: arrays: %w", v.Name, ErrUnsupported)
+		}
+		if v.CrossLevelGhostOf != "" {
+			return fmt.Errorf("%s: ghosts: %w", v.Name, ErrUnsupported)
+		}
+		s.vars[name] = &variable{v: v}
+		s.names = append(s.names, name)
+	}
+
+	for _, name := range s.names {
+		x := s.vars[name]
+		if x.v.GraphicalFunction != nil && len(x.v.GraphicalFunction.Points) > 0 {
+			x.gf = slices.Clone(x.v.GraphicalFunction.Points)
+			slices.SortFunc(x.gf, func(a, b sdjson.Point) int { return cmp.Compare(a.X, b.X) })
+		}
+		eqn := x.v.Equation
+		if strings.TrimSpace(eqn) == "" {
+			if x.gf == nil {
+				errs = append(errs, fmt.Errorf("%s: has no equation", x.v.Name))
+				continue
+			}
+			// a graphical function of time
+			eqn = "TIME"
+		}
+		n, err := equation.Parse(eqn)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: equation %q: %w", x.v.Name, eqn, err))
+			continue
+		}
+		x.eqn = n
+		errs = append(errs, s.check(x)...)
+
+		if x.v.Type != sdjson.VariableTypeStock {
+			continue
+		}
+		for _, f := range slices.Concat(x.v.Inflows, x.v.Outflows) {
+			if flow, ok := s.vars[equation.NormalizeName(f)]; !ok || flow.v.Type != sdjson.VariableTypeFlow {
+				errs = append(errs, fmt.Errorf("%s: %q isn't a flow in the model", x.v.Name, f))
+			}
+		}
+	}
+	// errors in the model matter more than what sim can't do
+	if wrong := slices.DeleteFunc(slices.Clone(errs), func(err error) bool {
+		return errors.Is(err, ErrUnsupported)
+	}); len(wrong) > 0 {
+		return errors.Join(wrong...)
+	}
+	return errors.Join(errs...)
+}
+
+// check returns the problems with a variable's references.
+func (s *sim) check(x *variable) []error {
+	var errs []error
+	equation.Walk(x.eqn, func(n equation.Node) {
+		switch n := n.(type) {
+		case equation.Ident:
+			if len(n.Subscripts) > 0 {
+				errs = append(errs, fmt.Errorf("%s: subscripts: %w", x.v.Name, ErrUnsupported))
+			} else if _, ok := s.vars[equation.NormalizeName(n.Name)]; !ok && !isBuiltinIdent(n.Name) {
+				errs = append(errs, fmt.Errorf("%s: refers to %q, which isn't in the model", x.v.Name, n.Name))
+			}
+		case equation.Call:
+			if _, ok := functions[n.Func]; !ok {
+				if v, ok := s.vars[equation.NormalizeName(n.Func)]; !ok || v.v.GraphicalFunction == nil {
+					errs = append(errs, fmt.Errorf("%s: function %s: %w", x.v.Name, n.Func, ErrUnsupported))
+				}
+			}
+		}
+	})
+	return errs
+}
+
+func isBuiltinIdent(name string) bool {
+	switch equation.NormalizeName(name) {
+	case "time", "dt", "time step", "starttime", "start time", "initial time", "stoptime", "stop time", "final time", "pi":
+		return true
+	}
+	return false
+}
+
+func (s *sim) reset() {
+	s.values = make(map[string]float64, len(s.names))
+	s.states = make(map[string]state, len(s.names))
+}
+
+// value returns the variable's value at the current time, evaluating
+// what it depends on first.
+func (s *sim) value(name string) (float64, error) {
+	x := s.vars[name]
+	if x.v.Type == sdjson.VariableTypeStock && !s.initial {
+		return s.stocks[name], nil
+	}
+	switch s.states[name] {
+	case evaluated:
+		return s.values[name], nil
+	case evaluating:
+		return 0, fmt.Errorf("%s depends on itself through other variables without passing through a stock", x.v.Name)
+	}
+
+	s.states[name] = evaluating
+	val, err := s.eval(x.eqn)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", x.v.Name, err)
+	}
+	if x.gf != nil {
+		val = lookup(x.gf, val)
+	}
+	if x.v.Type == sdjson.VariableTypeFlow && x.v.Uniflow {
+		val = max(val, 0)
+	}
+	if math.IsNaN(val) || math.IsInf(val, 0) {
+		return 0, fmt.Errorf("%s is %g at time %g", x.v.Name, val, s.time)
+	}
+	s.states[name] = evaluated
+	if x.v.Type == sdjson.VariableTypeStock {
+		s.stocks[name] = val
+	} else {
+		s.values[name] = val
+	}
+	return val, nil
+}
+
+func (s *sim) eval(n equation.Node) (float64, error) {
+	switch n := n.(type) {
+	case equation.Number:
+		return n.Value, nil
+	case equation.Ident:
+		name := equation.NormalizeName(n.Name)
+		if _, ok := s.vars[name]; ok {
+			return s.value(name)
+		}
+		switch name {
+		case "time":
+			return s.time, nil
+		case "dt", "time step":
+			return s.dt, nil
+		case "starttime", "start time", "initial time":
+			return s.start, nil
+		case "stoptime", "stop time", "final time":
+			return s.stop, nil
+		case "pi":
+			return math.Pi, nil
+		}
+		return 0, fmt.Errorf("unknown variable %q", n.Name)
+	case equation.Unary:
+		x, err := s.eval(n.X)
+		if err != nil {
+			return 0, err
+		}
+		switch n.Op {
+		case "-":
+			return -x, nil
+		case "NOT":
+			return boolean(x == 0), nil
+		}
+		return x, nil
+	case equation.Binary:
+		return s.binary(n)
+	case equation.If:
+		cond, err := s.eval(n.Cond)
+		if err != nil {
+			return 0, err
+		}
+		if cond != 0 {
+			return s.eval(n.Then)
+		}
+		return s.eval(n.Else)
+	case equation.Call:
+		args := make([]float64, len(n.Args))
+		for i, arg := range n.Args {
+			var err error
+			if args[i], err = s.eval(arg); err != nil {
+				return 0, err
+			}
+		}
+		if f, ok := functions[n.Func]; ok {
+			if len(args) < f.minArgs || (f.maxArgs >= 0 && len(args) > f.maxArgs) {
+				return 0, fmt.Errorf("%s takes %s, got %d", n.Func, f.arity(), len(args))
+			}
+			return f.fn(s, args), nil
+		}
+		// a graphical function called with its input
+		name := equation.NormalizeName(n.Func)
+		if x, ok := s.vars[name]; ok && x.gf != nil && len(args) == 1 {
+			return lookup(x.gf, args[0]), nil
+		}
+		return 0, fmt.Errorf("function %s: %w", n.Func, ErrUnsupported)
+	}
+	return 0, fmt.Errorf("unexpected %T", n)
+}
+
+func (s *sim) binary(n equation.Binary) (float64, error) {
+	l, err := s.eval(n.L)
+	if err != nil {
+		return 0, err
+	}
+	r, err := s.eval(n.R)
+	if err != nil {
+		return 0, err
+	}
+	switch n.Op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		return l / r, nil
+	case "//":
+		return math.Floor(l / r), nil
+	case "^":
+		return math.Pow(l, r), nil
+	case "MOD":
+		return math.Mod(l, r), nil
+	case "=":
+		return boolean(l == r), nil
+	case "<>":
+		return boolean(l != r), nil
+	case "<":
+		return boolean(l < r), nil
+	case "<=":
+		return boolean(l <= r), nil
+	case ">":
+		return boolean(l > r), nil
+	case ">=":
+		return boolean(l >= r), nil
+	case "AND":
+		return boolean(l != 0 && r != 0), nil
+	case "OR":
+		return boolean(l != 0 || r != 0), nil
+	}
+	return 0, fmt.Errorf("unknown operator %s", n.Op)
+}
+
+func boolean(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// lookup interpolates linearly between a graphical function's points,
+// holding its first and last values beyond them.
+func lookup(points []sdjson.Point, x float64) float64 {
+	i, _ := slices.BinarySearchFunc(points, x, func(p sdjson.Point, x float64) int { return cmp.Compare(p.X, x) })
+	switch {
+	case i == 0:
+		return points[0].Y
+	case i == len(points):
+		return points[len(points)-1].Y
+	}
+	a, b := points[i-1], points[i]
+	if b.X == a.X {
+		return b.Y
+	}
+	return a.Y + (b.Y-a.Y)*(x-a.X)/(b.X-a.X)
+}
@@ -0,0 +1,111 @@
+package sim
+
+import (
+	"testing"
+
+	"github.com/UB-IAD/sd-ai/third-party/causal-chains/sdjson"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func population() sdjson.Model {
+	return sdjson.Model{
+		Variables: []sdjson.Variable{
+			{Name: "Population", Type: sdjson.VariableTypeStock, Equation: "Initial Population", Inflows: []string{"Births"}, Outflows: []string{"Deaths"}},
+			{Name: "Births", Type: sdjson.VariableTypeFlow, Equation: "Population * birth_rate"},
+			{Name: "Deaths", Type: sdjson.VariableTypeFlow, Equation: "Population / Lifetime", Uniflow: true},
+			{Name: "Initial Population", Type: sdjson.VariableTypeAux, Equation: "100"},
+			{Name: "Birth Rate", Type: sdjson.VariableTypeAux, Equation: "0.1 + STEP(0.1, 2)"},
+			{Name: "Lifetime", Type: sdjson.VariableTypeAux, Equation: "10"},
+		},
+		Specs: sdjson.Specs{StartTime: 0, StopTime: 4, DT: 1},
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	res, err := Simulate(population())
+	require.NoError(t, err)
+
+	assert.Equal(t, []float64{0, 1, 2, 3, 4}, res.Time)
+	// births and deaths cancel until the birth rate doubles at time 2
+	assert.InDeltaSlice(t, []float64{100, 100, 100, 110, 121}, res.Values["Population"], 1e-9)
+	assert.InDeltaSlice(t, []float64{10, 10, 20, 22, 24.2}, res.Values["Births"], 1e-9)
+	assert.InDeltaSlice(t, []float64{10, 10, 10, 11, 12.1}, res.Values["Deaths"], 1e-9)
+}
+
+func TestSimulateGraphicalFunction(t *testing.T) {
+	m := sdjson.Model{
+		Variables: []sdjson.Variable{
+			{Name: "Effect", Equation: "TIME", GraphicalFunction: &sdjson.GraphicalFunction{Points: []sdjson.Point{{X: 0, Y: 0}, {X: 2, Y: 1}}}},
+			{Name: "Called", Equation: "Effect(TIME * 2)"},
+			{Name: "Water", Type: sdjson.VariableTypeStock, Equation: "0", Inflows: []string{"Fill"}},
+			{Name: "Fill", Type: sdjson.VariableTypeFlow, Equation: "PULSE(5, 1)"},
+		},
+		Specs: sdjson.Specs{StartTime: 0, StopTime: 3, DT: 0.5},
+	}
+	res, err := Simulate(m)
+	require.NoError(t, err)
+	assert.InDeltaSlice(t, []float64{0, 0.25, 0.5, 0.75, 1, 1, 1}, res.Values["Effect"], 1e-9)
+	assert.InDeltaSlice(t, []float64{0, 0.5, 1, 1, 1, 1, 1}, res.Values["Called"], 1e-9)
+	assert.InDeltaSlice(t, []float64{0, 0, 0, 5, 5, 5, 5}, res.Values["Water"], 1e-9)
+}
+
+func TestSimulateErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		change func(*sdjson.Model)
+		want   []string
+	}{
+		{
+			name: "parse and reference errors are reported together",
+			change: func(m *sdjson.Model) {
+				m.Variables[1].Equation = "Population * (birth_rate"
+				m.Variables[2].Equation = "Population / Life_Span"
+				m.Variables[0].Outflows = []string{"Lifetime"}
+			},
+			want: []string{"Births: equation", `Deaths: refers to "Life_Span", which isn't in the model`, `Population: "Lifetime" isn't a flow in the model`},
+		},
+		{
+			name: "algebraic loop",
+			change: func(m *sdjson.Model) {
+				m.Variables[4].Equation = "Lifetime / 100"
+				m.Variables[5].Equation = "Birth Rate * 100"
+			},
+			want: []string{"depends on itself"},
+		},
+		{
+			name:   "division by zero",
+			change: func(m *sdjson.Model) { m.Variables[5].Equation = "STEP(-10, 3)+10" },
+			want:   []string{"Deaths is +Inf at time 3"},
+		},
+		{
+			name:   "no equation",
+			change: func(m *sdjson.Model) { m.Variables[3].Equation = "" },
+			want:   []string{"Initial Population: has no equation"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := population()
+			c.change(&m)
+			_, err := Simulate(m)
+			require.Error(t, err)
+			assert.NotErrorIs(t, err, ErrUnsupported)
+			for _, want := range c.want {
+				assert.ErrorContains(t, err, want)
+			}
+		})
+	}
+}
+
+func TestSimulateUnsupported(t *testing.T) {
+	m := population()
+	m.Variables[1].Equation = "SMTH1(Population * birth_rate, 3)"
+	_, err := Simulate(m)
+	assert.ErrorIs(t, err, ErrUnsupported)
+
+	m = population()
+	m.Modules = []sdjson.Module{{Name: "Demographics"}}
+	_, err = Simulate(m)
+	assert.ErrorIs(t, err, ErrUnsupported)
+}
@@ -0,0 +1,416 @@
+package xmile
+
+import (
+	"cmp"
+	"encoding/xml"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/UB-IAD/sd-ai/third-party/causal-chains/sdjson"
+)
+
+var (
+	nanEquationRe = regexp.MustCompile(`(?i)^NAN\s*\(.*\)$`)
+	identRe       = regexp.MustCompile(`"[^"]*"|[\pL_][\pL\pN_$.]*`)
+)
+
+// Unmarshal parses an XMILE document into an SD-JSON model.
+//
+// Relationships are taken from the connectors in the model's views
+// when there are any (this is where XMILE tools record link polarity).
+// Otherwise they are inferred from flows and equation references, with
+// an unknown polarity for equation dependencies.
+func Unmarshal(data []byte) (*sdjson.Model, error) {
+	var f file
+	if err := xml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("xml.Unmarshal: %w", err)
+	}
+	if len(f.Models) == 0 {
+		return nil, fmt.Errorf("xmile: document has no <model>")
+	}
+
+	d := decoder{
+		models: make(map[string]*model, len(f.Models)),
+		byKey:  make(map[string]int),
+	}
+
+	root := &f.Models[0]
+	for i := range f.Models {
+		m := &f.Models[i]
+		if m.Name == "" {
+			root = m
+			continue
+		}
+		d.models[identKey(m.Name)] = m
+	}
+
+	specs, err := decodeSpecs(f.SimSpecs)
+	if err != nil {
+		return nil, err
+	}
+	d.mdl.Specs = specs
+	if f.Dimensions != nil {
+		for _, xd := range f.Dimensions.Dims {
+			d.mdl.Specs.ArrayDimensions = append(d.mdl.Specs.ArrayDimensions, decodeDimension(xd))
+		}
+	}
+
+	if err := d.visit(root, "", make(map[*model]bool)); err != nil {
+		return nil, err
+	}
+
+	d.applyConnects()
+	if !d.hasConnectors {
+		d.inferRelationships()
+	}
+
+	return &d.mdl, nil
+}
+
+type decoder struct {
+	mdl    sdjson.Model
+	models map[string]*model
+	// byKey indexes mdl.Variables by the identKey of their qualified name
+	byKey map[string]int
+	// connects are the module bindings, with fully-qualified names
+	connects      []connect
+	hasConnectors bool
+}
+
+func decodeSpecs(s *simSpecs) (sdjson.Specs, error) {
+	var specs sdjson.Specs
+	if s == nil {
+		return specs, nil
+	}
+
+	var err error
+	if specs.StartTime, err = parseNumber(s.Start); err != nil {
+		return specs, fmt.Errorf("xmile: sim_specs start: %w", err)
+	}
+	if specs.StopTime, err = parseNumber(s.Stop); err != nil {
+		return specs, fmt.Errorf("xmile: sim_specs stop: %w", err)
+	}
+	if s.DT != nil {
+		if specs.DT, err = parseNumber(s.DT.Value); err != nil {
+			return specs, fmt.Errorf("xmile: sim_specs dt: %w", err)
+		}
+		if s.DT.Reciprocal && specs.DT != 0 {
+			specs.DT = 1 / specs.DT
+		}
+	}
+	specs.TimeUnits = s.TimeUnits
+	if specs.TimeUnits == "" {
+		specs.TimeUnits = strings.TrimSpace(s.TimeUnitsElement)
+	}
+
+	return specs, nil
+}
+
+// parseNumber parses a numeric sim_specs value, which may also be
+// written as a simple fraction like "1/4".
+func parseNumber(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	if num, den, ok := strings.Cut(s, "/"); ok {
+		n, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+		if err != nil {
+			return 0, err
+		}
+		d, err := strconv.ParseFloat(strings.TrimSpace(den), 64)
+		if err != nil {
+			return 0, err
+		}
+		if d == 0 {
+			return 0, fmt.Errorf("division by zero in %q", s)
+		}
+		return n / d, nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+func decodeDimension(xd dim) sdjson.Dimension {
+	d := sdjson.Dimension{Name: xd.Name}
+	if len(xd.Elements) > 0 {
+		d.Type = "labels"
+		for _, el := range xd.Elements {
+			d.Elements = append(d.Elements, el.Name)
+		}
+		return d
+	}
+	d.Type = "numeric"
+	d.Size, _ = strconv.Atoi(strings.TrimSpace(xd.Size))
+	return d
+}
+
+// qualify returns the SD-JSON name for an XMILE identifier local to
+// the module at modulePath.
+func qualify(ident, modulePath string) string {
+	name := fromXMILEName(ident)
+	if modulePath == "" {
+		return name
+	}
+	return simpleName(modulePath) + "." + name
+}
+
+// simpleName returns the name of the module at modulePath.
+func simpleName(modulePath string) string {
+	return modulePath[strings.LastIndex(modulePath, ".")+1:]
+}
+
+func (d *decoder) visit(m *model, modulePath string, visited map[*model]bool) error {
+	if visited[m] {
+		return fmt.Errorf("xmile: module %q instantiates itself", modulePath)
+	}
+	visited[m] = true
+	defer delete(visited, m)
+
+	for _, xv := range m.Variables.Stocks {
+		d.addVariable(xv, sdjson.VariableTypeStock, modulePath)
+	}
+	for _, xv := range m.Variables.Flows {
+		d.addVariable(xv, sdjson.VariableTypeFlow, modulePath)
+	}
+	for _, xv := range m.Variables.Auxes {
+		d.addVariable(xv, sdjson.VariableTypeAux, modulePath)
+	}
+
+	for _, ref := range m.Variables.Modules {
+		mod := sdjson.Module{Name: fromXMILEName(ref.Name)}
+		if modulePath != "" {
+			mod.ParentModule = simpleName(modulePath)
+		}
+		d.mdl.Modules = append(d.mdl.Modules, mod)
+		path := mod.Path(d.mdl.Modules)
+
+		for _, c := range ref.Connects {
+			d.connects = append(d.connects, connect{
+				To:   qualifyRef(c.To, path),
+				From: qualifyRef(c.From, modulePath),
+			})
+		}
+
+		if child, ok := d.models[identKey(ref.Name)]; ok {
+			if err := d.visit(child, path, visited); err != nil {
+				return err
+			}
+		}
+	}
+
+	if m.Views != nil {
+		for _, v := range m.Views.Views {
+			for _, c := range v.Connectors {
+				d.hasConnectors = true
+				d.addRelationship(sdjson.Relationship{
+					From:     qualify(c.From, modulePath),
+					To:       qualify(c.To, modulePath),
+					Polarity: decodePolarity(cmp.Or(c.VendorPolarity, c.Polarity)),
+				})
+			}
+		}
+	}
+
+	return nil
+}
+
+// qualifyRef resolves a name used in a module <connect> binding.  sd-ai
+// writes these already qualified ("Module.var"); the spec's form is
+// relative to the containing model, with a leading dot for paths.
+func qualifyRef(ref, modulePath string) string {
+	ref = strings.TrimPrefix(strings.TrimSpace(ref), ".")
+	if i := strings.LastIndex(ref, "."); i >= 0 {
+		// keep only the immediate module qualifier
+		if j := strings.LastIndex(ref[:i], "."); j >= 0 {
+			ref = ref[j+1:]
+		}
+		return fromXMILEName(ref)
+	}
+	return qualify(ref, modulePath)
+}
+
+func decodePolarity(p string) sdjson.Polarity {
+	switch strings.TrimSpace(p) {
+	case "+":
+		return sdjson.PositivePolarity
+	case "-":
+		return sdjson.NegativePolarity
+	case "±":
+		return sdjson.NonmonotonicPolarity
+	default:
+		return sdjson.UnknownPolarity
+	}
+}
+
+func (d *decoder) addVariable(xv variable, typ sdjson.VariableType, modulePath string) {
+	v := sdjson.Variable{
+		Name:          qualify(xv.Name, modulePath),
+		Type:          typ,
+		Documentation: strings.TrimSpace(xv.Doc),
+		Units:         strings.TrimSpace(xv.Units),
+		Dimensions:    xv.Dimensions.names(),
+	}
+
+	eqn := strings.TrimSpace(xv.Eqn)
+	if nanEquationRe.MatchString(eqn) {
+		// placeholder equation for a qualitative variable
+		eqn = ""
+	}
+	v.Equation = eqn
+
+	if xv.GF != nil {
+		v.GraphicalFunction = decodeGF(xv.GF)
+	}
+
+	for _, el := range xv.Elements {
+		var forElements []string
+		for _, sub := range strings.Split(el.Subscript, ",") {
+			forElements = append(forElements, strings.TrimSpace(sub))
+		}
+		v.ArrayEquations = append(v.ArrayEquations, sdjson.ArrayEquation{
+			Equation:    strings.TrimSpace(el.Eqn),
+			ForElements: forElements,
+		})
+	}
+
+	for _, in := range xv.Inflows {
+		v.Inflows = append(v.Inflows, qualify(strings.TrimSpace(in), modulePath))
+	}
+	for _, out := range xv.Outflows {
+		v.Outflows = append(v.Outflows, qualify(strings.TrimSpace(out), modulePath))
+	}
+
+	v.Uniflow = typ == sdjson.VariableTypeFlow && xv.NonNegative != nil
+
+	d.byKey[identKey(v.Name)] = len(d.mdl.Variables)
+	d.mdl.Variables = append(d.mdl.Variables, v)
+}
+
+func parseList(s string) []float64 {
+	var values []float64
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return nil
+		}
+		values = append(values, f)
+	}
+	return values
+}
+
+func decodeGF(g *gf) *sdjson.GraphicalFunction {
+	ys := parseList(g.YPts)
+	if len(ys) == 0 {
+		return nil
+	}
+
+	xs := parseList(g.XPts)
+	if len(xs) != len(ys) {
+		// ypts with an xscale means the x values are evenly spaced
+		// over the scale's range.
+		xs = make([]float64, len(ys))
+		var lo, hi float64
+		if g.XScale != nil {
+			lo, _ = parseNumber(g.XScale.Min)
+			hi, _ = parseNumber(g.XScale.Max)
+		} else {
+			hi = float64(len(ys) - 1)
+		}
+		for i := range xs {
+			if len(ys) > 1 {
+				xs[i] = lo + (hi-lo)*float64(i)/float64(len(ys)-1)
+			} else {
+				xs[i] = lo
+			}
+		}
+	}
+
+	result := &sdjson.GraphicalFunction{Points: make([]sdjson.Point, len(ys))}
+	for i := range ys {
+		result.Points[i] = sdjson.Point{X: xs[i], Y: ys[i]}
+	}
+	return result
+}
+
+func (d *decoder) lookup(name string) (int, bool) {
+	i, ok := d.byKey[identKey(name)]
+	return i, ok
+}
+
+func (d *decoder) applyConnects() {
+	for _, c := range d.connects {
+		i, ok := d.lookup(c.To)
+		if !ok {
+			continue
+		}
+		src := c.From
+		if j, ok := d.lookup(c.From); ok {
+			src = d.mdl.Variables[j].Name
+		}
+		d.mdl.Variables[i].CrossLevelGhostOf = src
+	}
+}
+
+func (d *decoder) addRelationship(r sdjson.Relationship) {
+	for _, existing := range d.mdl.Relationships {
+		if identKey(existing.From) == identKey(r.From) && identKey(existing.To) == identKey(r.To) {
+			return
+		}
+	}
+	d.mdl.Relationships = append(d.mdl.Relationships, r)
+}
+
+// inferRelationships reconstructs causal links for documents without
+// connectors: each flow affects the stocks it fills or drains, and
+// each variable referenced in an equation affects that variable.
+func (d *decoder) inferRelationships() {
+	for _, v := range d.mdl.Variables {
+		if v.Type != sdjson.VariableTypeStock {
+			continue
+		}
+		for _, in := range v.Inflows {
+			d.addRelationship(sdjson.Relationship{From: in, To: v.Name, Polarity: sdjson.PositivePolarity})
+		}
+		for _, out := range v.Outflows {
+			d.addRelationship(sdjson.Relationship{From: out, To: v.Name, Polarity: sdjson.NegativePolarity})
+		}
+	}
+
+	for _, v := range d.mdl.Variables {
+		// a stock's equation is its initial value, not a causal link
+		if v.Type == sdjson.VariableTypeStock || v.CrossLevelGhostOf != "" {
+			continue
+		}
+		modulePath := ""
+		if prefix, _, ok := strings.Cut(v.Name, "."); ok {
+			modulePath = prefix
+		}
+
+		eqns := []string{v.Equation}
+		for _, ae := range v.ArrayEquations {
+			eqns = append(eqns, ae.Equation)
+		}
+		for _, eqn := range eqns {
+			for _, ident := range identRe.FindAllString(eqn, -1) {
+				ident = strings.Trim(ident, `"`)
+				i, ok := d.lookup(qualify(ident, modulePath))
+				if !ok {
+					i, ok = d.lookup(ident)
+				}
+				if !ok || d.mdl.Variables[i].Name == v.Name {
+					continue
+				}
+				d.addRelationship(sdjson.Relationship{
+					From:     d.mdl.Variables[i].Name,
+					To:       v.Name,
+					Polarity: sdjson.UnknownPolarity,
+				})
+			}
+		}
+	}
+}
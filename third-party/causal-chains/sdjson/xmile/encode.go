@@ -0,0 +1,383 @@
+package xmile
+
+import (
+	"cmp"
+	"encoding/xml"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/UB-IAD/sd-ai/third-party/causal-chains/sdjson"
+)
+
+// Options controls the header metadata and equation handling used
+// when writing XMILE.  The zero value is usable.
+type Options struct {
+	ModelName string // defaults to "SD Model"
+	Vendor    string // defaults to "BEAMS Initiative"
+	Product   string // defaults to "sd-ai"
+	Version   string // defaults to "1.0"
+	// KeepSafeDivision disables rewriting sd-ai's safe division
+	// operator (//) into plain division, which XMILE doesn't have.
+	KeepSafeDivision bool
+}
+
+func (o *Options) withDefaults() Options {
+	var opts Options
+	if o != nil {
+		opts = *o
+	}
+	opts.ModelName = cmp.Or(opts.ModelName, "SD Model")
+	opts.Vendor = cmp.Or(opts.Vendor, "BEAMS Initiative")
+	opts.Product = cmp.Or(opts.Product, "sd-ai")
+	opts.Version = cmp.Or(opts.Version, "1.0")
+	return opts
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Marshal converts an SD-JSON model into an XMILE v1.0 document.
+// Variables whose names are prefixed with a declared module name are
+// written into that module's <model> element, and cross-level ghosts
+// become module <connect> bindings.
+func Marshal(m sdjson.Model, opts *Options) ([]byte, error) {
+	o := opts.withDefaults()
+
+	e := encoder{
+		model:      m,
+		opts:       o,
+		modulePath: make(map[string]string, len(m.Modules)),
+		ghostSrcs:  make(map[string]bool),
+	}
+	for _, mod := range m.Modules {
+		e.modulePath[strings.ToLower(mod.Name)] = mod.Path(m.Modules)
+	}
+	for _, v := range m.Variables {
+		if v.CrossLevelGhostOf != "" {
+			e.ghostSrcs[identKey(v.CrossLevelGhostOf)] = true
+		}
+	}
+
+	f := file{
+		Version: Version,
+		Xmlns:   Namespace,
+		Header: header{
+			Vendor:  o.Vendor,
+			Product: product{Version: o.Version, Name: o.Product},
+			Name:    o.ModelName,
+		},
+		SimSpecs:   e.simSpecs(),
+		ModelUnits: e.modelUnits(),
+		Dimensions: e.dimensions(),
+	}
+
+	// the root model is the unnamed module, then each declared module
+	// gets its own (sibling) <model> element.
+	f.Models = append(f.Models, e.buildModel(""))
+	for _, mod := range m.Modules {
+		path := mod.Path(m.Modules)
+		if len(e.variablesIn(path)) == 0 && len(e.childModules(path)) == 0 {
+			continue
+		}
+		built := e.buildModel(path)
+		built.Name = toXMILEName(mod.Name)
+		f.Models = append(f.Models, built)
+	}
+
+	body, err := xml.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("xml.MarshalIndent: %w", err)
+	}
+
+	return append([]byte(xml.Header), body...), nil
+}
+
+type encoder struct {
+	model sdjson.Model
+	opts  Options
+	// modulePath maps a module's (lowercased) simple name to its full
+	// path in the module hierarchy.
+	modulePath map[string]string
+	// ghostSrcs is the set of variables that are the source of a
+	// cross-level ghost, and so are module outputs.
+	ghostSrcs map[string]bool
+}
+
+// moduleOf returns the full path of the module containing the
+// variable with the given name.  Variable names are qualified by only
+// their immediate containing module, e.g. "B.x" for x in module A.B.
+// Names whose prefix isn't a declared module are top-level.
+func (e *encoder) moduleOf(name string) string {
+	prefix, _, ok := strings.Cut(name, ".")
+	if !ok {
+		return ""
+	}
+	return e.modulePath[strings.ToLower(prefix)]
+}
+
+// localName strips the module qualifier from a variable name if it
+// refers to the given module.
+func localName(name, modulePath string) string {
+	if modulePath == "" {
+		return name
+	}
+	if local, ok := strings.CutPrefix(name, modulePath+"."); ok {
+		return local
+	}
+	if local, ok := strings.CutPrefix(name, simpleName(modulePath)+"."); ok {
+		return local
+	}
+	return name
+}
+
+func (e *encoder) variablesIn(modulePath string) []sdjson.Variable {
+	var vars []sdjson.Variable
+	for _, v := range e.model.Variables {
+		if e.moduleOf(v.Name) == modulePath {
+			vars = append(vars, v)
+		}
+	}
+	return vars
+}
+
+func (e *encoder) childModules(modulePath string) []sdjson.Module {
+	var children []sdjson.Module
+	for _, mod := range e.model.Modules {
+		parent := strings.TrimSuffix(mod.Path(e.model.Modules), mod.Name)
+		if strings.TrimSuffix(parent, ".") == modulePath {
+			children = append(children, mod)
+		}
+	}
+	return children
+}
+
+func (e *encoder) simSpecs() *simSpecs {
+	s := e.model.Specs
+	if s.StartTime == 0 && s.StopTime == 0 && s.DT == 0 && s.TimeUnits == "" {
+		return nil
+	}
+	step := s.DT
+	if step == 0 {
+		step = 1
+	}
+	return &simSpecs{
+		TimeUnits: s.TimeUnits,
+		Start:     formatFloat(s.StartTime),
+		Stop:      formatFloat(s.StopTime),
+		DT:        &dt{Value: formatFloat(step)},
+	}
+}
+
+func (e *encoder) modelUnits() *modelUnits {
+	seen := make(map[string]bool)
+	var names []string
+	for _, v := range e.model.Variables {
+		if u := strings.TrimSpace(v.Units); u != "" && !seen[u] {
+			seen[u] = true
+			names = append(names, u)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	slices.Sort(names)
+
+	mu := &modelUnits{}
+	for _, name := range names {
+		mu.Units = append(mu.Units, unit{Name: name, Eqn: name})
+	}
+	return mu
+}
+
+func (e *encoder) dimensions() *dimensions {
+	if len(e.model.Specs.ArrayDimensions) == 0 {
+		return nil
+	}
+	ds := &dimensions{}
+	for _, d := range e.model.Specs.ArrayDimensions {
+		xd := dim{Name: d.Name}
+		if d.Type == "numeric" {
+			xd.Size = strconv.Itoa(d.Size)
+		} else {
+			for _, el := range d.Elements {
+				xd.Elements = append(xd.Elements, elem{Name: el})
+			}
+		}
+		ds.Dims = append(ds.Dims, xd)
+	}
+	return ds
+}
+
+func (e *encoder) buildModel(modulePath string) model {
+	var mdl model
+	for _, v := range e.variablesIn(modulePath) {
+		xv := e.buildVariable(v, modulePath)
+		switch v.Type {
+		case sdjson.VariableTypeStock:
+			mdl.Variables.Stocks = append(mdl.Variables.Stocks, xv)
+		case sdjson.VariableTypeFlow:
+			mdl.Variables.Flows = append(mdl.Variables.Flows, xv)
+		default:
+			mdl.Variables.Auxes = append(mdl.Variables.Auxes, xv)
+		}
+	}
+
+	for _, child := range e.childModules(modulePath) {
+		ref := moduleRef{Name: toXMILEName(child.Name)}
+		childPath := child.Path(e.model.Modules)
+		for _, v := range e.model.Variables {
+			if v.CrossLevelGhostOf == "" {
+				continue
+			}
+			if e.moduleOf(v.Name) != childPath && e.moduleOf(v.CrossLevelGhostOf) != childPath {
+				continue
+			}
+			ref.Connects = append(ref.Connects, connect{
+				To:   toXMILEName(v.Name),
+				From: toXMILEName(v.CrossLevelGhostOf),
+			})
+		}
+		mdl.Variables.Modules = append(mdl.Variables.Modules, ref)
+	}
+
+	// XMILE has no place for link polarity outside of the diagram, so
+	// record relationships as (layout-less) connectors to preserve them.
+	var conns []connector
+	for _, r := range e.model.Relationships {
+		if e.moduleOf(r.To) != modulePath || e.moduleOf(r.From) != modulePath {
+			continue
+		}
+		conns = append(conns, connector{
+			UID:            len(conns) + 1,
+			Polarity:       encodePolarity(r.Polarity),
+			VendorPolarity: encodeVendorPolarity(r.Polarity),
+			From:           toXMILEName(localName(r.From, modulePath)),
+			To:             toXMILEName(localName(r.To, modulePath)),
+		})
+	}
+	if len(conns) > 0 {
+		mdl.Views = &views{Views: []view{{Connectors: conns}}}
+	}
+
+	return mdl
+}
+
+// encodePolarity returns the connector polarity attribute for a link.
+// XMILE tools only understand "+" and "-", so unknown and nonmonotonic
+// links are written without one, and read back as unknown by them.
+func encodePolarity(p sdjson.Polarity) string {
+	if !p.IsDetermined() {
+		return ""
+	}
+	return p.Symbol()
+}
+
+// encodeVendorPolarity returns the vendor polarity attribute, which
+// keeps nonmonotonic links from being read back as unknown.
+func encodeVendorPolarity(p sdjson.Polarity) string {
+	if p != sdjson.NonmonotonicPolarity {
+		return ""
+	}
+	return p.Symbol()
+}
+
+func (e *encoder) equation(eqn string) string {
+	if !e.opts.KeepSafeDivision {
+		eqn = strings.ReplaceAll(eqn, "//", "/")
+	}
+	return eqn
+}
+
+// nanEquation builds a NAN(...) placeholder equation listing the
+// causes of a variable, so that qualitative models still load in
+// simulators.
+func (e *encoder) nanEquation(name string) string {
+	var causes []string
+	for _, r := range e.model.Relationships {
+		if identKey(r.To) == identKey(name) {
+			causes = append(causes, toXMILEName(r.From))
+		}
+	}
+	if len(causes) == 0 {
+		return ""
+	}
+	return "NAN(" + strings.Join(causes, ",") + ")"
+}
+
+func (e *encoder) buildVariable(v sdjson.Variable, modulePath string) variable {
+	xv := variable{
+		Name:  toXMILEName(localName(v.Name, modulePath)),
+		Doc:   v.Documentation,
+		Units: v.Units,
+	}
+
+	if v.CrossLevelGhostOf != "" {
+		xv.Access = "input"
+	} else if e.ghostSrcs[identKey(v.Name)] {
+		xv.Access = "output"
+	}
+
+	// ghosts get their value through the module's <connect> bindings
+	if v.CrossLevelGhostOf == "" {
+		eqn := e.equation(v.Equation)
+		if eqn == "" && v.Type != sdjson.VariableTypeStock {
+			eqn = e.nanEquation(v.Name)
+		}
+		xv.Eqn = eqn
+
+		if gf := v.GraphicalFunction; gf != nil && len(gf.Points) > 0 && v.Type != sdjson.VariableTypeStock {
+			xv.GF = buildGF(gf)
+		}
+	}
+
+	for _, ae := range v.ArrayEquations {
+		xv.Elements = append(xv.Elements, element{
+			Subscript: strings.Join(ae.ForElements, ", "),
+			Eqn:       e.equation(ae.Equation),
+		})
+	}
+
+	if v.Type == sdjson.VariableTypeStock {
+		for _, in := range v.Inflows {
+			xv.Inflows = append(xv.Inflows, toXMILEName(localName(in, modulePath)))
+		}
+		for _, out := range v.Outflows {
+			xv.Outflows = append(xv.Outflows, toXMILEName(localName(out, modulePath)))
+		}
+	}
+
+	if v.Type == sdjson.VariableTypeFlow && v.Uniflow {
+		xv.NonNegative = &struct{}{}
+	}
+
+	if len(v.Dimensions) > 0 {
+		xv.Dimensions = &varDimensions{}
+		for _, d := range v.Dimensions {
+			xv.Dimensions.Dims = append(xv.Dimensions.Dims, dimRef{Name: d})
+		}
+	}
+
+	return xv
+}
+
+func buildGF(g *sdjson.GraphicalFunction) *gf {
+	xs := make([]string, 0, len(g.Points))
+	ys := make([]string, 0, len(g.Points))
+	xmin, xmax := g.Points[0].X, g.Points[0].X
+	ymin, ymax := g.Points[0].Y, g.Points[0].Y
+	for _, p := range g.Points {
+		xs = append(xs, formatFloat(p.X))
+		ys = append(ys, formatFloat(p.Y))
+		xmin, xmax = min(xmin, p.X), max(xmax, p.X)
+		ymin, ymax = min(ymin, p.Y), max(ymax, p.Y)
+	}
+	return &gf{
+		XScale: &scale{Min: formatFloat(xmin), Max: formatFloat(xmax)},
+		YScale: &scale{Min: formatFloat(ymin), Max: formatFloat(ymax)},
+		XPts:   strings.Join(xs, ","),
+		YPts:   strings.Join(ys, ","),
+	}
+}
@@ -0,0 +1,207 @@
+// Package xmile converts between sd-ai's SD-JSON model format and
+// XMILE v1.0, the OASIS interchange format used by Stella, Vensim
+// (via import), PySD and other System Dynamics tools.
+//
+// See https://docs.oasis-open.org/xmile/xmile/v1.0/xmile-v1.0.html
+package xmile
+
+import (
+	"encoding/xml"
+	"strings"
+)
+
+const (
+	// Namespace is the XML namespace for XMILE v1.0 documents.
+	Namespace = "http://docs.oasis-open.org/xmile/ns/XMILE/v1.0"
+	// Version is the XMILE specification version we read and write.
+	Version = "1.0"
+	// VendorNamespace is the XML namespace of the attributes sd-ai adds
+	// for what XMILE can't express, which other tools ignore.
+	VendorNamespace = "https://github.com/UB-IAD/sd-ai"
+)
+
+type file struct {
+	XMLName    xml.Name    `xml:"xmile"`
+	Version    string      `xml:"version,attr"`
+	Xmlns      string      `xml:"xmlns,attr,omitempty"`
+	Header     header      `xml:"header"`
+	SimSpecs   *simSpecs   `xml:"sim_specs"`
+	ModelUnits *modelUnits `xml:"model_units"`
+	Dimensions *dimensions `xml:"dimensions"`
+	Models     []model     `xml:"model"`
+}
+
+type product struct {
+	Version string `xml:"version,attr,omitempty"`
+	Name    string `xml:",chardata"`
+}
+
+type header struct {
+	Vendor  string  `xml:"vendor"`
+	Product product `xml:"product"`
+	Name    string  `xml:"name,omitempty"`
+}
+
+type dt struct {
+	Reciprocal bool   `xml:"reciprocal,attr,omitempty"`
+	Value      string `xml:",chardata"`
+}
+
+type simSpecs struct {
+	TimeUnits string `xml:"time_units,attr,omitempty"`
+	Start     string `xml:"start"`
+	Stop      string `xml:"stop"`
+	DT        *dt    `xml:"dt"`
+	// Some producers (including sd-ai's JavaScript exporter) write
+	// the time units as a child element rather than an attribute.
+	TimeUnitsElement string `xml:"time_units,omitempty"`
+}
+
+type unit struct {
+	Name string `xml:"name,attr"`
+	Eqn  string `xml:"eqn,omitempty"`
+}
+
+type modelUnits struct {
+	Units []unit `xml:"unit"`
+}
+
+type elem struct {
+	Name string `xml:"name,attr"`
+}
+
+type dim struct {
+	Name     string `xml:"name,attr"`
+	Size     string `xml:"size,attr,omitempty"`
+	Elements []elem `xml:"elem"`
+}
+
+type dimensions struct {
+	Dims []dim `xml:"dim"`
+}
+
+type gf struct {
+	XScale *scale `xml:"xscale"`
+	YScale *scale `xml:"yscale"`
+	XPts   string `xml:"xpts,omitempty"`
+	YPts   string `xml:"ypts"`
+}
+
+type scale struct {
+	Min string `xml:"min,attr"`
+	Max string `xml:"max,attr"`
+}
+
+type element struct {
+	Subscript string `xml:"subscript,attr"`
+	Eqn       string `xml:"eqn"`
+}
+
+type dimRef struct {
+	Name string `xml:"name,attr"`
+}
+
+// varDimensions is a variable's list of dimensions.  The spec form is
+// a list of <dim name="..."/> children, but the plain text form
+// ("Region, Product") is also seen in the wild and is accepted when
+// reading.
+type varDimensions struct {
+	Dims []dimRef `xml:"dim"`
+	Text string   `xml:",chardata"`
+}
+
+func (d *varDimensions) names() []string {
+	if d == nil {
+		return nil
+	}
+	var names []string
+	for _, ref := range d.Dims {
+		names = append(names, ref.Name)
+	}
+	if len(names) == 0 {
+		for _, name := range strings.Split(d.Text, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+type variable struct {
+	Name        string         `xml:"name,attr"`
+	Access      string         `xml:"access,attr,omitempty"`
+	Doc         string         `xml:"doc,omitempty"`
+	Eqn         string         `xml:"eqn,omitempty"`
+	GF          *gf            `xml:"gf"`
+	Elements    []element      `xml:"element"`
+	Inflows     []string       `xml:"inflow"`
+	Outflows    []string       `xml:"outflow"`
+	NonNegative *struct{}      `xml:"non_negative"`
+	Units       string         `xml:"units,omitempty"`
+	Dimensions  *varDimensions `xml:"dimensions"`
+}
+
+type connect struct {
+	To   string `xml:"to,attr"`
+	From string `xml:"from,attr"`
+}
+
+type moduleRef struct {
+	Name     string    `xml:"name,attr"`
+	Connects []connect `xml:"connect"`
+}
+
+type variables struct {
+	Stocks  []variable  `xml:"stock"`
+	Flows   []variable  `xml:"flow"`
+	Auxes   []variable  `xml:"aux"`
+	Modules []moduleRef `xml:"module"`
+}
+
+type connector struct {
+	UID      int    `xml:"uid,attr"`
+	Polarity string `xml:"polarity,attr,omitempty"`
+	// VendorPolarity is the polarity of links XMILE's "+" and "-" can't
+	// describe, in VendorNamespace.
+	VendorPolarity string `xml:"https://github.com/UB-IAD/sd-ai polarity,attr,omitempty"`
+	From           string `xml:"from"`
+	To             string `xml:"to"`
+}
+
+type view struct {
+	Connectors []connector `xml:"connector"`
+}
+
+type views struct {
+	Views []view `xml:"view"`
+}
+
+type model struct {
+	Name      string    `xml:"name,attr,omitempty"`
+	Variables variables `xml:"variables"`
+	Views     *views    `xml:"views"`
+}
+
+// toXMILEName converts an SD-JSON variable name into an XMILE
+// identifier, mirroring utils.xmileName on the JavaScript side.
+func toXMILEName(name string) string {
+	name = strings.ReplaceAll(name, "\r", " ")
+	name = strings.ReplaceAll(name, "\n", " ")
+	return strings.ReplaceAll(name, " ", "_")
+}
+
+// fromXMILEName is the inverse of toXMILEName.  XMILE identifiers may
+// use the escaped forms of newlines, which we treat as spaces.
+func fromXMILEName(name string) string {
+	name = strings.ReplaceAll(name, `\n`, " ")
+	name = strings.ReplaceAll(name, `\r`, " ")
+	return strings.Join(strings.Fields(strings.ReplaceAll(name, "_", " ")), " ")
+}
+
+// identKey is the key under which two names are considered to refer to
+// the same variable: XMILE identifiers are case-insensitive and treat
+// spaces and underscores equivalently.
+func identKey(name string) string {
+	return strings.ToLower(toXMILEName(fromXMILEName(name)))
+}
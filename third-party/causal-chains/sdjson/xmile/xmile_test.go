@@ -0,0 +1,273 @@
+package xmile
+
+import (
+	_ "embed"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/UB-IAD/sd-ai/third-party/causal-chains/sdjson"
+)
+
+//go:embed testdata/teacup.xmile
+var teacupXMILE string
+
+func TestNameConversion(t *testing.T) {
+	cases := []struct {
+		name  string
+		xmile string
+	}{
+		{name: "Tax Burden", xmile: "Tax_Burden"},
+		{name: "population", xmile: "population"},
+		{name: "Heat Loss\nto Room", xmile: "Heat_Loss_to_Room"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.xmile, toXMILEName(tt.name))
+			assert.Equal(t, strings.ReplaceAll(tt.name, "\n", " "), fromXMILEName(tt.xmile))
+		})
+	}
+}
+
+func TestMarshalFlatModel(t *testing.T) {
+	mdl := sdjson.Model{
+		Variables: []sdjson.Variable{
+			{
+				Name:     "population",
+				Type:     sdjson.VariableTypeStock,
+				Equation: "100",
+				Units:    "people",
+				Inflows:  []string{"births"},
+			},
+			{
+				Name:     "births",
+				Type:     sdjson.VariableTypeFlow,
+				Equation: "population * birth rate // 1",
+				Units:    "people/year",
+				Uniflow:  true,
+			},
+			{
+				Name:     "birth rate",
+				Type:     sdjson.VariableTypeAux,
+				Equation: "0.02",
+				Units:    "1/year",
+			},
+		},
+		Specs: sdjson.Specs{
+			StartTime: 0,
+			StopTime:  100,
+			DT:        0.25,
+			TimeUnits: "years",
+		},
+	}
+
+	out, err := Marshal(mdl, nil)
+	require.NoError(t, err)
+	doc := string(out)
+
+	assert.True(t, strings.HasPrefix(doc, "<?xml"))
+	assert.Contains(t, doc, `xmlns="`+Namespace+`"`)
+	assert.Contains(t, doc, `<sim_specs time_units="years">`)
+	assert.Contains(t, doc, `<dt>0.25</dt>`)
+	assert.Contains(t, doc, `<stock name="population">`)
+	assert.Contains(t, doc, `<inflow>births</inflow>`)
+	assert.Contains(t, doc, `<non_negative></non_negative>`)
+	assert.Contains(t, doc, `<aux name="birth_rate">`)
+	assert.Contains(t, doc, `<unit name="people/year">`)
+	// safe division is rewritten by default
+	assert.Contains(t, doc, `<eqn>population * birth rate / 1</eqn>`)
+
+	out, err = Marshal(mdl, &Options{KeepSafeDivision: true, ModelName: "pop"})
+	require.NoError(t, err)
+	assert.Contains(t, string(out), `birth rate // 1`)
+	assert.Contains(t, string(out), `<name>pop</name>`)
+}
+
+func TestRoundtripCLD(t *testing.T) {
+	mdl := sdjson.Model{
+		Variables: []sdjson.Variable{
+			{Name: "Tax Burden", Type: sdjson.VariableTypeAux},
+			{Name: "Colonist Anger", Type: sdjson.VariableTypeAux},
+		},
+		Relationships: []sdjson.Relationship{
+			{From: "Tax Burden", To: "Colonist Anger", Polarity: sdjson.PositivePolarity},
+			{From: "Colonist Anger", To: "Tax Burden", Polarity: sdjson.NegativePolarity},
+		},
+	}
+
+	out, err := Marshal(mdl, nil)
+	require.NoError(t, err)
+	// qualitative variables get placeholder equations so they load
+	assert.Contains(t, string(out), `<eqn>NAN(Tax_Burden)</eqn>`)
+
+	actual, err := Unmarshal(out)
+	require.NoError(t, err)
+
+	assert.Equal(t, mdl.Variables, actual.Variables)
+	assert.Equal(t, mdl.Relationships, actual.Relationships)
+}
+
+func TestRoundtripUndeterminedPolarities(t *testing.T) {
+	mdl := sdjson.Model{
+		Variables: []sdjson.Variable{
+			{Name: "Price", Type: sdjson.VariableTypeAux},
+			{Name: "Demand", Type: sdjson.VariableTypeAux},
+			{Name: "Revenue", Type: sdjson.VariableTypeAux},
+		},
+		Relationships: []sdjson.Relationship{
+			{From: "Price", To: "Revenue", Polarity: sdjson.NonmonotonicPolarity},
+			{From: "Price", To: "Demand", Polarity: sdjson.UnknownPolarity},
+		},
+	}
+
+	out, err := Marshal(mdl, nil)
+	require.NoError(t, err)
+	// other tools see neither link's polarity
+	assert.NotContains(t, string(out), ` polarity="?"`)
+	assert.Contains(t, string(out), `xmlns:sd-ai="`+VendorNamespace+`" sd-ai:polarity="±"`)
+
+	actual, err := Unmarshal(out)
+	require.NoError(t, err)
+	assert.Equal(t, mdl.Relationships, actual.Relationships)
+}
+
+func TestRoundtripArraysAndGraphicalFunctions(t *testing.T) {
+	mdl := sdjson.Model{
+		Variables: []sdjson.Variable{
+			{
+				Name:       "inventory",
+				Type:       sdjson.VariableTypeStock,
+				Equation:   "10",
+				Dimensions: []string{"Region"},
+			},
+			{
+				Name:     "effect of price",
+				Type:     sdjson.VariableTypeAux,
+				Equation: "price",
+				GraphicalFunction: &sdjson.GraphicalFunction{
+					Points: []sdjson.Point{{X: 0, Y: 1}, {X: 5, Y: 0.5}, {X: 10, Y: 0.1}},
+				},
+			},
+			{
+				Name:       "price",
+				Type:       sdjson.VariableTypeAux,
+				Dimensions: []string{"Region"},
+				ArrayEquations: []sdjson.ArrayEquation{
+					{Equation: "3", ForElements: []string{"North"}},
+					{Equation: "4", ForElements: []string{"South"}},
+				},
+			},
+		},
+		Specs: sdjson.Specs{
+			StartTime: 1,
+			StopTime:  10,
+			DT:        1,
+			ArrayDimensions: []sdjson.Dimension{
+				{Type: "labels", Name: "Region", Elements: []string{"North", "South"}},
+				{Type: "numeric", Name: "Cohort", Size: 3},
+			},
+		},
+	}
+
+	out, err := Marshal(mdl, nil)
+	require.NoError(t, err)
+
+	actual, err := Unmarshal(out)
+	require.NoError(t, err)
+
+	assert.Equal(t, mdl.Variables, actual.Variables)
+	assert.Equal(t, mdl.Specs, actual.Specs)
+}
+
+func TestRoundtripModules(t *testing.T) {
+	mdl := sdjson.Model{
+		Variables: []sdjson.Variable{
+			{Name: "demand", Type: sdjson.VariableTypeAux, Equation: "100"},
+			{Name: "Finance.revenue", Type: sdjson.VariableTypeAux, Equation: "price * 2"},
+			{Name: "Finance.price", Type: sdjson.VariableTypeAux, Equation: "5"},
+			{Name: "Operations.revenue", Type: sdjson.VariableTypeAux, CrossLevelGhostOf: "Finance.revenue"},
+			{Name: "Operations.capacity", Type: sdjson.VariableTypeAux, Equation: "revenue / 10"},
+			{Name: "Plant.output", Type: sdjson.VariableTypeAux, Equation: "3"},
+		},
+		Modules: []sdjson.Module{
+			{Name: "Finance"},
+			{Name: "Operations", ParentModule: "Finance"},
+			{Name: "Plant", ParentModule: "Operations"},
+		},
+	}
+
+	out, err := Marshal(mdl, nil)
+	require.NoError(t, err)
+	doc := string(out)
+	assert.Contains(t, doc, `<model name="Finance">`)
+	assert.Contains(t, doc, `<module name="Operations">`)
+	assert.Contains(t, doc, `<model name="Operations">`)
+	assert.Contains(t, doc, `<module name="Plant">`)
+	assert.Contains(t, doc, `<connect to="Operations.revenue" from="Finance.revenue"></connect>`)
+	assert.Contains(t, doc, `<aux name="revenue" access="input">`)
+	assert.Contains(t, doc, `<aux name="revenue" access="output">`)
+
+	actual, err := Unmarshal(out)
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, mdl.Variables, actual.Variables)
+	assert.Equal(t, mdl.Modules, actual.Modules)
+}
+
+func TestUnmarshalStella(t *testing.T) {
+	mdl, err := Unmarshal([]byte(teacupXMILE))
+	require.NoError(t, err)
+
+	assert.Equal(t, sdjson.Specs{
+		StartTime: 0,
+		StopTime:  30,
+		DT:        0.25,
+		TimeUnits: "Minutes",
+		ArrayDimensions: []sdjson.Dimension{
+			{Type: "labels", Name: "Cup", Elements: []string{"Small", "Large"}},
+		},
+	}, mdl.Specs)
+
+	require.Len(t, mdl.Variables, 6)
+
+	stock := mdl.Variables[0]
+	assert.Equal(t, "Teacup Temperature", stock.Name)
+	assert.Equal(t, sdjson.VariableTypeStock, stock.Type)
+	assert.Equal(t, []string{"Heat Loss to Room"}, stock.Outflows)
+
+	flow := mdl.Variables[1]
+	assert.Equal(t, "Heat Loss to Room", flow.Name)
+	assert.Equal(t, sdjson.VariableTypeFlow, flow.Type)
+	assert.Equal(t, "This is the rate at which heat flows from the cup into the room.", flow.Documentation)
+
+	gf := mdl.Variables[4]
+	require.NotNil(t, gf.GraphicalFunction)
+	assert.Equal(t, []sdjson.Point{{X: 0, Y: 0}, {X: 100, Y: 0.5}, {X: 200, Y: 1}}, gf.GraphicalFunction.Points)
+
+	arrayed := mdl.Variables[5]
+	assert.Equal(t, []string{"Cup"}, arrayed.Dimensions)
+	assert.Equal(t, []sdjson.ArrayEquation{
+		{Equation: "8", ForElements: []string{"Small"}},
+		{Equation: "16", ForElements: []string{"Large"}},
+	}, arrayed.ArrayEquations)
+
+	// without connectors, relationships come from flows and equations
+	assert.ElementsMatch(t, []sdjson.Relationship{
+		{From: "Heat Loss to Room", To: "Teacup Temperature", Polarity: sdjson.NegativePolarity},
+		{From: "Teacup Temperature", To: "Heat Loss to Room", Polarity: sdjson.UnknownPolarity},
+		{From: "Room Temperature", To: "Heat Loss to Room", Polarity: sdjson.UnknownPolarity},
+		{From: "Characteristic Time", To: "Heat Loss to Room", Polarity: sdjson.UnknownPolarity},
+		{From: "Teacup Temperature", To: "Cooling Effect", Polarity: sdjson.UnknownPolarity},
+	}, mdl.Relationships)
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	_, err := Unmarshal([]byte(`not xml`))
+	assert.Error(t, err)
+
+	_, err = Unmarshal([]byte(`<xmile version="1.0"><header/></xmile>`))
+	assert.Error(t, err)
+}
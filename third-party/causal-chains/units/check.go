@@ -0,0 +1,361 @@
+package units
+
+import (
+	"fmt"
+
+	"github.com/UB-IAD/sd-ai/third-party/causal-chains/sdjson"
+	"github.com/UB-IAD/sd-ai/third-party/causal-chains/sdjson/equation"
+)
+
+// Issue is a dimensional inconsistency found in a model.
+type Issue struct {
+	Variable string `json:"variable,omitzero"`
+	Message  string `json:"message"`
+}
+
+func (i Issue) String() string {
+	if i.Variable == "" {
+		return i.Message
+	}
+	return fmt.Sprintf("%s: %s", i.Variable, i.Message)
+}
+
+// Check infers the units of every equation in the model and reports
+// where they disagree with the declared units: equations whose units
+// differ from their variable's, sums and comparisons of quantities with
+// different units, and flows whose units aren't their stock's units per
+// time unit.  Variables without units, equations that don't parse, and
+// functions Check doesn't know are skipped rather than reported.
+func Check(m sdjson.Model) []Issue {
+	c := checker{declared: make(map[string]Unit)}
+
+	if m.Specs.TimeUnits != "" {
+		u, err := Parse(m.Specs.TimeUnits)
+		if err != nil {
+			c.report("", "time units: %s", err)
+		} else {
+			c.time, c.hasTime = u, true
+		}
+	}
+
+	for _, v := range m.Variables {
+		if v.Units == "" {
+			continue
+		}
+		u, err := Parse(v.Units)
+		if err != nil {
+			c.report(v.Name, "%s", err)
+			continue
+		}
+		c.declared[equation.NormalizeName(v.Name)] = u
+	}
+
+	for _, v := range m.Variables {
+		c.variable = v.Name
+		declared, hasUnits := c.declared[equation.NormalizeName(v.Name)]
+
+		// a graphical function's equation is its input, not its output
+		if v.GraphicalFunction == nil {
+			eqns := []string{v.Equation}
+			for _, ae := range v.ArrayEquations {
+				eqns = append(eqns, ae.Equation)
+			}
+			for _, eqn := range eqns {
+				c.checkEquation(v, eqn, declared, hasUnits)
+			}
+		}
+
+		if v.Type != sdjson.VariableTypeStock || !hasUnits || !c.hasTime {
+			continue
+		}
+		want := declared.Div(c.time)
+		for _, flow := range append(append([]string(nil), v.Inflows...), v.Outflows...) {
+			got, ok := c.declared[equation.NormalizeName(flow)]
+			if ok && !got.Equal(want) {
+				c.issues = append(c.issues, Issue{
+					Variable: flow,
+					Message:  fmt.Sprintf("flow has units %s, but stock %q needs %s (%s per %s)", got, v.Name, want, declared, c.time),
+				})
+			}
+		}
+	}
+
+	return c.issues
+}
+
+func (c *checker) checkEquation(v sdjson.Variable, eqn string, declared Unit, hasUnits bool) {
+	if eqn == "" {
+		return
+	}
+	n, err := equation.Parse(eqn)
+	if err != nil {
+		return
+	}
+	got := c.infer(n)
+	if !got.known || got.literal {
+		return
+	}
+
+	what := "equation"
+	if v.Type == sdjson.VariableTypeStock {
+		what = "initial value"
+	}
+	switch {
+	case !hasUnits && !got.unit.IsDimensionless():
+		c.report(v.Name, "has no units, but its %s has units %s", what, got.unit)
+	case hasUnits && !got.unit.Equal(declared):
+		c.report(v.Name, "%s has units %s, but the variable's units are %s", what, got.unit, declared)
+	}
+}
+
+type checker struct {
+	declared map[string]Unit
+	time     Unit
+	hasTime  bool
+	variable string
+	issues   []Issue
+}
+
+func (c *checker) report(variable, format string, args ...any) {
+	c.issues = append(c.issues, Issue{Variable: variable, Message: fmt.Sprintf(format, args...)})
+}
+
+// value is the inferred units of an expression.  Numeric literals are
+// dimensionless in products but take on whatever units they're added
+// to or compared with, so "stock - 100" isn't an error.
+type value struct {
+	unit    Unit
+	known   bool
+	literal bool
+}
+
+var (
+	unknown = value{}
+	literal = value{unit: Dimensionless, known: true, literal: true}
+	pure    = value{unit: Dimensionless, known: true}
+)
+
+// timeBuiltins are the names that evaluate to a time in the model's
+// time units.
+var timeBuiltins = map[string]bool{
+	"time":         true,
+	"dt":           true,
+	"time step":    true,
+	"starttime":    true,
+	"start time":   true,
+	"initial time": true,
+	"stoptime":     true,
+	"stop time":    true,
+	"final time":   true,
+}
+
+// sameAsFirst are functions whose result has the units of their first
+// argument.
+var sameAsFirst = map[string]bool{
+	"ABS":         true,
+	"INT":         true,
+	"INTEGER":     true,
+	"ROUND":       true,
+	"INIT":        true,
+	"INITIAL":     true,
+	"PREVIOUS":    true,
+	"STEP":        true,
+	"SMTH1":       true,
+	"SMTH3":       true,
+	"SMTHN":       true,
+	"SMOOTH":      true,
+	"SMOOTH3":     true,
+	"SMOOTHI":     true,
+	"SMOOTH3I":    true,
+	"DELAY":       true,
+	"DELAY1":      true,
+	"DELAY3":      true,
+	"DELAYN":      true,
+	"DELAY1I":     true,
+	"DELAY3I":     true,
+	"DELAY_FIXED": true,
+}
+
+// dimensionlessFuncs take and return dimensionless numbers.
+var dimensionlessFuncs = map[string]bool{
+	"EXP":    true,
+	"LN":     true,
+	"LOG":    true,
+	"LOG10":  true,
+	"SIN":    true,
+	"COS":    true,
+	"TAN":    true,
+	"ARCSIN": true,
+	"ARCCOS": true,
+	"ARCTAN": true,
+}
+
+func (c *checker) infer(n equation.Node) value {
+	switch n := n.(type) {
+	case equation.Number:
+		return literal
+	case equation.Ident:
+		name := equation.NormalizeName(n.Name)
+		if u, ok := c.declared[name]; ok {
+			return value{unit: u, known: true}
+		}
+		switch {
+		case timeBuiltins[name] && c.hasTime:
+			return value{unit: c.time, known: true}
+		case name == "pi" || name == "e":
+			return literal
+		}
+		return unknown
+	case equation.Unary:
+		x := c.infer(n.X)
+		if n.Op == "NOT" {
+			return pure
+		}
+		return x
+	case equation.Binary:
+		return c.binary(n.Op, c.infer(n.L), c.infer(n.R), n.R)
+	case equation.If:
+		c.infer(n.Cond)
+		return c.same("IF branches", c.infer(n.Then), c.infer(n.Else))
+	case equation.Call:
+		return c.call(n)
+	}
+	return unknown
+}
+
+func (c *checker) binary(op string, l, r value, rn equation.Node) value {
+	switch op {
+	case "+":
+		return c.same("sum", l, r)
+	case "-":
+		return c.same("difference", l, r)
+	case "=", "<>", "<", "<=", ">", ">=":
+		c.same("comparison", l, r)
+		return pure
+	case "AND", "OR":
+		return pure
+	case "MOD":
+		return l
+	case "*", "/", "//":
+		if !l.known || !r.known {
+			return unknown
+		}
+		out := value{known: true, literal: l.literal && r.literal}
+		if op == "*" {
+			out.unit = l.unit.Mul(r.unit)
+		} else {
+			out.unit = l.unit.Div(r.unit)
+		}
+		return out
+	case "^":
+		if !l.known {
+			return unknown
+		}
+		if exp, ok := intConstant(rn); ok {
+			return value{unit: l.unit.Pow(exp), known: true, literal: l.literal}
+		}
+		if l.unit.IsDimensionless() {
+			return l
+		}
+		c.report(c.variable, "%s raised to a non-integer or variable power", l.unit)
+		return unknown
+	}
+	return unknown
+}
+
+// same returns the units shared by the operands of a sum, comparison,
+// or choice, reporting them if they differ.
+func (c *checker) same(what string, vs ...value) value {
+	out := unknown
+	for _, v := range vs {
+		switch {
+		case !v.known:
+			continue
+		case !out.known:
+			out = v
+		case out.literal:
+			// a literal takes on the other operand's units
+			out = v
+		case v.literal:
+		case !v.unit.Equal(out.unit):
+			c.report(c.variable, "%s mixes units %s and %s", what, out.unit, v.unit)
+		}
+	}
+	return out
+}
+
+func intConstant(n equation.Node) (int, bool) {
+	switch n := n.(type) {
+	case equation.Number:
+		if n.Value == float64(int(n.Value)) {
+			return int(n.Value), true
+		}
+	case equation.Unary:
+		if v, ok := intConstant(n.X); ok && (n.Op == "-" || n.Op == "+") {
+			if n.Op == "-" {
+				v = -v
+			}
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+func (c *checker) call(n equation.Call) value {
+	args := make([]value, len(n.Args))
+	for i, arg := range n.Args {
+		args[i] = c.infer(arg)
+	}
+	arg := func(i int) value {
+		if i < len(args) {
+			return args[i]
+		}
+		return unknown
+	}
+
+	switch {
+	case sameAsFirst[n.Func]:
+		return arg(0)
+	case dimensionlessFuncs[n.Func]:
+		if a := arg(0); a.known && !a.unit.IsDimensionless() {
+			c.report(c.variable, "%s of %s, which isn't dimensionless", n.Func, a.unit)
+		}
+		return pure
+	}
+
+	switch n.Func {
+	case "MIN", "MAX":
+		return c.same(n.Func+" arguments", args...)
+	case "IF_THEN_ELSE":
+		return c.same("IF THEN ELSE branches", arg(1), arg(2))
+	case "SQRT":
+		a := arg(0)
+		if !a.known {
+			return unknown
+		}
+		u, ok := a.unit.Root(2)
+		if !ok {
+			c.report(c.variable, "SQRT of %s, which isn't a square", a.unit)
+			return unknown
+		}
+		return value{unit: u, known: true, literal: a.literal}
+	case "XIDZ", "ZIDZ", "SAFEDIV":
+		return c.binary("/", arg(0), arg(1), nil)
+	case "PULSE", "PULSE_TRAIN":
+		return pure
+	case "RAMP":
+		if a := arg(0); a.known && c.hasTime {
+			return value{unit: a.unit.Mul(c.time), known: true}
+		}
+		return unknown
+	}
+
+	if len(n.Args) == 0 && c.hasTime && timeBuiltins[equation.NormalizeName(n.Func)] {
+		return value{unit: c.time, known: true}
+	}
+	// calling a graphical function variable yields its units
+	if u, ok := c.declared[equation.NormalizeName(n.Func)]; ok {
+		return value{unit: u, known: true}
+	}
+	return unknown
+}
@@ -0,0 +1,316 @@
+// Package units parses the unit strings attached to SD-JSON variables
+// and checks models for dimensional consistency.
+//
+// Units are products of named base units raised to integer powers, so
+// "widgets/(week*worker)" is widget^1 · week^-1 · worker^-1.  Names
+// are compared case-insensitively and singularized (workers and worker
+// are the same unit), common abbreviations like yr and hrs are
+// expanded, and dmnl, dimensionless, unitless, and 1 all mean
+// dimensionless.
+package units
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Unit is a product of base units raised to non-zero integer powers.
+// The nil (or empty) Unit is dimensionless.
+type Unit map[string]int
+
+// Dimensionless is the unit of pure numbers.
+var Dimensionless = Unit(nil)
+
+// aliases normalizes common spellings of the same unit.
+var aliases = map[string]string{
+	"dmnl":          "",
+	"dimensionless": "",
+	"unitless":      "",
+	"fraction":      "",
+
+	"yr":     "year",
+	"yrs":    "year",
+	"mo":     "month",
+	"wk":     "week",
+	"hr":     "hour",
+	"hrs":    "hour",
+	"min":    "minute",
+	"mins":   "minute",
+	"sec":    "second",
+	"secs":   "second",
+	"s":      "second",
+	"people": "person",
+}
+
+func normalizeName(name string) string {
+	name = strings.ToLower(strings.Join(strings.Fields(strings.ReplaceAll(name, "_", " ")), " "))
+	if alias, ok := aliases[name]; ok {
+		return alias
+	}
+	return singular(name)
+}
+
+// singular strips English plural endings from the last word of name.
+// It only needs to be consistent, not grammatical: "widgets" and
+// "widget" must agree, and "mass" must survive.
+func singular(name string) string {
+	switch {
+	case len(name) <= 3:
+		return name
+	case strings.HasSuffix(name, "ies"):
+		return strings.TrimSuffix(name, "ies") + "y"
+	case strings.HasSuffix(name, "sses"), strings.HasSuffix(name, "ches"),
+		strings.HasSuffix(name, "shes"), strings.HasSuffix(name, "xes"):
+		return strings.TrimSuffix(name, "es")
+	case strings.HasSuffix(name, "ss"), strings.HasSuffix(name, "us"), strings.HasSuffix(name, "is"):
+		return name
+	}
+	return strings.TrimSuffix(name, "s")
+}
+
+// Base returns the unit consisting of a single named base unit.
+func Base(name string) Unit {
+	name = normalizeName(name)
+	if name == "" {
+		return Dimensionless
+	}
+	return Unit{name: 1}
+}
+
+// Mul returns u · v.
+func (u Unit) Mul(v Unit) Unit {
+	out := maps.Clone(u)
+	for name, exp := range v {
+		if out == nil {
+			out = make(Unit)
+		}
+		out[name] += exp
+		if out[name] == 0 {
+			delete(out, name)
+		}
+	}
+	return out
+}
+
+// Div returns u / v.
+func (u Unit) Div(v Unit) Unit {
+	return u.Mul(v.Pow(-1))
+}
+
+// Pow returns u raised to the integer power n.
+func (u Unit) Pow(n int) Unit {
+	if n == 0 {
+		return Dimensionless
+	}
+	out := make(Unit, len(u))
+	for name, exp := range u {
+		out[name] = exp * n
+	}
+	return out
+}
+
+// Root returns the nth root of u, and false if some exponent isn't
+// divisible by n.
+func (u Unit) Root(n int) (Unit, bool) {
+	out := make(Unit, len(u))
+	for name, exp := range u {
+		if exp%n != 0 {
+			return nil, false
+		}
+		out[name] = exp / n
+	}
+	return out, true
+}
+
+// Equal reports whether u and v are the same unit.
+func (u Unit) Equal(v Unit) bool {
+	return maps.Equal(u, v)
+}
+
+// IsDimensionless reports whether u has no base units.
+func (u Unit) IsDimensionless() bool {
+	return len(u) == 0
+}
+
+// String formats u in a canonical form that Parse accepts, with base
+// units in alphabetical order: "people/year", "widget/(week*worker)",
+// "meter^2/second^2", or "dmnl".
+func (u Unit) String() string {
+	if u.IsDimensionless() {
+		return "dmnl"
+	}
+
+	var num, den []string
+	for _, name := range slices.Sorted(maps.Keys(u)) {
+		exp := u[name]
+		// multi-word names round-trip through Parse as underscores
+		name = strings.ReplaceAll(name, " ", "_")
+		term := name
+		if abs := max(exp, -exp); abs != 1 {
+			term = fmt.Sprintf("%s^%d", name, abs)
+		}
+		if exp > 0 {
+			num = append(num, term)
+		} else {
+			den = append(den, term)
+		}
+	}
+
+	s := strings.Join(num, "*")
+	if s == "" {
+		s = "1"
+	}
+	switch len(den) {
+	case 0:
+		return s
+	case 1:
+		return s + "/" + den[0]
+	default:
+		return s + "/(" + strings.Join(den, "*") + ")"
+	}
+}
+
+// Parse parses a unit expression like "people/year",
+// "widgets/(week*worker)", "meters^2", "1/month", or "dollars per
+// year".  Multi-word unit names ("Degrees Fahrenheit") are allowed.
+// The empty string is an error; use "dmnl" for dimensionless.
+func Parse(s string) (Unit, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, fmt.Errorf("empty unit")
+	}
+	p := unitParser{s: s}
+	u, err := p.expr()
+	if err != nil {
+		return nil, fmt.Errorf("units.Parse(%q): %w", s, err)
+	}
+	if p.skipSpace(); p.i < len(p.s) {
+		return nil, fmt.Errorf("units.Parse(%q): unexpected %q at offset %d", s, p.s[p.i], p.i)
+	}
+	return u, nil
+}
+
+type unitParser struct {
+	s string
+	i int
+}
+
+func (p *unitParser) skipSpace() {
+	for p.i < len(p.s) && unicode.IsSpace(rune(p.s[p.i])) {
+		p.i++
+	}
+}
+
+// op returns the next operator, treating the word "per" as "/".
+func (p *unitParser) op() byte {
+	p.skipSpace()
+	if p.i >= len(p.s) {
+		return 0
+	}
+	switch c := p.s[p.i]; c {
+	case '*', '/', '^', '(', ')':
+		return c
+	}
+	if rest := strings.ToLower(p.s[p.i:]); strings.HasPrefix(rest, "per ") {
+		return 'p'
+	}
+	return 0
+}
+
+func (p *unitParser) expr() (Unit, error) {
+	u, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.op() {
+		case '*':
+			p.i++
+			v, err := p.term()
+			if err != nil {
+				return nil, err
+			}
+			u = u.Mul(v)
+		case '/':
+			p.i++
+			v, err := p.term()
+			if err != nil {
+				return nil, err
+			}
+			u = u.Div(v)
+		case 'p':
+			p.i += len("per")
+			v, err := p.term()
+			if err != nil {
+				return nil, err
+			}
+			u = u.Div(v)
+		default:
+			return u, nil
+		}
+	}
+}
+
+func (p *unitParser) term() (Unit, error) {
+	u, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	if p.op() != '^' {
+		return u, nil
+	}
+	p.i++
+	p.skipSpace()
+	start := p.i
+	if p.i < len(p.s) && (p.s[p.i] == '-' || p.s[p.i] == '+') {
+		p.i++
+	}
+	for p.i < len(p.s) && p.s[p.i] >= '0' && p.s[p.i] <= '9' {
+		p.i++
+	}
+	var n int
+	if _, err := fmt.Sscanf(p.s[start:p.i], "%d", &n); err != nil {
+		return nil, fmt.Errorf("bad exponent at offset %d", start)
+	}
+	return u.Pow(n), nil
+}
+
+func (p *unitParser) factor() (Unit, error) {
+	switch p.op() {
+	case '(':
+		p.i++
+		u, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.op() != ')' {
+			return nil, fmt.Errorf("missing ')' at offset %d", p.i)
+		}
+		p.i++
+		return u, nil
+	case 0:
+	default:
+		return nil, fmt.Errorf("expected a unit name at offset %d", p.i)
+	}
+
+	// a name runs until the next operator, and may contain spaces
+	start := p.i
+	for p.i < len(p.s) && !strings.ContainsRune("*/^()", rune(p.s[p.i])) {
+		if p.i > start && unicode.IsSpace(rune(p.s[p.i-1])) && strings.HasPrefix(strings.ToLower(p.s[p.i:]), "per ") {
+			break
+		}
+		p.i++
+	}
+	name := strings.TrimSpace(p.s[start:p.i])
+	switch {
+	case name == "":
+		return nil, fmt.Errorf("expected a unit name at offset %d", start)
+	case name == "1":
+		return Dimensionless, nil
+	case strings.IndexFunc(name, unicode.IsDigit) == 0:
+		return nil, fmt.Errorf("unsupported numeric factor %q", name)
+	}
+	return Base(name), nil
+}
@@ -0,0 +1,113 @@
+package units
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/UB-IAD/sd-ai/third-party/causal-chains/sdjson"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		units string
+		want  Unit
+		str   string
+	}{
+		{units: "people", want: Unit{"person": 1}, str: "person"},
+		{units: "people/year", want: Unit{"person": 1, "year": -1}, str: "person/year"},
+		{units: "Persons / Years", want: Unit{"person": 1, "year": -1}, str: "person/year"},
+		{units: "widgets/(week*worker)", want: Unit{"widget": 1, "week": -1, "worker": -1}, str: "widget/(week*worker)"},
+		{units: "1/month", want: Unit{"month": -1}, str: "1/month"},
+		{units: "meters^2/sec^2", want: Unit{"meter": 2, "second": -2}, str: "meter^2/second^2"},
+		{units: "dollars per year", want: Unit{"dollar": 1, "year": -1}, str: "dollar/year"},
+		{units: "Degrees Fahrenheit/minute", want: Unit{"degrees fahrenheit": 1, "minute": -1}, str: "degrees_fahrenheit/minute"},
+		{units: "kg*mass", want: Unit{"kg": 1, "mass": 1}, str: "kg*mass"},
+		{units: "companies", want: Unit{"company": 1}, str: "company"},
+		{units: "dmnl", want: Dimensionless, str: "dmnl"},
+		{units: "people/person", want: Unit{}, str: "dmnl"},
+		{units: "year^-1", want: Unit{"year": -1}, str: "1/year"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.units, func(t *testing.T) {
+			u, err := Parse(tt.units)
+			require.NoError(t, err)
+			assert.True(t, tt.want.Equal(u), "got %v", u)
+			assert.Equal(t, tt.str, u.String())
+
+			// the canonical form parses back to the same unit
+			again, err := Parse(u.String())
+			require.NoError(t, err)
+			assert.True(t, u.Equal(again))
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, s := range []string{"", "people/", "(people", "people)", "people^x", "1000 people", "*year"} {
+		t.Run(s, func(t *testing.T) {
+			_, err := Parse(s)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestCheckConsistentModel(t *testing.T) {
+	mdl := sdjson.Model{
+		Variables: []sdjson.Variable{
+			{Name: "population", Type: sdjson.VariableTypeStock, Equation: "1000", Units: "people", Inflows: []string{"births"}, Outflows: []string{"deaths"}},
+			{Name: "births", Type: sdjson.VariableTypeFlow, Equation: "population * birth_rate", Units: "people/year"},
+			{Name: "deaths", Type: sdjson.VariableTypeFlow, Equation: "MAX(0, population / lifetime - 5)", Units: "people/year"},
+			{Name: "birth rate", Type: sdjson.VariableTypeAux, Equation: "normal birth rate * effect_of_crowding(population / capacity)", Units: "1/year"},
+			{Name: "normal birth rate", Type: sdjson.VariableTypeAux, Equation: "0.03", Units: "1/yr"},
+			{Name: "lifetime", Type: sdjson.VariableTypeAux, Equation: "IF TIME > 10 THEN 70 ELSE 60", Units: "years"},
+			{Name: "capacity", Type: sdjson.VariableTypeAux, Equation: "5000", Units: "people"},
+			{
+				Name: "effect of crowding", Type: sdjson.VariableTypeAux, Equation: "population / capacity", Units: "dmnl",
+				GraphicalFunction: &sdjson.GraphicalFunction{Points: []sdjson.Point{{X: 0, Y: 1}, {X: 2, Y: 0}}},
+			},
+			{Name: "untyped", Type: sdjson.VariableTypeAux, Equation: "SOMEFUNC(population) + 1"},
+		},
+		Specs: sdjson.Specs{TimeUnits: "Year"},
+	}
+
+	assert.Empty(t, Check(mdl))
+}
+
+func TestCheckReportsMismatches(t *testing.T) {
+	mdl := sdjson.Model{
+		Variables: []sdjson.Variable{
+			{Name: "inventory", Type: sdjson.VariableTypeStock, Equation: "production", Units: "widgets", Inflows: []string{"production"}, Outflows: []string{"shipments"}},
+			{Name: "production", Type: sdjson.VariableTypeFlow, Equation: "workforce * productivity", Units: "widgets/week"},
+			{Name: "shipments", Type: sdjson.VariableTypeFlow, Equation: "inventory", Units: "widgets"},
+			{Name: "workforce", Type: sdjson.VariableTypeAux, Equation: "10", Units: "workers"},
+			{Name: "productivity", Type: sdjson.VariableTypeAux, Equation: "2", Units: "widgets/(week*worker)"},
+			{Name: "gap", Type: sdjson.VariableTypeAux, Equation: "inventory - production", Units: "widgets"},
+			// missing units are fine when the equation is dimensionless
+			{Name: "ratio", Type: sdjson.VariableTypeAux, Equation: "EXP(inventory)"},
+			{Name: "bad", Type: sdjson.VariableTypeAux, Units: "widgets/"},
+		},
+		Specs: sdjson.Specs{TimeUnits: "weeks"},
+	}
+
+	var msgs []string
+	for _, issue := range Check(mdl) {
+		msgs = append(msgs, issue.String())
+	}
+
+	assert.Equal(t, []string{
+		`bad: units.Parse("widgets/"): expected a unit name at offset 8`,
+		`inventory: initial value has units widget/week, but the variable's units are widget`,
+		`shipments: flow has units widget, but stock "inventory" needs widget/week (widget per week)`,
+		`gap: difference mixes units widget and widget/week`,
+		`ratio: EXP of widget, which isn't dimensionless`,
+	}, msgs)
+}
+
+func TestCheckBadTimeUnits(t *testing.T) {
+	issues := Check(sdjson.Model{Specs: sdjson.Specs{TimeUnits: "(weeks"}})
+	require.Len(t, issues, 1)
+	assert.Equal(t, "", issues[0].Variable)
+}